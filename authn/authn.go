@@ -0,0 +1,63 @@
+// Package authn is how relay finds out who someone logging in is. The
+// API server hands the credentials it gets to an Authenticator, which
+// checks them against relay's own users, a directory like LDAP, or both.
+//
+// Authenticators only answer who the user is. What they can do once they
+// are logged in is up to package authz.
+package authn
+
+import (
+	"context"
+
+	"github.com/run-ci/relay/store"
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+func init() {
+	logger = logrus.WithField("package", "authn")
+}
+
+// Authenticator checks a user's credentials. It returns the email of the
+// user they belong to, which is who the user is in relay from then on,
+// or store.ErrNotAuthenticated if they don't belong to anyone.
+type Authenticator interface {
+	Authenticate(ctx context.Context, user, pass string) (string, error)
+}
+
+// Local authenticates users against the passwords in the store.
+type Local struct {
+	Store interface {
+		Authenticate(ctx context.Context, email, pass string) error
+	}
+}
+
+// Authenticate checks the user's password in the store. Users log in
+// with their email, so that's who they are.
+func (l Local) Authenticate(ctx context.Context, user, pass string) (string, error) {
+	if err := l.Store.Authenticate(ctx, user, pass); err != nil {
+		return "", err
+	}
+
+	return user, nil
+}
+
+// First is a list of authenticators that are tried in order. The first
+// one that knows who the user is wins.
+type First []Authenticator
+
+// Authenticate tries every authenticator in turn, moving on to the next
+// one as long as they fail with store.ErrNotAuthenticated. Any other
+// error stops it, so a directory that's down doesn't look like a wrong
+// password.
+func (f First) Authenticate(ctx context.Context, user, pass string) (string, error) {
+	for _, a := range f {
+		email, err := a.Authenticate(ctx, user, pass)
+		if err != store.ErrNotAuthenticated {
+			return email, err
+		}
+	}
+
+	return "", store.ErrNotAuthenticated
+}
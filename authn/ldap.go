@@ -0,0 +1,227 @@
+package authn
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/run-ci/relay/store"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// LDAPDefaultTimeout bounds how long an LDAP login can take when the
+// context it's made with doesn't say.
+const LDAPDefaultTimeout = 10 * time.Second
+
+// LDAP authenticates users against an LDAP directory. The user is looked
+// up with a search, and then their password is checked by binding as
+// them. Users that aren't in relay yet are created the first time they
+// log in, and the groups they're in are kept in sync with the directory
+// every time they do.
+type LDAP struct {
+	// URL is where the directory is, as ldap://host:port or
+	// ldaps://host:port.
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before any
+	// credentials are sent over them.
+	StartTLS bool
+	TLS      *tls.Config
+
+	// BindDN and BindPassword are who searches for users. Without
+	// them, searches are anonymous.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is where users are searched for.
+	BaseDN string
+	// UserFilter finds the user logging in, with the name they log
+	// in with, escaped, in place of its %s.
+	UserFilter string
+
+	// EmailAttr, NameAttr and GroupAttr are the attributes of a user
+	// with their email, their name and the DNs of the groups they're
+	// in.
+	EmailAttr string
+	NameAttr  string
+	GroupAttr string
+
+	// Groups maps the DNs of directory groups to relay groups. Users
+	// are members of every relay group their directory groups map to,
+	// and only those. Relay groups aren't created, so they have to
+	// exist.
+	Groups map[string]string
+	// DefaultGroup is the relay group of users that aren't in any of
+	// the mapped directory groups. Without one, those users can't log
+	// in.
+	DefaultGroup string
+
+	Store UserStore
+}
+
+// NewLDAP returns an LDAP authenticator for the directory at the URL, with
+// the defaults of an OpenLDAP directory with the memberOf overlay.
+func NewLDAP(url, baseDN string, st UserStore) *LDAP {
+	return &LDAP{
+		URL:        url,
+		BaseDN:     baseDN,
+		UserFilter: "(&(objectClass=person)(mail=%s))",
+		EmailAttr:  "mail",
+		NameAttr:   "cn",
+		GroupAttr:  "memberOf",
+		Groups:     make(map[string]string),
+		Store:      st,
+	}
+}
+
+// Authenticate checks the user's password against the directory and makes
+// sure they're in relay, in the groups the directory says they're in.
+func (l *LDAP) Authenticate(ctx context.Context, user, pass string) (string, error) {
+	// An empty password is an unauthenticated bind, which directories
+	// let through without checking anything.
+	if user == "" || pass == "" {
+		return "", store.ErrNotAuthenticated
+	}
+
+	entry, err := l.check(ctx, user, pass)
+	if err != nil {
+		return "", err
+	}
+
+	email := entry.GetAttributeValue(l.EmailAttr)
+	if email == "" {
+		return "", fmt.Errorf("ldap: %v has no %v", entry.DN, l.EmailAttr)
+	}
+
+	groups := l.groups(entry.GetAttributeValues(l.GroupAttr))
+	if len(groups) == 0 {
+		return "", store.ErrNotAuthenticated
+	}
+
+	if err := provision(ctx, l.Store, email, entry.GetAttributeValue(l.NameAttr), groups); err != nil {
+		return "", err
+	}
+
+	return email, nil
+}
+
+// check finds the user in the directory and binds as them. It returns the
+// user's entry if the password is right.
+func (l *LDAP) check(ctx context.Context, user, pass string) (*ldap.Entry, error) {
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: binding as %v: %v", l.BindDN, err)
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(user)),
+		[]string{l.EmailAttr, l.NameAttr, l.GroupAttr},
+		nil,
+	))
+	// Anything but exactly one user means the filter doesn't pin
+	// users down, and there's no telling which one is logging in.
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, store.ErrNotAuthenticated
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: searching for user: %v", err)
+	}
+
+	if len(res.Entries) != 1 {
+		return nil, store.ErrNotAuthenticated
+	}
+
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, pass); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, store.ErrNotAuthenticated
+		}
+
+		return nil, fmt.Errorf("ldap: binding as %v: %v", entry.DN, err)
+	}
+
+	return entry, nil
+}
+
+// dial connects to the directory, over TLS if it's supposed to.
+func (l *LDAP) dial(ctx context.Context) (*ldap.Conn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: parsing url: %v", err)
+	}
+
+	timeout := LDAPDefaultTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	tlsConfig := l.TLS
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+
+	var nc net.Conn
+	var d net.Dialer
+	switch u.Scheme {
+	case "ldap":
+		nc, err = d.DialContext(ctx, "tcp", u.Host)
+	case "ldaps":
+		nc, err = (&tls.Dialer{NetDialer: &d, Config: tlsConfig}).DialContext(ctx, "tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("ldap: unknown url scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: dialing %v: %v", u.Host, err)
+	}
+
+	conn := ldap.NewConn(nc, u.Scheme == "ldaps")
+	conn.Start()
+	conn.SetTimeout(timeout)
+
+	if l.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: starting TLS: %v", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// groups returns the relay groups the directory groups map to, sorted by
+// name, or the default group if they don't map to any.
+func (l *LDAP) groups(dns []string) []string {
+	seen := map[string]bool{}
+	groups := []string{}
+
+	for _, dn := range dns {
+		for mapped, group := range l.Groups {
+			if strings.EqualFold(dn, mapped) && !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	if len(groups) == 0 && l.DefaultGroup != "" {
+		groups = append(groups, l.DefaultGroup)
+	}
+
+	sort.Strings(groups)
+
+	return groups
+}
@@ -0,0 +1,353 @@
+package authn
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/run-ci/relay/store"
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// fakeEntry is an entry in a fakeLDAP directory.
+type fakeEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+// fakeLDAP is an in-process LDAP server that's just enough of one for
+// the LDAP authenticator. It handles binds and searches with equality,
+// presence, and, or filters, and nothing else.
+type fakeLDAP struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	entries map[string]fakeEntry
+}
+
+func newFakeLDAP(t *testing.T, entries map[string]fakeEntry) *fakeLDAP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got error starting fake LDAP server: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeLDAP{ln: ln, entries: entries}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeLDAP) url() string {
+	return "ldap://" + f.ln.Addr().String()
+}
+
+// set adds or replaces the entry with the DN.
+func (f *fakeLDAP) set(dn string, e fakeEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.entries[dn] = e
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		f.mu.Lock()
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			pass := op.Children[2].Data.String()
+
+			code := ldap.LDAPResultInvalidCredentials
+			if e, ok := f.entries[dn]; ok && pass != "" && e.password == pass {
+				code = ldap.LDAPResultSuccess
+			}
+
+			reply(conn, id, result(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			base := strings.ToLower(op.Children[0].Value.(string))
+
+			for dn, e := range f.entries {
+				if strings.HasSuffix(strings.ToLower(dn), base) && match(op.Children[6], e.attrs) {
+					reply(conn, id, searchEntry(dn, e.attrs))
+				}
+			}
+
+			reply(conn, id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+	}
+}
+
+// match reports whether the attributes match the filter.
+func match(filter *ber.Packet, attrs map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, c := range filter.Children {
+			if !match(c, attrs) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range filter.Children {
+			if match(c, attrs) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		want := filter.Children[1].Value.(string)
+		for _, v := range attrs[filter.Children[0].Value.(string)] {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attrs[filter.Data.String()]) > 0
+	default:
+		return false
+	}
+}
+
+func reply(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+
+	conn.Write(packet.Bytes())
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+
+	return op
+}
+
+func searchEntry(dn string, attrs map[string][]string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+
+		attr.AppendChild(set)
+		list.AppendChild(attr)
+	}
+	op.AppendChild(list)
+
+	return op
+}
+
+func TestLDAP(t *testing.T) {
+	ctx := context.Background()
+
+	const (
+		devs = "cn=devs,ou=groups,dc=test"
+		ops  = "cn=ops,ou=groups,dc=test"
+	)
+
+	person := func(mail, name, pass string, groups ...string) fakeEntry {
+		return fakeEntry{
+			password: pass,
+			attrs: map[string][]string{
+				"objectClass": {"person"},
+				"mail":        {mail},
+				"cn":          {name},
+				"memberOf":    groups,
+			},
+		}
+	}
+
+	dir := newFakeLDAP(t, map[string]fakeEntry{
+		"cn=relay,dc=test":            {password: "service"},
+		"uid=alice,ou=people,dc=test": person("alice@test", "Alice", "alice", devs, ops),
+		"uid=bob,ou=people,dc=test":   person("bob@test", "Bob", "bob"),
+		"uid=eve,ou=people,dc=test":   person("eve@test", "Eve", "eve", devs),
+	})
+
+	st := store.NewMemory()
+	for _, g := range []string{"default", "devs", "ops"} {
+		if err := st.CreateGroup(ctx, &store.Group{Name: g}); err != nil {
+			t.Fatalf("got error creating group: %v", err)
+		}
+	}
+
+	l := NewLDAP(dir.url(), "ou=people,dc=test", st)
+	l.BindDN = "cn=relay,dc=test"
+	l.BindPassword = "service"
+	l.Groups[devs] = "devs"
+	l.Groups[ops] = "ops"
+
+	login := func(user, pass string) error {
+		email, err := l.Authenticate(ctx, user, pass)
+		if err == nil && email != user {
+			t.Fatalf("expected to log in as %v, got %v", user, email)
+		}
+
+		return err
+	}
+
+	groups := func(email string) []string {
+		u, err := st.GetUser(ctx, email)
+		if err != nil {
+			t.Fatalf("got error getting user: %v", err)
+		}
+
+		names := []string{}
+		for _, g := range u.Groups {
+			names = append(names, g.Name)
+		}
+
+		return append(names, "primary:"+u.Group.Name)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		pass string
+		err  error
+	}{
+		{name: "wrong password", user: "alice@test", pass: "nope", err: store.ErrNotAuthenticated},
+		{name: "empty password", user: "alice@test", pass: "", err: store.ErrNotAuthenticated},
+		{name: "unknown user", user: "mallory@test", pass: "alice", err: store.ErrNotAuthenticated},
+		{name: "filter injection", user: "*", pass: "alice", err: store.ErrNotAuthenticated},
+		{name: "no mapped groups", user: "bob@test", pass: "bob", err: store.ErrNotAuthenticated},
+		{name: "first login", user: "alice@test", pass: "alice"},
+	}
+
+	for _, test := range tests {
+		if err := login(test.user, test.pass); err != test.err {
+			t.Fatalf("%v: expected error %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	if got := groups("alice@test"); !reflect.DeepEqual(got, []string{"devs", "ops", "primary:devs"}) {
+		t.Fatalf("expected provisioned user in devs and ops, got %v", got)
+	}
+
+	if _, err := st.GetUser(ctx, "bob@test"); err != store.ErrUserNotFound {
+		t.Fatalf("expected user without groups not to be provisioned, got %v", err)
+	}
+
+	// Alice moves from devs to ops only, and the change follows her
+	// into relay the next time she logs in.
+	dir.set("uid=alice,ou=people,dc=test", person("alice@test", "Alice", "alice", ops))
+	if err := login("alice@test", "alice"); err != nil {
+		t.Fatalf("got error logging in: %v", err)
+	}
+
+	if got := groups("alice@test"); !reflect.DeepEqual(got, []string{"ops", "primary:ops"}) {
+		t.Fatalf("expected synced user in ops, got %v", got)
+	}
+
+	l.DefaultGroup = "default"
+	if err := login("bob@test", "bob"); err != nil {
+		t.Fatalf("got error logging in with a default group: %v", err)
+	}
+
+	if got := groups("bob@test"); !reflect.DeepEqual(got, []string{"default", "primary:default"}) {
+		t.Fatalf("expected user in the default group, got %v", got)
+	}
+
+	// Provisioned users can't log in with a relay password, and
+	// disabled users can't log in through the directory.
+	if _, err := (Local{Store: st}).Authenticate(ctx, "bob@test", "bob"); err != store.ErrNotAuthenticated {
+		t.Fatalf("expected provisioned user to have no known password, got %v", err)
+	}
+
+	disabled := true
+	if _, err := st.UpdateUser(ctx, "bob@test", store.UserUpdate{Disabled: &disabled}); err != nil {
+		t.Fatalf("got error disabling user: %v", err)
+	}
+
+	if err := login("bob@test", "bob"); err != store.ErrNotAuthenticated {
+		t.Fatalf("expected disabled user not to log in, got %v", err)
+	}
+
+	// A broken service account isn't a wrong password.
+	l.BindPassword = "nope"
+	if err := login("eve@test", "eve"); err == nil || err == store.ErrNotAuthenticated {
+		t.Fatalf("expected directory error, got %v", err)
+	}
+}
+
+func TestFirst(t *testing.T) {
+	ctx := context.Background()
+
+	st := store.NewMemory()
+	if err := st.CreateGroup(ctx, &store.DefaultGroup); err != nil {
+		t.Fatalf("got error creating group: %v", err)
+	}
+
+	u := store.User{Email: "local@test", Password: "local"}
+	if err := st.CreateUser(ctx, &u); err != nil {
+		t.Fatalf("got error creating user: %v", err)
+	}
+
+	dir := newFakeLDAP(t, map[string]fakeEntry{})
+	down := NewLDAP("ldap://127.0.0.1:1", "dc=test", st)
+
+	tests := []struct {
+		name string
+		auth First
+		pass string
+		err  error
+	}{
+		{name: "local after directory", auth: First{NewLDAP(dir.url(), "dc=test", st), Local{Store: st}}, pass: "local"},
+		{name: "wrong password everywhere", auth: First{NewLDAP(dir.url(), "dc=test", st), Local{Store: st}}, pass: "nope", err: store.ErrNotAuthenticated},
+		{name: "local before broken directory", auth: First{Local{Store: st}, down}, pass: "local"},
+	}
+
+	for _, test := range tests {
+		email, err := test.auth.Authenticate(ctx, "local@test", test.pass)
+		if err != test.err {
+			t.Fatalf("%v: expected error %v, got %v", test.name, test.err, err)
+		}
+
+		if err == nil && email != "local@test" {
+			t.Fatalf("%v: expected to log in as local@test, got %v", test.name, email)
+		}
+	}
+
+	if _, err := (First{down, Local{Store: st}}).Authenticate(ctx, "local@test", "local"); err == nil || err == store.ErrNotAuthenticated {
+		t.Fatalf("expected a broken directory to stop the login, got %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package authn
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/run-ci/relay/store"
+	"golang.org/x/oauth2"
+)
+
+// OIDC logs users in through an OpenID Connect provider, with the
+// authorization code flow. Users are sent to the provider to log in, and
+// come back with a code that's traded in for an ID token saying who they
+// are. Like with LDAP, users are created the first time they log in, and
+// their groups are kept in sync with the provider's every time they do.
+type OIDC struct {
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, which is
+	// the callback of the API server.
+	RedirectURL string
+	// Scopes are asked for on top of "openid".
+	Scopes []string
+
+	// GroupsClaim is the claim of the ID token with the user's groups
+	// in it. Groups maps them to relay groups, and users in none of
+	// them go in DefaultGroup, or can't log in without one.
+	GroupsClaim  string
+	Groups       map[string]string
+	DefaultGroup string
+
+	// AllowUnverifiedEmail lets users log in with ID tokens that don't
+	// say their email was verified, for providers that don't send the
+	// email_verified claim but only hand out emails they've verified.
+	AllowUnverifiedEmail bool
+
+	Store UserStore
+	// Client is what requests to the provider are made with.
+	Client *http.Client
+
+	provider oidcProvider
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+// oidcProvider is the part of an OpenID provider's configuration that's
+// needed to log in through it.
+type oidcProvider struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+// DiscoverOIDC returns an OIDC authenticator for the client, with the
+// endpoints of the provider found through its discovery document, under
+// the issuer URL.
+func DiscoverOIDC(ctx context.Context, issuer, clientID, clientSecret string, st UserStore) (*OIDC, error) {
+	o := &OIDC{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       []string{"email", "profile"},
+		GroupsClaim:  "groups",
+		Groups:       make(map[string]string),
+		Store:        st,
+		Client:       http.DefaultClient,
+	}
+
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := o.get(ctx, url, &o.provider); err != nil {
+		return nil, fmt.Errorf("oidc: discovering provider: %v", err)
+	}
+
+	// The issuer in the document has to be the one it was found
+	// under, or anyone who can serve one could hand out ID tokens.
+	if o.provider.Issuer != issuer {
+		return nil, fmt.Errorf("oidc: provider says its issuer is %q, not %q", o.provider.Issuer, issuer)
+	}
+
+	return o, nil
+}
+
+// AuthCodeURL returns the URL of the provider's login page, which sends
+// users back to RedirectURL with the state. The nonce ends up in the ID
+// token, tying it to this login.
+func (o *OIDC) AuthCodeURL(state, nonce string) string {
+	return o.config().AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce))
+}
+
+// Exchange trades the code the provider sent the user back with in for
+// an ID token, and returns the email of the user it's for. The ID token
+// has to have the nonce of the login in it.
+func (o *OIDC) Exchange(ctx context.Context, code, nonce string) (string, error) {
+	logger := logger.WithField("issuer", o.provider.Issuer)
+
+	token, err := o.config().Exchange(context.WithValue(ctx, oauth2.HTTPClient, o.Client), code)
+	if err != nil {
+		if _, ok := err.(*oauth2.RetrieveError); ok {
+			logger.WithError(err).Debug("provider rejected code")
+			return "", store.ErrNotAuthenticated
+		}
+
+		return "", fmt.Errorf("oidc: exchanging code: %v", err)
+	}
+
+	raw, _ := token.Extra("id_token").(string)
+
+	claims, err := o.verify(ctx, raw, nonce)
+	if err != nil {
+		logger.WithError(err).Debug("invalid ID token")
+		return "", store.ErrNotAuthenticated
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		logger.Debug("ID token has no email")
+		return "", store.ErrNotAuthenticated
+	}
+
+	// Unverified emails could be anyone's, including relay users', and
+	// users are linked to the ones already in the store by email.
+	if verified, _ := claims["email_verified"].(bool); !verified && !o.AllowUnverifiedEmail {
+		logger.WithField("email", email).Debug("email isn't verified")
+		return "", store.ErrNotAuthenticated
+	}
+
+	groups := o.groups(stringsClaim(claims[o.GroupsClaim]))
+	if len(groups) == 0 {
+		logger.WithField("email", email).Debug("user isn't in any groups")
+		return "", store.ErrNotAuthenticated
+	}
+
+	name, _ := claims["name"].(string)
+	if err := provision(ctx, o.Store, email, name, groups); err != nil {
+		return "", err
+	}
+
+	return email, nil
+}
+
+// verify checks the ID token was signed by the provider, for this client
+// and this login, and returns its claims.
+func (o *OIDC) verify(ctx context.Context, raw, nonce string) (jwt.MapClaims, error) {
+	if raw == "" {
+		return nil, errors.New("missing ID token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		key, err := o.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			if _, ok := key.(*rsa.PublicKey); ok {
+				return key, nil
+			}
+		case *jwt.SigningMethodECDSA:
+			if _, ok := key.(*ecdsa.PublicKey); ok {
+				return key, nil
+			}
+		}
+
+		return nil, fmt.Errorf("invalid signing method %v for key %q", token.Method.Alg(), kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != o.provider.Issuer {
+		return nil, fmt.Errorf("issued by %q", iss)
+	}
+
+	aud := stringsClaim(claims["aud"])
+	if !contains(aud, o.ClientID) {
+		return nil, fmt.Errorf("issued for %v", aud)
+	}
+
+	// Tokens for more than one client say which one they were
+	// handed to.
+	if azp, ok := claims["azp"].(string); (ok || len(aud) > 1) && azp != o.ClientID {
+		return nil, fmt.Errorf("authorized party is %q", azp)
+	}
+
+	if n, _ := claims["nonce"].(string); nonce == "" || n != nonce {
+		return nil, errors.New("nonce doesn't match")
+	}
+
+	return claims, nil
+}
+
+// key returns the provider's key with the ID. The provider's keys are
+// fetched again when there's no such key, since it might have rotated
+// them.
+func (o *OIDC) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+
+	set := struct {
+		Keys []json.RawMessage `json:"keys"`
+	}{}
+	if err := o.get(ctx, o.provider.JWKSURL, &set); err != nil {
+		return nil, fmt.Errorf("fetching keys: %v", err)
+	}
+
+	o.keys = make(map[string]crypto.PublicKey)
+	for _, raw := range set.Keys {
+		id, key, err := parseJWK(raw)
+		if err != nil {
+			// Keys of kinds that aren't supported can't have
+			// signed tokens that are accepted anyway.
+			logger.WithError(err).Debug("skipping provider key")
+			continue
+		}
+
+		o.keys[id] = key
+	}
+
+	key, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// groups returns the relay groups the provider's groups map to, sorted by
+// name, or the default group if they don't map to any.
+func (o *OIDC) groups(names []string) []string {
+	seen := map[string]bool{}
+	groups := []string{}
+
+	for _, name := range names {
+		if group, ok := o.Groups[name]; ok && !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	if len(groups) == 0 && o.DefaultGroup != "" {
+		groups = append(groups, o.DefaultGroup)
+	}
+
+	sort.Strings(groups)
+
+	return groups
+}
+
+func (o *OIDC) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Scopes:       append([]string{"openid"}, o.Scopes...),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  o.provider.AuthURL,
+			TokenURL: o.provider.TokenURL,
+		},
+	}
+}
+
+// get fetches the JSON document at the URL into v.
+func (o *OIDC) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %v from %v", resp.StatusCode, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// parseJWK returns the ID and public key of an RSA or P-256 ECDSA key in
+// JSON Web Key format.
+func parseJWK(raw []byte) (string, crypto.PublicKey, error) {
+	var k struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return "", nil, err
+	}
+
+	if k.Use != "" && k.Use != "sig" {
+		return "", nil, fmt.Errorf("key %q isn't for signing", k.Kid)
+	}
+
+	b64 := func(s string) (*big.Int, error) {
+		buf, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(buf), err
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return "", nil, err
+		}
+
+		e, err := b64(k.E)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return k.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return "", nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := b64(k.X)
+		if err != nil {
+			return "", nil, err
+		}
+
+		y, err := b64(k.Y)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return k.Kid, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// stringsClaim returns a claim that can be a string or a list of them as
+// a list.
+func stringsClaim(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		strs := []string{}
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	default:
+		return nil
+	}
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+
+	return false
+}
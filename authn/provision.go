@@ -0,0 +1,96 @@
+package authn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/run-ci/relay/store"
+)
+
+// UserStore is what authenticators that bring their own users need of
+// the store to keep those users in sync with relay.
+type UserStore interface {
+	GetUser(ctx context.Context, email string) (store.User, error)
+	CreateUser(context.Context, *store.User) error
+	UpdateUser(ctx context.Context, email string, u store.UserUpdate) (store.User, error)
+}
+
+// provision creates the user if they aren't in relay yet, and puts them in
+// the groups, sorted by name, if they are.
+func provision(ctx context.Context, st UserStore, email, name string, groups []string) error {
+	members := make([]store.Group, 0, len(groups))
+	for _, g := range groups {
+		members = append(members, store.Group{Name: g})
+	}
+
+	u, err := st.GetUser(ctx, email)
+	if err == store.ErrUserNotFound {
+		// These users never log in with a relay password, so they
+		// get one nobody knows.
+		password, err := randomPassword()
+		if err != nil {
+			return err
+		}
+
+		return st.CreateUser(ctx, &store.User{
+			Name:     name,
+			Email:    email,
+			Password: password,
+			Group:    members[0],
+			Groups:   members,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Logging in somewhere else doesn't turn disabled users back on.
+	if u.Disabled {
+		return store.ErrNotAuthenticated
+	}
+
+	if sameGroups(u.Groups, groups) {
+		return nil
+	}
+
+	// The primary group stays put as long as the user's still in it.
+	primary := members[0]
+	for _, g := range members {
+		if g.Name == u.Group.Name {
+			primary = g
+		}
+	}
+
+	_, err = st.UpdateUser(ctx, email, store.UserUpdate{
+		Group:  &primary,
+		Groups: &members,
+	})
+
+	return err
+}
+
+// sameGroups reports whether the groups have the names, which are sorted,
+// and only those.
+func sameGroups(groups []store.Group, names []string) bool {
+	if len(groups) != len(names) {
+		return false
+	}
+
+	for i, g := range groups {
+		if g.Name != names[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func randomPassword() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,143 @@
+// Package authz is the authorization policy of relay. It decides who can do
+// what to a resource, based on who owns it, the group it's shared with and
+// its permission bits.
+//
+// The policy lives here, and only here, so that every store applies the
+// same rules. Stores that can check resources one by one use Can, and
+// stores that need to filter in a query language use Where, which renders
+// the same policy as SQL.
+package authz
+
+import (
+	"fmt"
+	"strings"
+)
+
+// These are the permission bits of a resource. Bits 0-2 apply to the
+// resource's group and bits 3-5 apply to the public. The remaining two
+// bits are for extensibility.
+const (
+	GroupRead   = byte(128)
+	GroupWrite  = byte(64)
+	GroupRun    = byte(32)
+	PublicRead  = byte(16)
+	PublicWrite = byte(8)
+	PublicRun   = byte(4)
+)
+
+// Action is something a subject wants to do with a resource.
+type Action int
+
+const (
+	// Read is seeing the resource and everything in it.
+	Read Action = iota
+	// Write is creating, changing or deleting anything in the resource,
+	// or the resource itself.
+	Write
+	// Run is starting a run of anything in the resource.
+	Run
+	// Admin is changing the resource's settings, like its permissions.
+	// It's too much to hand out to the public, so only the group write
+	// bit allows it.
+	Admin
+)
+
+// bits returns the group and public bits that allow the action.
+func (a Action) bits() (group, public byte) {
+	switch a {
+	case Read:
+		return GroupRead, PublicRead
+	case Write:
+		return GroupWrite, PublicWrite
+	case Run:
+		return GroupRun, PublicRun
+	case Admin:
+		return GroupWrite, 0
+	default:
+		return 0, 0
+	}
+}
+
+func (a Action) String() string {
+	switch a {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Run:
+		return "run"
+	case Admin:
+		return "admin"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// Subject is who wants to take an action. An anonymous subject has an
+// empty ID and no groups.
+type Subject struct {
+	ID     string
+	Groups []string
+}
+
+// Resource is the authorization information of whatever the action is
+// being taken on.
+type Resource struct {
+	Owner       string
+	Group       string
+	Permissions byte
+}
+
+// Can reports whether the subject can take the action on the resource. The
+// owner can do anything. Everyone else needs the action's public bit, or
+// its group bit and to be in the resource's group.
+func Can(s Subject, a Action, r Resource) bool {
+	if s.ID != "" && s.ID == r.Owner {
+		return true
+	}
+
+	group, public := a.bits()
+
+	if r.Permissions&public != 0 {
+		return true
+	}
+
+	if r.Permissions&group == 0 {
+		return false
+	}
+
+	for _, g := range s.Groups {
+		if g != "" && g == r.Group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Columns names the SQL expressions that hold a resource's authorization.
+type Columns struct {
+	Owner       string
+	Group       string
+	Permissions string
+}
+
+// Where renders Can as a SQL condition, for filtering rows in a query.
+// subject is a SQL expression for the subject's ID and groups is one for
+// an array of its groups, usually placeholders or subqueries.
+func Where(a Action, c Columns, subject, groups string) string {
+	group, public := a.bits()
+
+	conds := []string{fmt.Sprintf("%v = %v", c.Owner, subject)}
+
+	if public != 0 {
+		conds = append(conds, fmt.Sprintf("(%v & %v) != 0", c.Permissions, public))
+	}
+
+	if group != 0 {
+		conds = append(conds, fmt.Sprintf("(%v & %v) != 0 AND %v = ANY(%v)",
+			c.Permissions, group, c.Group, groups))
+	}
+
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
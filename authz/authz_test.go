@@ -0,0 +1,115 @@
+package authz
+
+import "testing"
+
+func TestCan(t *testing.T) {
+	groupAll := GroupRead | GroupWrite | GroupRun
+	publicAll := PublicRead | PublicWrite | PublicRun
+
+	actions := []Action{Read, Write, Run, Admin}
+
+	tests := []struct {
+		name     string
+		subject  Subject
+		perms    byte
+		expected [4]bool
+	}{
+		{
+			name:     "owner",
+			subject:  Subject{ID: "owner@test", Groups: []string{"a"}},
+			perms:    0,
+			expected: [4]bool{true, true, true, true},
+		},
+		{
+			name:     "group member",
+			subject:  Subject{ID: "member@test", Groups: []string{"a"}},
+			perms:    groupAll,
+			expected: [4]bool{true, true, true, true},
+		},
+		{
+			name:     "group reader",
+			subject:  Subject{ID: "member@test", Groups: []string{"a"}},
+			perms:    GroupRead,
+			expected: [4]bool{true, false, false, false},
+		},
+		{
+			name:     "group runner",
+			subject:  Subject{ID: "member@test", Groups: []string{"a"}},
+			perms:    GroupRead | GroupRun,
+			expected: [4]bool{true, false, true, false},
+		},
+		{
+			name:     "public",
+			subject:  Subject{ID: "outsider@test", Groups: []string{"b"}},
+			perms:    publicAll,
+			expected: [4]bool{true, true, true, false},
+		},
+		{
+			name:     "public runner",
+			subject:  Subject{ID: "outsider@test", Groups: []string{"b"}},
+			perms:    PublicRun,
+			expected: [4]bool{false, false, true, false},
+		},
+		{
+			name:     "anonymous",
+			subject:  Subject{},
+			perms:    PublicRead | GroupRead,
+			expected: [4]bool{true, false, false, false},
+		},
+		{
+			name:     "outsider",
+			subject:  Subject{ID: "outsider@test", Groups: []string{"b"}},
+			perms:    groupAll,
+			expected: [4]bool{false, false, false, false},
+		},
+	}
+
+	for _, test := range tests {
+		r := Resource{
+			Owner:       "owner@test",
+			Group:       "a",
+			Permissions: test.perms,
+		}
+
+		for i, a := range actions {
+			actual := Can(test.subject, a, r)
+			if actual != test.expected[i] {
+				t.Fatalf("%v: expected %v allowed to be %v, got %v",
+					test.name, a, test.expected[i], actual)
+			}
+		}
+	}
+}
+
+func TestWhere(t *testing.T) {
+	c := Columns{
+		Owner:       "p.user_email",
+		Group:       "p.group_name",
+		Permissions: "p.permissions",
+	}
+
+	tests := []struct {
+		action   Action
+		expected string
+	}{
+		{
+			action:   Read,
+			expected: "(p.user_email = $1 OR (p.permissions & 16) != 0 OR (p.permissions & 128) != 0 AND p.group_name = ANY($2))",
+		},
+		{
+			action:   Run,
+			expected: "(p.user_email = $1 OR (p.permissions & 4) != 0 OR (p.permissions & 32) != 0 AND p.group_name = ANY($2))",
+		},
+		{
+			action:   Admin,
+			expected: "(p.user_email = $1 OR (p.permissions & 64) != 0 AND p.group_name = ANY($2))",
+		},
+	}
+
+	for _, test := range tests {
+		actual := Where(test.action, c, "$1", "$2")
+		if actual != test.expected {
+			t.Fatalf("%v: expected %v, got %v", test.action, test.expected, actual)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/run-ci/relay/store"
+	"github.com/sirupsen/logrus"
 )
 
 type jwtClaims struct {
@@ -24,7 +30,8 @@ func (srv *Server) handleAuth(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to read request body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
 	}
 
 	var auth map[string]string
@@ -32,51 +39,292 @@ func (srv *Server) handleAuth(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to unmarshal request body")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
 	}
 
 	if _, ok := auth["email"]; !ok {
 		err := errors.New("missing fields in auth request body")
 		logger.WithError(err).Error("unable to authenticate")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
 	}
 
 	if _, ok := auth["password"]; !ok {
 		err := errors.New("missing fields in auth request body")
 		logger.WithError(err).Error("unable to authenticate")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	ip := srv.clientIP(req)
+	logger = logger.WithFields(logrus.Fields{
+		"email": auth["email"],
+		"ip":    ip,
+	})
+
+	if srv.Throttle != nil {
+		if wait := srv.Throttle.Attempt(auth["email"], ip); wait > 0 {
+			err := errors.New("too many failed logins, try again later")
+			logger.WithError(err).Warn("unable to authenticate")
+
+			// Nothing was checked, so nothing is recorded. Otherwise
+			// anyone could add as many failed logins as they liked.
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeErrResp(rw, req, err, http.StatusTooManyRequests)
+			return
+		}
 	}
 
-	err = srv.st.Authenticate(auth["email"], auth["password"])
+	email, err := srv.Authenticator.Authenticate(ctx, auth["email"], auth["password"])
 	if err != nil {
 		logger.WithError(err).Error("unable to authenticate")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		if err == store.ErrNotAuthenticated {
+			if srv.Throttle != nil {
+				srv.Throttle.Fail(auth["email"], ip)
+			}
+
+			srv.recordFailedLogin(ctx, logger, auth["email"], ip, "bad credentials")
+
+			writeErrResp(rw, req, err, http.StatusBadRequest)
+			return
+		}
+
+		if srv.Throttle != nil {
+			srv.Throttle.Release(auth["email"], ip)
+		}
+
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
-	claims := &jwt.StandardClaims{
-		ExpiresAt: time.Now().Add(15 * time.Minute).Unix(),
-		// TODO: make this a constant or configurable by ENV
-		Issuer:  "relay",
-		Subject: auth["email"],
+	if srv.Throttle != nil {
+		srv.Throttle.Succeed(auth["email"], ip)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	ss, err := token.SignedString(srv.jwtsecret)
+	srv.login(ctx, rw, req, logger, email)
+}
+
+// recordFailedLogin saves a failed login for auditing. Not being able to
+// save it doesn't stop the response, which is already a failure anyway.
+func (srv *Server) recordFailedLogin(ctx context.Context, logger *logrus.Entry, email, ip, reason string) {
+	err := srv.st.RecordFailedLogin(ctx, &store.FailedLogin{
+		Email:  email,
+		IP:     ip,
+		Reason: reason,
+	})
+	if err != nil {
+		logger.WithError(err).Error("unable to save failed login")
+	}
+}
+
+// handleGetFailedLogins lists the newest failed logins, for the email in
+// the "email" query parameter, or for everyone.
+func (srv *Server) handleGetFailedLogins(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	limit, err := parseLimit(req)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse query parameters")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("retrieving failed logins from database")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logins, err := srv.st.GetFailedLogins(ctx, req.URL.Query().Get("email"), limit)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve failed logins from database")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err := json.Marshal(logins)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal JSON response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
+
+// login hands a user that just authenticated a new JWT and the refresh
+// token that starts a new family.
+func (srv *Server) login(ctx context.Context, rw http.ResponseWriter, req *http.Request, logger *logrus.Entry, user string) {
+	refresh := store.RefreshToken{
+		User:      user,
+		ExpiresAt: time.Now().Add(srv.RefreshTTL),
+	}
+	err := srv.st.CreateRefreshToken(ctx, &refresh)
+	if err != nil {
+		logger.WithError(err).Error("unable to save refresh token")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	srv.writeTokens(rw, req, logger, user, refresh.Token)
+}
+
+// handleRefresh trades a refresh token in for a new JWT and a new refresh
+// token. The old refresh token can't be used again.
+func (srv *Server) handleRefresh(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	refresh, err := readRefreshToken(req)
+	if err != nil || refresh == "" {
+		if err == nil {
+			err = errors.New("missing fields in refresh request body")
+		}
+		logger.WithError(err).Error("unable to refresh")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	next, err := srv.st.RotateRefreshToken(ctx, refresh, time.Now().Add(srv.RefreshTTL))
+	if err != nil {
+		logger.WithError(err).Error("unable to refresh")
+
+		status := http.StatusUnauthorized
+		if err != store.ErrNotAuthenticated {
+			status = errStatus(err)
+		}
+
+		writeErrResp(rw, req, err, status)
+		return
+	}
+
+	srv.writeTokens(rw, req, logger.WithField("request_subject", next.User), next.User, next.Token)
+}
+
+// handleLogout revokes the JWT the request was made with, and the refresh
+// tokens that came with it, if the request has one of them.
+func (srv *Server) handleLogout(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	refresh, err := readRefreshToken(req)
+	if err != nil {
+		logger.WithError(err).Error("unable to log out")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	if claims, ok := req.Context().Value(keyReqClaims).(*jwt.StandardClaims); ok && claims.Id != "" {
+		logger.Info("revoking token")
+
+		err := srv.st.RevokeJWT(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0))
+		if err != nil {
+			logger.WithError(err).Error("unable to revoke token")
+
+			writeErrResp(rw, req, err, errStatus(err))
+			return
+		}
+	}
+
+	if refresh != "" {
+		logger.Info("revoking refresh token")
+
+		err := srv.st.RevokeRefreshToken(ctx, refresh)
+		if err != nil {
+			logger.WithError(err).Error("unable to revoke refresh token")
+
+			writeErrResp(rw, req, err, errStatus(err))
+			return
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// readRefreshToken reads the "refresh_token" field out of the request
+// body. An empty body has no refresh token in it.
+func readRefreshToken(req *http.Request) (string, error) {
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil || len(buf) == 0 {
+		return "", err
+	}
+
+	var body map[string]string
+	err = json.Unmarshal(buf, &body)
+
+	return body["refresh_token"], err
+}
+
+// writeTokens signs a JWT for the user and writes it out as the response,
+// along with the refresh token.
+func (srv *Server) writeTokens(rw http.ResponseWriter, req *http.Request, logger *logrus.Entry, user, refresh string) {
+	ss, err := srv.signToken(user)
 	if err != nil {
 		logger.WithError(err).Error("unable to generate token")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
-	buf, err = json.Marshal(map[string]string{
-		"token": ss,
+	buf, err := json.Marshal(map[string]interface{}{
+		"token":         ss,
+		"refresh_token": refresh,
+		"expires_in":    int(srv.TokenTTL / time.Second),
 	})
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
 
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(buf)
 }
+
+// signToken returns a signed JWT for the user. Every JWT gets its own ID,
+// so it can be revoked. It's signed with the signing key if the server has
+// keys, and with the secret otherwise.
+func (srv *Server) signToken(user string) (string, error) {
+	claims := &jwt.StandardClaims{
+		Id:        uuid.New().String(),
+		ExpiresAt: time.Now().Add(srv.TokenTTL).Unix(),
+		Issuer:    srv.Issuer,
+		Subject:   user,
+	}
+
+	if srv.Keys != nil {
+		return srv.Keys.sign(claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(srv.jwtsecret)
+}
@@ -1,21 +1,20 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/run-ci/relay/store"
 )
 
-func (st *memStore) Authenticate(user, pass string) error {
-	return nil
-}
-
 func TestCheckAuth(t *testing.T) {
 	testfn := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		sub := req.Context().Value(keyReqSub).(string)
@@ -30,7 +29,9 @@ func TestCheckAuth(t *testing.T) {
 
 	jwtsecret := []byte("valid")
 	srv := &Server{
-		jwtsecret: jwtsecret,
+		st:           seedStore(t),
+		jwtsecret:    jwtsecret,
+		StoreTimeout: DefaultStoreTimeout,
 	}
 
 	handler := srv.checkAuth(testfn)
@@ -87,7 +88,8 @@ func TestCheckAuth(t *testing.T) {
 			expected: result{
 				status: http.StatusUnauthorized,
 				body: map[string]string{
-					"error": "missing bearer token",
+					"code":    "unauthorized",
+					"message": "missing bearer token",
 				},
 			},
 			actual: result{},
@@ -98,7 +100,8 @@ func TestCheckAuth(t *testing.T) {
 			expected: result{
 				status: http.StatusUnauthorized,
 				body: map[string]string{
-					"error": "missing bearer token",
+					"code":    "unauthorized",
+					"message": "missing bearer token",
 				},
 			},
 			actual: result{},
@@ -109,7 +112,8 @@ func TestCheckAuth(t *testing.T) {
 			expected: result{
 				status: http.StatusUnauthorized,
 				body: map[string]string{
-					"error": "token contains an invalid number of segments",
+					"code":    "unauthorized",
+					"message": "token contains an invalid number of segments",
 				},
 			},
 			actual: result{},
@@ -132,7 +136,8 @@ func TestCheckAuth(t *testing.T) {
 			expected: result{
 				status: http.StatusUnauthorized,
 				body: map[string]string{
-					"error": "signature is invalid",
+					"code":    "unauthorized",
+					"message": "signature is invalid",
 				},
 			},
 			actual: result{},
@@ -143,7 +148,8 @@ func TestCheckAuth(t *testing.T) {
 			expected: result{
 				status: http.StatusUnauthorized,
 				body: map[string]string{
-					"error": "token is expired by 1m0s",
+					"code":    "unauthorized",
+					"message": "token is expired by 1m0s",
 				},
 			},
 			actual: result{},
@@ -174,7 +180,17 @@ func TestCheckAuth(t *testing.T) {
 				t.Fatalf("got error reading response body: %v", err)
 			}
 
-			err = json.Unmarshal(body, &test.actual.body)
+			// Errors are compared by their code and message.
+			if resp.StatusCode != http.StatusOK {
+				var errResp ErrorResponse
+				err = json.Unmarshal(body, &errResp)
+				test.actual.body = map[string]string{
+					"code":    errResp.Error.Code,
+					"message": errResp.Error.Message,
+				}
+			} else {
+				err = json.Unmarshal(body, &test.actual.body)
+			}
 			if err != nil {
 				t.Fatalf("got error unmarshaling response body: %v", err)
 			}
@@ -225,3 +241,232 @@ func gentoken(exp time.Time, secret []byte, signMethod jwt.SigningMethod) string
 
 	return ss
 }
+
+func TestDisabledUserTokens(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	token, err := srv.signToken(testUser)
+	if err != nil {
+		t.Fatalf("got error signing token: %v", err)
+	}
+
+	getMe := func() int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	if status := getMe(); status != http.StatusOK {
+		t.Fatalf("expected status code %v before disabling, got %v", http.StatusOK, status)
+	}
+
+	disabled := true
+	if _, err := st.UpdateUser(ctx, testUser, store.UserUpdate{Disabled: &disabled}); err != nil {
+		t.Fatalf("got error disabling user: %v", err)
+	}
+
+	if status := getMe(); status != http.StatusUnauthorized {
+		t.Fatalf("expected status code %v after disabling, got %v", http.StatusUnauthorized, status)
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+	srv.Issuer = "relay-test"
+	srv.TokenTTL = time.Minute
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	type tokens struct {
+		Token     string `json:"token"`
+		Refresh   string `json:"refresh_token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+
+	post := func(path, bearer, body string) (int, tokens) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		defer resp.Body.Close()
+
+		tok := tokens{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+				t.Fatalf("got error decoding response body: %v", err)
+			}
+		}
+
+		return resp.StatusCode, tok
+	}
+
+	get := func(bearer string) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/projects", nil)
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+bearer)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	login := fmt.Sprintf(`{"email": %q, "password": "test"}`, testUser)
+	refreshBody := func(tok tokens) string {
+		return fmt.Sprintf(`{"refresh_token": %q}`, tok.Refresh)
+	}
+
+	status, first := post("/auth", "", login)
+	if status != http.StatusOK || first.Refresh == "" || first.ExpiresIn != 60 {
+		t.Fatalf("expected a token lasting 60s and a refresh token, got %v and %+v", status, first)
+	}
+
+	if status := get(first.Token); status != http.StatusOK {
+		t.Fatalf("expected the login token to work, got %v", status)
+	}
+
+	status, second := post("/auth/refresh", "", refreshBody(first))
+	if status != http.StatusOK || second.Refresh == first.Refresh {
+		t.Fatalf("expected refreshing to rotate the refresh token, got %v and %+v", status, second)
+	}
+
+	if status := get(second.Token); status != http.StatusOK {
+		t.Fatalf("expected the refreshed token to work, got %v", status)
+	}
+
+	// Trading in a refresh token twice means it was stolen, so
+	// every refresh token from that login stops working.
+	if status, _ := post("/auth/refresh", "", refreshBody(first)); status != http.StatusUnauthorized {
+		t.Fatalf("expected a reused refresh token to be rejected, got %v", status)
+	}
+
+	if status, _ := post("/auth/refresh", "", refreshBody(second)); status != http.StatusUnauthorized {
+		t.Fatalf("expected the family of a reused refresh token to be revoked, got %v", status)
+	}
+
+	if status, _ := post("/auth/refresh", "", `{}`); status != http.StatusBadRequest {
+		t.Fatalf("expected a missing refresh token to be a bad request, got %v", status)
+	}
+
+	_, third := post("/auth", "", login)
+
+	if status, _ := post("/auth/logout", third.Token, refreshBody(third)); status != http.StatusNoContent {
+		t.Fatalf("expected logging out to succeed, got %v", status)
+	}
+
+	if status := get(third.Token); status != http.StatusUnauthorized {
+		t.Fatalf("expected a logged out token to be rejected, got %v", status)
+	}
+
+	if status, _ := post("/auth/refresh", "", refreshBody(third)); status != http.StatusUnauthorized {
+		t.Fatalf("expected a logged out refresh token to be rejected, got %v", status)
+	}
+
+	claims := &jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		Issuer:    "someone-else",
+		Subject:   testUser,
+	}
+	foreign, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test"))
+
+	if status := get(foreign); status != http.StatusUnauthorized {
+		t.Fatalf("expected a token from another issuer to be rejected, got %v", status)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	st := seedPermissions(t)
+	public := addPermsProject(t, st, store.PermPublicRead|store.PermPublicWrite)
+	private := addPermsProject(t, st, store.PermGroupRead)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	token, err := srv.signToken("owner@test")
+	if err != nil {
+		t.Fatalf("got error signing token: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		bearer string
+		status int
+	}{
+		{name: "public project", method: http.MethodGet, path: fmt.Sprintf("/projects/%v", public.project), status: http.StatusOK},
+		{name: "public pipeline", method: http.MethodGet, path: fmt.Sprintf("/pipelines/%v", public.pipeline), status: http.StatusOK},
+		{name: "public task", method: http.MethodGet, path: fmt.Sprintf("/tasks/%v", public.task), status: http.StatusOK},
+		{name: "private project", method: http.MethodGet, path: fmt.Sprintf("/projects/%v", private.project), status: http.StatusNotFound},
+		{name: "private step", method: http.MethodGet, path: fmt.Sprintf("/steps/%v", private.step), status: http.StatusNotFound},
+		{name: "private project with token", method: http.MethodGet, path: fmt.Sprintf("/projects/%v", private.project), bearer: token, status: http.StatusOK},
+		{name: "bad token", method: http.MethodGet, path: fmt.Sprintf("/projects/%v", public.project), bearer: "nope", status: http.StatusUnauthorized},
+		{name: "publicly writable", method: http.MethodDelete, path: fmt.Sprintf("/pipelines/%v", public.pipeline), status: http.StatusUnauthorized},
+		{name: "me", method: http.MethodGet, path: "/me", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+		if test.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/projects")
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+
+	projects := []store.Project{}
+	err = json.NewDecoder(resp.Body).Decode(&projects)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if len(projects) != 1 || projects[0].ID != public.project {
+		t.Fatalf("expected only project %v, got %+v", public.project, projects)
+	}
+}
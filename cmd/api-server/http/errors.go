@@ -0,0 +1,208 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/run-ci/relay/store"
+)
+
+// ErrorResponse is the body of every error response, as
+// {"error": {...}}.
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// Error is what went wrong with a request. Code is meant for programs to
+// tell errors apart by, and doesn't change. Message is meant for people,
+// and might.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID is the ID the request was logged with.
+	RequestID string `json:"request_id,omitempty"`
+	// Fields says what's wrong with the fields of the request body,
+	// when that's what went wrong.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is what's wrong with one field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// These are the codes of errors that aren't from the store, and of the
+// ones that are, but that there's no specific code for.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeInvalidBody      = "invalid_body"
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeTooManyRequests  = "too_many_requests"
+	CodeUnavailable      = "unavailable"
+	CodeInternal         = "internal_error"
+)
+
+var (
+	errRouteNotFound    = errors.New("no such route")
+	errMethodNotAllowed = errors.New("method not allowed on route")
+)
+
+// storeError is how an error from the store is sent to clients.
+type storeError struct {
+	status int
+	code   string
+	// field is the field of the request body the error is about, if
+	// it's about one.
+	field string
+}
+
+var storeErrors = map[error]storeError{
+	store.ErrProjectNotFound:     {status: http.StatusNotFound, code: "project_not_found"},
+	store.ErrGitRemoteNotFound:   {status: http.StatusNotFound, code: "git_remote_not_found"},
+	store.ErrPipelineNotFound:    {status: http.StatusNotFound, code: "pipeline_not_found"},
+	store.ErrNoPipelines:         {status: http.StatusNotFound, code: "no_pipelines"},
+	store.ErrRunNotFound:         {status: http.StatusNotFound, code: "run_not_found"},
+	store.ErrStepNotFound:        {status: http.StatusNotFound, code: "step_not_found"},
+	store.ErrTaskNotFound:        {status: http.StatusNotFound, code: "task_not_found"},
+	store.ErrUserNotFound:        {status: http.StatusNotFound, code: "user_not_found"},
+	store.ErrGroupNotFound:       {status: http.StatusNotFound, code: "group_not_found"},
+	store.ErrAccessTokenNotFound: {status: http.StatusNotFound, code: "access_token_not_found"},
+
+	store.ErrNotAuthenticated: {status: http.StatusUnauthorized, code: "not_authenticated"},
+	store.ErrNotAuthorized:    {status: http.StatusForbidden, code: "not_authorized"},
+
+	store.ErrInvalidFilter:      {status: http.StatusBadRequest, code: "invalid_filter"},
+	store.ErrInvalidPermissions: {status: http.StatusUnprocessableEntity, code: "invalid_permissions", field: "permissions"},
+	store.ErrInvalidScopes:      {status: http.StatusUnprocessableEntity, code: "invalid_scopes", field: "scopes"},
+
+	store.ErrUserExists:        {status: http.StatusConflict, code: "user_exists"},
+	store.ErrGroupExists:       {status: http.StatusConflict, code: "group_exists"},
+	store.ErrGroupInUse:        {status: http.StatusConflict, code: "group_in_use"},
+	store.ErrAccessTokenExists: {status: http.StatusConflict, code: "access_token_exists"},
+	store.ErrRunConflict:       {status: http.StatusConflict, code: "run_conflict"},
+	store.ErrRunFinished:       {status: http.StatusConflict, code: "run_finished"},
+	store.ErrRunCancelled:      {status: http.StatusConflict, code: "run_cancelled"},
+	store.ErrRunNotFinished:    {status: http.StatusConflict, code: "run_not_finished"},
+	store.ErrRunSucceeded:      {status: http.StatusConflict, code: "run_succeeded"},
+	store.ErrRunNotRetryable:   {status: http.StatusConflict, code: "run_not_retryable"},
+}
+
+// statusCodes are the codes of errors with nothing more specific to go
+// on than their status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          CodeBadRequest,
+	http.StatusUnauthorized:        CodeUnauthorized,
+	http.StatusForbidden:           CodeForbidden,
+	http.StatusNotFound:            CodeNotFound,
+	http.StatusMethodNotAllowed:    CodeMethodNotAllowed,
+	http.StatusConflict:            CodeConflict,
+	http.StatusUnprocessableEntity: CodeInvalidRequest,
+	http.StatusTooManyRequests:     CodeTooManyRequests,
+	http.StatusServiceUnavailable:  CodeUnavailable,
+}
+
+// fieldError is a request body that's well formed, but that has a field
+// that doesn't make sense.
+type fieldError struct {
+	FieldError
+}
+
+func (err *fieldError) Error() string {
+	return err.Message
+}
+
+// invalidField returns an error saying what's wrong with a field of the
+// request body. Its status is 422.
+func invalidField(field, msg string) error {
+	return &fieldError{FieldError{Field: field, Message: msg}}
+}
+
+// errStatus is the status code for an error. Anything there isn't a
+// specific status for is a server error.
+func errStatus(err error) int {
+	if e, ok := storeErrors[err]; ok {
+		return e.status
+	}
+
+	switch err.(type) {
+	case *fieldError:
+		return http.StatusUnprocessableEntity
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// newError returns the Error that's sent for err with the status.
+// Server errors don't say what went wrong, since that's for the logs,
+// which the request ID is there to find them in.
+func newError(req *http.Request, err error, status int) Error {
+	e := Error{Message: err.Error()}
+
+	if id, ok := req.Context().Value(keyReqID).(string); ok {
+		e.RequestID = id
+	}
+
+	if se, ok := storeErrors[err]; ok {
+		e.Code = se.code
+		if se.field != "" {
+			e.Fields = []FieldError{{Field: se.field, Message: e.Message}}
+		}
+
+		return e
+	}
+
+	switch err := err.(type) {
+	case *fieldError:
+		e.Code = CodeInvalidRequest
+		e.Fields = []FieldError{err.FieldError}
+		return e
+	case *json.SyntaxError:
+		e.Code = CodeInvalidBody
+		return e
+	case *json.UnmarshalTypeError:
+		e.Code = CodeInvalidBody
+		e.Fields = []FieldError{{Field: err.Field, Message: "must be " + err.Type.String()}}
+		return e
+	}
+
+	code, ok := statusCodes[status]
+	if !ok {
+		return Error{Code: CodeInternal, Message: "internal error", RequestID: e.RequestID}
+	}
+
+	e.Code = code
+	return e
+}
+
+func writeErrResp(rw http.ResponseWriter, req *http.Request, err error, status int) {
+	rw.WriteHeader(status)
+
+	buf, err := json.Marshal(ErrorResponse{Error: newError(req, err, status)})
+	if err != nil {
+		return
+	}
+
+	rw.Write(buf)
+	return
+}
+
+// handleNotFound is what's served for routes that don't exist, so
+// they get the same error body as everything else.
+func handleNotFound(rw http.ResponseWriter, req *http.Request) {
+	writeErrResp(rw, req, errRouteNotFound, http.StatusNotFound)
+}
+
+// handleMethodNotAllowed is what's served for routes that exist, but not
+// with the request's method.
+func handleMethodNotAllowed(rw http.ResponseWriter, req *http.Request) {
+	writeErrResp(rw, req, errMethodNotAllowed, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorResponses(t *testing.T) {
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	token, err := srv.signToken(testUser)
+	if err != nil {
+		t.Fatalf("got error signing token: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+		fields []FieldError
+	}{
+		{
+			name: "missing project", method: http.MethodGet, path: "/projects/999",
+			status: http.StatusNotFound, code: "project_not_found",
+		},
+		{
+			name: "empty name", method: http.MethodPatch, path: "/projects/1", body: `{"name": ""}`,
+			status: http.StatusUnprocessableEntity, code: CodeInvalidRequest,
+			fields: []FieldError{{Field: "name", Message: "project name can't be empty"}},
+		},
+		{
+			name: "reserved bits", method: http.MethodPatch, path: "/projects/1", body: `{"permissions": 3}`,
+			status: http.StatusUnprocessableEntity, code: "invalid_permissions",
+			fields: []FieldError{{Field: "permissions", Message: "invalid permissions"}},
+		},
+		{
+			name: "wrong type", method: http.MethodPatch, path: "/projects/1", body: `{"name": 3}`,
+			status: http.StatusBadRequest, code: CodeInvalidBody,
+			fields: []FieldError{{Field: "name", Message: "must be string"}},
+		},
+		{
+			name: "bad json", method: http.MethodPatch, path: "/projects/1", body: `{"name": `,
+			status: http.StatusBadRequest, code: CodeInvalidBody,
+		},
+		{
+			name: "unknown route", method: http.MethodGet, path: "/nope",
+			status: http.StatusNotFound, code: CodeNotFound,
+		},
+		{
+			name: "wrong method", method: http.MethodPut, path: "/projects/1",
+			status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+
+		var body ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%v: got error decoding response body: %v", test.name, err)
+		}
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+
+		actual := body.Error
+		if actual.Code != test.code || actual.Message == "" || actual.RequestID == "" {
+			t.Fatalf("%v: expected code %v with a message and request ID, got %+v", test.name, test.code, actual)
+		}
+
+		if len(actual.Fields) != len(test.fields) {
+			t.Fatalf("%v: expected fields %+v, got %+v", test.name, test.fields, actual.Fields)
+		}
+
+		for i, f := range test.fields {
+			if actual.Fields[i] != f {
+				t.Fatalf("%v: expected fields %+v, got %+v", test.name, test.fields, actual.Fields)
+			}
+		}
+	}
+}
+
+func TestInternalErrorsAreHidden(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://test", nil)
+
+	e := newError(req, errors.New("pq: connection refused"), http.StatusInternalServerError)
+	if e.Code != CodeInternal || strings.Contains(e.Message, "pq") {
+		t.Fatalf("expected an internal error that doesn't say what happened, got %+v", e)
+	}
+}
@@ -29,7 +29,7 @@ func (srv *Server) handleCreateGitRemote(rw http.ResponseWriter, req *http.Reque
 		logger.WithField("error", err).
 			Error("unable to read request body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -42,7 +42,7 @@ func (srv *Server) handleCreateGitRemote(rw http.ResponseWriter, req *http.Reque
 		err := errors.New("missing paramter 'project_id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -52,7 +52,7 @@ func (srv *Server) handleCreateGitRemote(rw http.ResponseWriter, req *http.Reque
 	if err != nil {
 		logger.WithError(err).Error("unable to parse project id as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -65,7 +65,7 @@ func (srv *Server) handleCreateGitRemote(rw http.ResponseWriter, req *http.Reque
 		logger.WithField("error", err).
 			Error("unable to unmarshal request body")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -73,31 +73,20 @@ func (srv *Server) handleCreateGitRemote(rw http.ResponseWriter, req *http.Reque
 		"git_remote": fmt.Sprintf("%v#%v", gr.URL, gr.Branch),
 	})
 
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
 	logger.Info("saving git remote")
-	err = srv.st.CreateGitRemote(reqSub, &gr)
+	err = srv.st.CreateGitRemote(ctx, reqSub, &gr)
 	if err != nil {
 		logger.WithField("error", err).
 			Error("unable to save git repo in database")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
-	msg := map[string]string{
-		"op":     "create",
-		"remote": gr.URL,
-		"branch": gr.Branch,
-	}
-	rawmsg, err := json.Marshal(msg)
-	if err != nil {
-		logger.WithField("error", err).
-			Warn("unable to marshal poller create message")
-	} else {
-		// Not being able to send to the poller is not enough to cause the
-		// request to fail. For this reason, we should try as hard as possible
-		// to send the request.
-		go sendWithBackoff(logger, srv.pollch, rawmsg)
-	}
+	srv.notifyPoller(logger, "create", gr.URL, gr.Branch)
 
 	rw.WriteHeader(http.StatusAccepted)
 	return
@@ -120,7 +109,7 @@ func (srv *Server) handleGetGitRemote(rw http.ResponseWriter, req *http.Request)
 		err := errors.New("missing paramter 'project_id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -130,7 +119,7 @@ func (srv *Server) handleGetGitRemote(rw http.ResponseWriter, req *http.Request)
 	if err != nil {
 		logger.WithError(err).Error("unable to parse project id as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -140,7 +129,7 @@ func (srv *Server) handleGetGitRemote(rw http.ResponseWriter, req *http.Request)
 		err := errors.New("missing paramter 'id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -150,7 +139,7 @@ func (srv *Server) handleGetGitRemote(rw http.ResponseWriter, req *http.Request)
 	if err != nil {
 		logger.WithError(err).Error("unable to decode git remote")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -163,11 +152,14 @@ func (srv *Server) handleGetGitRemote(rw http.ResponseWriter, req *http.Request)
 
 	logger.Debug("fetching git remote")
 
-	remote, err := srv.st.GetGitRemote(reqSub, id, spec[0], spec[1])
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	remote, err := srv.st.GetGitRemote(ctx, reqSub, id, spec[0], spec[1])
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve git remote")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
@@ -177,7 +169,7 @@ func (srv *Server) handleGetGitRemote(rw http.ResponseWriter, req *http.Request)
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -185,3 +177,191 @@ func (srv *Server) handleGetGitRemote(rw http.ResponseWriter, req *http.Request)
 	rw.Write(buf)
 	return
 }
+
+func (srv *Server) handleDeleteGitRemote(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["project_id"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'project_id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing project id")
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse project id as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("project_id", id)
+
+	if raw, ok = vars["id"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("decoding git remote id")
+
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to decode git remote")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	spec := strings.SplitN(string(decoded), "#", 2)
+	if len(spec) != 2 {
+		err := errors.New("git remote id must be in the form 'url#branch'")
+		logger.WithError(err).Error("unable to decode git remote")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"url":    spec[0],
+		"branch": spec[1],
+	})
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Info("deleting git remote")
+	err = srv.st.DeleteGitRemote(ctx, reqSub, id, spec[0], spec[1])
+	if err != nil {
+		logger.WithError(err).Error("unable to delete git remote")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	srv.notifyPoller(logger, "delete", spec[0], spec[1])
+
+	rw.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// WebhookSecretRequest sets the secret the webhooks of a Git remote are
+// checked with. An empty secret turns them off.
+type WebhookSecretRequest struct {
+	Secret string `json:"secret"`
+}
+
+func (srv *Server) handleSetWebhookSecret(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["project_id"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'project_id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing project id")
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse project id as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("project_id", id)
+
+	if raw, ok = vars["id"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("decoding git remote id")
+
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to decode git remote")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	spec := strings.SplitN(string(decoded), "#", 2)
+	if len(spec) != 2 {
+		err := errors.New("git remote id must be in the form 'url#branch'")
+		logger.WithError(err).Error("unable to decode git remote")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"url":    spec[0],
+		"branch": spec[1],
+	})
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var secretreq WebhookSecretRequest
+	err = json.Unmarshal(buf, &secretreq)
+	if err != nil {
+		logger.WithError(err).Error("unable to unmarshal request body")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Info("setting webhook secret")
+	err = srv.st.SetWebhookSecret(ctx, reqSub, id, spec[0], spec[1], secretreq.Secret)
+	if err != nil {
+		logger.WithError(err).Error("unable to set webhook secret")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -2,46 +2,20 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/run-ci/relay/store"
 )
 
-func (st *memStore) CreateGitRemote(user string, r *store.GitRemote) error {
-	proj, ok := st.projectdb[r.ProjectID]
-	if !ok {
-		return store.ErrProjectNotFound
-	}
-
-	proj.GitRemotes = append(proj.GitRemotes, *r)
-	return nil
-}
-
-func (st *memStore) GetGitRemote(user string, pid int, url string, branch string) (store.GitRemote, error) {
-	proj, ok := st.projectdb[pid]
-	if !ok {
-		return store.GitRemote{}, store.ErrProjectNotFound
-	}
-
-	for _, remote := range proj.GitRemotes {
-		if remote.URL == url && remote.Branch == branch {
-			return remote, nil
-		}
-	}
-
-	return store.GitRemote{}, store.ErrGitRemoteNotFound
-}
-
 func TestCreateGitRemote(t *testing.T) {
-	st := &memStore{
-		projectdb: make(map[int]store.Project),
-	}
-	st.seedProjects()
+	st := seedStore(t)
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -75,10 +49,7 @@ func TestCreateGitRemote(t *testing.T) {
 }
 
 func TestGetGitRemote(t *testing.T) {
-	st := &memStore{
-		projectdb: make(map[int]store.Project),
-	}
-	st.seedProjects()
+	st := seedStore(t)
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -91,7 +62,7 @@ func TestGetGitRemote(t *testing.T) {
 
 	// TODO: make this table driven
 	spec := base64.StdEncoding.EncodeToString([]byte("//test-a.git#master"))
-	requrl := fmt.Sprintf("%v/projects/%v/git_remotes/%v", ts.URL, 0, spec)
+	requrl := fmt.Sprintf("%v/projects/%v/git_remotes/%v", ts.URL, 1, spec)
 	req, err := http.NewRequest(http.MethodGet, requrl, nil)
 	if err != nil {
 		t.Fatalf("error creating http request for test: %v", err)
@@ -106,3 +77,72 @@ func TestGetGitRemote(t *testing.T) {
 		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
 	}
 }
+
+func TestDeleteGitRemote(t *testing.T) {
+	st := seedStore(t)
+
+	pollch := make(chan []byte, 1)
+	srv := NewServer(":9001", pollch, st, "test")
+
+	r := mux.NewRouter()
+	r.Handle("/projects/{project_id}/git_remotes/{id}", chain(
+		srv.handleDeleteGitRemote, setRequestID, autoAuth))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		remote string
+		status int
+	}{
+		{remote: "//test-a.git#staging", status: http.StatusNotFound},
+		{remote: "//test-a.git#master", status: http.StatusNoContent},
+		{remote: "//test-a.git#master", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		spec := base64.StdEncoding.EncodeToString([]byte(test.remote))
+		requrl := fmt.Sprintf("%v/projects/%v/git_remotes/%v", ts.URL, 1, spec)
+		req, err := http.NewRequest(http.MethodDelete, requrl, nil)
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("expected status %v deleting %v, got %v", test.status, test.remote, resp.StatusCode)
+		}
+	}
+
+	for _, id := range []int{1, 2} {
+		_, err := st.GetPipeline(context.Background(), testUser, id)
+		if err != store.ErrPipelineNotFound {
+			t.Fatalf("expected pipeline %v to be deleted with its remote, got %v", id, err)
+		}
+	}
+
+	_, err := st.GetStep(context.Background(), testUser, 1)
+	if err != store.ErrStepNotFound {
+		t.Fatalf("expected steps to be deleted with their pipeline, got %v", err)
+	}
+
+	_, err = st.GetTask(context.Background(), testUser, 1)
+	if err != store.ErrTaskNotFound {
+		t.Fatalf("expected tasks to be deleted with their step, got %v", err)
+	}
+
+	select {
+	case msg := <-pollch:
+		expected := `{"branch":"master","op":"delete","remote":"//test-a.git"}`
+		if string(msg) != expected {
+			t.Fatalf("expected poller message %v, got %s", expected, msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a poller delete message")
+	}
+}
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+	"github.com/sirupsen/logrus"
+)
+
+func (srv *Server) handleCreateGroup(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var group store.Group
+	err = json.Unmarshal(buf, &group)
+	if err != nil {
+		logger.WithError(err).Error("unable to unmarshal request body")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	if group.Name == "" {
+		err := invalidField("name", "group name can't be empty")
+		logger.WithError(err).Error("invalid group")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger = logger.WithField("group", group.Name)
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Info("saving group")
+	err = srv.st.CreateGroup(ctx, &group)
+	if err != nil {
+		logger.WithError(err).Error("unable to save group")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err = json.Marshal(group)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		// We've already processed the request and taken action on it,
+		// so returning an error response code here would be misleading.
+		writeErrResp(rw, req, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleGetGroups(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("retrieving groups from database")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	groups, err := srv.st.GetGroups(ctx)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve groups from database")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err := json.Marshal(groups)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal JSON response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleDeleteGroup(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for name")
+	name, ok := mux.Vars(req)["name"]
+	if !ok || name == "" {
+		err := errors.New("missing paramter 'name' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("group", name)
+
+	logger.Info("deleting group")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	err := srv.st.DeleteGroup(ctx, name)
+	if err != nil {
+		logger.WithError(err).Error("unable to delete group")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -3,10 +3,12 @@ package http
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/run-ci/relay/authn"
 	"github.com/run-ci/relay/store"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -22,6 +24,8 @@ type ctxkey int
 const (
 	keyReqID ctxkey = iota
 	keyReqSub
+	keyReqScopes
+	keyReqClaims
 )
 
 func init() {
@@ -31,20 +35,56 @@ func init() {
 // apiStore is a grouping of the minimum number of store
 // interfaces the API needs to work.
 type apiStore interface {
-	GetPipelines(user string, pid int) ([]store.Pipeline, error)
-	GetPipeline(user string, id int) (store.Pipeline, error)
-	GetRun(user string, pid, id int) (store.Run, error)
-	GetStep(user string, id int) (store.Step, error)
-	GetTask(user string, id int) (store.Task, error)
-	GetGitRemote(user string, pid int, url string, branch string) (store.GitRemote, error)
-
-	CreateProject(*store.Project) error
-	GetProject(user string, id int) (store.Project, error)
-	GetProjects(user string) ([]store.Project, error)
-
-	CreateGitRemote(user string, remote *store.GitRemote) error
-
-	Authenticate(user, pass string) error
+	GetPipelines(ctx context.Context, user string, pid int, f store.ListFilter) (store.PipelinePage, error)
+	GetPipeline(ctx context.Context, user string, id int) (store.Pipeline, error)
+	GetRun(ctx context.Context, user string, pid, id int) (store.Run, error)
+	ListRuns(ctx context.Context, user string, pid int, f store.RunFilter) (store.RunPage, error)
+	QueueRun(ctx context.Context, user string, r *store.Run) error
+	CancelRun(ctx context.Context, user string, pid, n int) (store.Run, error)
+	RetryRun(ctx context.Context, user string, pid, n int, resume bool) (store.Run, error)
+	CreateRun(context.Context, *store.Run) error
+	UpdateRun(context.Context, *store.Run) error
+	GetStep(ctx context.Context, user string, id int) (store.Step, error)
+	GetTask(ctx context.Context, user string, id int) (store.Task, error)
+	GetGitRemote(ctx context.Context, user string, pid int, url string, branch string) (store.GitRemote, error)
+
+	CreateProject(context.Context, *store.Project) error
+	GetProject(ctx context.Context, user string, id int) (store.Project, error)
+	GetProjects(ctx context.Context, user string, f store.ListFilter) (store.ProjectPage, error)
+	UpdateProject(ctx context.Context, user string, id int, u store.ProjectUpdate) (store.Project, error)
+
+	CreateGitRemote(ctx context.Context, user string, remote *store.GitRemote) error
+	SetWebhookSecret(ctx context.Context, user string, pid int, url, branch, secret string) error
+	GetHookRemotes(ctx context.Context, urls []string, branch string) ([]store.HookRemote, error)
+
+	DeleteProject(ctx context.Context, user string, id int) ([]store.GitRemote, error)
+	DeleteGitRemote(ctx context.Context, user string, pid int, url, branch string) error
+	DeletePipeline(ctx context.Context, user string, id int) error
+
+	CreateUser(context.Context, *store.User) error
+	GetUser(ctx context.Context, email string) (store.User, error)
+	GetUsers(context.Context) ([]store.User, error)
+	UpdateUser(ctx context.Context, email string, u store.UserUpdate) (store.User, error)
+
+	CreateGroup(context.Context, *store.Group) error
+	GetGroups(context.Context) ([]store.Group, error)
+	DeleteGroup(ctx context.Context, name string) error
+
+	Authenticate(ctx context.Context, user, pass string) error
+
+	CreateAccessToken(context.Context, *store.AccessToken) error
+	GetAccessTokens(ctx context.Context, user string) ([]store.AccessToken, error)
+	RevokeAccessToken(ctx context.Context, user string, id int) error
+	AuthenticateAccessToken(ctx context.Context, token string) (store.AccessToken, error)
+
+	CreateRefreshToken(context.Context, *store.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, token string, expires time.Time) (store.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, token string) error
+	RevokeJWT(ctx context.Context, id string, expires time.Time) error
+	JWTRevoked(ctx context.Context, id string) (bool, error)
+
+	RecordFailedLogin(context.Context, *store.FailedLogin) error
+	GetFailedLogins(ctx context.Context, email string, limit int) ([]store.FailedLogin, error)
 }
 
 // Server is a net/http.Server with dependencies like
@@ -54,9 +94,63 @@ type Server struct {
 	pollch    chan<- []byte
 	jwtsecret []byte
 
+	// Runs is where runs started through the API are sent for the
+	// runlets to pick up. Runs can't be started without it.
+	Runs chan<- []byte
+	// Control is where messages about runs that are already running,
+	// like to cancel them, are sent for every runlet to see. Started
+	// runs can't be cancelled without it.
+	Control chan<- []byte
+
+	// status hands the status events of runs out to their streams.
+	status *statusHub
+
+	// Authenticator checks the credentials of users logging in. It's
+	// the store's own users unless it's set to something else.
+	Authenticator authn.Authenticator
+
+	// Throttle locks out accounts and addresses with too many failed
+	// logins. Logins aren't throttled without one.
+	Throttle *LoginThrottle
+	// RealIPHeader is the header a proxy in front of the server puts
+	// the address of the client in, like X-Forwarded-For. It's only
+	// trusted if it's set.
+	RealIPHeader string
+
+	// OIDC is the OpenID Connect provider users can log in through,
+	// if there is one.
+	OIDC *authn.OIDC
+
+	// Keys are the keys JWTs are signed with, if they're signed with
+	// keys and not the secret. JWTs signed with the secret are still
+	// accepted as long as there is one.
+	Keys *KeySet
+
+	// StoreTimeout bounds how long a single request can spend
+	// waiting on the store.
+	StoreTimeout time.Duration
+
+	// Issuer is who the JWTs the server hands out say they're from.
+	// JWTs from anyone else aren't accepted.
+	Issuer string
+	// TokenTTL is how long the JWTs the server hands out last.
+	TokenTTL time.Duration
+	// RefreshTTL is how long a refresh token lasts. Every refresh
+	// hands out a new one that lasts this long.
+	RefreshTTL time.Duration
+
 	*http.Server
 }
 
+// These are the defaults a Server gets for whatever isn't set to
+// something else.
+const (
+	DefaultStoreTimeout = 10 * time.Second
+	DefaultIssuer       = "relay"
+	DefaultTokenTTL     = 15 * time.Minute
+	DefaultRefreshTTL   = 7 * 24 * time.Hour
+)
+
 // NewServer returns a Server with a reference to `st`, listening
 // on `addr`.
 func NewServer(addr string, pollch chan<- []byte, st apiStore, jwtsecret string) *Server {
@@ -68,11 +162,23 @@ func NewServer(addr string, pollch chan<- []byte, st apiStore, jwtsecret string)
 		st:        st,
 		pollch:    pollch,
 		jwtsecret: []byte(jwtsecret),
+		status:    newStatusHub(),
+
+		Authenticator: authn.Local{Store: st},
+		Throttle:      NewLoginThrottle(),
+
+		StoreTimeout: DefaultStoreTimeout,
+		Issuer:       DefaultIssuer,
+		TokenTTL:     DefaultTokenTTL,
+		RefreshTTL:   DefaultRefreshTTL,
 	}
 
 	r := mux.NewRouter()
 	srv.Handler = r
 
+	r.NotFoundHandler = chain(handleNotFound, setRequestID, logRequest)
+	r.MethodNotAllowedHandler = chain(handleMethodNotAllowed, setRequestID, logRequest)
+
 	r.Handle("/", chain(getRoot, setRequestID, logRequest)).
 		Methods(http.MethodGet)
 
@@ -81,76 +187,306 @@ func NewServer(addr string, pollch chan<- []byte, st apiStore, jwtsecret string)
 		setRequestID,
 		logRequest,
 		srv.checkAuth,
+		requireScope(store.ScopeWrite),
 	)).Methods(http.MethodPost)
 
 	r.Handle("/projects", chain(
 		srv.handleGetProjects,
 		setRequestID,
 		logRequest,
-		srv.checkAuth,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
 	r.Handle("/projects/{id}", chain(
 		srv.handleGetProject,
 		setRequestID,
 		logRequest,
-		srv.checkAuth,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
-	// TODO: delete projects
+	r.Handle("/projects/{id}", chain(
+		srv.handleUpdateProject,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+	)).Methods(http.MethodPatch)
+
+	r.Handle("/projects/{id}", chain(
+		srv.handleDeleteProject,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+	)).Methods(http.MethodDelete)
 
 	r.Handle("/projects/{project_id}/git_remotes", chain(
 		srv.handleCreateGitRemote,
 		setRequestID,
 		logRequest,
 		srv.checkAuth,
+		requireScope(store.ScopeWrite),
 	)).Methods(http.MethodPost)
 
 	r.Handle("/projects/{project_id}/git_remotes/{id}", chain(
 		srv.handleGetGitRemote,
 		setRequestID,
 		logRequest,
-		srv.checkAuth,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
+	r.Handle("/projects/{project_id}/git_remotes/{id}", chain(
+		srv.handleDeleteGitRemote,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+	)).Methods(http.MethodDelete)
+
+	// The secret starts runs, so tokens setting it need both scopes.
+	r.Handle("/projects/{project_id}/git_remotes/{id}/webhook_secret", chain(
+		srv.handleSetWebhookSecret,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+		requireScope(store.ScopeRun),
+	)).Methods(http.MethodPut)
+
+	// Webhooks are checked against the secrets of the remotes they're
+	// for, rather than being authenticated.
+	r.Handle("/webhooks/{provider}", chain(
+		srv.handleWebhook,
+		setRequestID,
+		logRequest,
+	)).Methods(http.MethodPost)
+
 	r.Handle("/projects/{project_id}/pipelines", chain(
 		srv.handleGetPipelines,
 		setRequestID,
 		logRequest,
-		srv.checkAuth,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
 	r.Handle("/pipelines/{id}", chain(
 		srv.handleGetPipeline,
 		setRequestID,
 		logRequest,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
+	)).Methods(http.MethodGet)
+
+	r.Handle("/pipelines/{id}", chain(
+		srv.handleDeletePipeline,
+		setRequestID,
+		logRequest,
 		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+	)).Methods(http.MethodDelete)
+
+	r.Handle("/pipelines/{pid}/runs", chain(
+		srv.handleCreateRun,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRun),
+	)).Methods(http.MethodPost)
+
+	r.Handle("/pipelines/{pid}/runs", chain(
+		srv.handleListRuns,
+		setRequestID,
+		logRequest,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
 	r.Handle("/pipelines/{pid}/runs/{count}", chain(
 		srv.handleGetRun,
 		setRequestID,
 		logRequest,
-		srv.checkAuth,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
+	r.Handle("/pipelines/{pid}/runs/{count}/events", chain(
+		srv.handleStreamRun,
+		setRequestID,
+		logRequest,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
+	)).Methods(http.MethodGet)
+
+	r.Handle("/pipelines/{pid}/runs/{count}/cancel", chain(
+		srv.handleCancelRun,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRun),
+	)).Methods(http.MethodPost)
+
+	r.Handle("/pipelines/{pid}/runs/{count}/retry", chain(
+		srv.handleRetryRun,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRun),
+	)).Methods(http.MethodPost)
+
 	r.Handle("/steps/{id}", chain(
 		srv.handleGetStep,
 		setRequestID,
 		logRequest,
-		srv.checkAuth,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
 	r.Handle("/tasks/{id}", chain(
 		srv.handleGetTask,
 		setRequestID,
 		logRequest,
+		srv.optionalAuth,
+		requireScope(store.ScopeRead),
+	)).Methods(http.MethodGet)
+
+	r.Handle("/me", chain(
+		srv.handleGetMe,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRead),
+	)).Methods(http.MethodGet)
+
+	r.Handle("/users", chain(
+		srv.handleCreateUser,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+		srv.requireAdmin,
+	)).Methods(http.MethodPost)
+
+	r.Handle("/users", chain(
+		srv.handleGetUsers,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRead),
+		srv.requireAdmin,
+	)).Methods(http.MethodGet)
+
+	r.Handle("/users/{email}", chain(
+		srv.handleGetUser,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRead),
+		srv.requireAdmin,
+	)).Methods(http.MethodGet)
+
+	r.Handle("/users/{email}", chain(
+		srv.handleUpdateUser,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+		srv.requireAdmin,
+	)).Methods(http.MethodPatch)
+
+	r.Handle("/users/{email}", chain(
+		srv.handleDeactivateUser,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+		srv.requireAdmin,
+	)).Methods(http.MethodDelete)
+
+	r.Handle("/groups", chain(
+		srv.handleCreateGroup,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+		srv.requireAdmin,
+	)).Methods(http.MethodPost)
+
+	r.Handle("/groups", chain(
+		srv.handleGetGroups,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRead),
+		srv.requireAdmin,
+	)).Methods(http.MethodGet)
+
+	r.Handle("/groups/{name}", chain(
+		srv.handleDeleteGroup,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+		srv.requireAdmin,
+	)).Methods(http.MethodDelete)
+
+	r.Handle("/tokens", chain(
+		srv.handleCreateAccessToken,
+		setRequestID,
+		logRequest,
 		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+	)).Methods(http.MethodPost)
+
+	r.Handle("/tokens", chain(
+		srv.handleGetAccessTokens,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRead),
 	)).Methods(http.MethodGet)
 
+	r.Handle("/tokens/{id}", chain(
+		srv.handleRevokeAccessToken,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeWrite),
+	)).Methods(http.MethodDelete)
+
+	r.Handle("/.well-known/jwks.json", chain(srv.handleJWKS, setRequestID, logRequest)).
+		Methods(http.MethodGet)
+
 	r.Handle("/auth", chain(srv.handleAuth, setRequestID, logRequest)).
 		Methods(http.MethodPost)
 
+	r.Handle("/auth/refresh", chain(srv.handleRefresh, setRequestID, logRequest)).
+		Methods(http.MethodPost)
+
+	r.Handle("/auth/oidc/login", chain(srv.handleOIDCLogin, setRequestID, logRequest)).
+		Methods(http.MethodGet)
+
+	r.Handle("/auth/oidc/callback", chain(srv.handleOIDCCallback, setRequestID, logRequest)).
+		Methods(http.MethodGet)
+
+	r.Handle("/auth/logout", chain(
+		srv.handleLogout,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+	)).Methods(http.MethodPost)
+
+	r.Handle("/failed-logins", chain(
+		srv.handleGetFailedLogins,
+		setRequestID,
+		logRequest,
+		srv.checkAuth,
+		requireScope(store.ScopeRead),
+		srv.requireAdmin,
+	)).Methods(http.MethodGet)
+
 	return srv
 }
 
@@ -177,6 +513,7 @@ func setRequestID(f http.HandlerFunc) http.HandlerFunc {
 		id := uuid.New().String()
 
 		ctx := context.WithValue(req.Context(), keyReqID, id)
+		ctx = store.WithRequestID(ctx, id)
 		logger.WithField("request_id", id).
 			Debug("setting request ID")
 
@@ -198,6 +535,13 @@ func logRequest(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// storeContext returns the context requests to the store should be made
+// with. It's canceled when the client goes away or when the request has
+// spent StoreTimeout waiting on the store, whichever comes first.
+func (srv *Server) storeContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), srv.StoreTimeout)
+}
+
 func (srv *Server) checkAuth(f http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		hdrline, ok := req.Header["Authorization"]
@@ -205,7 +549,7 @@ func (srv *Server) checkAuth(f http.HandlerFunc) http.HandlerFunc {
 			err := errors.New("missing bearer token")
 
 			logger.WithError(err).Error("unable to authorize request")
-			writeErrResp(rw, err, http.StatusUnauthorized)
+			writeErrResp(rw, req, err, http.StatusUnauthorized)
 			return
 		}
 
@@ -215,27 +559,44 @@ func (srv *Server) checkAuth(f http.HandlerFunc) http.HandlerFunc {
 			err := errors.New("missing bearer token")
 
 			logger.WithError(err).Error("unable to authorize request")
-			writeErrResp(rw, err, http.StatusUnauthorized)
+			writeErrResp(rw, req, err, http.StatusUnauthorized)
 			return
 		}
 
 		// Tokens come in the form of "Bearer $TOKEN"
 		bearer := hdr[1]
 
-		keyfn := func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				err := errors.New("invalid signing method for bearer token")
+		if strings.HasPrefix(bearer, store.AccessTokenPrefix) {
+			srv.checkAccessToken(f, rw, req, bearer)
+			return
+		}
 
-				return nil, err
+		keyfn := func(token *jwt.Token) (interface{}, error) {
+			switch token.Method.(type) {
+			case *jwt.SigningMethodHMAC:
+				// With keys and no secret, the server only hands out
+				// tokens signed with its keys, so it shouldn't accept
+				// ones signed with an empty secret.
+				if srv.Keys != nil && len(srv.jwtsecret) == 0 {
+					return nil, errors.New("invalid signing method for bearer token")
+				}
+
+				return srv.jwtsecret, nil
+			case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+				if srv.Keys == nil {
+					return nil, errors.New("invalid signing method for bearer token")
+				}
+
+				return srv.Keys.verifier(token)
 			}
 
-			return srv.jwtsecret, nil
+			return nil, errors.New("invalid signing method for bearer token")
 		}
 
 		token, err := jwt.ParseWithClaims(bearer, &jwt.StandardClaims{}, keyfn)
 		if err != nil {
 			logger.WithError(err).Error("unable to authorize request")
-			writeErrResp(rw, err, http.StatusUnauthorized)
+			writeErrResp(rw, req, err, http.StatusUnauthorized)
 			return
 		}
 
@@ -243,11 +604,49 @@ func (srv *Server) checkAuth(f http.HandlerFunc) http.HandlerFunc {
 			if time.Now().Unix() > claims.ExpiresAt {
 				err := errors.New("token expired")
 				logger.WithError(err).Error("unable to authorize request")
-				writeErrResp(rw, err, http.StatusUnauthorized)
+				writeErrResp(rw, req, err, http.StatusUnauthorized)
+				return
+			}
+
+			if !claims.VerifyIssuer(srv.Issuer, false) {
+				err := errors.New("token from unknown issuer")
+				logger.WithError(err).Error("unable to authorize request")
+				writeErrResp(rw, req, err, http.StatusUnauthorized)
+				return
+			}
+
+			// Only tokens with an ID can be revoked, and all the ones
+			// handed out by handleAuth have one.
+			if claims.Id != "" {
+				if err := srv.checkRevoked(req, claims.Id); err != nil {
+					logger.WithError(err).Error("unable to authorize request")
+
+					status := http.StatusUnauthorized
+					if err != errRevoked {
+						status = http.StatusInternalServerError
+					}
+
+					writeErrResp(rw, req, err, status)
+					return
+				}
+			}
+
+			// Users that were disabled after the token was handed out
+			// don't get to keep using it.
+			if err := srv.checkSubject(req, claims.Subject); err != nil {
+				logger.WithError(err).Error("unable to authorize request")
+
+				status := http.StatusUnauthorized
+				if err != errDisabled {
+					status = http.StatusInternalServerError
+				}
+
+				writeErrResp(rw, req, err, status)
 				return
 			}
 
 			ctx := context.WithValue(req.Context(), keyReqSub, claims.Subject)
+			ctx = context.WithValue(ctx, keyReqClaims, claims)
 			logger.WithField("sub", claims.Subject).
 				Debug("setting auth subject")
 
@@ -257,7 +656,126 @@ func (srv *Server) checkAuth(f http.HandlerFunc) http.HandlerFunc {
 
 		err = errors.New("invalid bearer token")
 		logger.WithError(err).Error("unable to authorize request")
-		writeErrResp(rw, err, http.StatusUnauthorized)
+		writeErrResp(rw, req, err, http.StatusUnauthorized)
 		return
 	}
 }
+
+// anonymous is the subject of requests without a bearer token. It isn't
+// anyone, so it only gets to see what's public.
+const anonymous = ""
+
+// optionalAuth lets requests without a bearer token through as anonymous.
+// Requests with one go through checkAuth, so a bad token is rejected
+// rather than quietly treated as no token at all.
+func (srv *Server) optionalAuth(f http.HandlerFunc) http.HandlerFunc {
+	checked := srv.checkAuth(f)
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if _, ok := req.Header["Authorization"]; ok {
+			checked(rw, req)
+			return
+		}
+
+		logger.Debug("no bearer token, continuing as anonymous")
+
+		ctx := context.WithValue(req.Context(), keyReqSub, anonymous)
+		f(rw, req.WithContext(ctx))
+	}
+}
+
+// errRevoked is what checkRevoked returns for tokens that were revoked.
+var errRevoked = errors.New("token revoked")
+
+// checkRevoked makes sure the JWT with the given ID isn't on the
+// revocation list.
+func (srv *Server) checkRevoked(req *http.Request, id string) error {
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	revoked, err := srv.st.JWTRevoked(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return errRevoked
+	}
+
+	return nil
+}
+
+// errDisabled is what checkSubject returns for users that are disabled,
+// or that don't exist.
+var errDisabled = errors.New("user disabled")
+
+// checkSubject makes sure the subject of a JWT is a user that's still
+// allowed in.
+func (srv *Server) checkSubject(req *http.Request, sub string) error {
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	user, err := srv.st.GetUser(ctx, sub)
+	if err == store.ErrUserNotFound {
+		return errDisabled
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Disabled {
+		return errDisabled
+	}
+
+	return nil
+}
+
+// checkAccessToken is checkAuth for personal access tokens. The request is
+// limited to the token's scopes.
+func (srv *Server) checkAccessToken(f http.HandlerFunc, rw http.ResponseWriter, req *http.Request, bearer string) {
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	token, err := srv.st.AuthenticateAccessToken(ctx, bearer)
+	if err != nil {
+		logger.WithError(err).Error("unable to authorize request")
+
+		status := http.StatusUnauthorized
+		if err != store.ErrNotAuthenticated {
+			status = http.StatusInternalServerError
+		}
+
+		writeErrResp(rw, req, err, status)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"sub":      token.User,
+		"token_id": token.ID,
+	}).Debug("setting auth subject")
+
+	ctx = context.WithValue(req.Context(), keyReqSub, token.User)
+	ctx = context.WithValue(ctx, keyReqScopes, token.Scopes)
+
+	f(rw, req.WithContext(ctx))
+}
+
+// requireScope only lets through requests whose credentials allow the
+// scope. It has to come after checkAuth in the chain. Requests made with
+// a password login aren't limited to any scopes.
+func requireScope(scope store.Scope) middleware {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			scopes, ok := req.Context().Value(keyReqScopes).([]store.Scope)
+			if ok && !(store.AccessToken{Scopes: scopes}).Allows(scope) {
+				err := fmt.Errorf("access token is missing the %v scope", scope)
+				logger.WithError(err).Error("unable to authorize request")
+
+				writeErrResp(rw, req, err, http.StatusForbidden)
+				return
+			}
+
+			f(rw, req)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package http
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Key is an asymmetric key JWTs are signed and verified with. Keys that
+// only have a public half can verify JWTs, but not sign them, which is
+// what keys that are being rotated out look like.
+type Key struct {
+	// ID is the key's "kid", which is in the header of every JWT
+	// signed with it.
+	ID      string
+	Method  jwt.SigningMethod
+	Public  crypto.PublicKey
+	Private crypto.PrivateKey
+}
+
+// KeySet is every key the server accepts JWTs signed with, and the one
+// it signs new JWTs with. Rotating keys is adding a new one, signing with
+// it, and dropping the old one once the JWTs it signed have expired.
+type KeySet struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// LoadKeySet loads every .pem file in dir as a key, with the name of the
+// file, minus the extension, as its ID. A file can have an RSA key, used
+// with RS256, or a P-256 ECDSA key, used with ES256, in it. New JWTs are
+// signed with the key whose ID is signing, which has to have its private
+// half. Without one, they're signed with the last private key, going by
+// ID, so naming keys by date rotates to new ones as they're added.
+func LoadKeySet(dir, signing string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{keys: make(map[string]*Key)}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := ParseKey(id, buf)
+		if err != nil {
+			return nil, fmt.Errorf("loading %v: %v", path, err)
+		}
+
+		ks.keys[id] = key
+
+		// Glob sorts, so the last private key wins.
+		if key.Private != nil && signing == "" {
+			ks.signing = key
+		}
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("no keys in %v", dir)
+	}
+
+	if signing == "" {
+		if ks.signing == nil {
+			return nil, fmt.Errorf("no private keys in %v", dir)
+		}
+
+		return ks, nil
+	}
+
+	if err := ks.SignWith(signing); err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// SignWith makes the key with the given ID the one new JWTs are signed
+// with.
+func (ks *KeySet) SignWith(id string) error {
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("no key with ID %q", id)
+	}
+
+	if key.Private == nil {
+		return fmt.Errorf("key %q can't sign, it has no private key", id)
+	}
+
+	ks.signing = key
+
+	return nil
+}
+
+// ParseKey parses a PEM encoded RSA or ECDSA key, private or public.
+func ParseKey(id string, buf []byte) (*Key, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: id}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Public = k
+	case *ecdsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case *ecdsa.PublicKey:
+		key.Public = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		key.Method = jwt.SigningMethodES256
+	}
+
+	return key, nil
+}
+
+// verifier returns the key to verify the JWT with, going by its "kid".
+func (ks *KeySet) verifier(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if key.Method.Alg() != token.Method.Alg() {
+		return nil, errors.New("invalid signing method for bearer token")
+	}
+
+	return key.Public, nil
+}
+
+// sign signs the claims with the signing key.
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	if ks.signing == nil {
+		return "", errors.New("no signing key")
+	}
+
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+
+	return token.SignedString(ks.signing.Private)
+}
+
+// jwk is a public key in JSON Web Key format, RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// ECDSA keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwks returns the public half of every key, sorted by ID.
+func (ks *KeySet) jwks() []jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	keys := []jwk{}
+	for _, k := range ks.keys {
+		j := jwk{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			j.Kty = "RSA"
+			j.N = b64(pub.N.Bytes())
+			j.E = b64(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			// Coordinates are padded to the size of the curve.
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			j.Kty = "EC"
+			j.Crv = pub.Curve.Params().Name
+			j.X = b64(pub.X.FillBytes(make([]byte, size)))
+			j.Y = b64(pub.Y.FillBytes(make([]byte, size)))
+		}
+
+		keys = append(keys, j)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Kid < keys[j].Kid
+	})
+
+	return keys
+}
+
+// handleJWKS serves the public keys JWTs are verified with, so other
+// services can verify the JWTs relay hands out. The HMAC secret is never
+// in there, being secret.
+func (srv *Server) handleJWKS(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	keys := []jwk{}
+	if srv.Keys != nil {
+		keys = srv.Keys.jwks()
+	}
+
+	buf, err := json.Marshal(map[string][]jwk{"keys": keys})
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal JSON response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
@@ -0,0 +1,171 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestKeySet(t *testing.T) {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("got error generating RSA key: %v", err)
+	}
+
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("got error generating ECDSA key: %v", err)
+	}
+
+	ecpub, err := x509.MarshalPKIXPublicKey(&eckey.PublicKey)
+	if err != nil {
+		t.Fatalf("got error marshaling ECDSA public key: %v", err)
+	}
+
+	ecpriv, err := x509.MarshalECPrivateKey(eckey)
+	if err != nil {
+		t.Fatalf("got error marshaling ECDSA private key: %v", err)
+	}
+
+	write := func(dir, name, typ string, der []byte) {
+		buf := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0600); err != nil {
+			t.Fatalf("got error writing key: %v", err)
+		}
+	}
+
+	// The ECDSA key is the old one, being rotated out, so only its
+	// public half is left. The RSA key is the one that signs.
+	dir := t.TempDir()
+	write(dir, "2026-01.pem", "PUBLIC KEY", ecpub)
+	write(dir, "2026-02.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsakey))
+
+	if _, err := LoadKeySet(dir, "2026-01"); err == nil {
+		t.Fatal("expected error signing with a public key")
+	}
+
+	ks, err := LoadKeySet(dir, "")
+	if err != nil {
+		t.Fatalf("got error loading keys: %v", err)
+	}
+
+	srv := NewServer(":9001", make(chan []byte), seedStore(t), "")
+	srv.Keys = ks
+
+	handler := srv.checkAuth(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		claims := &jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			Subject:   "user@test",
+		}
+
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+
+		ss, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("got error signing token: %v", err)
+		}
+
+		return ss
+	}
+
+	signed, err := srv.signToken("user@test")
+	if err != nil {
+		t.Fatalf("got error signing token: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "signing key", token: signed, status: http.StatusOK},
+		{name: "rotated out key", token: sign(jwt.SigningMethodES256, "2026-01", eckey), status: http.StatusOK},
+		{name: "unknown kid", token: sign(jwt.SigningMethodES256, "2025-12", eckey), status: http.StatusUnauthorized},
+		{name: "missing kid", token: sign(jwt.SigningMethodRS256, "", rsakey), status: http.StatusUnauthorized},
+		{name: "wrong algorithm for kid", token: sign(jwt.SigningMethodES256, "2026-02", eckey), status: http.StatusUnauthorized},
+		{name: "empty secret", token: sign(jwt.SigningMethodHS256, "", []byte{}), status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://test", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		if rr.Code != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, rr.Code)
+		}
+	}
+
+	token, _ := jwt.Parse(signed, nil)
+	if token.Header["kid"] != "2026-02" || token.Header["alg"] != "RS256" {
+		t.Fatalf("expected token signed by 2026-02 with RS256, got %+v", token.Header)
+	}
+
+	// The private ECDSA key can sign too, once it's told to.
+	write(dir, "2026-01.pem", "EC PRIVATE KEY", ecpriv)
+	ks, err = LoadKeySet(dir, "2026-01")
+	if err != nil {
+		t.Fatalf("got error loading keys: %v", err)
+	}
+	srv.Keys = ks
+
+	signed, err = srv.signToken("user@test")
+	if err != nil {
+		t.Fatalf("got error signing token: %v", err)
+	}
+
+	token, _ = jwt.Parse(signed, nil)
+	if token.Header["kid"] != "2026-01" || token.Header["alg"] != "ES256" {
+		t.Fatalf("expected token signed by 2026-01 with ES256, got %+v", token.Header)
+	}
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if len(set.Keys) != 2 {
+		t.Fatalf("expected 2 keys, got %+v", set.Keys)
+	}
+
+	ec, rs := set.Keys[0], set.Keys[1]
+	if ec["kid"] != "2026-01" || ec["kty"] != "EC" || ec["crv"] != "P-256" || ec["x"] == "" || ec["d"] != "" {
+		t.Fatalf("expected public P-256 key 2026-01, got %+v", ec)
+	}
+
+	if rs["kid"] != "2026-02" || rs["kty"] != "RSA" || rs["alg"] != "RS256" || rs["e"] != "AQAB" {
+		t.Fatalf("expected public RSA key 2026-02, got %+v", rs)
+	}
+}
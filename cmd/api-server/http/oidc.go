@@ -0,0 +1,123 @@
+package http
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/run-ci/relay/store"
+)
+
+// oidcCookie keeps the state and nonce of an OIDC login between sending
+// the user to the provider and them coming back.
+const oidcCookie = "relay_oidc"
+
+// errNoOIDC is what's returned by the OIDC routes when there's no
+// provider to log in through.
+var errNoOIDC = errors.New("OIDC login isn't configured")
+
+// handleOIDCLogin sends the user to the OIDC provider to log in.
+func (srv *Server) handleOIDCLogin(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	if srv.OIDC == nil {
+		logger.WithError(errNoOIDC).Error("unable to log in")
+
+		writeErrResp(rw, req, errNoOIDC, http.StatusNotFound)
+		return
+	}
+
+	// The state ties the callback to the browser that started the
+	// login, and the nonce ties the ID token to the login.
+	state, nonce := uuid.New().String(), uuid.New().String()
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce,
+		Path:     "/auth/oidc",
+		MaxAge:   10 * 60,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	logger.Debug("redirecting to OIDC provider")
+	http.Redirect(rw, req, srv.OIDC.AuthCodeURL(state, nonce), http.StatusFound)
+}
+
+// handleOIDCCallback is where the OIDC provider sends the user back to. It
+// logs them in like handleAuth does, with the user the provider's ID token
+// is for.
+func (srv *Server) handleOIDCCallback(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	if srv.OIDC == nil {
+		logger.WithError(errNoOIDC).Error("unable to log in")
+
+		writeErrResp(rw, req, errNoOIDC, http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		err := errors.New("OIDC provider refused login: " + reason)
+		logger.WithError(err).Error("unable to log in")
+
+		writeErrResp(rw, req, err, http.StatusUnauthorized)
+		return
+	}
+
+	var state, nonce string
+	if cookie, err := req.Cookie(oidcCookie); err == nil {
+		parts := strings.SplitN(cookie.Value, ".", 2)
+		if len(parts) == 2 {
+			state, nonce = parts[0], parts[1]
+		}
+	}
+
+	// Each login's state is only good once.
+	http.SetCookie(rw, &http.Cookie{
+		Name:   oidcCookie,
+		Path:   "/auth/oidc",
+		MaxAge: -1,
+	})
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		err := errors.New("invalid OIDC login state")
+		logger.WithError(err).Error("unable to log in")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		err := errors.New("missing paramter 'code' from request")
+		logger.WithError(err).Error("unable to log in")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	email, err := srv.OIDC.Exchange(ctx, code, nonce)
+	if err != nil {
+		logger.WithError(err).Error("unable to log in")
+
+		status := http.StatusUnauthorized
+		if err != store.ErrNotAuthenticated {
+			status = errStatus(err)
+		}
+
+		writeErrResp(rw, req, err, status)
+		return
+	}
+
+	srv.login(ctx, rw, req, logger.WithField("request_subject", email), email)
+}
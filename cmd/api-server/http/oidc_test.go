@@ -0,0 +1,287 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/run-ci/relay/authn"
+	"github.com/run-ci/relay/store"
+)
+
+// mockProvider is an OpenID provider that logs in whoever's sent to it,
+// with the claims it's told to put in their ID token.
+type mockProvider struct {
+	*httptest.Server
+
+	clientID string
+	secret   string
+	keys     *KeySet
+
+	mu sync.Mutex
+	// edit changes the claims of the next ID tokens.
+	edit  func(jwt.MapClaims)
+	codes map[string]jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T, clientID, secret string) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("got error generating RSA key: %v", err)
+	}
+
+	p := &mockProvider{
+		clientID: clientID,
+		secret:   secret,
+		keys: &KeySet{keys: map[string]*Key{
+			"mock": {ID: "mock", Method: jwt.SigningMethodRS256, Public: &key.PublicKey, Private: key},
+		}},
+		codes: make(map[string]jwt.MapClaims),
+	}
+	p.keys.signing = p.keys.keys["mock"]
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string][]jwk{"keys": p.keys.jwks()})
+	})
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// authorize logs the user in and sends them back with a code for their
+// ID token.
+func (p *mockProvider) authorize(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	claims := jwt.MapClaims{
+		"iss":            p.URL,
+		"aud":            q.Get("client_id"),
+		"sub":            "alice",
+		"email":          "alice@test",
+		"email_verified": true,
+		"name":           "Alice",
+		"groups":         []string{"engineering"},
+		"nonce":          q.Get("nonce"),
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+
+	p.mu.Lock()
+	if p.edit != nil {
+		p.edit(claims)
+	}
+
+	code := fmt.Sprintf("code-%v", len(p.codes))
+	p.codes[code] = claims
+	p.mu.Unlock()
+
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+
+	http.Redirect(rw, req, redirect.String(), http.StatusFound)
+}
+
+// token trades a code in for its ID token, once.
+func (p *mockProvider) token(rw http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	id, secret, ok := req.BasicAuth()
+	if !ok {
+		id, secret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+
+	p.mu.Lock()
+	claims, found := p.codes[req.PostForm.Get("code")]
+	delete(p.codes, req.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	if id != p.clientID || secret != p.secret || !found {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+
+	idToken, _ := p.keys.sign(claims)
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	for _, g := range []string{"devs", "ops"} {
+		if err := st.CreateGroup(ctx, &store.Group{Name: g}); err != nil {
+			t.Fatalf("got error creating group: %v", err)
+		}
+	}
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %v without a provider, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+
+	p := newMockProvider(t, "relay", "secret")
+
+	if _, err := authn.DiscoverOIDC(ctx, p.URL+"/", "relay", "secret", st); err == nil {
+		t.Fatal("expected error discovering provider under the wrong issuer")
+	}
+
+	srv.OIDC, err = authn.DiscoverOIDC(ctx, p.URL, "relay", "secret", st)
+	if err != nil {
+		t.Fatalf("got error discovering provider: %v", err)
+	}
+	srv.OIDC.RedirectURL = ts.URL + "/auth/oidc/callback"
+	srv.OIDC.Groups = map[string]string{"engineering": "devs", "sre": "ops"}
+
+	// Logging in goes from relay to the provider and back, and the
+	// state cookie has to make the whole trip.
+	login := func(edit func(jwt.MapClaims)) (int, string) {
+		p.mu.Lock()
+		p.edit = edit
+		p.mu.Unlock()
+
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		resp, err := client.Get(ts.URL + "/auth/oidc/login")
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		defer resp.Body.Close()
+
+		tok := map[string]interface{}{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+				t.Fatalf("got error decoding response body: %v", err)
+			}
+		}
+
+		token, _ := tok["token"].(string)
+
+		return resp.StatusCode, token
+	}
+
+	tests := []struct {
+		name   string
+		edit   func(jwt.MapClaims)
+		status int
+	}{
+		{name: "other client", edit: func(c jwt.MapClaims) { c["aud"] = "other" }, status: http.StatusUnauthorized},
+		{name: "other issuer", edit: func(c jwt.MapClaims) { c["iss"] = "https://evil.test" }, status: http.StatusUnauthorized},
+		{name: "other login", edit: func(c jwt.MapClaims) { c["nonce"] = "replayed" }, status: http.StatusUnauthorized},
+		{name: "expired", edit: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, status: http.StatusUnauthorized},
+		{name: "unverified email", edit: func(c jwt.MapClaims) { c["email_verified"] = false }, status: http.StatusUnauthorized},
+		{name: "email not said to be verified", edit: func(c jwt.MapClaims) { delete(c, "email_verified") }, status: http.StatusUnauthorized},
+		{name: "no email", edit: func(c jwt.MapClaims) { delete(c, "email") }, status: http.StatusUnauthorized},
+		{name: "no mapped groups", edit: func(c jwt.MapClaims) { c["groups"] = []string{"sales"} }, status: http.StatusUnauthorized},
+		{name: "first login", status: http.StatusOK},
+		{name: "groups changed", edit: func(c jwt.MapClaims) { c["groups"] = []string{"engineering", "sre"} }, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if status, _ := login(test.edit); status != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, status)
+		}
+	}
+
+	u, err := st.GetUser(ctx, "alice@test")
+	if err != nil {
+		t.Fatalf("got error getting provisioned user: %v", err)
+	}
+
+	if u.Name != "Alice" || u.Group.Name != "devs" || len(u.Groups) != 2 || u.Groups[1].Name != "ops" {
+		t.Fatalf("expected Alice in devs and ops, got %+v", u)
+	}
+
+	// Providers that don't say whether emails are verified can be
+	// trusted to have verified them, but only when asked to.
+	srv.OIDC.AllowUnverifiedEmail = true
+	if status, _ := login(func(c jwt.MapClaims) { delete(c, "email_verified") }); status != http.StatusOK {
+		t.Fatalf("expected status code %v allowing unverified emails, got %v", http.StatusOK, status)
+	}
+	srv.OIDC.AllowUnverifiedEmail = false
+
+	// The token is a relay token like any other.
+	_, token := login(nil)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+
+	me := store.User{}
+	err = json.NewDecoder(resp.Body).Decode(&me)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || me.Email != "alice@test" {
+		t.Fatalf("expected to be alice@test, got %v and %+v", resp.StatusCode, me)
+	}
+
+	callbacks := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{name: "no state cookie", query: "?code=code-0&state=x", status: http.StatusBadRequest},
+		{name: "provider error", query: "?error=access_denied&state=x", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range callbacks {
+		resp, err := http.Get(ts.URL + "/auth/oidc/callback" + test.query)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+)
+
+// seedPermissions returns a store with owner@test and member@test in
+// group a, and outsider@test in group b.
+func seedPermissions(t *testing.T) *store.Memory {
+	ctx := context.Background()
+	st := store.NewMemory()
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("got error seeding store: %v", err)
+		}
+	}
+
+	must(st.CreateGroup(ctx, &store.Group{Name: "a"}))
+	must(st.CreateGroup(ctx, &store.Group{Name: "b"}))
+
+	users := []store.User{
+		{Email: "owner@test", Group: store.Group{Name: "a"}},
+		{Email: "member@test", Group: store.Group{Name: "a"}},
+		{Email: "outsider@test", Group: store.Group{Name: "b"}},
+	}
+	for _, u := range users {
+		u.Password = "test"
+		must(st.CreateUser(ctx, &u))
+	}
+
+	return st
+}
+
+// permsFixture is what's created by addPermsProject.
+type permsFixture struct {
+	project  int
+	remote   string
+	pipeline int
+	step     int
+	task     int
+}
+
+// addPermsProject adds a project with the given permissions, owned by
+// owner@test, to the store. The project has one of everything in it.
+func addPermsProject(t *testing.T, st *store.Memory, perms byte) permsFixture {
+	ctx := context.Background()
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("got error seeding store: %v", err)
+		}
+	}
+
+	proj := store.Project{
+		Name: "perms",
+		Authorization: store.Authorization{
+			User:        store.User{Email: "owner@test"},
+			Permissions: store.Permission(perms),
+		},
+	}
+	must(st.CreateProject(ctx, &proj))
+
+	url := fmt.Sprintf("//perms-%v.git", proj.ID)
+	remote := store.GitRemote{URL: url, Branch: "master", ProjectID: proj.ID}
+	must(st.CreateGitRemote(ctx, "owner@test", &remote))
+
+	p := store.Pipeline{Name: "default", GitRemote: remote}
+	must(st.CreatePipeline(ctx, &p))
+	must(st.SetPipelineDefinition(ctx, p.ID, []byte(`[{"name": "default", "tasks": []}]`)))
+
+	r := store.Run{PipelineID: p.ID}
+	must(st.CreateRun(ctx, &r))
+
+	s := store.Step{Name: "default", PipelineID: p.ID, RunCount: r.Count}
+	must(st.CreateStep(ctx, &s))
+
+	task := store.Task{Name: "test", StepID: s.ID}
+	must(st.CreateTask(ctx, &task))
+
+	return permsFixture{
+		project:  proj.ID,
+		remote:   base64.StdEncoding.EncodeToString([]byte(url + "#master")),
+		pipeline: p.ID,
+		step:     s.ID,
+		task:     task.ID,
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	const (
+		read = iota
+		write
+		run
+		admin
+	)
+
+	endpoints := []struct {
+		method string
+		route  string
+		path   func(permsFixture) string
+		body   string
+		action int
+		ok     int
+		handle func(*Server) http.HandlerFunc
+	}{
+		{
+			method: http.MethodGet, route: "/projects/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/projects/%v", f.project) },
+			action: read, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleGetProject },
+		},
+		{
+			method: http.MethodPatch, route: "/projects/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/projects/%v", f.project) },
+			body:   `{"description": "changed"}`,
+			action: admin, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleUpdateProject },
+		},
+		{
+			method: http.MethodDelete, route: "/projects/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/projects/%v", f.project) },
+			action: write, ok: http.StatusNoContent,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleDeleteProject },
+		},
+		{
+			method: http.MethodPost, route: "/projects/{project_id}/git_remotes",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/projects/%v/git_remotes", f.project) },
+			body:   `{"url": "//perms.git", "branch": "staging"}`,
+			action: write, ok: http.StatusAccepted,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleCreateGitRemote },
+		},
+		{
+			method: http.MethodGet, route: "/projects/{project_id}/git_remotes/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/projects/%v/git_remotes/%v", f.project, f.remote) },
+			action: read, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleGetGitRemote },
+		},
+		{
+			method: http.MethodDelete, route: "/projects/{project_id}/git_remotes/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/projects/%v/git_remotes/%v", f.project, f.remote) },
+			action: write, ok: http.StatusNoContent,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleDeleteGitRemote },
+		},
+		{
+			method: http.MethodGet, route: "/pipelines/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/pipelines/%v", f.pipeline) },
+			action: read, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleGetPipeline },
+		},
+		{
+			method: http.MethodDelete, route: "/pipelines/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/pipelines/%v", f.pipeline) },
+			action: write, ok: http.StatusNoContent,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleDeletePipeline },
+		},
+		{
+			method: http.MethodGet, route: "/pipelines/{pid}/runs",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/pipelines/%v/runs", f.pipeline) },
+			action: read, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleListRuns },
+		},
+		{
+			method: http.MethodPost, route: "/pipelines/{pid}/runs",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/pipelines/%v/runs", f.pipeline) },
+			action: run, ok: http.StatusAccepted,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleCreateRun },
+		},
+		{
+			method: http.MethodGet, route: "/pipelines/{pid}/runs/{count}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/pipelines/%v/runs/1", f.pipeline) },
+			action: read, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleGetRun },
+		},
+		{
+			method: http.MethodGet, route: "/steps/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/steps/%v", f.step) },
+			action: read, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleGetStep },
+		},
+		{
+			method: http.MethodGet, route: "/tasks/{id}",
+			path:   func(f permsFixture) string { return fmt.Sprintf("/tasks/%v", f.task) },
+			action: read, ok: http.StatusOK,
+			handle: func(srv *Server) http.HandlerFunc { return srv.handleGetTask },
+		},
+	}
+
+	groupAll := store.PermGroupRead | store.PermGroupWrite | store.PermGroupRun
+	publicAll := store.PermPublicRead | store.PermPublicWrite | store.PermPublicRun
+
+	// expect holds the status for read, write, run and admin
+	// endpoints, with zero meaning the endpoint's own success status.
+	principals := []struct {
+		name   string
+		user   string
+		perms  byte
+		expect [4]int
+	}{
+		{name: "owner", user: "owner@test", perms: 0},
+		{name: "group member", user: "member@test", perms: groupAll},
+		{
+			name: "group reader", user: "member@test", perms: store.PermGroupRead,
+			expect: [4]int{0, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		},
+		{
+			name: "group outsider", user: "member@test", perms: publicAll &^ store.PermPublicRead,
+			expect: [4]int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound},
+		},
+		{
+			name: "public", user: "outsider@test", perms: publicAll,
+			expect: [4]int{0, 0, 0, http.StatusForbidden},
+		},
+		{
+			name: "public reader", user: "outsider@test", perms: store.PermPublicRead,
+			expect: [4]int{0, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		},
+		{
+			name: "outsider", user: "outsider@test", perms: groupAll,
+			expect: [4]int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound},
+		},
+	}
+
+	for _, pr := range principals {
+		t.Run(pr.name, func(t *testing.T) {
+			// Every endpoint gets its own project, so the ones
+			// that delete things don't get in each other's way.
+			st := seedPermissions(t)
+			srv := NewServer(":9001", make(chan []byte, len(endpoints)), st, "test")
+			srv.Runs = make(chan []byte, len(endpoints))
+
+			for _, ep := range endpoints {
+				f := addPermsProject(t, st, pr.perms)
+
+				r := mux.NewRouter()
+				r.Handle(ep.route, chain(ep.handle(srv), setRequestID, authAs(pr.user))).
+					Methods(ep.method)
+
+				ts := httptest.NewServer(r)
+
+				req, err := http.NewRequest(ep.method, ts.URL+ep.path(f), bytes.NewBufferString(ep.body))
+				if err != nil {
+					t.Fatalf("error creating http request for test: %v", err)
+				}
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("error executing test against test server: %v", err)
+				}
+				resp.Body.Close()
+				ts.Close()
+
+				expected := pr.expect[ep.action]
+				if expected == 0 {
+					expected = ep.ok
+				}
+
+				if resp.StatusCode != expected {
+					t.Fatalf("%v %v: expected status code %v, got %v", ep.method, ep.route, expected, resp.StatusCode)
+				}
+			}
+		})
+	}
+}
@@ -60,7 +60,7 @@ func (srv *Server) handleGetPipelines(rw http.ResponseWriter, req *http.Request)
 		err := errors.New("missing paramter 'project_id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -70,32 +70,48 @@ func (srv *Server) handleGetPipelines(rw http.ResponseWriter, req *http.Request)
 	if err != nil {
 		logger.WithError(err).Error("unable to parse project id as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
 	logger = logger.WithField("project_id", pid)
+	logger.Debug("parsing list filter")
+
+	f, err := parseListFilter(req)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse list filter")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
 
 	logger.Debug("retrieving pipelines from store")
 
-	pipelines, err := srv.st.GetPipelines(reqSub, pid)
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	page, err := srv.st.GetPipelines(ctx, reqSub, pid, f)
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve pipelines")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
 	logger.Debug("marshaling response body")
 
-	buf, err := json.Marshal(pipelines)
+	buf, err := json.Marshal(page.Pipelines)
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
+	if page.Next != "" {
+		setNextLink(rw, req, page.Next)
+	}
+
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(buf)
 	return
@@ -118,7 +134,7 @@ func (srv *Server) handleGetPipeline(rw http.ResponseWriter, req *http.Request)
 		err := errors.New("missing paramter 'id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -128,7 +144,7 @@ func (srv *Server) handleGetPipeline(rw http.ResponseWriter, req *http.Request)
 	if err != nil {
 		logger.WithError(err).Error("unable to parse id as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -136,11 +152,14 @@ func (srv *Server) handleGetPipeline(rw http.ResponseWriter, req *http.Request)
 
 	logger.Debug("retrieving pipelines from store")
 
-	pipeline, err := srv.st.GetPipeline(reqSub, id)
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	pipeline, err := srv.st.GetPipeline(ctx, reqSub, id)
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve pipeline")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
@@ -150,7 +169,7 @@ func (srv *Server) handleGetPipeline(rw http.ResponseWriter, req *http.Request)
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -158,3 +177,52 @@ func (srv *Server) handleGetPipeline(rw http.ResponseWriter, req *http.Request)
 	rw.Write(buf)
 	return
 }
+
+func (srv *Server) handleDeletePipeline(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["id"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing id")
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse pipeline id as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("id", id)
+	logger.Info("deleting pipeline")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	err = srv.st.DeletePipeline(ctx, reqSub, id)
+	if err != nil {
+		logger.WithError(err).Error("unable to delete pipeline")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+	return
+}
@@ -17,91 +17,8 @@ import (
 // All requests should be scoped to the user, their group, or public projects. Right
 // now these tests don't test for that, and they should!
 
-func (st *memStore) GetPipelines(user string, project int) ([]store.Pipeline, error) {
-	pipelines := []store.Pipeline{}
-	for _, pipeline := range st.pipelinedb {
-		if project == pipeline.ProjectID {
-			pipelines = append(pipelines, pipeline)
-		}
-	}
-
-	return pipelines, nil
-}
-
-func (st *memStore) GetPipeline(user string, id int) (store.Pipeline, error) {
-	p, ok := st.pipelinedb[id]
-	if !ok {
-		return p, store.ErrPipelineNotFound
-	}
-
-	return p, nil
-}
-
-func (st *memStore) seedPipelines() {
-	data := []struct {
-		id           int
-		name         string
-		success      bool
-		remoteURL    string
-		remoteBranch string
-		projectID    int
-	}{
-		{
-			id:           1,
-			name:         "default",
-			success:      true,
-			remoteURL:    "https://github.com/run-ci/relay.git",
-			remoteBranch: "master",
-			projectID:    1,
-		},
-		{
-			id:           2,
-			name:         "docker",
-			success:      true,
-			remoteURL:    "https://github.com/run-ci/relay.git",
-			remoteBranch: "master",
-			projectID:    1,
-		},
-		{
-			id:           3,
-			name:         "default",
-			success:      false,
-			remoteURL:    "https://github.com/run-ci/run.git",
-			remoteBranch: "master",
-			projectID:    2,
-		},
-	}
-
-	for _, d := range data {
-		st.pipelinedb[d.projectID] = store.Pipeline{
-			ID:      d.id,
-			Name:    d.name,
-			Success: &d.success,
-			GitRemote: store.GitRemote{
-				Branch: d.remoteBranch,
-				URL:    d.remoteURL,
-			},
-			Runs: []store.Run{
-				store.Run{
-					Count:      1,
-					Success:    &d.success,
-					PipelineID: d.id,
-				},
-				store.Run{
-					Count:      2,
-					Success:    &d.success,
-					PipelineID: d.id,
-				},
-			},
-		}
-	}
-}
-
 func TestGetPipelines(t *testing.T) {
-	st := &memStore{
-		pipelinedb: make(map[int]store.Pipeline),
-	}
-	st.seedPipelines()
+	st := seedStore(t)
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -110,9 +27,12 @@ func TestGetPipelines(t *testing.T) {
 		expected []store.Pipeline
 		actual   []store.Pipeline
 	}{
-		input:    0,
-		expected: []store.Pipeline{st.pipelinedb[0], st.pipelinedb[1]},
-		actual:   []store.Pipeline{},
+		input: 1,
+		expected: []store.Pipeline{
+			store.Pipeline{ID: 1, Name: "default"},
+			store.Pipeline{ID: 2, Name: "docker"},
+		},
+		actual: []store.Pipeline{},
 	}
 
 	r := mux.NewRouter()
@@ -155,10 +75,8 @@ func TestGetPipelines(t *testing.T) {
 }
 
 func TestGetPipeline(t *testing.T) {
-	st := &memStore{
-		pipelinedb: make(map[int]store.Pipeline),
-	}
-	st.seedPipelines()
+	st := seedStore(t)
+	success := true
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -167,9 +85,18 @@ func TestGetPipeline(t *testing.T) {
 		expected store.Pipeline
 		actual   store.Pipeline
 	}{
-		input:    1,
-		expected: st.pipelinedb[1],
-		actual:   store.Pipeline{},
+		input: 1,
+		expected: store.Pipeline{
+			ID:      1,
+			Name:    "default",
+			Success: &success,
+			GitRemote: store.GitRemote{
+				URL:    "//test-a.git",
+				Branch: "master",
+			},
+			ProjectID: 1,
+		},
+		actual: store.Pipeline{},
 	}
 
 	r := mux.NewRouter()
@@ -235,3 +162,43 @@ func TestGetPipeline(t *testing.T) {
 // TODO: test that getting pipelines respects authorization
 
 // TODO: test pipeline not found returns 404
+
+func TestDeletePipeline(t *testing.T) {
+	st := seedStore(t)
+	seedOthers(t, st)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{user: "outsider@test", status: http.StatusNotFound},
+		{user: "member@test", status: http.StatusForbidden},
+		{user: testUser, status: http.StatusNoContent},
+		{user: testUser, status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		r.Handle("/pipelines/{id}", chain(srv.handleDeletePipeline, setRequestID, authAs(test.user)))
+
+		ts := httptest.NewServer(r)
+
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/pipelines/4", nil)
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+		ts.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("expected status %v for %v, got %v", test.status, test.user, resp.StatusCode)
+		}
+	}
+}
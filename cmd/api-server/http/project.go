@@ -26,7 +26,7 @@ func (srv *Server) handleCreateProject(rw http.ResponseWriter, req *http.Request
 		logger.WithField("error", err).
 			Error("unable to read request body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -37,7 +37,7 @@ func (srv *Server) handleCreateProject(rw http.ResponseWriter, req *http.Request
 		logger.WithField("error", err).
 			Error("unable to unmarshal request body")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -47,13 +47,16 @@ func (srv *Server) handleCreateProject(rw http.ResponseWriter, req *http.Request
 
 	proj.User.Email = reqSub
 
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
 	logger.Info("saving project")
-	err = srv.st.CreateProject(&proj)
+	err = srv.st.CreateProject(ctx, &proj)
 	if err != nil {
 		logger.WithField("error", err).
 			Error("unable to save git repo in database")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
@@ -64,7 +67,7 @@ func (srv *Server) handleCreateProject(rw http.ResponseWriter, req *http.Request
 
 		// We've already processed the request and taken action on it,
 		// so returning an error response code here would be misleading.
-		writeErrResp(rw, err, http.StatusAccepted)
+		writeErrResp(rw, req, err, http.StatusAccepted)
 		return
 	}
 
@@ -81,24 +84,41 @@ func (srv *Server) handleGetProjects(rw http.ResponseWriter, req *http.Request)
 		"request_subject": reqSub,
 	})
 
+	logger.Debug("parsing list filter")
+
+	f, err := parseListFilter(req)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse list filter")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
 	logger.Debug("retrieving projects from database")
 
-	projects, err := srv.st.GetProjects(reqSub)
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	page, err := srv.st.GetProjects(ctx, reqSub, f)
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve projects from database")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
-	buf, err := json.Marshal(projects)
+	buf, err := json.Marshal(page.Projects)
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal JSON response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
+	if page.Next != "" {
+		setNextLink(rw, req, page.Next)
+	}
+
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(buf)
 }
@@ -120,7 +140,7 @@ func (srv *Server) handleGetProject(rw http.ResponseWriter, req *http.Request) {
 		err := errors.New("missing paramter 'id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -130,18 +150,21 @@ func (srv *Server) handleGetProject(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to parse project id as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
 	logger = logger.WithField("project_id", id)
 	logger.Debug("getting project")
 
-	proj, err := srv.st.GetProject(reqSub, id)
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	proj, err := srv.st.GetProject(ctx, reqSub, id)
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve project from database")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
@@ -149,10 +172,151 @@ func (srv *Server) handleGetProject(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleDeleteProject(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["id"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing id")
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse project id as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("project_id", id)
+	logger.Info("deleting project")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	remotes, err := srv.st.DeleteProject(ctx, reqSub, id)
+	if err != nil {
+		logger.WithError(err).Error("unable to delete project")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	for _, remote := range remotes {
+		srv.notifyPoller(logger, "delete", remote.URL, remote.Branch)
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+	return
+}
+
+func (srv *Server) handleUpdateProject(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["id"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing id")
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse project id as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("project_id", id)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var update store.ProjectUpdate
+	err = json.Unmarshal(buf, &update)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	if update.Name != nil && *update.Name == "" {
+		err := invalidField("name", "project name can't be empty")
+		logger.WithError(err).Error("invalid project update")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger.Info("updating project")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	proj, err := srv.st.UpdateProject(ctx, reqSub, id, update)
+	if err != nil {
+		logger.WithError(err).Error("unable to update project")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err = json.Marshal(proj)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(buf)
+	return
 }
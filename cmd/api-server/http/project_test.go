@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/run-ci/relay/store"
@@ -19,95 +21,139 @@ import (
 // All requests should be scoped to the user, their group, or public projects. Right
 // now these tests don't test for that, and they should!
 
-type memStore struct {
-	projectdb  map[int]store.Project
-	pipelinedb map[int]store.Pipeline
-	stepdb     map[int]store.Step
-	taskdb     map[int]store.Task
+// testUser is the user every test request is authenticated as. It owns
+// everything seeded by seedStore.
+const testUser = "user@test"
 
-	createProject func(proj *store.Project) error
-}
-
-func (st *memStore) CreateProject(proj *store.Project) error {
-	if st.createProject != nil {
-		return st.createProject(proj)
+// seedStore returns an in-memory store with a project tree for the handlers
+// to serve up. Everything is created in order, so IDs are predictable:
+//
+//	project 1 (test-a) -> //test-a.git#master -> pipelines 1 (default), 2 (docker)
+//	project 2 (test-b) -> //test-b.git#master -> pipeline 3 (default)
+//
+// Every pipeline has two runs. Run 1 of pipeline 1 has steps 1 (default)
+// and 2 (docker), with tasks 1 (build) and 2 (test) in step 1 and task 3
+// (package) in step 2.
+func seedStore(t *testing.T) *store.Memory {
+	ctx := context.Background()
+	st := store.NewMemory()
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("got error seeding store: %v", err)
+		}
 	}
 
-	st.projectdb[proj.ID] = *proj
-	return nil
-}
+	must(st.CreateGroup(ctx, &store.Group{Name: "test"}))
+	must(st.CreateUser(ctx, &store.User{
+		Email:    testUser,
+		Name:     "test",
+		Password: "test",
+		Group:    store.Group{Name: "test"},
+	}))
 
-func (st *memStore) GetProject(user string, id int) (store.Project, error) {
-	ret := st.projectdb[id]
-	if ret.User.Email != user {
-		return store.Project{}, store.ErrProjectNotFound
+	projects := []struct {
+		name   string
+		remote string
+	}{
+		{name: "test-a", remote: "//test-a.git"},
+		{name: "test-b", remote: "//test-b.git"},
 	}
-	return st.projectdb[id], nil
-}
 
-func (st *memStore) GetProjects(user string) ([]store.Project, error) {
-	ret := []store.Project{}
-	for _, proj := range st.projectdb {
-		if proj.User.Email == user {
-			ret = append(ret, proj)
+	for _, d := range projects {
+		proj := store.Project{
+			Name:        d.name,
+			Description: "A project used for testing.",
+			Authorization: store.Authorization{
+				User: store.User{Email: testUser},
+			},
 		}
-	}
+		must(st.CreateProject(ctx, &proj))
 
-	return ret, nil
-}
+		must(st.CreateGitRemote(ctx, testUser, &store.GitRemote{
+			URL:       d.remote,
+			Branch:    "master",
+			ProjectID: proj.ID,
+		}))
+	}
 
-func (st *memStore) seedProjects() {
-	st.projectdb[0] = store.Project{
-		ID:          0,
-		Name:        "test-a",
-		Description: "A project used for testing.",
-		Authorization: store.Authorization{
-			User: store.User{
-				Email: "user@test",
-			},
-		},
-		GitRemotes: []store.GitRemote{
-			store.GitRemote{
-				URL:       "//test-a.git",
-				Branch:    "master",
-				ProjectID: 0,
-			},
-		},
+	pipelines := []struct {
+		name    string
+		success bool
+		remote  string
+	}{
+		{name: "default", success: true, remote: "//test-a.git"},
+		{name: "docker", success: true, remote: "//test-a.git"},
+		{name: "default", success: false, remote: "//test-b.git"},
 	}
 
-	st.projectdb[1] = store.Project{
-		ID:          1,
-		Name:        "test-b",
-		Description: "A project used for testing.",
-		Authorization: store.Authorization{
-			User: store.User{
-				Email: "user@test",
+	for _, d := range pipelines {
+		p := store.Pipeline{
+			Name: d.name,
+			GitRemote: store.GitRemote{
+				URL:    d.remote,
+				Branch: "master",
 			},
-		},
-		GitRemotes: []store.GitRemote{
-			store.GitRemote{
-				URL:       "//test-b.git",
-				Branch:    "master",
-				ProjectID: 0,
-			},
-		},
+		}
+		must(st.CreatePipeline(ctx, &p))
+
+		p.MarkSuccess(d.success)
+		must(st.UpdatePipeline(ctx, &p))
+
+		for i := 0; i < 2; i++ {
+			r := store.Run{PipelineID: p.ID}
+			r.SetStart()
+			must(st.CreateRun(ctx, &r))
+
+			r.SetEnd()
+			r.MarkSuccess(d.success)
+			must(st.UpdateRun(ctx, &r))
+		}
 	}
-}
 
-func TestPostProject(t *testing.T) {
-	send := make(chan []byte)
-	st := &memStore{
-		projectdb: make(map[int]store.Project),
+	steps := []struct {
+		name    string
+		success bool
+		tasks   []string
+	}{
+		{name: "default", success: true, tasks: []string{"build", "test"}},
+		{name: "docker", success: false, tasks: []string{"package"}},
 	}
 
-	// Setting this so that the ID gets set appropriately.
-	st.createProject = func(proj *store.Project) error {
-		proj.ID = 999
-		st.projectdb[proj.ID] = *proj
+	for _, d := range steps {
+		s := store.Step{
+			Name:       d.name,
+			PipelineID: 1,
+			RunCount:   1,
+		}
+		s.SetStart()
+		must(st.CreateStep(ctx, &s))
+
+		for _, name := range d.tasks {
+			task := store.Task{
+				Name:   name,
+				StepID: s.ID,
+			}
+			task.SetStart()
+			must(st.CreateTask(ctx, &task))
 
-		return nil
+			task.SetEnd()
+			task.MarkSuccess(d.success)
+			must(st.UpdateTask(ctx, &task))
+		}
+
+		s.SetEnd()
+		s.MarkSuccess(d.success)
+		must(st.UpdateStep(ctx, &s))
 	}
 
+	return st
+}
+
+func TestPostProject(t *testing.T) {
+	send := make(chan []byte)
+	st := seedStore(t)
+
 	srv := NewServer(":9001", send, st, "test")
 
 	r := mux.NewRouter()
@@ -155,8 +201,12 @@ func TestPostProject(t *testing.T) {
 		t.Fatalf("got error unmarshaling JSON response body: %v", err)
 	}
 
-	if result.ID != 999 {
-		t.Fatalf("expected project ID to be set to 999, got %v", result.ID)
+	if result.ID == 0 {
+		t.Fatalf("expected project ID to be set, got %v", result.ID)
+	}
+
+	if _, err := st.GetProject(context.Background(), testUser, result.ID); err != nil {
+		t.Fatalf("expected project %v to be saved, got error: %v", result.ID, err)
 	}
 
 	if result.Name != proj["name"] {
@@ -169,10 +219,13 @@ func TestPostProject(t *testing.T) {
 }
 
 func TestGetAllProjects(t *testing.T) {
-	st := &memStore{
-		projectdb: make(map[int]store.Project),
+	st := seedStore(t)
+
+	page, err := st.GetProjects(context.Background(), testUser, store.ListFilter{})
+	if err != nil {
+		t.Fatalf("got error getting seeded projects: %v", err)
 	}
-	st.seedProjects()
+	stored := page.Projects
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -180,7 +233,7 @@ func TestGetAllProjects(t *testing.T) {
 	ctx := context.WithValue(
 		context.WithValue(context.Background(), keyReqID, "test"),
 		keyReqSub,
-		"user@test",
+		testUser,
 	)
 	req = req.WithContext(ctx)
 	rw := httptest.NewRecorder()
@@ -204,22 +257,109 @@ func TestGetAllProjects(t *testing.T) {
 		t.Fatalf("got error unmarshaling response body: %v", err)
 	}
 
-	if len(results) != len(st.projectdb) {
-		t.Fatalf("expected to get %v projects, got %v", len(st.projectdb), len(results))
+	if len(results) != len(stored) {
+		t.Fatalf("expected to get %v projects, got %v", len(stored), len(results))
 	}
 
-	for _, result := range results {
-		if stored, ok := st.projectdb[result.ID]; !ok {
+	for i, result := range results {
+		if result.ID != stored[i].ID {
 			t.Fatalf("got repo %+v that isn't in DB", result)
-		} else {
-			if result.Name != stored.Name {
-				t.Fatalf("expected %+v, got %+v", stored, result)
+		}
+
+		if result.Name != stored[i].Name {
+			t.Fatalf("expected %+v, got %+v", stored[i], result)
+		}
+
+		if result.Description != stored[i].Description {
+			t.Fatalf("expected %+v, got %+v", stored[i], result)
+		}
+	}
+}
+
+func TestGetProjectsPages(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	// With test-a and test-b from the seed, this makes 6 projects.
+	for _, name := range []string{"zulu", "alpha", "Test-c", "bravo"} {
+		proj := store.Project{
+			Name: name,
+			Authorization: store.Authorization{
+				User: store.User{Email: testUser},
+			},
+		}
+		if err := st.CreateProject(ctx, &proj); err != nil {
+			t.Fatalf("got error creating project: %v", err)
+		}
+	}
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	r := mux.NewRouter()
+	r.Handle("/projects", chain(srv.handleGetProjects, setRequestID, autoAuth))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		query    string
+		status   int
+		expected []string
+	}{
+		{query: "", status: http.StatusOK, expected: []string{"test-a", "test-b", "zulu", "alpha", "Test-c", "bravo"}},
+		{query: "?limit=4", status: http.StatusOK, expected: []string{"test-a", "test-b", "zulu", "alpha", "Test-c", "bravo"}},
+		{query: "?order=desc&limit=5", status: http.StatusOK, expected: []string{"bravo", "Test-c", "alpha", "zulu", "test-b", "test-a"}},
+		{query: "?sort=name&limit=2", status: http.StatusOK, expected: []string{"Test-c", "alpha", "bravo", "test-a", "test-b", "zulu"}},
+		{query: "?sort=name&order=desc&limit=1", status: http.StatusOK, expected: []string{"zulu", "test-b", "test-a", "bravo", "alpha", "Test-c"}},
+		{query: "?name=TEST&sort=name&limit=2", status: http.StatusOK, expected: []string{"Test-c", "test-a", "test-b"}},
+		{query: "?name=nothing", status: http.StatusOK, expected: []string{}},
+		{query: "?sort=bogus", status: http.StatusBadRequest},
+		{query: "?order=sideways", status: http.StatusBadRequest},
+		{query: "?cursor=garbage!", status: http.StatusBadRequest},
+		{query: "?limit=lots", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			names := []string{}
+
+			// Follow the Link headers until the last page.
+			next := "/projects" + test.query
+			for next != "" {
+				resp, err := http.Get(ts.URL + next)
+				if err != nil {
+					t.Fatalf("error executing test against test server: %v", err)
+				}
+				defer resp.Body.Close()
+
+				if resp.StatusCode != test.status {
+					t.Fatalf("expected status code %v, got %v", test.status, resp.StatusCode)
+				}
+
+				if test.status != http.StatusOK {
+					return
+				}
+
+				results := []store.Project{}
+				err = json.NewDecoder(resp.Body).Decode(&results)
+				if err != nil {
+					t.Fatalf("got error decoding response body: %v", err)
+				}
+
+				for _, p := range results {
+					names = append(names, p.Name)
+				}
+
+				next = ""
+				if link := resp.Header.Get("Link"); link != "" {
+					next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+				}
 			}
 
-			if result.Description != stored.Description {
-				t.Fatalf("expected %+v, got %+v", stored, result)
+			if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+				t.Fatalf("expected projects %v, got %v", test.expected, names)
 			}
-		}
+		})
 	}
 }
 
@@ -228,7 +368,7 @@ func autoAuth(fn http.HandlerFunc) http.HandlerFunc {
 		ctx := context.WithValue(
 			req.Context(),
 			keyReqSub,
-			"user@test",
+			testUser,
 		)
 		req = req.WithContext(ctx)
 
@@ -236,11 +376,125 @@ func autoAuth(fn http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-func TestGetProject(t *testing.T) {
-	st := &memStore{
-		projectdb: make(map[int]store.Project),
+// authAs is like autoAuth, but for any user.
+func authAs(user string) middleware {
+	return func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), keyReqSub, user)
+			fn(rw, req.WithContext(ctx))
+		}
+	}
+}
+
+// seedOthers adds a member of the test user's group and an outsider to
+// the store, along with project 3. The project is readable, but not
+// writable, by the test group and has pipeline 4 in it.
+func seedOthers(t *testing.T, st *store.Memory) {
+	ctx := context.Background()
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("got error seeding store: %v", err)
+		}
+	}
+
+	must(st.CreateGroup(ctx, &store.Group{Name: "other"}))
+	must(st.CreateUser(ctx, &store.User{
+		Email:    "member@test",
+		Password: "test",
+		Group:    store.Group{Name: "test"},
+	}))
+	must(st.CreateUser(ctx, &store.User{
+		Email:    "outsider@test",
+		Password: "test",
+		Group:    store.Group{Name: "other"},
+	}))
+
+	proj := store.Project{
+		Name: "test-c",
+		Authorization: store.Authorization{
+			User:        store.User{Email: testUser},
+			Permissions: store.Permission(store.PermGroupRead),
+		},
+	}
+	must(st.CreateProject(ctx, &proj))
+	must(st.CreateGitRemote(ctx, testUser, &store.GitRemote{
+		URL:       "//test-c.git",
+		Branch:    "master",
+		ProjectID: proj.ID,
+	}))
+	must(st.CreatePipeline(ctx, &store.Pipeline{
+		Name:      "default",
+		GitRemote: store.GitRemote{URL: "//test-c.git", Branch: "master"},
+	}))
+}
+
+func TestDeleteProject(t *testing.T) {
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{user: "outsider@test", status: http.StatusNotFound},
+		{user: "member@test", status: http.StatusForbidden},
+		{user: testUser, status: http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			st := seedStore(t)
+			seedOthers(t, st)
+
+			pollch := make(chan []byte, 1)
+			srv := NewServer(":9001", pollch, st, "test")
+
+			r := mux.NewRouter()
+			r.Handle("/projects/{id}", chain(srv.handleDeleteProject, setRequestID, authAs(test.user)))
+
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodDelete, ts.URL+"/projects/3", nil)
+			if err != nil {
+				t.Fatalf("error creating http request for test: %v", err)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("error executing test against test server: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Fatalf("expected status code %v, got %v", test.status, resp.StatusCode)
+			}
+
+			_, err = st.GetPipeline(context.Background(), testUser, 4)
+			if test.status != http.StatusNoContent {
+				if err != nil {
+					t.Fatalf("expected pipeline to survive, got %v", err)
+				}
+				return
+			}
+
+			if err != store.ErrPipelineNotFound {
+				t.Fatalf("expected pipeline to be deleted with its project, got %v", err)
+			}
+
+			select {
+			case msg := <-pollch:
+				expected := `{"branch":"master","op":"delete","remote":"//test-c.git"}`
+				if string(msg) != expected {
+					t.Fatalf("expected poller message %v, got %s", expected, msg)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected a poller delete message")
+			}
+		})
 	}
-	st.seedProjects()
+}
+
+func TestGetProject(t *testing.T) {
+	st := seedStore(t)
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -249,8 +503,12 @@ func TestGetProject(t *testing.T) {
 		expected store.Project
 		actual   store.Project
 	}{
-		input:    0,
-		expected: st.projectdb[0],
+		input: 1,
+		expected: store.Project{
+			ID:          1,
+			Name:        "test-a",
+			Description: "A project used for testing.",
+		},
 	}
 
 	r := mux.NewRouter()
@@ -326,3 +584,107 @@ func TestGetProject(t *testing.T) {
 // 		t.Fatalf(`expected "branch" to be set to "master", got %v`, branch)
 // 	}
 // }
+
+func TestUpdateProject(t *testing.T) {
+	st := seedStore(t)
+	seedOthers(t, st)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	// These run in order against the same store, so later
+	// tests see the changes made by earlier ones.
+	tests := []struct {
+		name   string
+		user   string
+		body   string
+		status int
+		expect store.Project
+	}{
+		{name: "outsider", user: "outsider@test", body: `{"name": "x"}`, status: http.StatusNotFound},
+		{name: "group reader", user: "member@test", body: `{"name": "x"}`, status: http.StatusForbidden},
+		{name: "bad json", user: testUser, body: `{"name": `, status: http.StatusBadRequest},
+		{name: "empty name", user: testUser, body: `{"name": ""}`, status: http.StatusUnprocessableEntity},
+		{name: "reserved bits", user: testUser, body: `{"permissions": 3}`, status: http.StatusUnprocessableEntity},
+		{
+			name:   "owner renames",
+			user:   testUser,
+			body:   `{"name": "renamed"}`,
+			status: http.StatusOK,
+			expect: store.Project{ID: 3, Name: "renamed", Authorization: store.Authorization{
+				Permissions: store.Permission(store.PermGroupRead),
+			}},
+		},
+		{
+			name:   "owner shares with group",
+			user:   testUser,
+			body:   `{"permissions": 192, "description": "shared"}`,
+			status: http.StatusOK,
+			expect: store.Project{ID: 3, Name: "renamed", Description: "shared", Authorization: store.Authorization{
+				Permissions: store.Permission(store.PermGroupRead | store.PermGroupWrite),
+			}},
+		},
+		{
+			name:   "group writer renames",
+			user:   "member@test",
+			body:   `{"name": "by member"}`,
+			status: http.StatusOK,
+			expect: store.Project{ID: 3, Name: "by member", Description: "shared", Authorization: store.Authorization{
+				Permissions: store.Permission(store.PermGroupRead | store.PermGroupWrite),
+			}},
+		},
+		{
+			name:   "owner makes public",
+			user:   testUser,
+			body:   `{"permissions": 24}`,
+			status: http.StatusOK,
+			expect: store.Project{ID: 3, Name: "by member", Description: "shared", Authorization: store.Authorization{
+				Permissions: store.Permission(store.PermPublicRead | store.PermPublicWrite),
+			}},
+		},
+		{name: "public writer", user: "outsider@test", body: `{"name": "x"}`, status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		r.Handle("/projects/{id}", chain(srv.handleUpdateProject, setRequestID, authAs(test.user)))
+
+		ts := httptest.NewServer(r)
+
+		req, err := http.NewRequest(http.MethodPatch, ts.URL+"/projects/3", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatalf("%v: error creating http request for test: %v", test.name, err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v: error executing test against test server: %v", test.name, err)
+		}
+
+		actual := store.Project{}
+		err = json.NewDecoder(resp.Body).Decode(&actual)
+		resp.Body.Close()
+		ts.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%v: got error decoding response body: %v", test.name, err)
+		}
+
+		if actual.ID != test.expect.ID || actual.Name != test.expect.Name ||
+			actual.Description != test.expect.Description ||
+			actual.Permissions != test.expect.Permissions {
+			t.Fatalf("%v: expected %+v, got %+v", test.name, test.expect, actual)
+		}
+
+		if actual.User.Email != testUser {
+			t.Fatalf("%v: expected owner to stay %v, got %v", test.name, testUser, actual.User.Email)
+		}
+	}
+}
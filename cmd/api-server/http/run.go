@@ -1,15 +1,137 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
 	"github.com/sirupsen/logrus"
 )
 
+func (srv *Server) handleListRuns(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for pipeline id")
+	vars := mux.Vars(req)
+
+	raw, ok := vars["pid"]
+	if !ok || raw == "" {
+		err := errors.New("missing paramter 'pid' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing pipeline id")
+
+	pid, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse pid as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("pid", pid)
+	logger.Debug("parsing run filter")
+
+	f, err := parseRunFilter(req)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse run filter")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("listing runs from store")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	page, err := srv.st.ListRuns(ctx, reqSub, pid, f)
+	if err != nil {
+		logger.WithError(err).Error("unable to list runs")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	logger.Debug("marshaling response body")
+
+	buf, err := json.Marshal(page.Runs)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	if page.Next != 0 {
+		setNextLink(rw, req, strconv.Itoa(page.Next))
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+// parseRunFilter reads a store.RunFilter out of the query string. Times
+// are expected in RFC 3339 format.
+func parseRunFilter(req *http.Request) (store.RunFilter, error) {
+	q := req.URL.Query()
+
+	f := store.RunFilter{
+		Status: store.RunStatus(q.Get("status")),
+		Order:  store.Order(q.Get("order")),
+	}
+
+	var err error
+
+	f.Limit, err = parseLimit(req)
+	if err != nil {
+		return f, err
+	}
+
+	if raw := q.Get("cursor"); raw != "" {
+		f.After, err = strconv.Atoi(raw)
+		if err != nil {
+			return f, errors.New("invalid 'cursor' parameter")
+		}
+	}
+
+	if raw := q.Get("since"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return f, errors.New("invalid 'since' parameter")
+		}
+		f.Since = &t
+	}
+
+	if raw := q.Get("until"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return f, errors.New("invalid 'until' parameter")
+		}
+		f.Until = &t
+	}
+
+	return f, nil
+}
+
 func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 	reqID := req.Context().Value(keyReqID).(string)
 	reqSub := req.Context().Value(keyReqSub).(string)
@@ -27,7 +149,7 @@ func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 		err := errors.New("missing paramter 'pid' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -37,7 +159,7 @@ func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to parse pid as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -48,7 +170,7 @@ func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 		err := errors.New("missing paramter 'count' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -58,7 +180,7 @@ func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to parse count as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -66,11 +188,14 @@ func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 
 	logger.Debug("retrieving run from store")
 
-	run, err := srv.st.GetRun(reqSub, pid, count)
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	run, err := srv.st.GetRun(ctx, reqSub, pid, count)
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve run")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
@@ -80,7 +205,7 @@ func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -88,3 +213,505 @@ func (srv *Server) handleGetRun(rw http.ResponseWriter, req *http.Request) {
 	rw.Write(buf)
 	return
 }
+
+// RunRequest is what can be changed about a run started through the API.
+// Everything in it is optional.
+type RunRequest struct {
+	// Branch runs the pipeline's steps on another branch of its Git
+	// remote.
+	Branch string `json:"branch"`
+	// Commit runs the pipeline's steps on the commit, instead of the
+	// tip of the branch.
+	Commit string `json:"commit"`
+	// Parameters are set in the environment of every task, over the
+	// task's own arguments.
+	Parameters map[string]string `json:"parameters"`
+}
+
+// validate makes sure the branch and commit can be checked out. Git takes
+// anything starting with "-" as an option, and no branch or commit does.
+func (runreq RunRequest) validate() error {
+	if strings.HasPrefix(runreq.Branch, "-") {
+		return invalidField("branch", "branch can't start with '-'")
+	}
+
+	if strings.HasPrefix(runreq.Commit, "-") {
+		return invalidField("commit", "commit can't start with '-'")
+	}
+
+	return nil
+}
+
+// runEvent is what runlets run pipelines from. It's the runlet's Event,
+// with the steps left as the JSON they're stored as.
+type runEvent struct {
+	GitRemote store.GitRemote `json:"git_remote"`
+	Name      string          `json:"name"`
+	Steps     json.RawMessage `json:"steps"`
+
+	// PipelineID and Run are the queued run the runlet is to start,
+	// rather than creating a new one.
+	PipelineID int               `json:"pipeline_id"`
+	Run        int               `json:"run"`
+	Commit     string            `json:"commit,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+
+	// Resume is how many of the steps were copied from the run that
+	// this one retries, which the runlet skips.
+	Resume int `json:"resume,omitempty"`
+}
+
+var (
+	errNoRunQueue = errors.New("runs can't be started, there's no queue to send them to")
+	errNoSteps    = errors.New("pipeline hasn't been run yet, so there are no steps to run")
+)
+
+// handleCreateRun queues a run of the pipeline and sends it to the
+// runlets. The run is saved before it's sent so that its count can be
+// handed back, for the client to poll the run with.
+func (srv *Server) handleCreateRun(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	if srv.Runs == nil {
+		logger.WithError(errNoRunQueue).Error("unable to start run")
+
+		writeErrResp(rw, req, errNoRunQueue, http.StatusServiceUnavailable)
+		return
+	}
+
+	logger.Debug("checking mux vars for pipeline id")
+
+	raw, ok := mux.Vars(req)["pid"]
+	if !ok || raw == "" {
+		err := errors.New("missing paramter 'pid' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing pipeline id")
+
+	pid, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse pid as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("pid", pid)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The body is optional, since there's nothing that has to be
+	// changed about a run.
+	var runreq RunRequest
+	if len(buf) > 0 {
+		logger.Debug("unmarshaling request body")
+		err = json.Unmarshal(buf, &runreq)
+		if err != nil {
+			logger.WithError(err).Error("unable to unmarshal request body")
+
+			writeErrResp(rw, req, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := runreq.validate(); err != nil {
+		logger.WithError(err).Error("invalid run request")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Debug("retrieving pipeline from store")
+
+	pipeline, err := srv.st.GetPipeline(ctx, reqSub, pid)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve pipeline")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	if len(pipeline.Definition) == 0 {
+		logger.WithError(errNoSteps).Error("unable to start run")
+
+		writeErrResp(rw, req, errNoSteps, http.StatusConflict)
+		return
+	}
+
+	logger.Info("queuing run")
+
+	// What the run is run with is saved with it, so that it can be
+	// retried the same way.
+	run := store.Run{
+		PipelineID: pid,
+		Branch:     pipeline.GitRemote.Branch,
+		Commit:     runreq.Commit,
+		Parameters: runreq.Parameters,
+		Definition: pipeline.Definition,
+	}
+	if runreq.Branch != "" {
+		run.Branch = runreq.Branch
+	}
+
+	err = srv.st.QueueRun(ctx, reqSub, &run)
+	if err != nil {
+		logger.WithError(err).Error("unable to queue run")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	srv.sendRun(ctx, rw, req, logger.WithField("count", run.Count), pipeline, run)
+}
+
+// sendRun sends the queued run of the pipeline to the runlets, and
+// responds with it.
+func (srv *Server) sendRun(ctx context.Context, rw http.ResponseWriter, req *http.Request,
+	logger *logrus.Entry, pipeline store.Pipeline, run store.Run) {
+	status, err := srv.publishRun(ctx, logger, pipeline, run)
+	if err != nil {
+		writeErrResp(rw, req, err, status)
+		return
+	}
+
+	buf, err := json.Marshal(run)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		// We've already processed the request and taken action on it,
+		// so returning an error response code here would be misleading.
+		writeErrResp(rw, req, err, http.StatusAccepted)
+		return
+	}
+
+	rw.Header().Set("Location", fmt.Sprintf("/pipelines/%v/runs/%v", run.PipelineID, run.Count))
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+}
+
+// publishRun sends the queued run of the pipeline to the runlets. If it
+// can't, it fails the run and returns the status to respond with.
+func (srv *Server) publishRun(ctx context.Context, logger *logrus.Entry, pipeline store.Pipeline, run store.Run) (int, error) {
+	ev := runEvent{
+		GitRemote:  pipeline.GitRemote,
+		Name:       pipeline.Name,
+		Steps:      run.Definition,
+		PipelineID: run.PipelineID,
+		Run:        run.Count,
+		Commit:     run.Commit,
+		Parameters: run.Parameters,
+		Resume:     len(run.Steps),
+	}
+	if run.Branch != "" {
+		ev.GitRemote.Branch = run.Branch
+	}
+
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal run event")
+
+		srv.failRun(logger, run)
+		return http.StatusInternalServerError, err
+	}
+
+	logger.Debug("sending run to runlets")
+
+	// Unlike poller messages, the run has to make it to the runlets
+	// for the request to have worked.
+	select {
+	case srv.Runs <- buf:
+	case <-ctx.Done():
+		logger.WithError(ctx.Err()).Error("unable to send run to runlets")
+
+		srv.failRun(logger, run)
+		return http.StatusServiceUnavailable, ctx.Err()
+	}
+
+	return http.StatusAccepted, nil
+}
+
+// failRun ends a queued run that never made it to the runlets as a failure,
+// since nothing is ever going to start it. It's usually the request's
+// context that ran out, so it gets its own.
+func (srv *Server) failRun(logger *logrus.Entry, run store.Run) {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.StoreTimeout)
+	defer cancel()
+
+	run.SetEnd()
+	run.MarkSuccess(false)
+
+	err := srv.st.UpdateRun(ctx, &run)
+	if err != nil {
+		logger.WithError(err).Error("unable to fail run that wasn't sent, it'll stay queued")
+	}
+}
+
+// RetryRequest is how a run is retried. Everything in it is optional.
+type RetryRequest struct {
+	// Resume reuses the results of the steps of the run that succeeded,
+	// and only runs the steps from the first one that didn't.
+	Resume bool `json:"resume"`
+}
+
+// handleRetryRun queues a run of the pipeline with what one of its runs
+// was run with, optionally resuming it from its first step that didn't
+// succeed, and sends it to the runlets.
+func (srv *Server) handleRetryRun(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	if srv.Runs == nil {
+		logger.WithError(errNoRunQueue).Error("unable to retry run")
+
+		writeErrResp(rw, req, errNoRunQueue, http.StatusServiceUnavailable)
+		return
+	}
+
+	logger.Debug("checking mux vars for pipeline id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["pid"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'pid' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing pipeline id")
+
+	pid, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse pid as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("pid", pid)
+	logger.Debug("checking mux vars for count")
+
+	if raw, ok = vars["count"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'count' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing count")
+
+	count, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse count as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("count", count)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	var retryreq RetryRequest
+	if len(buf) > 0 {
+		logger.Debug("unmarshaling request body")
+		err = json.Unmarshal(buf, &retryreq)
+		if err != nil {
+			logger.WithError(err).Error("unable to unmarshal request body")
+
+			writeErrResp(rw, req, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Debug("retrieving pipeline from store")
+
+	pipeline, err := srv.st.GetPipeline(ctx, reqSub, pid)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve pipeline")
+
+		// The run is what was asked for, so not being able to see
+		// its pipeline means not being able to see it.
+		if err == store.ErrPipelineNotFound {
+			err = store.ErrRunNotFound
+		}
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	logger.WithField("resume", retryreq.Resume).Info("retrying run")
+
+	run, err := srv.st.RetryRun(ctx, reqSub, pid, count, retryreq.Resume)
+	if err != nil {
+		logger.WithError(err).Error("unable to retry run")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	srv.sendRun(ctx, rw, req, logger.WithField("retry", run.Count), pipeline, run)
+}
+
+// runControl is what runlets are told to do with a run they're running.
+type runControl struct {
+	Op         string `json:"op"`
+	PipelineID int    `json:"pipeline_id"`
+	Run        int    `json:"run"`
+}
+
+// opCancel tells the runlet running a run to stop it.
+const opCancel = "cancel"
+
+var errNoControlQueue = errors.New("runs can't be cancelled, there's no queue to tell runlets with")
+
+// handleCancelRun cancels a run. Runs that haven't started are cancelled
+// in the store and that's it. Runs that have are marked as cancelled, and
+// the runlets are told to stop them, which the one running it does, and
+// ends it.
+func (srv *Server) handleCancelRun(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	if srv.Control == nil {
+		logger.WithError(errNoControlQueue).Error("unable to cancel run")
+
+		writeErrResp(rw, req, errNoControlQueue, http.StatusServiceUnavailable)
+		return
+	}
+
+	logger.Debug("checking mux vars for pipeline id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["pid"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'pid' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing pipeline id")
+
+	pid, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse pid as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("pid", pid)
+	logger.Debug("checking mux vars for count")
+
+	if raw, ok = vars["count"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'count' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing count")
+
+	count, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse count as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("count", count)
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Info("cancelling run")
+
+	run, err := srv.st.CancelRun(ctx, reqSub, pid, count)
+	if err != nil {
+		logger.WithError(err).Error("unable to cancel run")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	// Runs that hadn't started are already over. The rest are still
+	// running on some runlet, which has to stop them.
+	if run.Start != nil {
+		buf, err := json.Marshal(runControl{Op: opCancel, PipelineID: pid, Run: count})
+		if err != nil {
+			logger.WithError(err).Error("unable to marshal control message")
+
+			writeErrResp(rw, req, err, http.StatusInternalServerError)
+			return
+		}
+
+		logger.Debug("telling runlets to stop run")
+
+		select {
+		case srv.Control <- buf:
+		case <-ctx.Done():
+			logger.WithError(ctx.Err()).Error("unable to tell runlets to stop run")
+
+			writeErrResp(rw, req, ctx.Err(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	buf, err := json.Marshal(run)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		// We've already processed the request and taken action on it,
+		// so returning an error response code here would be misleading.
+		writeErrResp(rw, req, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+}
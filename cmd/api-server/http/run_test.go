@@ -1,12 +1,15 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/run-ci/relay/store"
@@ -17,24 +20,9 @@ import (
 // All requests should be scoped to the user, their group, or public projects. Right
 // now these tests don't test for that, and they should!
 
-func (st *memStore) GetRun(user string, pid, n int) (store.Run, error) {
-	p, ok := st.pipelinedb[pid]
-	if !ok {
-		return store.Run{}, store.ErrPipelineNotFound
-	}
-
-	if len(p.Runs) < (n + 1) {
-		return store.Run{}, store.ErrRunNotFound
-	}
-
-	return p.Runs[n], nil
-}
-
 func TestGetRun(t *testing.T) {
-	st := &memStore{
-		pipelinedb: make(map[int]store.Pipeline),
-	}
-	st.seedPipelines()
+	st := seedStore(t)
+	success := true
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -43,9 +31,13 @@ func TestGetRun(t *testing.T) {
 		expected store.Run
 		actual   store.Run
 	}{
-		input:    1,
-		expected: st.pipelinedb[1].Runs[1],
-		actual:   store.Run{},
+		input: 1,
+		expected: store.Run{
+			Count:      1,
+			Success:    &success,
+			PipelineID: 1,
+		},
+		actual: store.Run{},
 	}
 
 	r := mux.NewRouter()
@@ -97,3 +89,425 @@ func TestGetRun(t *testing.T) {
 }
 
 // TODO: test that request authorization is respected
+
+func TestListRuns(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	// Pipeline 1 already has runs 1 and 2, both successful.
+	// Add a failed run 3 and a run 4 that's still going.
+	failed := store.Run{PipelineID: 1}
+	failed.SetStart()
+	if err := st.CreateRun(ctx, &failed); err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+	failed.SetEnd()
+	failed.MarkSuccess(false)
+	if err := st.UpdateRun(ctx, &failed); err != nil {
+		t.Fatalf("got error updating run: %v", err)
+	}
+
+	running := store.Run{PipelineID: 1}
+	running.SetStart()
+	if err := st.CreateRun(ctx, &running); err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	r := mux.NewRouter()
+	r.Handle("/pipelines/{pid}/runs", chain(srv.handleListRuns, setRequestID, autoAuth))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		query    string
+		status   int
+		expected []int
+		next     string
+	}{
+		{query: "", status: http.StatusOK, expected: []int{4, 3, 2, 1}},
+		{query: "?order=asc", status: http.StatusOK, expected: []int{1, 2, 3, 4}},
+		{
+			query:    "?limit=2",
+			status:   http.StatusOK,
+			expected: []int{4, 3},
+			next:     `</pipelines/1/runs?cursor=3&limit=2>; rel="next"`,
+		},
+		{query: "?limit=2&cursor=3", status: http.StatusOK, expected: []int{2, 1}},
+		{query: "?status=success", status: http.StatusOK, expected: []int{2, 1}},
+		{query: "?status=failure", status: http.StatusOK, expected: []int{3}},
+		{query: "?status=in_progress", status: http.StatusOK, expected: []int{4}},
+		{query: "?since=2000-01-01T00:00:00Z&until=2001-01-01T00:00:00Z", status: http.StatusOK, expected: []int{}},
+		{query: "?status=bogus", status: http.StatusBadRequest},
+		{query: "?since=yesterday", status: http.StatusBadRequest},
+		{query: "?limit=-1", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			resp, err := http.Get(fmt.Sprintf("%v/pipelines/1/runs%v", ts.URL, test.query))
+			if err != nil {
+				t.Fatalf("error executing test against test server: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Fatalf("expected status code %v, got %v", test.status, resp.StatusCode)
+			}
+
+			if test.status != http.StatusOK {
+				return
+			}
+
+			if link := resp.Header.Get("Link"); link != test.next {
+				t.Fatalf("expected Link header %q, got %q", test.next, link)
+			}
+
+			runs := []store.Run{}
+			err = json.NewDecoder(resp.Body).Decode(&runs)
+			if err != nil {
+				t.Fatalf("got error decoding runs: %v", err)
+			}
+
+			if len(runs) != len(test.expected) {
+				t.Fatalf("expected runs %v, got %+v", test.expected, runs)
+			}
+
+			for i, run := range runs {
+				if run.Count != test.expected[i] {
+					t.Fatalf("expected runs %v, got %+v", test.expected, runs)
+				}
+			}
+		})
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%v/pipelines/99/runs", ts.URL))
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %v for a missing pipeline, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestCreateRun(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	steps := `[{"name":"default","tasks":[{"name":"test","image":"alpine","command":"true"}]}]`
+	if err := st.SetPipelineDefinition(ctx, 1, []byte(steps)); err != nil {
+		t.Fatalf("got error setting pipeline definition: %v", err)
+	}
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	r := mux.NewRouter()
+	r.Handle("/pipelines/{pid}/runs", chain(srv.handleCreateRun, setRequestID, autoAuth))
+	r.Handle("/outsider/pipelines/{pid}/runs", chain(srv.handleCreateRun, setRequestID, authAs("outsider@test")))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	postAs := func(prefix string, pid int, body string) *http.Response {
+		requrl := fmt.Sprintf("%v%v/pipelines/%v/runs", ts.URL, prefix, pid)
+		resp, err := http.Post(requrl, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	post := func(pid int, body string) *http.Response {
+		return postAs("", pid, body)
+	}
+
+	if resp := post(1, ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %v without a queue, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	runs := make(chan []byte, 1)
+	srv.Runs = runs
+
+	// Pipeline 2 has no steps, but whoever can't see it shouldn't find
+	// that out.
+	tests := []struct {
+		name   string
+		prefix string
+		pid    int
+		body   string
+		status int
+	}{
+		{name: "missing pipeline", pid: 999, status: http.StatusNotFound},
+		{name: "unreadable pipeline", prefix: "/outsider", pid: 2, status: http.StatusNotFound},
+		{name: "never run", pid: 2, status: http.StatusConflict},
+		{name: "bad body", pid: 1, body: `{"parameters": []}`, status: http.StatusBadRequest},
+		{name: "branch that's an option", pid: 1, body: `{"branch": "--orphan=x"}`, status: http.StatusUnprocessableEntity},
+		{name: "commit that's an option", pid: 1, body: `{"commit": "-b"}`, status: http.StatusUnprocessableEntity},
+	}
+
+	for _, test := range tests {
+		if resp := postAs(test.prefix, test.pid, test.body); resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	resp := post(1, `{"branch": "dev", "commit": "abc123", "parameters": {"TARGET": "prod"}}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	// Pipeline 1 already has runs 1 and 2.
+	if loc := resp.Header.Get("Location"); loc != "/pipelines/1/runs/3" {
+		t.Fatalf("expected run at /pipelines/1/runs/3, got %q", loc)
+	}
+
+	var ev runEvent
+	if err := json.Unmarshal(<-runs, &ev); err != nil {
+		t.Fatalf("got error unmarshaling run event: %v", err)
+	}
+
+	if ev.PipelineID != 1 || ev.Run != 3 || ev.Name != "default" || string(ev.Steps) != steps {
+		t.Fatalf("expected event for run 3 of pipeline 1 with its steps, got %+v", ev)
+	}
+
+	if ev.GitRemote.URL != "//test-a.git" || ev.GitRemote.Branch != "dev" || ev.Commit != "abc123" ||
+		ev.Parameters["TARGET"] != "prod" {
+		t.Fatalf("expected event for commit abc123 on dev with parameters, got %+v", ev)
+	}
+
+	run, err := st.GetRun(ctx, testUser, 1, 3)
+	if err != nil {
+		t.Fatalf("got error getting queued run: %v", err)
+	}
+
+	if run.Start != nil {
+		t.Fatalf("expected run to be queued, got %+v", run)
+	}
+
+	// Runs that can't be sent would never start, so they fail.
+	srv.Runs = make(chan []byte)
+	srv.StoreTimeout = 50 * time.Millisecond
+
+	if resp := post(1, ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %v when the run can't be sent, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	run, err = st.GetRun(ctx, testUser, 1, 4)
+	if err != nil {
+		t.Fatalf("got error getting unsent run: %v", err)
+	}
+
+	if run.End == nil || !run.Failed() {
+		t.Fatalf("expected run that wasn't sent to have failed, got %+v", run)
+	}
+}
+
+func TestCancelRun(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	r := mux.NewRouter()
+	r.Handle("/pipelines/{pid}/runs/{count}/cancel", chain(srv.handleCancelRun, setRequestID, autoAuth))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	post := func(pid, count int) *http.Response {
+		requrl := fmt.Sprintf("%v/pipelines/%v/runs/%v/cancel", ts.URL, pid, count)
+		resp, err := http.Post(requrl, "application/json", nil)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	if resp := post(1, 1); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %v without a queue, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	control := make(chan []byte, 1)
+	srv.Control = control
+
+	queued, started := store.Run{PipelineID: 1}, store.Run{PipelineID: 1}
+	for _, run := range []*store.Run{&queued, &started} {
+		if err := st.QueueRun(ctx, testUser, run); err != nil {
+			t.Fatalf("got error queuing run: %v", err)
+		}
+	}
+
+	started.SetStart()
+	if err := st.StartRun(ctx, &started); err != nil {
+		t.Fatalf("got error starting run: %v", err)
+	}
+
+	// Pipeline 1 already has runs 1 and 2, which have finished.
+	tests := []struct {
+		name   string
+		pid    int
+		count  int
+		status int
+	}{
+		{name: "missing run", pid: 1, count: 99, status: http.StatusNotFound},
+		{name: "finished", pid: 1, count: 1, status: http.StatusConflict},
+		{name: "queued", pid: 1, count: queued.Count, status: http.StatusAccepted},
+	}
+
+	for _, test := range tests {
+		if resp := post(test.pid, test.count); resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	// Queued runs don't have a runlet to tell.
+	select {
+	case msg := <-control:
+		t.Fatalf("expected no control message for a queued run, got %s", msg)
+	default:
+	}
+
+	if resp := post(1, started.Count); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status code %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	var msg runControl
+	if err := json.Unmarshal(<-control, &msg); err != nil {
+		t.Fatalf("got error unmarshaling control message: %v", err)
+	}
+
+	if msg.Op != opCancel || msg.PipelineID != 1 || msg.Run != started.Count {
+		t.Fatalf("expected cancel message for run %v of pipeline 1, got %+v", started.Count, msg)
+	}
+}
+
+func TestRetryRun(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	r := mux.NewRouter()
+	r.Handle("/pipelines/{pid}/runs/{count}/retry", chain(srv.handleRetryRun, setRequestID, autoAuth))
+	r.Handle("/outsider/pipelines/{pid}/runs/{count}/retry", chain(srv.handleRetryRun, setRequestID, authAs("outsider@test")))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	postAs := func(prefix string, pid, count int, body string) *http.Response {
+		requrl := fmt.Sprintf("%v%v/pipelines/%v/runs/%v/retry", ts.URL, prefix, pid, count)
+		resp, err := http.Post(requrl, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	post := func(pid, count int, body string) *http.Response {
+		return postAs("", pid, count, body)
+	}
+
+	if resp := post(1, 1, ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %v without a queue, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	runs := make(chan []byte, 1)
+	srv.Runs = runs
+
+	steps := `[{"name":"build","tasks":[]},{"name":"test","tasks":[]}]`
+	failed := store.Run{
+		PipelineID: 1,
+		Branch:     "dev",
+		Commit:     "abc123",
+		Definition: []byte(steps),
+	}
+	if err := st.QueueRun(ctx, testUser, &failed); err != nil {
+		t.Fatalf("got error queuing run: %v", err)
+	}
+
+	for _, ok := range []bool{true, false} {
+		s := store.Step{Name: "step", PipelineID: 1, RunCount: failed.Count}
+		s.SetStart()
+		if err := st.CreateStep(ctx, &s); err != nil {
+			t.Fatalf("got error creating step: %v", err)
+		}
+
+		s.SetEnd()
+		s.MarkSuccess(ok)
+		if err := st.UpdateStep(ctx, &s); err != nil {
+			t.Fatalf("got error updating step: %v", err)
+		}
+	}
+
+	failed.SetStart()
+	failed.SetEnd()
+	failed.MarkSuccess(false)
+	if err := st.UpdateRun(ctx, &failed); err != nil {
+		t.Fatalf("got error updating run: %v", err)
+	}
+
+	// Pipeline 1 already has runs 1 and 2, from before runs had their
+	// steps recorded. Whoever can't see them shouldn't find that out.
+	tests := []struct {
+		name   string
+		prefix string
+		pid    int
+		count  int
+		body   string
+		status int
+	}{
+		{name: "missing pipeline", pid: 999, count: 1, status: http.StatusNotFound},
+		{name: "missing run", pid: 1, count: 99, status: http.StatusNotFound},
+		{name: "unreadable run", prefix: "/outsider", pid: 1, count: 1, status: http.StatusNotFound},
+		{name: "not recorded", pid: 1, count: 1, status: http.StatusConflict},
+		{name: "bad body", pid: 1, count: failed.Count, body: `{"resume": "yes"}`, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		if resp := postAs(test.prefix, test.pid, test.count, test.body); resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	for _, resume := range []int{0, 1} {
+		body := fmt.Sprintf(`{"resume": %v}`, resume == 1)
+
+		resp := post(1, failed.Count, body)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("%v: expected status code %v, got %v", body, http.StatusAccepted, resp.StatusCode)
+		}
+
+		var ev runEvent
+		if err := json.Unmarshal(<-runs, &ev); err != nil {
+			t.Fatalf("%v: got error unmarshaling run event: %v", body, err)
+		}
+
+		if loc := resp.Header.Get("Location"); loc != fmt.Sprintf("/pipelines/1/runs/%v", ev.Run) {
+			t.Fatalf("%v: expected run %v at its location, got %q", body, ev.Run, loc)
+		}
+
+		if ev.GitRemote.Branch != "dev" || ev.Commit != "abc123" || string(ev.Steps) != steps || ev.Resume != resume {
+			t.Fatalf("%v: expected event with the inputs of run %v resuming after %v steps, got %+v",
+				body, failed.Count, resume, ev)
+		}
+
+		run, err := st.GetRun(ctx, testUser, 1, ev.Run)
+		if err != nil {
+			t.Fatalf("%v: got error getting retried run: %v", body, err)
+		}
+
+		if run.RetryOf != failed.Count {
+			t.Fatalf("%v: expected run to retry run %v, got %+v", body, failed.Count, run)
+		}
+	}
+}
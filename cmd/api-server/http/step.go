@@ -27,7 +27,7 @@ func (srv *Server) handleGetStep(rw http.ResponseWriter, req *http.Request) {
 		err := errors.New("missing paramter 'id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -37,7 +37,7 @@ func (srv *Server) handleGetStep(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to parse id as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -45,11 +45,14 @@ func (srv *Server) handleGetStep(rw http.ResponseWriter, req *http.Request) {
 
 	logger.Debug("retrieving step from store")
 
-	step, err := srv.st.GetStep(reqSub, id)
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	step, err := srv.st.GetStep(ctx, reqSub, id)
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve step")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
@@ -59,7 +62,7 @@ func (srv *Server) handleGetStep(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -17,52 +17,9 @@ import (
 // All requests should be scoped to the user, their group, or public projects. Right
 // now these tests don't test for that, and they should!
 
-func (st *memStore) GetStep(user string, id int) (store.Step, error) {
-	s, ok := st.stepdb[id]
-	if !ok {
-		return store.Step{}, store.ErrStepNotFound
-	}
-
-	return s, nil
-}
-
-func (st *memStore) seedSteps() {
-	data := []struct {
-		id      int
-		name    string
-		success bool
-	}{
-		{
-			id:      1,
-			name:    "default",
-			success: true,
-		},
-		{
-			id:      2,
-			name:    "docker",
-			success: true,
-		},
-		{
-			id:      3,
-			name:    "default",
-			success: false,
-		},
-	}
-
-	for _, d := range data {
-		st.stepdb[d.id] = store.Step{
-			ID:      d.id,
-			Name:    d.name,
-			Success: &d.success,
-		}
-	}
-}
-
 func TestGetStep(t *testing.T) {
-	st := &memStore{
-		stepdb: make(map[int]store.Step),
-	}
-	st.seedSteps()
+	st := seedStore(t)
+	success := true
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -72,9 +29,13 @@ func TestGetStep(t *testing.T) {
 		expected store.Step
 		actual   store.Step
 	}{
-		input:    1,
-		expected: st.stepdb[1],
-		actual:   store.Step{},
+		input: 1,
+		expected: store.Step{
+			ID:      1,
+			Name:    "default",
+			Success: &success,
+		},
+		actual: store.Step{},
 	}
 
 	r := mux.NewRouter()
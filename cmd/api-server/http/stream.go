@@ -0,0 +1,551 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// These are the types of status events. Run, step and task events are
+// sent by the runlet whenever it saves one of them. A snapshot is the
+// whole run, steps, tasks and all, as it is in the store, which is what
+// streams start with when there's nothing to resume from.
+const (
+	statusRun      = "run"
+	statusStep     = "step"
+	statusTask     = "task"
+	statusSnapshot = "snapshot"
+)
+
+const (
+	// statusHistory is how many of a run's latest events are kept for
+	// streams to resume from.
+	statusHistory = 512
+	// statusTTL is how long a run's events are kept after its last one,
+	// unless something is still streaming it.
+	statusTTL = 10 * time.Minute
+	// statusBuffer is how far a stream can fall behind before it's
+	// dropped. Clients can resume from wherever they were dropped.
+	statusBuffer = 64
+	// streamKeepAlive is how often streams send something, so that
+	// proxies don't take them for idle and close them.
+	streamKeepAlive = 30 * time.Second
+)
+
+var errStreamUnsupported = errors.New("response can't be streamed")
+
+// statusEvent is a change to a run, or to one of its steps or tasks. Seq
+// is its place among the run's events, counted by the runlet running the
+// run, and is what streams are resumed from.
+type statusEvent struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	PipelineID int    `json:"pipeline_id"`
+	Run        int    `json:"run"`
+	// StepID is the step of the task, for task events.
+	StepID int             `json:"step_id,omitempty"`
+	Data   json.RawMessage `json:"data"`
+
+	// done is whether the event is the run finishing, after which it
+	// doesn't have any more.
+	done bool
+}
+
+// parseStatus parses a status event sent by a runlet.
+func parseStatus(buf []byte) (statusEvent, error) {
+	var ev statusEvent
+	err := json.Unmarshal(buf, &ev)
+	if err != nil {
+		return ev, err
+	}
+
+	if ev.Type != statusRun {
+		return ev, nil
+	}
+
+	var run store.Run
+	err = json.Unmarshal(ev.Data, &run)
+	if err != nil {
+		return ev, err
+	}
+
+	ev.done = run.End != nil
+	return ev, nil
+}
+
+// snapshotOf returns the snapshot event of the run, in the place of the
+// event with the seq.
+func snapshotOf(run store.Run, seq int) (statusEvent, error) {
+	buf, err := json.Marshal(run)
+	if err != nil {
+		return statusEvent{}, err
+	}
+
+	return statusEvent{
+		Seq:        seq,
+		Type:       statusSnapshot,
+		PipelineID: run.PipelineID,
+		Run:        run.Count,
+		Data:       buf,
+		done:       run.End != nil,
+	}, nil
+}
+
+type runKey struct {
+	pipelineID int
+	count      int
+}
+
+// statusHub hands status events out to the streams of their runs, and
+// keeps the latest events of every run for streams to resume from. Every
+// API server gets every event, and has its own hub, so a stream can be
+// resumed from any of them.
+type statusHub struct {
+	mu   sync.Mutex
+	runs map[runKey]*runEvents
+
+	now func() time.Time
+}
+
+type runEvents struct {
+	events []statusEvent
+	subs   map[chan statusEvent]bool
+	last   time.Time
+}
+
+func newStatusHub() *statusHub {
+	return &statusHub{
+		runs: make(map[runKey]*runEvents),
+		now:  time.Now,
+	}
+}
+
+// entry returns the events of the run, adding them if there aren't any.
+func (h *statusHub) entry(key runKey, now time.Time) *runEvents {
+	re, ok := h.runs[key]
+	if !ok {
+		re = &runEvents{subs: make(map[chan statusEvent]bool)}
+		h.runs[key] = re
+	}
+
+	re.last = now
+	return re
+}
+
+// publish keeps the event and sends it to the streams of its run. Streams
+// that have fallen too far behind to take it are dropped, by closing
+// their channel.
+func (h *statusHub) publish(ev statusEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+
+	re := h.entry(runKey{pipelineID: ev.PipelineID, count: ev.Run}, now)
+	re.events = append(re.events, ev)
+	if len(re.events) > statusHistory {
+		re.events = re.events[len(re.events)-statusHistory:]
+	}
+
+	for ch := range re.subs {
+		select {
+		case ch <- ev:
+		default:
+			close(ch)
+			delete(re.subs, ch)
+		}
+	}
+
+	// Runs are only pruned on events, which are what adds them.
+	for key, re := range h.runs {
+		if len(re.subs) == 0 && now.Sub(re.last) > statusTTL {
+			delete(h.runs, key)
+		}
+	}
+}
+
+// subscribe returns a channel that gets the run's events from now on. It
+// also returns the run's events after the one with the seq, and whether
+// those are all of them, which they aren't if the hub didn't get them or
+// has forgotten them. last is the seq of the run's latest event, or 0 if
+// the hub hasn't had any.
+func (h *statusHub) subscribe(key runKey, after int) (ch chan statusEvent, replay []statusEvent, last int, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	re := h.entry(key, h.now())
+
+	ch = make(chan statusEvent, statusBuffer)
+	re.subs[ch] = true
+
+	if len(re.events) == 0 {
+		return ch, nil, 0, false
+	}
+
+	last = re.events[len(re.events)-1].Seq
+	if re.events[0].Seq > after+1 || after > last {
+		return ch, nil, last, false
+	}
+
+	for _, ev := range re.events {
+		if ev.Seq > after {
+			replay = append(replay, ev)
+		}
+	}
+
+	return ch, replay, last, true
+}
+
+// unsubscribe stops sending the run's events to the channel. Runs that
+// nothing is streaming and that haven't had any events are forgotten.
+func (h *statusHub) unsubscribe(key runKey, ch chan statusEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if re, ok := h.runs[key]; ok {
+		delete(re.subs, ch)
+
+		if len(re.subs) == 0 && len(re.events) == 0 {
+			delete(h.runs, key)
+		}
+	}
+}
+
+// WatchStatus hands out the status events the runlets send on the channel
+// to the streams of their runs, until the channel is closed. Without it,
+// streams only get the run as it is when they start.
+func (srv *Server) WatchStatus(status <-chan []byte) {
+	for buf := range status {
+		ev, err := parseStatus(buf)
+		if err != nil {
+			logger.WithError(err).Error("unable to parse status event, skipping")
+
+			continue
+		}
+
+		srv.status.publish(ev)
+	}
+}
+
+// handleStreamRun streams the status events of a run, over Server-Sent
+// Events, or over a WebSocket if the request is to upgrade to one. Streams
+// start with a snapshot of the run, unless they're resumed from the ID of
+// the last event the client got, in which case they start with the events
+// it missed. They end once the run finishes.
+func (srv *Server) handleStreamRun(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for pipeline id")
+	vars := mux.Vars(req)
+
+	var raw string
+	var ok bool
+	if raw, ok = vars["pid"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'pid' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing pipeline id")
+
+	pid, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse pid as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("pid", pid)
+	logger.Debug("checking mux vars for count")
+
+	if raw, ok = vars["count"]; !ok || raw == "" {
+		err := errors.New("missing paramter 'count' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing count")
+
+	count, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse count as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("count", count)
+
+	after, resume, err := lastEventID(req)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse last event id")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("retrieving run from store")
+
+	// The run is read before subscribing to it, so that the hub only
+	// keeps track of runs that exist, for whoever can read them.
+	ctx, cancel := srv.storeContext(req)
+	_, err = srv.st.GetRun(ctx, reqSub, pid, count)
+	cancel()
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve run")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	// It's read again after subscribing, so that nothing that happens
+	// in between is missed.
+	key := runKey{pipelineID: pid, count: count}
+	ch, replay, last, ok := srv.status.subscribe(key, after)
+	defer srv.status.unsubscribe(key, ch)
+
+	ctx, cancel = srv.storeContext(req)
+	run, err := srv.st.GetRun(ctx, reqSub, pid, count)
+	cancel()
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve run")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	// A stream of a finished run ends once the client has it finishing,
+	// so a client resuming after that has nothing left to get. A 204
+	// tells EventSource to stop reconnecting. Clients resuming from
+	// events the hub doesn't have get a snapshot instead.
+	if resume && ok && after >= last && run.End != nil {
+		logger.Debug("run already finished, nothing to stream")
+
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	events, sent := replay, after
+	if !resume || !ok {
+		logger.Debug("starting stream from snapshot")
+
+		snapshot, err := snapshotOf(run, last)
+		if err != nil {
+			logger.WithError(err).Error("unable to marshal snapshot")
+
+			writeErrResp(rw, req, err, http.StatusInternalServerError)
+			return
+		}
+
+		events, sent = []statusEvent{snapshot}, last
+	}
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		logger.Debug("streaming run over websocket")
+
+		ws := websocket.Server{
+			// Streams are authenticated by their Authorization header,
+			// not by cookies, so where they're opened from doesn't
+			// matter.
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(conn *websocket.Conn) {
+				ctx, cancel := context.WithCancel(req.Context())
+				defer cancel()
+
+				// Nothing's read from the client, except to notice it
+				// going away.
+				go func() {
+					io.Copy(ioutil.Discard, conn)
+					cancel()
+				}()
+
+				streamEvents(ctx, logger, wsStream{conn}, events, sent, ch)
+			},
+		}
+
+		ws.ServeHTTP(rw, req)
+		return
+	}
+
+	s, ok := newSSEStream(rw)
+	if !ok {
+		logger.WithError(errStreamUnsupported).Error("unable to stream run")
+
+		writeErrResp(rw, req, errStreamUnsupported, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("streaming run over server-sent events")
+
+	streamEvents(req.Context(), logger, s, events, sent, ch)
+}
+
+// lastEventID returns the ID of the last event the client got, from the
+// Last-Event-ID header EventSource resumes with, or from the last_event_id
+// parameter for clients that can't set it.
+func lastEventID(req *http.Request) (int, bool, error) {
+	raw := req.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = req.URL.Query().Get("last_event_id")
+	}
+
+	if raw == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.Atoi(raw)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("invalid last event id %q", raw)
+	}
+
+	return id, true, nil
+}
+
+// streamer is how status events get to the client.
+type streamer interface {
+	send(statusEvent) error
+	keepAlive() error
+}
+
+// streamEvents sends the events, then the ones that come in on ch after
+// the one with the seq, until the run finishes or the client goes away.
+// A closed ch means the stream fell behind and was dropped.
+func streamEvents(ctx context.Context, logger *logrus.Entry, s streamer, events []statusEvent, seq int, ch <-chan statusEvent) {
+	for _, ev := range events {
+		if err := s.send(ev); err != nil {
+			logger.WithError(err).Debug("unable to send event, ending stream")
+			return
+		}
+
+		if ev.done {
+			logger.Debug("run finished, ending stream")
+			return
+		}
+	}
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("client went away, ending stream")
+			return
+		case <-ticker.C:
+			if err := s.keepAlive(); err != nil {
+				logger.WithError(err).Debug("unable to send keepalive, ending stream")
+				return
+			}
+		case ev, ok := <-ch:
+			if !ok {
+				logger.Warn("stream fell behind, dropping it")
+				return
+			}
+
+			if ev.Seq <= seq {
+				continue
+			}
+			seq = ev.Seq
+
+			if err := s.send(ev); err != nil {
+				logger.WithError(err).Debug("unable to send event, ending stream")
+				return
+			}
+
+			if ev.done {
+				logger.Debug("run finished, ending stream")
+				return
+			}
+		}
+	}
+}
+
+// sseStream sends events as Server-Sent Events, with their seq as their ID
+// and their type as their event name.
+type sseStream struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newSSEStream starts the response as an event stream. It returns false if
+// the response can't be flushed, which streaming needs.
+func newSSEStream(rw http.ResponseWriter) (sseStream, bool) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return sseStream{}, false
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	// This keeps nginx from buffering the stream.
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return sseStream{rw: rw, flusher: flusher}, true
+}
+
+func (s sseStream) send(ev statusEvent) error {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.rw, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, buf)
+	if err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+	return nil
+}
+
+func (s sseStream) keepAlive() error {
+	_, err := io.WriteString(s.rw, ": keepalive\n\n")
+	if err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+	return nil
+}
+
+// wsStream sends events as JSON text messages on a WebSocket.
+type wsStream struct {
+	conn *websocket.Conn
+}
+
+func (s wsStream) send(ev statusEvent) error {
+	return websocket.JSON.Send(s.conn, ev)
+}
+
+func (s wsStream) keepAlive() error {
+	s.conn.PayloadType = websocket.PingFrame
+	defer func() { s.conn.PayloadType = websocket.TextFrame }()
+
+	_, err := s.conn.Write(nil)
+	return err
+}
@@ -0,0 +1,358 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+	"golang.org/x/net/websocket"
+)
+
+func TestStatusHub(t *testing.T) {
+	h := newStatusHub()
+
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	key := runKey{pipelineID: 1, count: 1}
+	for seq := 1; seq <= 3; seq++ {
+		h.publish(statusEvent{Seq: seq, Type: statusStep, PipelineID: 1, Run: 1})
+	}
+
+	tests := []struct {
+		after  int
+		replay []int
+		last   int
+		ok     bool
+	}{
+		{after: 0, replay: []int{1, 2, 3}, last: 3, ok: true},
+		{after: 1, replay: []int{2, 3}, last: 3, ok: true},
+		{after: 3, replay: []int{}, last: 3, ok: true},
+		{after: 4, replay: []int{}, last: 3, ok: false},
+	}
+
+	for _, test := range tests {
+		ch, replay, last, ok := h.subscribe(key, test.after)
+		h.unsubscribe(key, ch)
+
+		if last != test.last || ok != test.ok || len(replay) != len(test.replay) {
+			t.Fatalf("after %v: expected replay %v, last %v and ok %v, got %+v, %v and %v",
+				test.after, test.replay, test.last, test.ok, replay, last, ok)
+		}
+
+		for i, seq := range test.replay {
+			if replay[i].Seq != seq {
+				t.Fatalf("after %v: expected replay %v, got %+v", test.after, test.replay, replay)
+			}
+		}
+	}
+
+	// Events that have been forgotten can't be resumed from.
+	long := runKey{pipelineID: 1, count: 2}
+	for seq := 1; seq <= statusHistory+1; seq++ {
+		h.publish(statusEvent{Seq: seq, Type: statusStep, PipelineID: 1, Run: 2})
+	}
+
+	ch, _, last, ok := h.subscribe(long, 0)
+	if ok || last != statusHistory+1 {
+		t.Fatalf("expected forgotten events not to be resumable, got last %v and ok %v", last, ok)
+	}
+
+	// Streams that fall behind are dropped.
+	for seq := statusHistory + 2; seq <= statusHistory+2+statusBuffer; seq++ {
+		h.publish(statusEvent{Seq: seq, Type: statusStep, PipelineID: 1, Run: 2})
+	}
+
+	n := 0
+	for range ch {
+		n++
+	}
+
+	if n != statusBuffer {
+		t.Fatalf("expected stream to be dropped after %v events, got %v", statusBuffer, n)
+	}
+
+	// Runs nothing is streaming are forgotten after a while.
+	now = now.Add(statusTTL + time.Second)
+	h.publish(statusEvent{Seq: 1, Type: statusRun, PipelineID: 2, Run: 1})
+
+	if _, ok := h.runs[key]; ok {
+		t.Fatal("expected old run to be forgotten")
+	}
+}
+
+// sseEvent is an event read off of a Server-Sent Events stream.
+type sseEvent struct {
+	id    string
+	event string
+	data  statusEvent
+}
+
+// readSSE reads the next event off of the stream, skipping comments.
+func readSSE(r *bufio.Reader) (sseEvent, error) {
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ev, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev.event != "" {
+				return ev, nil
+			}
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data)
+			if err != nil {
+				return ev, err
+			}
+		}
+	}
+}
+
+func TestStreamRun(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	status := make(chan []byte)
+	defer close(status)
+	go srv.WatchStatus(status)
+
+	r := mux.NewRouter()
+	r.Handle("/pipelines/{pid}/runs/{count}/events", chain(srv.handleStreamRun, setRequestID, autoAuth))
+	r.Handle("/anonymous/pipelines/{pid}/runs/{count}/events", chain(srv.handleStreamRun, setRequestID, authAs(anonymous)))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	run := store.Run{PipelineID: 1}
+	if err := st.QueueRun(ctx, testUser, &run); err != nil {
+		t.Fatalf("got error queuing run: %v", err)
+	}
+
+	requrl := fmt.Sprintf("%v/pipelines/1/runs/%v/events", ts.URL, run.Count)
+
+	get := func(lastID string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, requrl, nil)
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+
+		return resp
+	}
+
+	send := func(ev string) {
+		select {
+		case status <- []byte(ev):
+		case <-time.After(time.Second):
+			t.Fatal("timed out sending status event")
+		}
+	}
+
+	resp := get("")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected event stream with status code %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	body := bufio.NewReader(resp.Body)
+
+	ev, err := readSSE(body)
+	if err != nil {
+		t.Fatalf("got error reading snapshot: %v", err)
+	}
+
+	if ev.id != "0" || ev.event != statusSnapshot || ev.data.Run != run.Count {
+		t.Fatalf("expected snapshot of run %v first, got %+v", run.Count, ev)
+	}
+
+	send(fmt.Sprintf(`{"seq": 1, "type": "step", "pipeline_id": 1, "run": %v, "data": {"id": 1, "name": "test"}}`, run.Count))
+	send(fmt.Sprintf(`{"seq": 2, "type": "run", "pipeline_id": 1, "run": %v,
+		"data": {"count": %v, "end": "2018-12-01T00:00:00Z", "cancelled": true}}`, run.Count, run.Count))
+
+	for _, expected := range []string{statusStep, statusRun} {
+		ev, err := readSSE(body)
+		if err != nil {
+			t.Fatalf("got error reading %v event: %v", expected, err)
+		}
+
+		if ev.event != expected || ev.id != fmt.Sprint(ev.data.Seq) {
+			t.Fatalf("expected %v event, got %+v", expected, ev)
+		}
+	}
+
+	if _, err := readSSE(body); err != io.EOF {
+		t.Fatalf("expected stream to end once run finished, got %v", err)
+	}
+
+	// Resuming only sends what was missed.
+	resp = get("1")
+	body = bufio.NewReader(resp.Body)
+
+	ev, err = readSSE(body)
+	if err != nil {
+		t.Fatalf("got error reading resumed event: %v", err)
+	}
+
+	if ev.event != statusRun || ev.id != "2" {
+		t.Fatalf("expected run event resumed from 1, got %+v", ev)
+	}
+	resp.Body.Close()
+
+	// Once the run is over, there's nothing to resume.
+	run.SetEnd()
+	run.MarkCancelled()
+	if err := st.UpdateRun(ctx, &run); err != nil {
+		t.Fatalf("got error updating run: %v", err)
+	}
+
+	resp = get("2")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %v resuming finished run, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+
+	// Events the hub doesn't have can't be resumed from, even for a
+	// finished run.
+	resp = get("5")
+	body = bufio.NewReader(resp.Body)
+
+	ev, err = readSSE(body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("got error reading snapshot: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || ev.event != statusSnapshot {
+		t.Fatalf("expected snapshot resuming from an unknown event, got %v and %+v", resp.StatusCode, ev)
+	}
+
+	resp = get("x")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status code %v for bad last event id, got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/pipelines/1/runs/999/events", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %v for missing run, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+
+	srv.status.mu.Lock()
+	_, found := srv.status.runs[runKey{pipelineID: 1, count: 999}]
+	srv.status.mu.Unlock()
+
+	if found {
+		t.Fatal("expected missing run not to be kept track of")
+	}
+
+	// The test projects are private, so anonymous clients can't stream
+	// their runs.
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("%v/anonymous/pipelines/1/runs/%v/events", ts.URL, run.Count), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %v for private run, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestStreamRunWebSocket(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	status := make(chan []byte)
+	defer close(status)
+	go srv.WatchStatus(status)
+
+	r := mux.NewRouter()
+	r.Handle("/pipelines/{pid}/runs/{count}/events", chain(srv.handleStreamRun, setRequestID, autoAuth))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	run := store.Run{PipelineID: 1}
+	if err := st.QueueRun(ctx, testUser, &run); err != nil {
+		t.Fatalf("got error queuing run: %v", err)
+	}
+
+	wsurl := fmt.Sprintf("ws%v/pipelines/1/runs/%v/events", strings.TrimPrefix(ts.URL, "http"), run.Count)
+	conn, err := websocket.Dial(wsurl, "", ts.URL)
+	if err != nil {
+		t.Fatalf("got error opening websocket: %v", err)
+	}
+	defer conn.Close()
+
+	var ev statusEvent
+	if err := websocket.JSON.Receive(conn, &ev); err != nil {
+		t.Fatalf("got error reading snapshot: %v", err)
+	}
+
+	if ev.Type != statusSnapshot || ev.Run != run.Count {
+		t.Fatalf("expected snapshot of run %v first, got %+v", run.Count, ev)
+	}
+
+	status <- []byte(fmt.Sprintf(`{"seq": 1, "type": "task", "pipeline_id": 1, "run": %v, "step_id": 3, "data": {"id": 4}}`, run.Count))
+	status <- []byte(fmt.Sprintf(`{"seq": 2, "type": "run", "pipeline_id": 1, "run": %v,
+		"data": {"count": %v, "end": "2018-12-01T00:00:00Z", "success": true}}`, run.Count, run.Count))
+
+	if err := websocket.JSON.Receive(conn, &ev); err != nil {
+		t.Fatalf("got error reading task event: %v", err)
+	}
+
+	if ev.Type != statusTask || ev.Seq != 1 || ev.StepID != 3 {
+		t.Fatalf("expected task event of step 3, got %+v", ev)
+	}
+
+	if err := websocket.JSON.Receive(conn, &ev); err != nil {
+		t.Fatalf("got error reading run event: %v", err)
+	}
+
+	if ev.Type != statusRun || ev.Seq != 2 {
+		t.Fatalf("expected run event, got %+v", ev)
+	}
+
+	if err := websocket.JSON.Receive(conn, &ev); err != io.EOF {
+		t.Fatalf("expected websocket to be closed once run finished, got %v", err)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"strconv"
 
 	"github.com/gorilla/mux"
-	"github.com/run-ci/relay/store"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,7 +27,7 @@ func (srv *Server) handleGetTask(rw http.ResponseWriter, req *http.Request) {
 		err := errors.New("missing paramter 'id' from request")
 		logger.WithError(err).Error("unable to complete request")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -38,7 +37,7 @@ func (srv *Server) handleGetTask(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to parse id as integer")
 
-		writeErrResp(rw, err, http.StatusBadRequest)
+		writeErrResp(rw, req, err, http.StatusBadRequest)
 		return
 	}
 
@@ -46,15 +45,14 @@ func (srv *Server) handleGetTask(rw http.ResponseWriter, req *http.Request) {
 
 	logger.Debug("retrieving step from store")
 
-	task, err := srv.st.GetTask(reqSub, id)
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	task, err := srv.st.GetTask(ctx, reqSub, id)
 	if err != nil {
 		logger.WithError(err).Error("unable to retrieve task")
-		if err == store.ErrTaskNotFound {
-			writeErrResp(rw, err, http.StatusNotFound)
-			return
-		}
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, errStatus(err))
 		return
 	}
 
@@ -64,7 +62,7 @@ func (srv *Server) handleGetTask(rw http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		logger.WithError(err).Error("unable to marshal response body")
 
-		writeErrResp(rw, err, http.StatusInternalServerError)
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -17,52 +17,9 @@ import (
 // All requests should be scoped to the user, their group, or public projects. Right
 // now these tests don't test for that, and they should!
 
-func (st *memStore) GetTask(user string, id int) (store.Task, error) {
-	t, ok := st.taskdb[id]
-	if !ok {
-		return store.Task{}, store.ErrTaskNotFound
-	}
-
-	return t, nil
-}
-
-func (st *memStore) seedTasks() {
-	data := []struct {
-		id      int
-		name    string
-		success bool
-	}{
-		{
-			id:      1,
-			name:    "build",
-			success: true,
-		},
-		{
-			id:      2,
-			name:    "test",
-			success: true,
-		},
-		{
-			id:      3,
-			name:    "package",
-			success: false,
-		},
-	}
-
-	for _, d := range data {
-		st.taskdb[d.id] = store.Task{
-			ID:      d.id,
-			Name:    d.name,
-			Success: &d.success,
-		}
-	}
-}
-
 func TestGetTask(t *testing.T) {
-	st := &memStore{
-		taskdb: make(map[int]store.Task),
-	}
-	st.seedTasks()
+	st := seedStore(t)
+	success := true
 
 	srv := NewServer(":9001", make(chan []byte), st, "test")
 
@@ -72,10 +29,14 @@ func TestGetTask(t *testing.T) {
 		actual   store.Task
 		status   int
 	}{
-		input:    1,
-		expected: st.taskdb[1],
-		actual:   store.Task{},
-		status:   http.StatusOK,
+		input: 1,
+		expected: store.Task{
+			ID:      1,
+			Name:    "build",
+			Success: &success,
+		},
+		actual: store.Task{},
+		status: http.StatusOK,
 	}
 
 	r := mux.NewRouter()
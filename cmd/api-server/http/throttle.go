@@ -0,0 +1,232 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// These are the defaults of a LoginThrottle.
+const (
+	DefaultMaxLoginFailures   = 5
+	DefaultMaxIPLoginFailures = 20
+	DefaultLoginLockout       = 30 * time.Second
+	DefaultMaxLoginLockout    = time.Hour
+)
+
+// LoginThrottle slows down password guessing by locking out accounts, and
+// the addresses logins come from, after too many failed logins in a row.
+// Every failure past the limit doubles the lockout, up to MaxLockout.
+//
+// Failures are only counted in memory, so every API server counts its
+// own, and they're forgotten once there's been none for MaxLockout.
+type LoginThrottle struct {
+	// MaxFailures is how many times in a row logging into an account
+	// can fail before it's locked out. Logging in resets it.
+	MaxFailures int
+	// MaxIPFailures is how many times in a row logins from an address
+	// can fail before it's locked out. These are logins to any
+	// account, so it's higher than MaxFailures, and logging in doesn't
+	// reset it, or one account could be used to keep guessing the
+	// passwords of others.
+	MaxIPFailures int
+
+	// Lockout is how long the first lockout lasts.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+
+	now func() time.Time
+}
+
+type throttleEntry struct {
+	failures int
+	// pending counts the logins that are still being checked, which
+	// could all be failures.
+	pending int
+	last    time.Time
+	until   time.Time
+}
+
+// NewLoginThrottle returns a LoginThrottle with the defaults.
+func NewLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{
+		MaxFailures:   DefaultMaxLoginFailures,
+		MaxIPFailures: DefaultMaxIPLoginFailures,
+		Lockout:       DefaultLoginLockout,
+		MaxLockout:    DefaultMaxLoginLockout,
+		entries:       make(map[string]*throttleEntry),
+		now:           time.Now,
+	}
+}
+
+// Attempt starts a login to the account from the address, and returns how
+// long until logins to it, or from it, are let through again. It's zero
+// if this one is let through, and then it has to be settled with Fail,
+// Succeed or Release once it's been checked.
+//
+// Logins that are let through count towards the limits until they're
+// settled, so that guessing in parallel can't get more logins through
+// than guessing one at a time. Logins that the ones being checked could
+// lock out wait for the first lockout.
+func (t *LoginThrottle) Attempt(email, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	account, addr := t.entry(accountKey(email), now), t.entry(ipKey(ip), now)
+
+	var wait time.Duration
+	for _, lim := range []struct {
+		e   *throttleEntry
+		max int
+	}{{account, t.MaxFailures}, {addr, t.MaxIPFailures}} {
+		if lim.e.until.After(now) && lim.e.until.Sub(now) > wait {
+			wait = lim.e.until.Sub(now)
+		}
+
+		if lim.e.pending > 0 && lim.e.failures+lim.e.pending >= lim.max && t.Lockout > wait {
+			wait = t.Lockout
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	for _, e := range []*throttleEntry{account, addr} {
+		e.pending++
+		e.last = now
+	}
+
+	return 0
+}
+
+// Fail counts a failed login to the account from the address.
+func (t *LoginThrottle) Fail(email, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	t.fail(accountKey(email), t.MaxFailures, now)
+	t.fail(ipKey(ip), t.MaxIPFailures, now)
+
+	// Entries are only pruned on failures, which are what adds them.
+	for key, e := range t.entries {
+		if e.pending == 0 && now.Sub(e.last) > t.MaxLockout {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Succeed resets the failures of the account, and settles the login from
+// the address.
+func (t *LoginThrottle) Succeed(email, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	key := accountKey(email)
+	if e := t.entry(key, now); e.pending > 1 {
+		e.pending--
+		e.failures = 0
+		e.until = time.Time{}
+	} else {
+		delete(t.entries, key)
+	}
+
+	t.settle(ipKey(ip), now)
+}
+
+// Release settles a login that was neither a success nor a failure, like
+// when it couldn't be checked.
+func (t *LoginThrottle) Release(email, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	t.settle(accountKey(email), now)
+	t.settle(ipKey(ip), now)
+}
+
+func (t *LoginThrottle) fail(key string, max int, now time.Time) {
+	e := t.settle(key, now)
+
+	e.failures++
+	e.last = now
+
+	if e.failures < max {
+		return
+	}
+
+	lockout := t.MaxLockout
+	if shift := uint(e.failures - max); shift < 32 && t.Lockout<<shift < t.MaxLockout {
+		lockout = t.Lockout << shift
+	}
+
+	e.until = now.Add(lockout)
+}
+
+// settle stops counting a login that was being checked, and returns the
+// entry it was counted in.
+func (t *LoginThrottle) settle(key string, now time.Time) *throttleEntry {
+	e := t.entry(key, now)
+	if e.pending > 0 {
+		e.pending--
+	}
+
+	return e
+}
+
+// entry returns the entry with the key, adding it if there isn't one. Its
+// failures are forgotten once there's been none for MaxLockout.
+func (t *LoginThrottle) entry(key string, now time.Time) *throttleEntry {
+	e, ok := t.entries[key]
+	if !ok {
+		e = &throttleEntry{}
+		t.entries[key] = e
+	}
+
+	if now.Sub(e.last) > t.MaxLockout {
+		e.failures = 0
+		e.until = time.Time{}
+	}
+
+	return e
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP returns the address the request came from. Behind a proxy, that's
+// the last address in the header the proxy puts it in, if the server is
+// told which one that is. The ones before it are whatever the client sent
+// in the header, so they could be anything.
+func (srv *Server) clientIP(req *http.Request) string {
+	if srv.RealIPHeader != "" {
+		if hdr := req.Header.Get(srv.RealIPHeader); hdr != "" {
+			addrs := strings.Split(hdr, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
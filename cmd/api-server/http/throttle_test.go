@@ -0,0 +1,263 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/run-ci/relay/store"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Now()
+
+	th := NewLoginThrottle()
+	th.MaxFailures = 3
+	th.MaxIPFailures = 5
+	th.Lockout = time.Minute
+	th.MaxLockout = 10 * time.Minute
+	th.now = func() time.Time { return now }
+
+	fail := func(n int, email, ip string) {
+		for i := 0; i < n; i++ {
+			th.Fail(email, ip)
+		}
+	}
+
+	// Checking for a lockout starts a login, which has to be settled.
+	locked := func(email, ip string) time.Duration {
+		wait := th.Attempt(email, ip)
+		if wait == 0 {
+			th.Release(email, ip)
+		}
+
+		return wait
+	}
+
+	fail(2, "a@test", "10.0.0.1")
+	if wait := locked("a@test", "10.0.0.1"); wait != 0 {
+		t.Fatalf("expected no lockout under the limit, got %v", wait)
+	}
+
+	fail(1, "A@test", "10.0.0.1")
+	if wait := locked("a@test", "10.0.0.2"); wait != time.Minute {
+		t.Fatalf("expected account to be locked out for %v, got %v", time.Minute, wait)
+	}
+
+	// Every failure past the limit doubles the lockout, up to the max.
+	fail(2, "a@test", "10.0.0.1")
+	if wait := locked("a@test", "10.0.0.2"); wait != 4*time.Minute {
+		t.Fatalf("expected account to be locked out for %v, got %v", 4*time.Minute, wait)
+	}
+
+	fail(10, "a@test", "10.0.0.3")
+	if wait := locked("a@test", "10.0.0.2"); wait != 10*time.Minute {
+		t.Fatalf("expected account to be locked out for %v, got %v", 10*time.Minute, wait)
+	}
+
+	// Logging in resets the account, but not the address.
+	th.Succeed("a@test", "10.0.0.1")
+	if wait := locked("b@test", "10.0.0.1"); wait != time.Minute {
+		t.Fatalf("expected address to be locked out for %v, got %v", time.Minute, wait)
+	}
+
+	if wait := locked("a@test", "10.0.0.2"); wait != 0 {
+		t.Fatalf("expected account to be reset, got %v", wait)
+	}
+
+	// Failures are forgotten once there's been none for a while.
+	fail(2, "c@test", "10.0.0.4")
+	now = now.Add(11 * time.Minute)
+	fail(1, "c@test", "10.0.0.4")
+
+	if wait := locked("c@test", "10.0.0.1"); wait != 0 {
+		t.Fatalf("expected old failures to be forgotten, got %v", wait)
+	}
+
+	// Logins being checked count towards the limit, so guessing in
+	// parallel doesn't get more guesses in.
+	for i := 0; i < 3; i++ {
+		if wait := th.Attempt("d@test", "10.0.0.5"); wait != 0 {
+			t.Fatalf("expected login %v to be let through, got %v", i, wait)
+		}
+	}
+
+	if wait := th.Attempt("d@test", "10.0.0.6"); wait != time.Minute {
+		t.Fatalf("expected login past the ones being checked to wait %v, got %v", time.Minute, wait)
+	}
+
+	th.Fail("d@test", "10.0.0.5")
+	th.Succeed("d@test", "10.0.0.5")
+	th.Fail("d@test", "10.0.0.5")
+
+	if wait := locked("d@test", "10.0.0.6"); wait != 0 {
+		t.Fatalf("expected account to be reset by the login that succeeded, got %v", wait)
+	}
+
+	// Once a lockout is over, there's one more guess before the next.
+	fail(3, "e@test", "10.0.0.7")
+	now = now.Add(time.Minute)
+
+	if wait := th.Attempt("e@test", "10.0.0.8"); wait != 0 {
+		t.Fatalf("expected login to be let through after the lockout, got %v", wait)
+	}
+
+	if wait := th.Attempt("e@test", "10.0.0.9"); wait != time.Minute {
+		t.Fatalf("expected second login to wait %v, got %v", time.Minute, wait)
+	}
+
+	th.Fail("e@test", "10.0.0.8")
+	if wait := locked("e@test", "10.0.0.9"); wait != 2*time.Minute {
+		t.Fatalf("expected account to be locked out for %v, got %v", 2*time.Minute, wait)
+	}
+}
+
+func TestAuthThrottling(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	admin := true
+	if _, err := st.UpdateUser(ctx, testUser, store.UserUpdate{Admin: &admin}); err != nil {
+		t.Fatalf("got error making user an admin: %v", err)
+	}
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+	srv.Throttle.MaxFailures = 2
+	srv.RealIPHeader = "X-Forwarded-For"
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	auth := func(email, password, ip string) *http.Response {
+		// An empty password is left out, rather than being a password
+		// that's empty.
+		body := `{"email": "` + email + `"}`
+		if password != "" {
+			body = `{"email": "` + email + `", "password": "` + password + `"}`
+		}
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/auth", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+		// The proxy adds the address to whatever the client sent.
+		req.Header.Set("X-Forwarded-For", "10.0.0.254, "+ip)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		status   int
+	}{
+		{name: "missing password", email: testUser, status: http.StatusBadRequest},
+		{name: "wrong password", email: testUser, password: "nope", status: http.StatusBadRequest},
+		{name: "unknown user", email: "nobody@test", password: "nope", status: http.StatusBadRequest},
+		{name: "right password", email: testUser, password: "test", status: http.StatusOK},
+		{name: "wrong password after login", email: testUser, password: "nope", status: http.StatusBadRequest},
+		{name: "wrong password again", email: testUser, password: "nope", status: http.StatusBadRequest},
+		{name: "right password when locked out", email: testUser, password: "test", status: http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		if resp := auth(test.email, test.password, "192.0.2.1"); resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	if resp := auth(testUser, "test", "192.0.2.1"); resp.Header.Get("Retry-After") == "" {
+		t.Fatal("expected locked out login to say when to retry")
+	}
+
+	token, err := srv.signToken(testUser)
+	if err != nil {
+		t.Fatalf("got error signing token: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/failed-logins?email="+testUser, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+
+	logins := []store.FailedLogin{}
+	err = json.NewDecoder(resp.Body).Decode(&logins)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	reasons := []string{}
+	for _, l := range logins {
+		if l.IP != "192.0.2.1" || l.Email != testUser {
+			t.Fatalf("expected failed login from 192.0.2.1 to %v, got %+v", testUser, l)
+		}
+
+		reasons = append(reasons, l.Reason)
+	}
+
+	// Logins that were locked out never had their credentials checked,
+	// so they aren't recorded.
+	want := "bad credentials,bad credentials,bad credentials"
+	if strings.Join(reasons, ",") != want {
+		t.Fatalf("expected failed logins %v, got %v", want, reasons)
+	}
+}
+
+// brokenAuthenticator is an authenticator that can't reach whatever it
+// checks credentials against.
+type brokenAuthenticator struct{}
+
+func (brokenAuthenticator) Authenticate(ctx context.Context, user, pass string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func TestAuthOutage(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+	srv.Throttle.MaxFailures = 1
+	srv.Authenticator = brokenAuthenticator{}
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// Not being able to check the credentials isn't a failed login, so
+	// it doesn't lock anyone out either.
+	for i := 0; i < 2; i++ {
+		body := `{"email": "` + testUser + `", "password": "test"}`
+		resp, err := http.Post(ts.URL+"/auth", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("expected status code %v, got %v", http.StatusInternalServerError, resp.StatusCode)
+		}
+	}
+
+	logins, err := st.GetFailedLogins(ctx, testUser, 10)
+	if err != nil {
+		t.Fatalf("got error getting failed logins: %v", err)
+	}
+
+	if len(logins) != 0 {
+		t.Fatalf("expected no failed logins, got %+v", logins)
+	}
+}
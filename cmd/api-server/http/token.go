@@ -0,0 +1,176 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+	"github.com/sirupsen/logrus"
+)
+
+func (srv *Server) handleCreateAccessToken(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var token store.AccessToken
+	err = json.Unmarshal(buf, &token)
+	if err != nil {
+		logger.WithError(err).Error("unable to unmarshal request body")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	if token.Name == "" {
+		err := invalidField("name", "access token name can't be empty")
+		logger.WithError(err).Error("invalid access token")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if token.ExpiresAt != nil && !token.ExpiresAt.After(time.Now()) {
+		err := invalidField("expires_at", "access token can't expire in the past")
+		logger.WithError(err).Error("invalid access token")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// An access token can't be used to hand out one that can do
+	// more than it can.
+	if scopes, ok := req.Context().Value(keyReqScopes).([]store.Scope); ok {
+		for _, s := range token.Scopes {
+			if !(store.AccessToken{Scopes: scopes}).Allows(s) {
+				err := errors.New("access token can't have scopes the request doesn't")
+				logger.WithError(err).Error("invalid access token")
+
+				writeErrResp(rw, req, err, http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	token.User = reqSub
+
+	logger = logger.WithField("token", token.Name)
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Info("saving access token")
+	err = srv.st.CreateAccessToken(ctx, &token)
+	if err != nil {
+		logger.WithError(err).Error("unable to save access token")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err = json.Marshal(token)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleGetAccessTokens(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("retrieving access tokens from database")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	tokens, err := srv.st.GetAccessTokens(ctx, reqSub)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve access tokens from database")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err := json.Marshal(tokens)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal JSON response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleRevokeAccessToken(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for id")
+	raw, ok := mux.Vars(req)["id"]
+	if !ok || raw == "" {
+		err := errors.New("missing paramter 'id' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse access token id as integer")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("token_id", id)
+
+	logger.Info("revoking access token")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	err = srv.st.RevokeAccessToken(ctx, reqSub, id)
+	if err != nil {
+		logger.WithError(err).Error("unable to revoke access token")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/run-ci/relay/store"
+)
+
+func TestAccessTokens(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	// The server's own router is used so requests go through checkAuth
+	// and the scopes of every route.
+	srv := NewServer(":9001", make(chan []byte, 10), st, "test")
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	mint := func(name string, scopes []store.Scope, expires *time.Time) store.AccessToken {
+		tok := store.AccessToken{Name: name, User: testUser, Scopes: scopes, ExpiresAt: expires}
+		if err := st.CreateAccessToken(ctx, &tok); err != nil {
+			t.Fatalf("got error creating access token: %v", err)
+		}
+
+		return tok
+	}
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	reader := mint("reader", []store.Scope{store.ScopeRead}, nil)
+	writer := mint("writer", []store.Scope{store.ScopeRead, store.ScopeWrite}, &future)
+	expired := mint("expired", []store.Scope{store.ScopeRead}, &past)
+
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+
+		return resp
+	}
+
+	// These run in order against the same store, so later
+	// tests see the changes made by earlier ones.
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{name: "unknown token", method: http.MethodGet, path: "/projects", token: store.AccessTokenPrefix + "nope", status: http.StatusUnauthorized},
+		{name: "expired token", method: http.MethodGet, path: "/projects", token: expired.Token, status: http.StatusUnauthorized},
+		{name: "read scope reads", method: http.MethodGet, path: "/projects", token: reader.Token, status: http.StatusOK},
+		{name: "read scope writes", method: http.MethodDelete, path: "/pipelines/3", token: reader.Token, status: http.StatusForbidden},
+		{name: "read scope creates token", method: http.MethodPost, path: "/tokens", token: reader.Token, body: `{"name": "x", "scopes": ["read"]}`, status: http.StatusForbidden},
+		{name: "write scope writes", method: http.MethodDelete, path: "/pipelines/3", token: writer.Token, status: http.StatusNoContent},
+		{name: "write scope sets webhook secret", method: http.MethodPut, path: "/projects/1/git_remotes/" + base64.StdEncoding.EncodeToString([]byte("//test-a.git#master")) + "/webhook_secret", token: writer.Token, body: `{"secret": "shh"}`, status: http.StatusForbidden},
+		{name: "token widens scopes", method: http.MethodPost, path: "/tokens", token: writer.Token, body: `{"name": "x", "scopes": ["run"]}`, status: http.StatusForbidden},
+		{name: "token without scopes", method: http.MethodPost, path: "/tokens", token: writer.Token, body: `{"name": "x"}`, status: http.StatusUnprocessableEntity},
+		{name: "token without name", method: http.MethodPost, path: "/tokens", token: writer.Token, body: `{"scopes": ["read"]}`, status: http.StatusUnprocessableEntity},
+		{name: "token expiring in the past", method: http.MethodPost, path: "/tokens", token: writer.Token, body: `{"name": "x", "scopes": ["read"], "expires_at": "2000-01-01T00:00:00Z"}`, status: http.StatusUnprocessableEntity},
+		{name: "duplicate token name", method: http.MethodPost, path: "/tokens", token: writer.Token, body: `{"name": "reader", "scopes": ["read"]}`, status: http.StatusConflict},
+		{name: "revoke missing token", method: http.MethodDelete, path: "/tokens/100", token: writer.Token, status: http.StatusNotFound},
+		{name: "revoke token", method: http.MethodDelete, path: fmt.Sprintf("/tokens/%v", reader.ID), token: writer.Token, status: http.StatusNoContent},
+		{name: "revoked token", method: http.MethodGet, path: "/projects", token: reader.Token, status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		resp := do(test.method, test.path, test.token, test.body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	resp := do(http.MethodPost, "/tokens", writer.Token, `{"name": "bot", "scopes": ["read"]}`)
+	created := store.AccessToken{}
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusAccepted || created.Token == "" {
+		t.Fatalf("expected a new token with status %v, got %v and %+v", http.StatusAccepted, resp.StatusCode, created)
+	}
+
+	resp = do(http.MethodGet, "/tokens", created.Token, "")
+	listed := []map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if len(listed) != 3 {
+		t.Fatalf("expected 3 tokens, got %+v", listed)
+	}
+
+	for _, tok := range listed {
+		if _, ok := tok["token"]; ok {
+			t.Fatalf("expected listed tokens to be hidden, got %+v", tok)
+		}
+
+		if tok["name"] == "bot" && tok["last_used"] == nil {
+			t.Fatalf("expected token to be marked as used, got %+v", tok)
+		}
+	}
+
+	disabled := true
+	_, err = st.UpdateUser(ctx, testUser, store.UserUpdate{Disabled: &disabled})
+	if err != nil {
+		t.Fatalf("got error disabling user: %v", err)
+	}
+
+	resp = do(http.MethodGet, "/projects", created.Token, "")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected tokens of disabled users to be rejected, got %v", resp.StatusCode)
+	}
+}
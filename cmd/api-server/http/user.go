@@ -0,0 +1,367 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+	"github.com/sirupsen/logrus"
+)
+
+// requireAdmin only lets through requests from admin users. It has to
+// come after checkAuth in the chain.
+//
+// Whether someone is an admin is looked up on every request rather than
+// put in their token, so that taking it away works right away.
+func (srv *Server) requireAdmin(f http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		reqSub := req.Context().Value(keyReqSub).(string)
+		logger := logger.WithField("request_subject", reqSub)
+
+		ctx, cancel := srv.storeContext(req)
+		defer cancel()
+
+		user, err := srv.st.GetUser(ctx, reqSub)
+		if err != nil && err != store.ErrUserNotFound {
+			logger.WithError(err).Error("unable to look up request subject")
+
+			writeErrResp(rw, req, err, http.StatusInternalServerError)
+			return
+		}
+
+		if err == store.ErrUserNotFound || !user.Admin || user.Disabled {
+			err := errors.New("only admins can do that")
+			logger.WithError(err).Error("unable to authorize request")
+
+			writeErrResp(rw, req, err, http.StatusForbidden)
+			return
+		}
+
+		f(rw, req)
+	}
+}
+
+func (srv *Server) handleCreateUser(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var user store.User
+	err = json.Unmarshal(buf, &user)
+	if err != nil {
+		logger.WithError(err).Error("unable to unmarshal request body")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case user.Email == "":
+		err = invalidField("email", "users need an email")
+	case user.Password == "":
+		err = invalidField("password", "users need a password")
+	}
+	if err != nil {
+		logger.WithError(err).Error("invalid user")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger = logger.WithField("email", user.Email)
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Info("saving user")
+	err = srv.st.CreateUser(ctx, &user)
+	if err != nil {
+		logger.WithError(err).Error("unable to save user")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	user.Password = ""
+
+	buf, err = json.Marshal(user)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		// We've already processed the request and taken action on it,
+		// so returning an error response code here would be misleading.
+		writeErrResp(rw, req, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleGetUsers(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("retrieving users from database")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	users, err := srv.st.GetUsers(ctx)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve users from database")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err := json.Marshal(users)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal JSON response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleGetUser(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for email")
+	email, ok := mux.Vars(req)["email"]
+	if !ok || email == "" {
+		err := errors.New("missing paramter 'email' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	srv.writeUser(rw, req, logger.WithField("email", email), email)
+}
+
+// handleGetMe is GET /users/{email} for whoever is making the request,
+// and it's open to everyone, not just admins.
+func (srv *Server) handleGetMe(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	srv.writeUser(rw, req, logger, reqSub)
+}
+
+// writeUser looks up the user with the given email and writes it out as
+// the response.
+func (srv *Server) writeUser(rw http.ResponseWriter, req *http.Request, logger *logrus.Entry, email string) {
+	logger.Debug("retrieving user from database")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	user, err := srv.st.GetUser(ctx, email)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve user from database")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err := json.Marshal(user)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal JSON response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
+
+func (srv *Server) handleUpdateUser(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for email")
+	email, ok := mux.Vars(req)["email"]
+	if !ok || email == "" {
+		err := errors.New("missing paramter 'email' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("email", email)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var update store.UserUpdate
+	err = json.Unmarshal(buf, &update)
+	if err != nil {
+		logger.WithError(err).Error("unable to unmarshal request body")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	err = checkUserUpdate(reqSub, email, update)
+	if err != nil {
+		logger.WithError(err).Error("invalid user update")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger.Info("updating user")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	user, err := srv.st.UpdateUser(ctx, email, update)
+	if err != nil {
+		logger.WithError(err).Error("unable to update user")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	buf, err = json.Marshal(user)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		writeErrResp(rw, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+}
+
+// handleDeactivateUser disables the user. Users are never deleted, since
+// they own projects. A disabled user can't log in anymore, and the tokens
+// that were already handed out to them stop working.
+func (srv *Server) handleDeactivateUser(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	reqSub := req.Context().Value(keyReqSub).(string)
+	logger := logger.WithFields(logrus.Fields{
+		"request_id":      reqID,
+		"request_subject": reqSub,
+	})
+
+	logger.Debug("checking mux vars for email")
+	email, ok := mux.Vars(req)["email"]
+	if !ok || email == "" {
+		err := errors.New("missing paramter 'email' from request")
+		logger.WithError(err).Error("unable to complete request")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("email", email)
+
+	disabled := true
+	update := store.UserUpdate{Disabled: &disabled}
+
+	err := checkUserUpdate(reqSub, email, update)
+	if err != nil {
+		logger.WithError(err).Error("invalid user update")
+
+		writeErrResp(rw, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger.Info("deactivating user")
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	_, err = srv.st.UpdateUser(ctx, email, update)
+	if err != nil {
+		logger.WithError(err).Error("unable to deactivate user")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// checkUserUpdate makes sure an update the subject wants to make to the
+// user with the given email makes sense. Admins can't demote or disable
+// themselves, so there's always at least one admin left.
+func checkUserUpdate(sub, email string, u store.UserUpdate) error {
+	if u.Password != nil && *u.Password == "" {
+		return invalidField("password", "password can't be empty")
+	}
+
+	if u.Group != nil && u.Group.Name == "" {
+		return invalidField("group", "group name can't be empty")
+	}
+
+	if u.Groups != nil {
+		for _, g := range *u.Groups {
+			if g.Name == "" {
+				return invalidField("groups", "group name can't be empty")
+			}
+		}
+	}
+
+	if sub != email {
+		return nil
+	}
+
+	if u.Admin != nil && !*u.Admin {
+		return invalidField("admin", "admins can't demote themselves")
+	}
+
+	if u.Disabled != nil && *u.Disabled {
+		return invalidField("disabled", "admins can't disable themselves")
+	}
+
+	return nil
+}
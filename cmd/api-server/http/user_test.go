@@ -0,0 +1,185 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+)
+
+// seedUsers returns a store with admin@test, an admin, and user@test,
+// who isn't, both in group "test".
+func seedUsers(t *testing.T) *store.Memory {
+	ctx := context.Background()
+	st := store.NewMemory()
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("got error seeding store: %v", err)
+		}
+	}
+
+	must(st.CreateGroup(ctx, &store.Group{Name: "test"}))
+	must(st.CreateUser(ctx, &store.User{
+		Email:    "admin@test",
+		Password: "test",
+		Group:    store.Group{Name: "test"},
+		Admin:    true,
+	}))
+	must(st.CreateUser(ctx, &store.User{
+		Email:    testUser,
+		Password: "test",
+		Group:    store.Group{Name: "test"},
+	}))
+
+	return st
+}
+
+// userRouter routes the user and group endpoints like NewServer does,
+// with requests authenticated as the given user.
+func userRouter(srv *Server, user string) *mux.Router {
+	r := mux.NewRouter()
+
+	admin := func(h http.HandlerFunc) http.Handler {
+		return chain(h, setRequestID, authAs(user), srv.requireAdmin)
+	}
+
+	r.Handle("/me", chain(srv.handleGetMe, setRequestID, authAs(user))).
+		Methods(http.MethodGet)
+	r.Handle("/users", admin(srv.handleCreateUser)).Methods(http.MethodPost)
+	r.Handle("/users", admin(srv.handleGetUsers)).Methods(http.MethodGet)
+	r.Handle("/users/{email}", admin(srv.handleGetUser)).Methods(http.MethodGet)
+	r.Handle("/users/{email}", admin(srv.handleUpdateUser)).Methods(http.MethodPatch)
+	r.Handle("/users/{email}", admin(srv.handleDeactivateUser)).Methods(http.MethodDelete)
+	r.Handle("/groups", admin(srv.handleCreateGroup)).Methods(http.MethodPost)
+	r.Handle("/groups", admin(srv.handleGetGroups)).Methods(http.MethodGet)
+	r.Handle("/groups/{name}", admin(srv.handleDeleteGroup)).Methods(http.MethodDelete)
+
+	return r
+}
+
+func TestUserManagement(t *testing.T) {
+	st := seedUsers(t)
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	// These run in order against the same store, so later
+	// tests see the changes made by earlier ones.
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "me", user: testUser, method: http.MethodGet, path: "/me", status: http.StatusOK},
+		{name: "non-admin lists users", user: testUser, method: http.MethodGet, path: "/users", status: http.StatusForbidden},
+		{name: "non-admin creates group", user: testUser, method: http.MethodPost, path: "/groups", body: `{"name": "x"}`, status: http.StatusForbidden},
+		{name: "unknown subject", user: "ghost@test", method: http.MethodGet, path: "/users", status: http.StatusForbidden},
+		{name: "list users", user: "admin@test", method: http.MethodGet, path: "/users", status: http.StatusOK},
+		{name: "get missing user", user: "admin@test", method: http.MethodGet, path: "/users/ghost@test", status: http.StatusNotFound},
+		{name: "create group", user: "admin@test", method: http.MethodPost, path: "/groups", body: `{"name": "ops"}`, status: http.StatusAccepted},
+		{name: "create duplicate group", user: "admin@test", method: http.MethodPost, path: "/groups", body: `{"name": "ops"}`, status: http.StatusConflict},
+		{name: "create unnamed group", user: "admin@test", method: http.MethodPost, path: "/groups", body: `{}`, status: http.StatusUnprocessableEntity},
+		{name: "create user without password", user: "admin@test", method: http.MethodPost, path: "/users", body: `{"email": "new@test"}`, status: http.StatusUnprocessableEntity},
+		{name: "create user in missing group", user: "admin@test", method: http.MethodPost, path: "/users", body: `{"email": "new@test", "password": "pw", "group": {"name": "nope"}}`, status: http.StatusNotFound},
+		{name: "create user", user: "admin@test", method: http.MethodPost, path: "/users", body: `{"email": "new@test", "password": "pw", "group": {"name": "ops"}}`, status: http.StatusAccepted},
+		{name: "create duplicate user", user: "admin@test", method: http.MethodPost, path: "/users", body: `{"email": "new@test", "password": "pw", "group": {"name": "test"}}`, status: http.StatusConflict},
+		{name: "delete group in use", user: "admin@test", method: http.MethodDelete, path: "/groups/ops", status: http.StatusConflict},
+		{name: "move user", user: "admin@test", method: http.MethodPatch, path: "/users/new@test", body: `{"group": {"name": "test"}, "name": "New"}`, status: http.StatusOK},
+		{name: "add user to groups", user: "admin@test", method: http.MethodPatch, path: "/users/new@test", body: `{"groups": [{"name": "ops"}]}`, status: http.StatusOK},
+		{name: "add user to unnamed group", user: "admin@test", method: http.MethodPatch, path: "/users/new@test", body: `{"groups": [{}]}`, status: http.StatusUnprocessableEntity},
+		{name: "delete group with members", user: "admin@test", method: http.MethodDelete, path: "/groups/ops", status: http.StatusConflict},
+		{name: "drop user from groups", user: "admin@test", method: http.MethodPatch, path: "/users/new@test", body: `{"groups": []}`, status: http.StatusOK},
+		{name: "move user to missing group", user: "admin@test", method: http.MethodPatch, path: "/users/new@test", body: `{"group": {"name": "nope"}}`, status: http.StatusNotFound},
+		{name: "delete emptied group", user: "admin@test", method: http.MethodDelete, path: "/groups/ops", status: http.StatusNoContent},
+		{name: "delete missing group", user: "admin@test", method: http.MethodDelete, path: "/groups/ops", status: http.StatusNotFound},
+		{name: "demote self", user: "admin@test", method: http.MethodPatch, path: "/users/admin@test", body: `{"admin": false}`, status: http.StatusUnprocessableEntity},
+		{name: "deactivate self", user: "admin@test", method: http.MethodDelete, path: "/users/admin@test", status: http.StatusUnprocessableEntity},
+		{name: "promote user", user: "admin@test", method: http.MethodPatch, path: "/users/" + testUser, body: `{"admin": true}`, status: http.StatusOK},
+		{name: "promoted user lists groups", user: testUser, method: http.MethodGet, path: "/groups", status: http.StatusOK},
+		{name: "deactivate user", user: "admin@test", method: http.MethodDelete, path: "/users/new@test", status: http.StatusNoContent},
+		{name: "deactivate missing user", user: "admin@test", method: http.MethodDelete, path: "/users/ghost@test", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(userRouter(srv, test.user))
+
+		req, err := http.NewRequest(test.method, ts.URL+test.path, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatalf("%v: error creating http request for test: %v", test.name, err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v: error executing test against test server: %v", test.name, err)
+		}
+		resp.Body.Close()
+		ts.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+
+	ctx := context.Background()
+
+	user, err := st.GetUser(ctx, "new@test")
+	if err != nil {
+		t.Fatalf("got error getting user: %v", err)
+	}
+
+	expected := store.User{
+		Name:     "New",
+		Email:    "new@test",
+		Group:    store.Group{Name: "test"},
+		Groups:   []store.Group{{Name: "test"}},
+		Disabled: true,
+	}
+	if !reflect.DeepEqual(user, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, user)
+	}
+
+	err = st.Authenticate(ctx, "new@test", "pw")
+	if err != store.ErrNotAuthenticated {
+		t.Fatalf("expected deactivated user to fail authentication, got %v", err)
+	}
+}
+
+func TestGetMe(t *testing.T) {
+	st := seedUsers(t)
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	ts := httptest.NewServer(userRouter(srv, testUser))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/me")
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	actual := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&actual)
+	if err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if actual["email"] != testUser {
+		t.Fatalf("expected email %v, got %v", testUser, actual["email"])
+	}
+
+	if _, ok := actual["password"]; ok {
+		t.Fatalf("expected no password in response, got %v", actual["password"])
+	}
+}
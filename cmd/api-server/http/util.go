@@ -2,26 +2,83 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/run-ci/relay/store"
 	"github.com/sirupsen/logrus"
 )
 
-func writeErrResp(rw http.ResponseWriter, err error, status int) {
-	rw.WriteHeader(status)
+// parseLimit reads the "limit" query parameter. It's zero if the
+// parameter isn't set, leaving the store to pick the default.
+func parseLimit(req *http.Request) (int, error) {
+	raw := req.URL.Query().Get("limit")
+	if raw == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 0 {
+		return 0, errors.New("invalid 'limit' parameter")
+	}
+
+	return limit, nil
+}
+
+// parseListFilter reads a store.ListFilter out of the "name", "sort",
+// "order", "cursor" and "limit" query parameters.
+func parseListFilter(req *http.Request) (store.ListFilter, error) {
+	q := req.URL.Query()
+
+	f := store.ListFilter{
+		Name:  q.Get("name"),
+		Sort:  store.SortField(q.Get("sort")),
+		Order: store.Order(q.Get("order")),
+		After: q.Get("cursor"),
+	}
 
-	buf, err := json.Marshal(map[string]string{
-		"error": err.Error(),
-	})
+	var err error
+	f.Limit, err = parseLimit(req)
+
+	return f, err
+}
+
+// notifyPoller tells the pollers about a change to a Git remote. The op
+// is what happened to the remote, like "create" or "delete".
+func (srv *Server) notifyPoller(logger *logrus.Entry, op, url, branch string) {
+	msg := map[string]string{
+		"op":     op,
+		"remote": url,
+		"branch": branch,
+	}
+	rawmsg, err := json.Marshal(msg)
 	if err != nil {
+		logger.WithField("error", err).
+			Warnf("unable to marshal poller %v message", op)
 		return
 	}
 
-	rw.Write(buf)
-	return
+	// Not being able to send to the poller is not enough to cause the
+	// request to fail. For this reason, we should try as hard as possible
+	// to send the request.
+	go sendWithBackoff(logger, srv.pollch, rawmsg)
+}
+
+// setNextLink points the client at the next page of a list with a Link
+// header. The next page's URL is the same as the request's, with the
+// cursor swapped out.
+func setNextLink(rw http.ResponseWriter, req *http.Request, cursor string) {
+	u := *req.URL
+	q := u.Query()
+	q.Set("cursor", cursor)
+	u.RawQuery = q.Encode()
+
+	rw.Header().Set("Link", fmt.Sprintf("<%v>; rel=\"next\"", u.RequestURI()))
 }
 
 func sendWithBackoff(logger *logrus.Entry, ch chan<- []byte, msg []byte) {
@@ -37,7 +94,7 @@ func sendWithBackoff(logger *logrus.Entry, ch chan<- []byte, msg []byte) {
 			base := math.Pow(float64(2), float64(i))
 			backoff := time.Duration(jitter.Intn(int(base))) * time.Second
 
-			logger.Warnf("unable to send poller create message, sleeping for %v", backoff)
+			logger.Warnf("unable to send poller message, sleeping for %v", backoff)
 			time.Sleep(backoff)
 		}
 	}
@@ -0,0 +1,439 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/relay/store"
+	"github.com/sirupsen/logrus"
+)
+
+// maxHookBody is the most that's read of a webhook's body. It's what
+// GitHub caps its payloads at.
+const maxHookBody = 25 << 20
+
+var (
+	errUnknownHookProvider = errors.New("unknown webhook provider")
+	errBadHookSignature    = errors.New("webhook signature doesn't match any git remote")
+)
+
+// hookEvent is what a webhook says happened, whichever host it's from.
+type hookEvent struct {
+	// URLs are every URL the repository goes by, since its Git remotes
+	// could have been saved with any of them.
+	URLs   []string
+	Branch string
+	Commit string
+}
+
+// hookProvider is a Git host that sends webhooks.
+type hookProvider interface {
+	// parse returns what the webhook says happened. It returns false
+	// for events that don't start runs, like pings, tags and deleted
+	// branches.
+	parse(req *http.Request, body []byte) (hookEvent, bool, error)
+	// verify returns whether the webhook was sent with the secret.
+	verify(req *http.Request, body []byte, secret string) bool
+}
+
+var hookProviders = map[string]hookProvider{
+	"github": githubHook{},
+	"gitea":  giteaHook{},
+	"gitlab": gitlabHook{},
+}
+
+// handleWebhook starts runs of the pipelines of the Git remotes that a
+// push or a pull request is for. It isn't authenticated like the rest of
+// the API. Instead, the webhook has to be signed with the secret of the
+// remotes it starts runs for.
+func (srv *Server) handleWebhook(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	if srv.Runs == nil {
+		logger.WithError(errNoRunQueue).Error("unable to handle webhook")
+
+		writeErrResp(rw, req, errNoRunQueue, http.StatusServiceUnavailable)
+		return
+	}
+
+	name := mux.Vars(req)["provider"]
+	hp, ok := hookProviders[name]
+	if !ok {
+		logger.WithError(errUnknownHookProvider).Error("unable to handle webhook")
+
+		writeErrResp(rw, req, errUnknownHookProvider, http.StatusNotFound)
+		return
+	}
+
+	logger = logger.WithField("provider", name)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxHookBody))
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug("parsing webhook")
+
+	ev, ok, err := hp.parse(req, buf)
+	if err != nil {
+		logger.WithError(err).Error("unable to parse webhook")
+
+		writeErrResp(rw, req, err, http.StatusBadRequest)
+		return
+	}
+
+	if !ok {
+		logger.Debug("webhook doesn't start runs, ignoring it")
+
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"branch": ev.Branch,
+		"commit": ev.Commit,
+	})
+
+	ctx, cancel := srv.storeContext(req)
+	defer cancel()
+
+	logger.Debug("retrieving git remotes from store")
+
+	remotes, err := srv.st.GetHookRemotes(ctx, ev.URLs, ev.Branch)
+	if err != nil {
+		logger.WithError(err).Error("unable to retrieve git remotes")
+
+		writeErrResp(rw, req, err, errStatus(err))
+		return
+	}
+
+	// Not matching any remote and not being signed by any of them look
+	// the same, so that which repositories have webhooks isn't leaked.
+	verified := []store.HookRemote{}
+	for _, remote := range remotes {
+		if hp.verify(req, buf, remote.Secret) {
+			verified = append(verified, remote)
+		}
+	}
+
+	if len(verified) == 0 {
+		logger.WithError(errBadHookSignature).Error("unable to handle webhook")
+
+		writeErrResp(rw, req, errBadHookSignature, http.StatusUnauthorized)
+		return
+	}
+
+	// Runs that were sent aren't taken back, so the webhook only fails if
+	// none of them were. Otherwise the Git host would send it again, and
+	// they'd be run twice.
+	runs := []store.Run{}
+	var failed error
+	var status int
+	for _, remote := range verified {
+		for _, pipeline := range remote.Pipelines {
+			logger := logger.WithFields(logrus.Fields{
+				"git_remote": remote.URL,
+				"pid":        pipeline.ID,
+			})
+
+			if len(pipeline.Definition) == 0 {
+				logger.WithError(errNoSteps).Warn("unable to start run, skipping pipeline")
+				continue
+			}
+
+			logger.Info("queuing run")
+
+			run := store.Run{
+				PipelineID: pipeline.ID,
+				Branch:     ev.Branch,
+				Commit:     ev.Commit,
+				Definition: pipeline.Definition,
+			}
+
+			err := srv.st.CreateRun(ctx, &run)
+			if err != nil {
+				logger.WithError(err).Error("unable to queue run, skipping pipeline")
+
+				failed, status = err, errStatus(err)
+				continue
+			}
+
+			code, err := srv.publishRun(ctx, logger.WithField("count", run.Count), pipeline, run)
+			if err != nil {
+				failed, status = err, code
+				continue
+			}
+
+			runs = append(runs, run)
+		}
+	}
+
+	if len(runs) == 0 && failed != nil {
+		writeErrResp(rw, req, failed, status)
+		return
+	}
+
+	buf, err = json.Marshal(runs)
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal response body")
+
+		// We've already processed the request and taken action on it,
+		// so returning an error response code here would be misleading.
+		writeErrResp(rw, req, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+}
+
+// githubHook is GitHub, which signs webhooks with an HMAC-SHA256 of the
+// body, in hex, prefixed with "sha256=".
+type githubHook struct{}
+
+func (githubHook) parse(req *http.Request, body []byte) (hookEvent, bool, error) {
+	return parseGitHubPayload(req.Header.Get("X-GitHub-Event"), body)
+}
+
+func (githubHook) verify(req *http.Request, body []byte, secret string) bool {
+	sig := req.Header.Get("X-Hub-Signature-256")
+	if !strings.HasPrefix(sig, "sha256=") {
+		return false
+	}
+
+	return validMAC(body, strings.TrimPrefix(sig, "sha256="), secret)
+}
+
+// giteaHook is Gitea, which sends the same payloads as GitHub, and signs
+// them the same way, but without the prefix.
+type giteaHook struct{}
+
+func (giteaHook) parse(req *http.Request, body []byte) (hookEvent, bool, error) {
+	return parseGitHubPayload(req.Header.Get("X-Gitea-Event"), body)
+}
+
+func (giteaHook) verify(req *http.Request, body []byte, secret string) bool {
+	return validMAC(body, req.Header.Get("X-Gitea-Signature"), secret)
+}
+
+// gitlabHook is GitLab, which doesn't sign webhooks. It sends the secret
+// as it is instead.
+type gitlabHook struct{}
+
+func (gitlabHook) parse(req *http.Request, body []byte) (hookEvent, bool, error) {
+	return parseGitLabPayload(req.Header.Get("X-Gitlab-Event"), body)
+}
+
+func (gitlabHook) verify(req *http.Request, body []byte, secret string) bool {
+	token := req.Header.Get("X-Gitlab-Token")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// githubPayload is the part of GitHub's push and pull request payloads
+// that runs are started from.
+type githubPayload struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+
+	Action      string `json:"action"`
+	PullRequest struct {
+		Head struct {
+			SHA  string      `json:"sha"`
+			Repo *githubRepo `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref  string      `json:"ref"`
+			Repo *githubRepo `json:"repo"`
+		} `json:"base"`
+	} `json:"pull_request"`
+
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		GitURL   string `json:"git_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// githubRepo is the repository a pull request is from, or into. It's
+// null for pull requests from forks that were deleted.
+type githubRepo struct {
+	ID int `json:"id"`
+}
+
+// parseGitHubPayload returns what happened for push and pull request
+// events. Pull requests are run on the branch they're into, with the
+// commit they'd bring in. Pull requests from forks are left alone, since
+// their commits aren't in the repository that's cloned for the run.
+func parseGitHubPayload(event string, body []byte) (hookEvent, bool, error) {
+	switch event {
+	case "push", "pull_request":
+	default:
+		return hookEvent{}, false, nil
+	}
+
+	var p githubPayload
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return hookEvent{}, false, err
+	}
+
+	repo := p.Repository
+	ev := hookEvent{URLs: hookURLs(repo.CloneURL, repo.SSHURL, repo.GitURL, repo.HTMLURL)}
+
+	if event == "push" {
+		branch, ok := branchOf(p.Ref)
+		if !ok || p.Deleted || zeroSHA(p.After) {
+			return hookEvent{}, false, nil
+		}
+
+		ev.Branch, ev.Commit = branch, p.After
+		return ev, true, nil
+	}
+
+	// Gitea says "synchronized" where GitHub says "synchronize".
+	switch p.Action {
+	case "opened", "reopened", "synchronize", "synchronized":
+	default:
+		return hookEvent{}, false, nil
+	}
+
+	pr := p.PullRequest
+	if pr.Head.Repo == nil || pr.Base.Repo == nil || pr.Head.Repo.ID != pr.Base.Repo.ID {
+		return hookEvent{}, false, nil
+	}
+
+	ev.Branch, ev.Commit = pr.Base.Ref, pr.Head.SHA
+	return ev, true, nil
+}
+
+// gitlabPayload is the part of GitLab's push and merge request payloads
+// that runs are started from.
+type gitlabPayload struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+
+	ObjectAttributes struct {
+		Action          string `json:"action"`
+		TargetBranch    string `json:"target_branch"`
+		SourceProjectID int    `json:"source_project_id"`
+		TargetProjectID int    `json:"target_project_id"`
+		LastCommit      struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+// parseGitLabPayload returns what happened for push and merge request
+// events, like parseGitHubPayload.
+func parseGitLabPayload(event string, body []byte) (hookEvent, bool, error) {
+	switch event {
+	case "Push Hook", "Merge Request Hook":
+	default:
+		return hookEvent{}, false, nil
+	}
+
+	var p gitlabPayload
+	err := json.Unmarshal(body, &p)
+	if err != nil {
+		return hookEvent{}, false, err
+	}
+
+	proj := p.Project
+	ev := hookEvent{URLs: hookURLs(proj.GitHTTPURL, proj.GitSSHURL, proj.WebURL)}
+
+	if event == "Push Hook" {
+		branch, ok := branchOf(p.Ref)
+		if !ok || zeroSHA(p.After) {
+			return hookEvent{}, false, nil
+		}
+
+		ev.Branch, ev.Commit = branch, p.After
+		return ev, true, nil
+	}
+
+	attrs := p.ObjectAttributes
+	switch attrs.Action {
+	case "open", "reopen", "update":
+	default:
+		return hookEvent{}, false, nil
+	}
+
+	if attrs.SourceProjectID != attrs.TargetProjectID {
+		return hookEvent{}, false, nil
+	}
+
+	ev.Branch, ev.Commit = attrs.TargetBranch, attrs.LastCommit.ID
+	return ev, true, nil
+}
+
+// validMAC returns whether sig is the hex HMAC-SHA256 of the body with the
+// secret.
+func validMAC(body []byte, sig, secret string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil || len(got) == 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// branchOf returns the branch the ref is for, if it's one.
+func branchOf(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, "refs/heads/") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(ref, "refs/heads/"), true
+}
+
+// zeroSHA returns whether the commit is the one hosts send for branches
+// that were deleted.
+func zeroSHA(sha string) bool {
+	return strings.Trim(sha, "0") == ""
+}
+
+// hookURLs returns the URLs, with and without a ".git" on the end, since
+// a remote could have been saved either way.
+func hookURLs(urls ...string) []string {
+	ret := []string{}
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+
+		url = strings.TrimSuffix(url, ".git")
+		for _, u := range []string{url, url + ".git"} {
+			if !seen[u] {
+				seen[u] = true
+				ret = append(ret, u)
+			}
+		}
+	}
+
+	return ret
+}
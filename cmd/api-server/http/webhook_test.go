@@ -0,0 +1,254 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/run-ci/relay/store"
+)
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	st := seedStore(t)
+
+	steps := `[{"name":"default","tasks":[]}]`
+	if err := st.SetPipelineDefinition(ctx, 1, []byte(steps)); err != nil {
+		t.Fatalf("got error setting pipeline definition: %v", err)
+	}
+
+	srv := NewServer(":9001", make(chan []byte), st, "test")
+
+	runs := make(chan []byte, 10)
+	srv.Runs = runs
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	token, err := srv.signToken(testUser)
+	if err != nil {
+		t.Fatalf("got error signing token: %v", err)
+	}
+
+	// Webhooks are turned on by giving the remote a secret.
+	id := base64.StdEncoding.EncodeToString([]byte("//test-a.git#master"))
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/projects/1/git_remotes/"+id+"/webhook_secret",
+		strings.NewReader(`{"secret": "shh"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status code %v setting webhook secret, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+
+	sign := func(body, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	push := `{"ref": "refs/heads/master", "after": "abc123", "repository": {"clone_url": "//test-a"}}`
+	deleted := `{"ref": "refs/heads/master", "after": "0000000000000000000000000000000000000000", "deleted": true,
+		"repository": {"clone_url": "//test-a"}}`
+	tag := `{"ref": "refs/tags/v1", "after": "abc123", "repository": {"clone_url": "//test-a"}}`
+	other := `{"ref": "refs/heads/master", "after": "abc123", "repository": {"clone_url": "//other"}}`
+	pr := `{"action": "synchronized", "pull_request": {"head": {"sha": "def456", "repo": {"id": 1}},
+		"base": {"ref": "master", "repo": {"id": 1}}}, "repository": {"clone_url": "//test-a.git"}}`
+	closed := `{"action": "closed", "pull_request": {"head": {"sha": "def456", "repo": {"id": 1}},
+		"base": {"ref": "master", "repo": {"id": 1}}}, "repository": {"clone_url": "//test-a.git"}}`
+	fork := `{"action": "opened", "pull_request": {"head": {"sha": "def456", "repo": {"id": 2}},
+		"base": {"ref": "master", "repo": {"id": 1}}}, "repository": {"clone_url": "//test-a.git"}}`
+	mr := `{"object_attributes": {"action": "open", "target_branch": "master", "source_project_id": 1,
+		"target_project_id": 1, "last_commit": {"id": "fed789"}}, "project": {"git_http_url": "//test-a.git"}}`
+	forkMR := `{"object_attributes": {"action": "open", "target_branch": "master", "source_project_id": 2,
+		"target_project_id": 1, "last_commit": {"id": "fed789"}}, "project": {"git_http_url": "//test-a.git"}}`
+
+	tests := []struct {
+		name     string
+		provider string
+		headers  map[string]string
+		body     string
+		status   int
+		commit   string
+	}{
+		{
+			name: "github push", provider: "github", body: push,
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(push, "shh")},
+			status:  http.StatusAccepted, commit: "abc123",
+		},
+		{
+			name: "wrong secret", provider: "github", body: push,
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(push, "nope")},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name: "unsigned", provider: "github", body: push,
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name: "unknown remote", provider: "github", body: other,
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(other, "shh")},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name: "ping", provider: "github", body: `{"zen": "Keep it simple."}`,
+			headers: map[string]string{"X-GitHub-Event": "ping"},
+			status:  http.StatusNoContent,
+		},
+		{
+			name: "deleted branch", provider: "github", body: deleted,
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(deleted, "shh")},
+			status:  http.StatusNoContent,
+		},
+		{
+			name: "tag", provider: "github", body: tag,
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(tag, "shh")},
+			status:  http.StatusNoContent,
+		},
+		{
+			name: "bad json", provider: "github", body: `{"ref": `,
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name: "gitea pull request", provider: "gitea", body: pr,
+			headers: map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Signature": sign(pr, "shh")},
+			status:  http.StatusAccepted, commit: "def456",
+		},
+		{
+			name: "gitea closed pull request", provider: "gitea", body: closed,
+			headers: map[string]string{"X-Gitea-Event": "pull_request", "X-Gitea-Signature": sign(closed, "shh")},
+			status:  http.StatusNoContent,
+		},
+		{
+			name: "github pull request from a fork", provider: "github", body: fork,
+			headers: map[string]string{"X-GitHub-Event": "pull_request", "X-Hub-Signature-256": "sha256=" + sign(fork, "shh")},
+			status:  http.StatusNoContent,
+		},
+		{
+			name: "gitlab merge request from a fork", provider: "gitlab", body: forkMR,
+			headers: map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": "shh"},
+			status:  http.StatusNoContent,
+		},
+		{
+			name: "gitlab merge request", provider: "gitlab", body: mr,
+			headers: map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": "shh"},
+			status:  http.StatusAccepted, commit: "fed789",
+		},
+		{
+			name: "gitlab wrong token", provider: "gitlab", body: mr,
+			headers: map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": "nope"},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name: "unknown provider", provider: "bitbucket", body: push,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/webhooks/"+test.provider, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("error creating http request for test: %v", err)
+		}
+
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing test against test server: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: expected status code %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+
+		if test.commit == "" {
+			if len(runs) != 0 {
+				t.Fatalf("%v: expected no runs to be started, got %v", test.name, len(runs))
+			}
+
+			continue
+		}
+
+		// Pipeline 2 is on the same remote, but hasn't been run, so it
+		// doesn't have any steps to run.
+		if len(runs) != 1 {
+			t.Fatalf("%v: expected one run to be started, got %v", test.name, len(runs))
+		}
+
+		var ev runEvent
+		if err := json.Unmarshal(<-runs, &ev); err != nil {
+			t.Fatalf("%v: got error unmarshaling run event: %v", test.name, err)
+		}
+
+		if ev.PipelineID != 1 || ev.GitRemote.Branch != "master" || ev.Commit != test.commit || string(ev.Steps) != steps {
+			t.Fatalf("%v: expected run of pipeline 1 on commit %v, got %+v", test.name, test.commit, ev)
+		}
+
+		run, err := st.GetRun(ctx, testUser, 1, ev.Run)
+		if err != nil {
+			t.Fatalf("%v: got error getting queued run: %v", test.name, err)
+		}
+
+		if run.Commit != test.commit || run.Start != nil {
+			t.Fatalf("%v: expected queued run on commit %v, got %+v", test.name, test.commit, run)
+		}
+	}
+
+	// Runs that were sent aren't undone when later ones can't be, so
+	// the webhook still works and isn't sent again.
+	if err := st.SetPipelineDefinition(ctx, 2, []byte(steps)); err != nil {
+		t.Fatalf("got error setting pipeline definition: %v", err)
+	}
+
+	srv.Runs = make(chan []byte, 1)
+	srv.StoreTimeout = 50 * time.Millisecond
+
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/webhooks/github", strings.NewReader(push))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", "sha256="+sign(push, "shh"))
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error executing test against test server: %v", err)
+	}
+
+	sent := []store.Run{}
+	err = json.NewDecoder(resp.Body).Decode(&sent)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusAccepted || len(sent) != 1 {
+		t.Fatalf("expected status code %v with the one run that was sent, got %v and %+v",
+			http.StatusAccepted, resp.StatusCode, sent)
+	}
+
+	page, err := st.ListRuns(ctx, testUser, 3-sent[0].PipelineID, store.RunFilter{Limit: 1})
+	if err != nil {
+		t.Fatalf("got error listing runs: %v", err)
+	}
+
+	if len(page.Runs) != 1 || page.Runs[0].End == nil || !page.Runs[0].Failed() {
+		t.Fatalf("expected run that wasn't sent to have failed, got %+v", page.Runs)
+	}
+}
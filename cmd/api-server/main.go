@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/run-ci/relay/authn"
 	"github.com/run-ci/relay/cmd/api-server/http"
 	"github.com/run-ci/relay/cmd/api-server/queue"
 	"github.com/run-ci/relay/store"
@@ -15,7 +20,11 @@ import (
 
 var logger *logrus.Entry
 
-var pgconnstr, natsURL, jwtsecret string
+var storeType, pgconnstr, natsURL, jwtsecret, jwtIssuer string
+var adminEmail, adminPassword string
+var storeTimeout, jwtTTL, refreshTTL time.Duration
+var pgmigrate bool
+var jwtKeys *http.KeySet
 
 func init() {
 	lvl, err := logrus.ParseLevel(os.Getenv("RELAY_LOG_LEVEL"))
@@ -27,6 +36,102 @@ func init() {
 
 	logger = logrus.WithField("package", "main")
 
+	storeType = os.Getenv("RELAY_STORE")
+	if storeType == "" {
+		storeType = "postgres"
+	}
+
+	storeTimeout = envDuration("RELAY_STORE_TIMEOUT", http.DefaultStoreTimeout)
+
+	if storeType == "postgres" {
+		pgconnstr = initpg()
+
+		// Migrating on boot is the default so that deploying a new
+		// build is enough to get the schema it needs.
+		pgmigrate = os.Getenv("RELAY_POSTGRES_MIGRATE") != "false"
+	}
+
+	// Nobody can make the first admin through the API, so it's made
+	// from these on boot. Nothing is kept in the memory store, so it
+	// needs them every time.
+	adminEmail = os.Getenv("RELAY_ADMIN_EMAIL")
+	adminPassword = os.Getenv("RELAY_ADMIN_PASSWORD")
+	if (adminEmail == "") != (adminPassword == "") {
+		logger.Fatal("need both RELAY_ADMIN_EMAIL and RELAY_ADMIN_PASSWORD, or neither")
+	}
+
+	if storeType == "memory" && adminEmail == "" {
+		logger.Fatal("need RELAY_ADMIN_EMAIL and RELAY_ADMIN_PASSWORD with RELAY_STORE=memory")
+	}
+
+	natsURL = os.Getenv("RELAY_NATS_URL")
+	if natsURL == "" {
+		logger.Warnf("setting NATS url to %v", nats.DefaultURL)
+		natsURL = nats.DefaultURL
+	}
+
+	jwtsecret = os.Getenv("RELAY_JWT_SECRET")
+
+	if dir := os.Getenv("RELAY_JWT_KEYS_DIR"); dir != "" {
+		var err error
+		jwtKeys, err = http.LoadKeySet(dir, os.Getenv("RELAY_JWT_SIGNING_KEY"))
+		if err != nil {
+			logger.WithError(err).Fatal("unable to load JWT keys")
+		}
+	}
+
+	if jwtsecret == "" && jwtKeys == nil {
+		// Anyone can sign tokens with an empty secret, so booting
+		// with one has to be asked for.
+		if os.Getenv("RELAY_JWT_INSECURE") != "true" {
+			logger.Fatal("need RELAY_JWT_SECRET or RELAY_JWT_KEYS_DIR, or RELAY_JWT_INSECURE=true")
+		}
+
+		logger.Warn("RELAY_JWT_SECRET not set - defaulting to \"\" (HIGHLY INSECURE!)")
+	}
+
+	jwtIssuer = os.Getenv("RELAY_JWT_ISSUER")
+	if jwtIssuer == "" {
+		jwtIssuer = http.DefaultIssuer
+	}
+
+	jwtTTL = envDuration("RELAY_JWT_TTL", http.DefaultTokenTTL)
+	refreshTTL = envDuration("RELAY_REFRESH_TTL", http.DefaultRefreshTTL)
+}
+
+// envDuration parses the duration in the environment variable, falling
+// back to def if it isn't set.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		logger.WithError(err).Fatalf("unable to parse %v", name)
+	}
+
+	return d
+}
+
+// envInt parses the integer in the environment variable, falling back to
+// def if it isn't set.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(raw)
+	if err != nil || i <= 0 {
+		logger.WithField("value", raw).Fatalf("unable to parse %v as a positive integer", name)
+	}
+
+	return i
+}
+
+func initpg() string {
 	pguser := os.Getenv("RELAY_POSTGRES_USER")
 	if pguser == "" {
 		logger.Fatal("need RELAY_POSTGRES_USER")
@@ -53,28 +158,103 @@ func init() {
 		pgssl = "verify-full"
 	}
 
-	pgconnstr = fmt.Sprintf("postgres://%v:%v@%v/%v?sslmode=%v",
+	return fmt.Sprintf("postgres://%v:%v@%v/%v?sslmode=%v",
 		pguser, pgpass, pghref, pgdb, pgssl)
+}
 
-	natsURL = os.Getenv("RELAY_NATS_URL")
-	if natsURL == "" {
-		logger.Warnf("setting NATS url to %v", nats.DefaultURL)
-		natsURL = nats.DefaultURL
+// initldap returns the authenticator for logging in through LDAP. Users
+// in the store can still log in with their own passwords, unless
+// RELAY_LDAP_LOCAL_USERS is false, so the bootstrap admin isn't locked out.
+func initldap(st store.RelayStore) authn.Authenticator {
+	basedn := os.Getenv("RELAY_LDAP_BASE_DN")
+	if basedn == "" {
+		logger.Fatal("need RELAY_LDAP_BASE_DN")
 	}
 
-	jwtsecret = os.Getenv("RELAY_JWT_SECRET")
-	if jwtsecret == "" {
-		logger.Warn("RELAY_JWT_SECRET not set - defaulting to \"\" (HIGHLY INSECURE!)")
+	l := authn.NewLDAP(os.Getenv("RELAY_LDAP_URL"), basedn, st)
+	l.StartTLS = os.Getenv("RELAY_LDAP_STARTTLS") == "true"
+	l.BindDN = os.Getenv("RELAY_LDAP_BIND_DN")
+	l.BindPassword = os.Getenv("RELAY_LDAP_BIND_PASS")
+	l.DefaultGroup = os.Getenv("RELAY_LDAP_DEFAULT_GROUP")
+
+	if filter := os.Getenv("RELAY_LDAP_USER_FILTER"); filter != "" {
+		l.UserFilter = filter
+	}
+
+	l.Groups = groupMap("RELAY_LDAP_GROUPS")
+
+	if os.Getenv("RELAY_LDAP_LOCAL_USERS") == "false" {
+		return l
+	}
+
+	return authn.First{l, authn.Local{Store: st}}
+}
+
+// initoidc returns the OIDC provider users can log in through, found
+// through the discovery document of its issuer.
+func initoidc(st store.RelayStore) *authn.OIDC {
+	clientID := os.Getenv("RELAY_OIDC_CLIENT_ID")
+	if clientID == "" {
+		logger.Fatal("need RELAY_OIDC_CLIENT_ID")
+	}
+
+	redirect := os.Getenv("RELAY_OIDC_REDIRECT_URL")
+	if redirect == "" {
+		logger.Fatal("need RELAY_OIDC_REDIRECT_URL")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	o, err := authn.DiscoverOIDC(ctx, os.Getenv("RELAY_OIDC_ISSUER"), clientID, os.Getenv("RELAY_OIDC_CLIENT_SECRET"), st)
+	if err != nil {
+		logger.WithError(err).Fatal("unable to discover OIDC provider")
+	}
+
+	o.RedirectURL = redirect
+	o.Groups = groupMap("RELAY_OIDC_GROUPS")
+	o.DefaultGroup = os.Getenv("RELAY_OIDC_DEFAULT_GROUP")
+	o.AllowUnverifiedEmail = os.Getenv("RELAY_OIDC_ALLOW_UNVERIFIED_EMAIL") == "true"
+
+	if claim := os.Getenv("RELAY_OIDC_GROUPS_CLAIM"); claim != "" {
+		o.GroupsClaim = claim
 	}
+
+	return o
+}
+
+// groupMap parses the mapping of outside groups to relay groups in the
+// environment variable, which looks like "group=outside;group=outside".
+// LDAP groups are DNs, with "=" in them, so only the first one splits.
+func groupMap(name string) map[string]string {
+	groups := make(map[string]string)
+
+	for _, m := range strings.Split(os.Getenv(name), ";") {
+		if m == "" {
+			continue
+		}
+
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 {
+			logger.Fatalf("invalid %v mapping %q", name, m)
+		}
+
+		groups[parts[1]] = parts[0]
+	}
+
+	return groups
 }
 
 func main() {
 	logger.Info("booting server...")
 
-	logger.Info("connecting to database")
-	st, err := store.NewPostgres(pgconnstr)
+	st, err := initStore()
 	if err != nil {
-		logger.WithField("error", err).Fatal("unable to connect to postgres")
+		logger.WithField("error", err).Fatal("unable to initialize store")
+	}
+
+	if err := bootstrapAdmin(context.Background(), st); err != nil {
+		logger.WithField("error", err).Fatal("unable to create bootstrap admin")
 	}
 
 	logger.Info("setting up NATS connection")
@@ -86,9 +266,105 @@ func main() {
 	logger.Info("setting up pollers send channel")
 	send := bus.SenderOn("pollers")
 
+	logger.Info("setting up runlets send channel")
+	runs := bus.SenderOn("pipelines")
+
+	logger.Info("setting up runlets control channel")
+	control := bus.SenderOn("runs.control")
+
 	srv := http.NewServer(":9001", send, st, jwtsecret)
+	srv.Runs = runs
+	srv.Control = control
+	srv.StoreTimeout = storeTimeout
+	srv.Issuer = jwtIssuer
+	srv.TokenTTL = jwtTTL
+	srv.RefreshTTL = refreshTTL
+	srv.Keys = jwtKeys
+	srv.RealIPHeader = os.Getenv("RELAY_REAL_IP_HEADER")
+	srv.Throttle.MaxFailures = envInt("RELAY_LOGIN_MAX_FAILURES", http.DefaultMaxLoginFailures)
+	srv.Throttle.MaxIPFailures = envInt("RELAY_LOGIN_MAX_IP_FAILURES", http.DefaultMaxIPLoginFailures)
+	srv.Throttle.Lockout = envDuration("RELAY_LOGIN_LOCKOUT", http.DefaultLoginLockout)
+	srv.Throttle.MaxLockout = envDuration("RELAY_LOGIN_MAX_LOCKOUT", http.DefaultMaxLoginLockout)
+
+	// Every API server gets every status event, since the streams of a
+	// run could be on any of them.
+	logger.Info("setting up run status receive channel")
+	status, err := bus.ReceiverOn("runs.status")
+	if err != nil {
+		logger.WithField("error", err).Warn("unable to receive run status, streams won't be updated")
+	} else {
+		go srv.WatchStatus(status)
+	}
+
+	if os.Getenv("RELAY_LDAP_URL") != "" {
+		srv.Authenticator = initldap(st)
+	}
+
+	if os.Getenv("RELAY_OIDC_ISSUER") != "" {
+		srv.OIDC = initoidc(st)
+	}
 
 	if err := srv.ListenAndServe(); err != nil {
 		logger.WithField("error", err).Fatal("shutting down server")
 	}
 }
+
+func initStore() (store.RelayStore, error) {
+	switch storeType {
+	case "postgres":
+		logger.Info("connecting to database")
+		st, err := store.NewPostgres(pgconnstr)
+		if err != nil {
+			return nil, err
+		}
+
+		if m, ok := st.(store.Migrator); ok && pgmigrate {
+			logger.Info("migrating database schema")
+			if err := m.Migrate(context.Background()); err != nil {
+				return nil, err
+			}
+		}
+
+		return st, nil
+	case "memory":
+		logger.Warn("using in-memory store - nothing will be persisted")
+
+		return store.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q", storeType)
+	}
+}
+
+// bootstrapAdmin creates the admin from RELAY_ADMIN_EMAIL and
+// RELAY_ADMIN_PASSWORD in the default group, creating that too, unless
+// they're already there. Either way, nothing that's there is changed.
+func bootstrapAdmin(ctx context.Context, st store.RelayStore) error {
+	if adminEmail == "" {
+		return nil
+	}
+
+	err := st.CreateGroup(ctx, &store.DefaultGroup)
+	if err != nil && err != store.ErrGroupExists {
+		return err
+	}
+
+	admin := store.User{
+		Name:     "admin",
+		Email:    adminEmail,
+		Password: adminPassword,
+		Group:    store.DefaultGroup,
+		Admin:    true,
+	}
+
+	err = st.CreateUser(ctx, &admin)
+	if err == store.ErrUserExists {
+		logger.WithField("email", adminEmail).Info("bootstrap admin already exists")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.WithField("email", adminEmail).Info("created bootstrap admin")
+	return nil
+}
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"time"
@@ -9,6 +10,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var errNotConnected = errors.New("not connected to NATS")
+
 // NATS encapsulates a connection to NATS, with functionality
 // for creating channels to send and receive.
 type NATS struct {
@@ -76,3 +79,30 @@ func (q *NATS) SenderOn(subj string) chan<- []byte {
 
 	return send
 }
+
+// ReceiverOn returns a channel that gets every message sent on the given
+// subject. Every receiver on the subject gets every message, rather than
+// sharing them out.
+func (q *NATS) ReceiverOn(subj string) (<-chan []byte, error) {
+	logger := logger.WithField("subject", subj)
+
+	if q.conn == nil {
+		return nil, errNotConnected
+	}
+
+	logger.Debug("setting up queue receiver")
+
+	recv := make(chan []byte)
+	_, err := q.conn.Subscribe(subj, func(msg *nats.Msg) {
+		logger.Debugf("received data: %s", msg.Data)
+
+		recv <- msg.Data
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("queue receiver initialized successfully")
+
+	return recv, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+	nats "github.com/nats-io/go-nats"
+	"github.com/run-ci/run/pkg/run"
+	log "github.com/sirupsen/logrus"
+)
+
+// opCancel tells the runlet running a run to stop it.
+const opCancel = "cancel"
+
+// Control is a message about a run that's already running. Every runlet
+// gets it, and the one running the run acts on it.
+type Control struct {
+	Op         string `json:"op"`
+	PipelineID int    `json:"pipeline_id"`
+	Run        int    `json:"run"`
+}
+
+// current is the run the runlet is running, for control messages to be
+// checked against. The main loop sets it and checks whether it's been
+// cancelled between tasks, and the control loop cancels it.
+type current struct {
+	mu         sync.Mutex
+	pipelineID int
+	count      int
+	vol        string
+	cancelled  bool
+}
+
+// start sets the run the runlet is running.
+func (c *current) start(pid, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pipelineID, c.count = pid, count
+	c.vol = ""
+	c.cancelled = false
+}
+
+// setVolume sets the volume the run's containers mount, which is how
+// they're found to be stopped.
+func (c *current) setVolume(vol string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.vol = vol
+}
+
+// finish unsets the run, once the runlet is done with it.
+func (c *current) finish() {
+	c.start(0, 0)
+}
+
+// isCancelled returns whether the run has been cancelled.
+func (c *current) isCancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cancelled
+}
+
+// cancel cancels the run, if it's the one the runlet is running, and
+// returns the volume of its containers. It returns false for other runs.
+func (c *current) cancel(pid, count int) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if count == 0 || c.pipelineID != pid || c.count != count {
+		return "", false
+	}
+
+	c.cancelled = true
+	return c.vol, true
+}
+
+// listenForControl acts on control messages for the current run until
+// the queue is closed.
+func listenForControl(ctlq <-chan *nats.Msg, cur *current, agent *run.Agent, client *docker.Client) {
+	for msg := range ctlq {
+		var ctl Control
+		err := json.Unmarshal(msg.Data, &ctl)
+		if err != nil {
+			logger.WithError(err).Error("error parsing control message, skipping")
+
+			continue
+		}
+
+		logger := logger.WithFields(log.Fields{
+			"op":          ctl.Op,
+			"pipeline_id": ctl.PipelineID,
+			"run":         ctl.Run,
+		})
+
+		if ctl.Op != opCancel {
+			logger.Warn("unknown control message, skipping")
+
+			continue
+		}
+
+		vol, ok := cur.cancel(ctl.PipelineID, ctl.Run)
+		if !ok {
+			logger.Debug("run isn't running here, skipping")
+
+			continue
+		}
+
+		logger.Info("cancelling run")
+
+		if vol != "" {
+			stopContainers(logger, agent, client, vol)
+		}
+	}
+}
+
+// stopContainers stops the containers that mount the volume, which are
+// the ones running the run's tasks. Removing a container is what makes
+// the agent return from running it.
+func stopContainers(logger *log.Entry, agent *run.Agent, client *docker.Client, vol string) {
+	logger = logger.WithField("vol", vol)
+
+	cnts, err := client.ListContainers(docker.ListContainersOptions{
+		Filters: map[string][]string{"volume": {vol}},
+	})
+	if err != nil {
+		logger.WithError(err).Error("unable to list run containers")
+		return
+	}
+
+	for _, cnt := range cnts {
+		logger.WithField("container_id", cnt.ID).Debug("stopping task container")
+
+		err := agent.CleanupContainer(cnt.ID, false)
+		if err != nil {
+			logger.WithError(err).WithField("container_id", cnt.ID).Error("unable to stop task container")
+		}
+	}
+}
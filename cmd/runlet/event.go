@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/run-ci/relay/store"
 	"github.com/run-ci/run/pkg/run"
 )
@@ -10,6 +13,43 @@ type Event struct {
 	GitRemote store.GitRemote `json:"git_remote"`
 	Name      string          `json:"name"`
 	Steps     []Step          `json:"steps"`
+
+	// PipelineID and Run are set on runs started through the API, which
+	// saves the run before sending it. The runlet starts that run
+	// instead of creating a new one.
+	PipelineID int `json:"pipeline_id"`
+	Run        int `json:"run"`
+
+	// Commit is checked out instead of the tip of the branch, if it's
+	// set.
+	Commit string `json:"commit"`
+	// Parameters are set in the environment of every task, over the
+	// task's own arguments.
+	Parameters map[string]string `json:"parameters"`
+
+	// Resume is how many of the steps are skipped, because the run
+	// retries one that already ran them, and reuses their results.
+	Resume int `json:"resume"`
+}
+
+// Checkout returns the arguments to git checkout that check out what the
+// run is for from the Git remote. Commits aren't branches, so they're
+// checked out detached. Anything starting with "-" would be taken as an
+// option, so it isn't checked out at all.
+func (ev Event) Checkout() ([]string, error) {
+	if ev.Commit != "" {
+		if strings.HasPrefix(ev.Commit, "-") {
+			return nil, fmt.Errorf("invalid commit %q", ev.Commit)
+		}
+
+		return []string{"--detach", ev.Commit}, nil
+	}
+
+	if strings.HasPrefix(ev.GitRemote.Branch, "-") {
+		return nil, fmt.Errorf("invalid branch %q", ev.GitRemote.Branch)
+	}
+
+	return []string{ev.GitRemote.Branch}, nil
 }
 
 // Step is a grouping of tasks that can be run in parallel.
@@ -28,3 +68,18 @@ type Task struct {
 	// run, it's necessary to have the actual value.
 	Arguments map[string]interface{} `json:"arguments"`
 }
+
+// Env is the environment the task runs in. It's the task's arguments,
+// with the parameters of the run over them.
+func (t Task) Env(params map[string]string) map[string]string {
+	env := make(map[string]string, len(t.Arguments)+len(params))
+	for k, v := range t.Arguments {
+		env[k] = fmt.Sprint(v)
+	}
+
+	for k, v := range params {
+		env[k] = v
+	}
+
+	return env
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -16,7 +17,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var natsURL, gitimg, cimnt, pgconnstr string
+var natsURL, gitimg, checkoutimg, cimnt, storeType, pgconnstr string
+var pgmigrate bool
+var storeTimeout time.Duration
 var logger *log.Entry
 
 func init() {
@@ -32,12 +35,39 @@ func init() {
 		gitimg = "runci/git-clone"
 	}
 
+	// The checkout image is run as git, with the arguments to check
+	// out the run's ref in the cloned repo.
+	checkoutimg = os.Getenv("RELAY_GIT_CHECKOUT_IMAGE")
+	if checkoutimg == "" {
+		checkoutimg = "alpine/git"
+	}
+
 	cimnt = os.Getenv("RELAY_CI_MOUNT")
 	if cimnt == "" {
 		cimnt = "/ci/repo"
 	}
 
-	pgconnstr = initpg()
+	storeTimeout = 10 * time.Second
+	if raw := os.Getenv("RELAY_STORE_TIMEOUT"); raw != "" {
+		var err error
+		storeTimeout, err = time.ParseDuration(raw)
+		if err != nil {
+			logger.WithError(err).Fatal("unable to parse RELAY_STORE_TIMEOUT")
+		}
+	}
+
+	storeType = os.Getenv("RELAY_STORE")
+	if storeType == "" {
+		storeType = "postgres"
+	}
+
+	if storeType == "postgres" {
+		pgconnstr = initpg()
+
+		// Migrating on boot is the default so that deploying a new
+		// build is enough to get the schema it needs.
+		pgmigrate = os.Getenv("RELAY_POSTGRES_MIGRATE") != "false"
+	}
 }
 
 func main() {
@@ -46,13 +76,21 @@ func main() {
 	evq, teardown := SubscribeToQueue(natsURL, "pipelines", "runlet")
 	defer teardown()
 
-	st, err := store.NewPostgres(pgconnstr)
+	// Control messages go to every runlet, since only the one running
+	// the run they're about can act on them.
+	ctlq, ctlteardown := SubscribeToQueue(natsURL, "runs.control", "")
+	defer ctlteardown()
+
+	statusq, statusteardown := PublishOn(natsURL, "runs.status")
+	defer statusteardown()
+
+	statuses := statusPublisher{send: statusq}
+
+	st, err := initStore()
 	if err != nil {
-		logger.WithField("error", err).Fatal("unable to connect to postgres")
+		logger.WithField("error", err).Fatal("unable to initialize store")
 	}
 
-	logger.Info("connecting to database")
-
 	client, err := docker.NewClient("unix:///var/run/docker.sock")
 	if err != nil {
 		logger.WithFields(log.Fields{
@@ -69,6 +107,9 @@ func main() {
 
 	logger.Info("initialized run agent")
 
+	var cur current
+	go listenForControl(ctlq, &cur, agent, client)
+
 	for msg := range evq {
 		logger.Debugf("processing message %s", msg.Data)
 
@@ -82,62 +123,98 @@ func main() {
 			continue
 		}
 
-		vol := initCIVolume(agent, client, ev.GitRemote)
-
 		logger := logger.WithFields(log.Fields{
 			"git_remote":    ev.GitRemote.URL,
 			"git_branch":    ev.GitRemote.Branch,
 			"pipeline_name": ev.Name,
 		})
 
-		logger.Debug("loading pipeline")
+		pipeline, r, err := startRun(st, logger, ev)
+		if err == store.ErrRunCancelled {
+			logger.WithField("run", ev.Run).Info("pipeline run was cancelled before it started, skipping this run")
+
+			// The API ended the run when it was cancelled, but anything
+			// streaming it only hears about it from here.
+			r := store.Run{Count: ev.Run, PipelineID: ev.PipelineID}
+			r.SetEnd()
+			r.MarkCancelled()
 
-		var pipeline store.Pipeline
-		pipeline.ID, err = st.GetPipelineID(ev.GitRemote, ev.Name)
-		if err != nil && err != store.ErrNoPipelines {
-			logger.WithField("error", err).Error("error loading pipeline from store, skipping this run")
+			statuses.start(ev.PipelineID, ev.Run)
+			statuses.run(r)
 
 			continue
 		}
-		if err == store.ErrNoPipelines {
-			logger.Info("no pipeline found, creating one")
+		if err != nil {
+			logger.WithField("error", err).Error("unable to start pipeline run, skipping this run")
 
-			p := store.Pipeline{
-				Name:      ev.Name,
-				GitRemote: ev.GitRemote,
-			}
-			err := st.CreatePipeline(&p)
-			if err != nil {
-				logger.WithField("error", err).Error("unable to create pipeline, skipping this run")
+			continue
+		}
 
-				continue
-			}
+		logger = logger.WithField("run", r.Count)
 
-			pipeline = p
-		}
+		cur.start(pipeline.ID, r.Count)
 
-		logger.Debugf("got pipeline %+v", pipeline)
+		// The run could have been cancelled after it was started but
+		// before the runlet was listening for it, in which case nobody
+		// heard the control message, so the store is asked too.
+		var cancelled bool
+		err = storeCall(func(ctx context.Context) (err error) {
+			cancelled, err = st.RunCancelled(ctx, pipeline.ID, r.Count)
+			return
+		})
+		if err != nil {
+			logger.WithField("error", err).Warn("unable to check whether run was cancelled, continuing")
+		}
+		if cancelled {
+			logger.Info("pipeline run was cancelled as it started")
 
-		r := store.Run{
-			PipelineID: pipeline.ID,
+			cur.cancel(pipeline.ID, r.Count)
 		}
-		r.SetStart()
 
-		logger.Debug("creating new pipeline run")
+		statuses.start(pipeline.ID, r.Count)
+		statuses.run(r)
 
-		err = st.CreateRun(&r)
-		if err != nil {
-			logger.WithField("error", err).Error("unable to save pipeline run")
+		var vol string
+		if !cur.isCancelled() {
+			checkout, err := ev.Checkout()
+			if err == nil {
+				vol, err = initCIVolume(agent, client, ev.GitRemote, checkout)
+				cur.setVolume(vol)
+			}
 
-			continue
+			if err != nil {
+				// Running the steps on anything else would say something
+				// about the wrong commit, so the run fails without them.
+				logger.WithField("error", err).Error("unable to check out run, failing it")
+
+				r.MarkSuccess(false)
+			} else {
+				// The commit is saved with the run, so that it can be
+				// retried on the same one, even if it was a run of a branch.
+				commit, err := resolveCommit(client, vol)
+				if err != nil {
+					logger.WithField("error", err).Warn("unable to resolve checked out commit, continuing")
+				} else {
+					r.Commit = commit
+				}
+			}
 		}
 
-		for _, step := range ev.Steps {
+		for i, step := range ev.Steps {
+			// A resumed run already has the results of the steps
+			// before the one it resumes from.
+			if i < ev.Resume {
+				logger.WithField("step", step.Name).Debug("reusing results of step")
+
+				continue
+			}
+
 			// The pipeline could have been marked unsuccessful in some task. At
 			// that point, the right thing to do is to break out of this loop.
 			// Since the tasks are run in their own loop, they can't break to the
-			// right spot, so this check needs to be here.
-			if r.Failed() {
+			// right spot, so this check needs to be here. The same goes for the
+			// run being cancelled, which skips the rest of the steps.
+			if r.Failed() || cur.isCancelled() {
 				break
 			}
 
@@ -156,17 +233,28 @@ func main() {
 			}
 			r.Steps = append(r.Steps, s)
 
-			err = st.CreateStep(&s)
+			err = storeCall(func(ctx context.Context) error {
+				return st.CreateStep(ctx, &s)
+			})
 			if err != nil {
 				logger.WithField("error", err).Error("unable to save step, aborting")
 
 				s.MarkSuccess(false)
+				r.MarkSuccess(false)
 				pipeline.MarkSuccess(false)
 
 				break
 			}
 
+			statuses.step(s)
+
 			for _, task := range step.Tasks {
+				if cur.isCancelled() {
+					s.MarkCancelled()
+
+					break
+				}
+
 				logger := logger.WithField("task", task.Name)
 
 				logger.Debug("running task")
@@ -179,7 +267,9 @@ func main() {
 				}
 				s.Tasks = append(s.Tasks, t)
 
-				err := st.CreateTask(&t)
+				err := storeCall(func(ctx context.Context) error {
+					return st.CreateTask(ctx, &t)
+				})
 				if err != nil {
 					logger.WithField("error", err).Error("unable to save task, aborting")
 
@@ -190,6 +280,8 @@ func main() {
 					break
 				}
 
+				statuses.task(t)
+
 				if task.Mount == "" {
 					task.Mount = cimnt
 
@@ -243,6 +335,7 @@ func main() {
 				spec := run.ContainerSpec{
 					Imgref: task.Image,
 					Cmd:    task.GetCmd(),
+					Env:    task.Env(ev.Parameters),
 					Mount: run.Mount{
 						Src:   vol,
 						Point: task.Mount,
@@ -264,51 +357,222 @@ func main() {
 
 				logger.Debugf("task container exited with status %v", status)
 
+				// A cancelled run's container is stopped from under the
+				// agent, so how it exited doesn't say anything.
 				t.SetEnd()
-				t.MarkSuccess(true)
-				err = st.UpdateTask(&t)
+				if cur.isCancelled() {
+					logger.Info("pipeline run cancelled, task stopped")
+
+					t.MarkCancelled()
+				} else if err != nil {
+					t.MarkSuccess(false)
+				} else {
+					t.MarkExited(status)
+				}
+				err = storeCall(func(ctx context.Context) error {
+					return st.UpdateTask(ctx, &t)
+				})
 				if err != nil {
 					logger.WithField("error", err).Error("unable to save pipeline task, continuing")
 
-					// Continuing here is safe because the task itself finished successfully.
+					// Continuing here is safe because the task itself is done.
+				} else {
+					statuses.task(t)
+				}
+
+				if t.Cancelled {
+					s.MarkCancelled()
+
+					break
+				}
+
+				// The step's other tasks still run, since they don't
+				// depend on this one, but the steps after it don't.
+				if t.Failed() {
+					logger.Info("task failed")
+
+					s.MarkSuccess(false)
 				}
 			}
 
 			s.SetEnd()
-			s.MarkSuccess(true)
-			err = st.UpdateStep(&s)
+			if s.Failed() {
+				r.MarkSuccess(false)
+			} else if !s.Cancelled {
+				s.MarkSuccess(true)
+			}
+			err = storeCall(func(ctx context.Context) error {
+				return st.UpdateStep(ctx, &s)
+			})
 			if err != nil {
 				logger.WithField("error", err).Error("unable to save pipeline step, continuing")
 
-				// Continuing here is safe because the step itself finished successfully.
+				// Continuing here is safe because the step itself is done.
+			} else {
+				statuses.step(s)
 			}
 		}
 
-		err = client.RemoveVolume(vol)
-		if err != nil {
-			logger.WithFields(log.Fields{
-				"error": err,
-				"vol":   vol,
-			}).Error("unable to delete volume")
+		if vol != "" {
+			err = client.RemoveVolume(vol)
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"error": err,
+					"vol":   vol,
+				}).Error("unable to delete volume")
+			}
 		}
 
 		r.SetEnd()
-		r.MarkSuccess(true)
-		err = st.UpdateRun(&r)
+		if cur.isCancelled() {
+			r.MarkCancelled()
+		} else if !r.Failed() {
+			r.MarkSuccess(true)
+		}
+		cur.finish()
+
+		err = storeCall(func(ctx context.Context) error {
+			return st.UpdateRun(ctx, &r)
+		})
 		if err != nil {
 			logger.WithFields(log.Fields{
 				"error": err,
 			}).Error("unable to save run")
+		} else {
+			statuses.run(r)
+		}
+
+		// A cancelled run didn't get far enough to say anything about
+		// the pipeline.
+		if r.Cancelled {
+			continue
 		}
 
-		pipeline.MarkSuccess(true)
-		err = st.UpdatePipeline(&pipeline)
+		pipeline.MarkSuccess(!r.Failed())
+		err = storeCall(func(ctx context.Context) error {
+			return st.UpdatePipeline(ctx, &pipeline)
+		})
 		if err != nil {
 			logger.WithError(err).Error("unable to save pipeline")
 		}
 	}
 }
 
+// startRun saves the start of the event's run. Runs started through the API
+// were saved when they were queued, so they're only marked as started,
+// unless they were cancelled while they were queued, in which case it
+// returns store.ErrRunCancelled.
+// Everything else gets a new run, in a new pipeline if the remote doesn't
+// have one with the event's name yet.
+func startRun(st store.RelayStore, logger *log.Entry, ev Event) (store.Pipeline, store.Run, error) {
+	if ev.Run != 0 {
+		logger.Debug("starting queued pipeline run")
+
+		pipeline := store.Pipeline{ID: ev.PipelineID}
+		r := store.Run{
+			Count:      ev.Run,
+			PipelineID: ev.PipelineID,
+		}
+		r.SetStart()
+
+		err := storeCall(func(ctx context.Context) error {
+			return st.StartRun(ctx, &r)
+		})
+
+		return pipeline, r, err
+	}
+
+	logger.Debug("loading pipeline")
+
+	var pipeline store.Pipeline
+	err := storeCall(func(ctx context.Context) (err error) {
+		pipeline.ID, err = st.GetPipelineID(ctx, ev.GitRemote, ev.Name)
+		return
+	})
+	if err != nil && err != store.ErrNoPipelines {
+		return pipeline, store.Run{}, err
+	}
+	if err == store.ErrNoPipelines {
+		logger.Info("no pipeline found, creating one")
+
+		pipeline = store.Pipeline{
+			Name:      ev.Name,
+			GitRemote: ev.GitRemote,
+		}
+		err := storeCall(func(ctx context.Context) error {
+			return st.CreatePipeline(ctx, &pipeline)
+		})
+		if err != nil {
+			return pipeline, store.Run{}, err
+		}
+	}
+
+	logger.Debugf("got pipeline %+v", pipeline)
+
+	// The steps are kept so that the pipeline can be run again through
+	// the API, which only knows what's in the store.
+	def, err := json.Marshal(ev.Steps)
+	if err == nil {
+		err = storeCall(func(ctx context.Context) error {
+			return st.SetPipelineDefinition(ctx, pipeline.ID, def)
+		})
+	}
+	if err != nil {
+		logger.WithField("error", err).Warn("unable to save pipeline definition, continuing")
+	}
+
+	r := store.Run{
+		PipelineID: pipeline.ID,
+		Branch:     ev.GitRemote.Branch,
+		Commit:     ev.Commit,
+		Parameters: ev.Parameters,
+		Definition: def,
+	}
+	r.SetStart()
+
+	logger.Debug("creating new pipeline run")
+
+	err = storeCall(func(ctx context.Context) error {
+		return st.CreateRun(ctx, &r)
+	})
+
+	return pipeline, r, err
+}
+
+// storeCall runs fn with a context that's canceled after storeTimeout,
+// so that a wedged database can't hang a run forever.
+func storeCall(fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	return fn(ctx)
+}
+
+func initStore() (store.RelayStore, error) {
+	switch storeType {
+	case "postgres":
+		logger.Info("connecting to database")
+		st, err := store.NewPostgres(pgconnstr)
+		if err != nil {
+			return nil, err
+		}
+
+		if m, ok := st.(store.Migrator); ok && pgmigrate {
+			logger.Info("migrating database schema")
+			if err := m.Migrate(context.Background()); err != nil {
+				return nil, err
+			}
+		}
+
+		return st, nil
+	case "memory":
+		logger.Warn("using in-memory store - nothing will be persisted")
+		return store.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q", storeType)
+	}
+}
+
 func initpg() string {
 	pguser := os.Getenv("RELAY_POSTGRES_USER")
 	if pguser == "" {
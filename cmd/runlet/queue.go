@@ -8,42 +8,32 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// SubscribeToQueue sets up a subscription in NATS on the "pipelines" subject.
+// SubscribeToQueue sets up a subscription in NATS on the subject. Messages
+// are shared out between the subscribers in the same group, or sent to every
+// subscriber if the group is empty.
 // TODO: abstract away the dependency on NATS.
 func SubscribeToQueue(url, subject, group string) (<-chan *nats.Msg, func()) {
-	logger.Info("connecting to nats")
-
-	nc, err := nats.Connect(url)
-	if err != nil {
-		for i := 1; i <= 3; i++ {
-			timeout := time.Duration(math.Pow(2, float64(i))) * time.Second
+	nc := connect(url)
 
-			logger.WithFields(log.Fields{
-				"error": err,
-			}).Warnf("error connecting to nats, retrying after %v seconds", timeout)
+	ch := make(chan *nats.Msg)
 
-			time.Sleep(timeout)
-			nc, err = nats.Connect(url)
-			if err == nil {
-				break
-			}
-		}
+	var err error
+	var sub *nats.Subscription
+	if group == "" {
+		sub, err = nc.ChanSubscribe(subject, ch)
+	} else {
+		sub, err = nc.ChanQueueSubscribe(subject, group, ch)
 	}
-
-	logger.Info("nats connection successful")
-
-	ch := make(chan *nats.Msg)
-	sub, err := nc.ChanQueueSubscribe(subject, group, ch)
 	if err != nil {
 		logger.Fatalf("error listening to subject %v: %v", subject, err)
 	}
 
-	logger = logger.WithFields(log.Fields{
+	logger := logger.WithFields(log.Fields{
 		"subject": subject,
 		"group":   group,
 	})
 
-	logger.Debug("queue group joined")
+	logger.Debug("subscribed to subject")
 
 	teardown := func() {
 		logger.Debugf("begin tearing down nats connection")
@@ -62,3 +52,69 @@ func SubscribeToQueue(url, subject, group string) (<-chan *nats.Msg, func()) {
 
 	return ch, teardown
 }
+
+// PublishOn returns a channel to send messages on the subject, and a
+// function to close it with once nothing's sent anymore.
+func PublishOn(url, subject string) (chan<- []byte, func()) {
+	nc := connect(url)
+
+	logger := logger.WithField("subject", subject)
+
+	send := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for msg := range send {
+			logger.Debugf("publishing message %s", msg)
+
+			err := nc.Publish(subject, msg)
+			if err != nil {
+				logger.WithError(err).Error("unable to publish message")
+			}
+		}
+	}()
+
+	teardown := func() {
+		logger.Debug("begin tearing down nats connection")
+
+		close(send)
+		<-done
+
+		// Flushing makes sure the last messages get out before the
+		// connection is closed.
+		if err := nc.Flush(); err != nil {
+			logger.WithError(err).Error("unable to flush messages")
+		}
+		nc.Close()
+	}
+
+	return send, teardown
+}
+
+// connect connects to NATS, retrying with backoff a few times before
+// giving up.
+func connect(url string) *nats.Conn {
+	logger.Info("connecting to nats")
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		for i := 1; i <= 3; i++ {
+			timeout := time.Duration(math.Pow(2, float64(i))) * time.Second
+
+			logger.WithFields(log.Fields{
+				"error": err,
+			}).Warnf("error connecting to nats, retrying after %v seconds", timeout)
+
+			time.Sleep(timeout)
+			nc, err = nats.Connect(url)
+			if err == nil {
+				break
+			}
+		}
+	}
+
+	logger.Info("nats connection successful")
+
+	return nc
+}
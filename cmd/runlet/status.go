@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/run-ci/relay/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// These are the types of status events, for what was saved.
+const (
+	statusRun  = "run"
+	statusStep = "step"
+	statusTask = "task"
+)
+
+// Status is a message about a change to a run, or to one of its steps or
+// tasks, for the API to stream to whoever's watching the run. Seq counts
+// the run's messages, and is what streams are resumed from.
+type Status struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	PipelineID int         `json:"pipeline_id"`
+	Run        int         `json:"run"`
+	StepID     int         `json:"step_id,omitempty"`
+	Data       interface{} `json:"data"`
+}
+
+// statusPublisher publishes the status of the run the runlet is running,
+// as it's saved, so that what's streamed is what's in the store.
+type statusPublisher struct {
+	send chan<- []byte
+
+	pipelineID int
+	count      int
+	seq        int
+}
+
+// start sets the run that statuses are published for, and starts counting
+// its messages over.
+func (p *statusPublisher) start(pid, count int) {
+	p.pipelineID, p.count = pid, count
+	p.seq = 0
+}
+
+// run publishes the run, without its steps or definition, which are
+// published on their own or are already known.
+func (p *statusPublisher) run(r store.Run) {
+	r.Steps = nil
+	r.Definition = nil
+
+	p.publish(statusRun, 0, r)
+}
+
+// step publishes the step, without its tasks, which are published on
+// their own.
+func (p *statusPublisher) step(s store.Step) {
+	s.Tasks = nil
+
+	p.publish(statusStep, 0, s)
+}
+
+func (p *statusPublisher) task(t store.Task) {
+	p.publish(statusTask, t.StepID, t)
+}
+
+func (p *statusPublisher) publish(typ string, stepID int, data interface{}) {
+	p.seq++
+
+	logger := logger.WithFields(log.Fields{
+		"pipeline_id": p.pipelineID,
+		"run":         p.count,
+		"seq":         p.seq,
+		"type":        typ,
+	})
+
+	buf, err := json.Marshal(Status{
+		Seq:        p.seq,
+		Type:       typ,
+		PipelineID: p.pipelineID,
+		Run:        p.count,
+		StepID:     stepID,
+		Data:       data,
+	})
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal status, skipping")
+		return
+	}
+
+	logger.Debug("publishing status")
+
+	p.send <- buf
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"strings"
 
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/google/uuid"
@@ -10,8 +13,15 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func initCIVolume(agent *run.Agent, client *docker.Client, remote store.GitRemote) string {
-	logger := logger.WithField("remote", remote)
+// initCIVolume creates a volume with the remote cloned into it, and checks
+// out what git checkout does with the arguments. If cloning or checking out
+// fails, it returns an error along with the volume, which is left to be
+// removed.
+func initCIVolume(agent *run.Agent, client *docker.Client, remote store.GitRemote, checkout []string) (string, error) {
+	logger := logger.WithFields(log.Fields{
+		"remote":   remote,
+		"checkout": checkout,
+	})
 
 	name := fmt.Sprintf("runlet.%v", uuid.New())
 
@@ -34,8 +44,7 @@ func initCIVolume(agent *run.Agent, client *docker.Client, remote store.GitRemot
 
 	spec := run.ContainerSpec{
 		Imgref: gitimg,
-		// TODO: use the URL and the branch here
-		Cmd: []string{remote.URL, "."},
+		Cmd:    []string{remote.URL, "."},
 		Mount: run.Mount{
 			Src:   vol.Name,
 			Point: cimnt,
@@ -52,5 +61,93 @@ func initCIVolume(agent *run.Agent, client *docker.Client, remote store.GitRemot
 
 	logger.Debugf("git clone container exited with status %v", status)
 
-	return name
+	if status != 0 {
+		return name, fmt.Errorf("git clone exited with status %v", status)
+	}
+
+	err = agent.VerifyImagePresent(checkoutimg, true)
+	if err != nil {
+		logger.WithField("error", err).
+			Fatalf("unable to verify git checkout image presence")
+	}
+
+	spec = run.ContainerSpec{
+		Imgref: checkoutimg,
+		Cmd:    append([]string{"-C", cimnt, "checkout"}, checkout...),
+		Mount: run.Mount{
+			Src:   vol.Name,
+			Point: cimnt,
+			Type:  "volume",
+		},
+	}
+
+	logger.Debug("checking out ref")
+
+	id, status, err = agent.RunContainer(spec)
+	if err != nil {
+		log.Fatalf("error running git checkout container %v: %v", id, err)
+	}
+
+	logger.Debugf("git checkout container exited with status %v", status)
+
+	if status != 0 {
+		return name, fmt.Errorf("git checkout exited with status %v", status)
+	}
+
+	return name, nil
+}
+
+// resolveCommit returns the commit checked out in the volume. The container
+// is run without the agent, which only streams the output of what it runs,
+// so that the output can be read once the container is done.
+func resolveCommit(client *docker.Client, vol string) (string, error) {
+	cnt, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: checkoutimg,
+			Cmd:   []string{"-C", cimnt, "rev-parse", "HEAD"},
+		},
+		HostConfig: &docker.HostConfig{
+			Mounts: []docker.HostMount{
+				docker.HostMount{
+					Target: cimnt,
+					Source: vol,
+					Type:   "volume",
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	defer client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:    cnt.ID,
+		Force: true,
+	})
+
+	err = client.StartContainer(cnt.ID, nil)
+	if err != nil {
+		return "", err
+	}
+
+	status, err := client.WaitContainer(cnt.ID)
+	if err != nil {
+		return "", err
+	}
+	if status != 0 {
+		return "", fmt.Errorf("git rev-parse exited with status %v", status)
+	}
+
+	var out bytes.Buffer
+	err = client.Logs(docker.LogsOptions{
+		Container:    cnt.ID,
+		Stdout:       true,
+		OutputStream: &out,
+		ErrorStream:  ioutil.Discard,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
 }
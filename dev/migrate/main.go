@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/run-ci/relay/store"
+)
+
+func usage() {
+	fmt.Println("usage: go run dev/migrate/main.go $POSTGRES_CONNECTION_STRING [$VERSION]")
+	fmt.Println()
+	fmt.Println("Migrates to the latest schema version if no version is given.")
+}
+
+func main() {
+	// The `--` needed to pass arguments to `go run` counts as one
+	// of the arguments in `os.Args`.
+	if len(os.Args) < 3 || len(os.Args) > 4 {
+		usage()
+		os.Exit(1)
+	}
+
+	args := os.Args[2:]
+
+	connstr := args[0]
+	if connstr == "" {
+		usage()
+		os.Exit(1)
+	}
+
+	version := store.LatestSchemaVersion()
+	if len(args) == 2 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Printf("got error parsing version: %v\n", err)
+			os.Exit(1)
+		}
+
+		version = v
+	}
+
+	db, err := store.NewPostgres(connstr)
+	if err != nil {
+		fmt.Printf("got error connecting to postgres: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("migrating %v to schema version %v\n", connstr, version)
+
+	err = db.(store.Migrator).MigrateTo(context.Background(), version)
+	if err != nil {
+		fmt.Printf("got error migrating: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("done!")
+}
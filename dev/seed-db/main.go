@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -62,15 +63,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	ctx := context.Background()
+
 	fmt.Println("inserting default group")
-	err = db.CreateGroup(&store.DefaultGroup)
+	err = db.CreateGroup(ctx, &store.DefaultGroup)
 	if err != nil {
 		fmt.Printf("got error inserting group: %v\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Println("inserting default user")
-	err = db.CreateUser(&store.DefaultUser)
+	err = db.CreateUser(ctx, &store.DefaultUser)
 	if err != nil {
 		fmt.Printf("got error inserting default user: %v\n", err)
 		os.Exit(1)
@@ -83,7 +86,7 @@ func main() {
 		proj.Group = store.DefaultGroup
 		proj.Permissions = store.Permission(store.PermGroupRead | store.PermGroupWrite | store.PermGroupRun)
 
-		err := db.CreateProject(&proj)
+		err := db.CreateProject(ctx, &proj)
 		if err != nil {
 			fmt.Printf("got error inserting project: %v\n", err)
 			os.Exit(1)
@@ -93,7 +96,7 @@ func main() {
 			fmt.Printf("inserting git remote %v#%v\n", remote.URL, remote.Branch)
 
 			remote.ProjectID = proj.ID
-			err := db.CreateGitRemote(proj.User.Email, &remote)
+			err := db.CreateGitRemote(ctx, proj.User.Email, &remote)
 			if err != nil {
 				fmt.Printf("error inserting git remote: %v\n", err)
 				os.Exit(1)
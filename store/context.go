@@ -0,0 +1,30 @@
+package store
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ctxkey int
+
+const (
+	keyRequestID ctxkey = iota
+)
+
+// WithRequestID returns a copy of ctx carrying the ID of the request it
+// belongs to. Store implementations add it to their log fields so that
+// queries can be traced back to the request that made them.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, keyRequestID, id)
+}
+
+// ctxlogger returns the package logger with whatever fields can be pulled
+// out of ctx.
+func ctxlogger(ctx context.Context) *log.Entry {
+	if id, ok := ctx.Value(keyRequestID).(string); ok {
+		return logger.WithField("request_id", id)
+	}
+
+	return logger
+}
@@ -0,0 +1,302 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// contractStores returns the stores that have to behave the same way: a
+// Memory store, and a Postgres store when RELAY_TEST_POSTGRES has the
+// connection string of a database the tests can migrate and write to.
+func contractStores(t *testing.T) map[string]RelayStore {
+	stores := map[string]RelayStore{
+		"memory": NewMemory(),
+	}
+
+	connstr := os.Getenv("RELAY_TEST_POSTGRES")
+	if connstr == "" {
+		t.Log("RELAY_TEST_POSTGRES not set, only testing the memory store")
+		return stores
+	}
+
+	st, err := NewPostgres(connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+
+	if err := st.(*Postgres).Migrate(context.Background()); err != nil {
+		t.Fatalf("got error migrating postgres: %v", err)
+	}
+
+	stores["postgres"] = st
+
+	return stores
+}
+
+// contractSeed is what seedContract created. The private project has a
+// remote and a pipeline with two runs, one of which has a step.
+type contractSeed struct {
+	owner, outsider string
+
+	empty, private int
+	pipeline       int
+	run, stepped   int
+}
+
+// seedContract seeds the store with names that are unique to the test run,
+// so that it can be run against the same database more than once.
+func seedContract(t *testing.T, st RelayStore) contractSeed {
+	ctx := context.Background()
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("got error seeding store: %v", err)
+		}
+	}
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	seed := contractSeed{
+		owner:    "owner-" + suffix + "@test",
+		outsider: "outsider-" + suffix + "@test",
+	}
+
+	a, b := Group{Name: "a-" + suffix}, Group{Name: "b-" + suffix}
+	must(st.CreateGroup(ctx, &a))
+	must(st.CreateGroup(ctx, &b))
+	must(st.CreateUser(ctx, &User{Email: seed.owner, Password: "test", Group: a}))
+	must(st.CreateUser(ctx, &User{Email: seed.outsider, Password: "test", Group: b}))
+
+	empty := Project{
+		Name: "empty",
+		Authorization: Authorization{
+			User:        User{Email: seed.owner},
+			Permissions: Permission(PermGroupRead),
+		},
+	}
+	must(st.CreateProject(ctx, &empty))
+	seed.empty = empty.ID
+
+	private := Project{
+		Name: "private",
+		Authorization: Authorization{
+			User: User{Email: seed.owner},
+		},
+	}
+	must(st.CreateProject(ctx, &private))
+	seed.private = private.ID
+
+	remote := GitRemote{URL: "//" + suffix + ".git", Branch: "master", ProjectID: private.ID}
+	must(st.CreateGitRemote(ctx, seed.owner, &remote))
+
+	p := Pipeline{Name: "test", GitRemote: remote}
+	must(st.CreatePipeline(ctx, &p))
+	seed.pipeline = p.ID
+
+	r := Run{PipelineID: p.ID}
+	must(st.CreateRun(ctx, &r))
+	seed.run = r.Count
+
+	stepped := Run{PipelineID: p.ID}
+	must(st.CreateRun(ctx, &stepped))
+	seed.stepped = stepped.Count
+	must(st.CreateStep(ctx, &Step{Name: "test", PipelineID: p.ID, RunCount: stepped.Count}))
+
+	return seed
+}
+
+func TestStoreGetContract(t *testing.T) {
+	ctx := context.Background()
+
+	for name, st := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			seed := seedContract(t, st)
+
+			p, err := st.GetProject(ctx, seed.owner, seed.empty)
+			if err != nil {
+				t.Fatalf("got error getting project without remotes: %v", err)
+			}
+			if p.ID != seed.empty || len(p.GitRemotes) != 0 {
+				t.Fatalf("expected project %v without remotes, got %+v", seed.empty, p)
+			}
+
+			pl, err := st.GetPipeline(ctx, seed.owner, seed.pipeline)
+			if err != nil {
+				t.Fatalf("got error getting pipeline: %v", err)
+			}
+			if pl.ID != seed.pipeline || len(pl.Runs) != 2 {
+				t.Fatalf("expected pipeline %v with two runs, got %+v", seed.pipeline, pl)
+			}
+
+			r, err := st.GetRun(ctx, seed.owner, seed.pipeline, seed.run)
+			if err != nil {
+				t.Fatalf("got error getting run without steps: %v", err)
+			}
+			if r.Count != seed.run || len(r.Steps) != 0 {
+				t.Fatalf("expected run %v without steps, got %+v", seed.run, r)
+			}
+
+			r, err = st.GetRun(ctx, seed.owner, seed.pipeline, seed.stepped)
+			if err != nil {
+				t.Fatalf("got error getting run with steps: %v", err)
+			}
+			if r.Count != seed.stepped || len(r.Steps) != 1 {
+				t.Fatalf("expected run %v with a step, got %+v", seed.stepped, r)
+			}
+
+			tests := []struct {
+				name     string
+				users    []string
+				get      func(user string) error
+				expected error
+			}{
+				{
+					name:  "missing project",
+					users: []string{seed.owner, seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.GetProject(ctx, user, seed.private+1000)
+						return err
+					},
+					expected: ErrProjectNotFound,
+				},
+				{
+					name:  "private project",
+					users: []string{seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.GetProject(ctx, user, seed.private)
+						return err
+					},
+					expected: ErrProjectNotFound,
+				},
+				{
+					name:  "missing pipeline",
+					users: []string{seed.owner, seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.GetPipeline(ctx, user, seed.pipeline+1000)
+						return err
+					},
+					expected: ErrPipelineNotFound,
+				},
+				{
+					name:  "private pipeline",
+					users: []string{seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.GetPipeline(ctx, user, seed.pipeline)
+						return err
+					},
+					expected: ErrPipelineNotFound,
+				},
+				{
+					name:  "missing run",
+					users: []string{seed.owner, seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.GetRun(ctx, user, seed.pipeline, seed.stepped+1)
+						return err
+					},
+					expected: ErrRunNotFound,
+				},
+				{
+					name:  "private run",
+					users: []string{seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.GetRun(ctx, user, seed.pipeline, seed.run)
+						return err
+					},
+					expected: ErrRunNotFound,
+				},
+				{
+					name:  "private run with steps",
+					users: []string{seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.GetRun(ctx, user, seed.pipeline, seed.stepped)
+						return err
+					},
+					expected: ErrRunNotFound,
+				},
+				{
+					name:  "retry of missing run",
+					users: []string{seed.owner, seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.RetryRun(ctx, user, seed.pipeline, seed.stepped+1, false)
+						return err
+					},
+					expected: ErrRunNotFound,
+				},
+				{
+					name:  "retry of private run",
+					users: []string{seed.outsider, ""},
+					get: func(user string) error {
+						_, err := st.RetryRun(ctx, user, seed.pipeline, seed.run, false)
+						return err
+					},
+					expected: ErrRunNotFound,
+				},
+			}
+
+			for _, test := range tests {
+				for _, user := range test.users {
+					if err := test.get(user); err != test.expected {
+						t.Errorf("%v: expected %v for %q, got %v", test.name, test.expected, user, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStoreCancelContract(t *testing.T) {
+	ctx := context.Background()
+
+	for name, st := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			seed := seedContract(t, st)
+
+			cancelled, err := st.RunCancelled(ctx, seed.pipeline, seed.run)
+			if err != nil || cancelled {
+				t.Fatalf("expected run not to be cancelled, got %v and error %v", cancelled, err)
+			}
+
+			if _, err := st.RunCancelled(ctx, seed.pipeline, seed.stepped+1); err != ErrRunNotFound {
+				t.Fatalf("expected %v for missing run, got %v", ErrRunNotFound, err)
+			}
+
+			r := Run{PipelineID: seed.pipeline, Count: seed.run}
+			r.SetStart()
+			if err := st.StartRun(ctx, &r); err != nil {
+				t.Fatalf("got error starting run: %v", err)
+			}
+
+			// The run is cancelled before whatever is running it hears
+			// about it, so it finishes it as if it wasn't.
+			if _, err := st.CancelRun(ctx, seed.owner, seed.pipeline, seed.run); err != nil {
+				t.Fatalf("got error cancelling run: %v", err)
+			}
+
+			cancelled, err = st.RunCancelled(ctx, seed.pipeline, seed.run)
+			if err != nil || !cancelled {
+				t.Fatalf("expected run to be cancelled, got %v and error %v", cancelled, err)
+			}
+
+			r.SetEnd()
+			r.MarkSuccess(true)
+			if err := st.UpdateRun(ctx, &r); err != nil {
+				t.Fatalf("got error updating run: %v", err)
+			}
+
+			if !r.Cancelled || r.Success != nil {
+				t.Fatalf("expected updated run to be cancelled, got %+v", r)
+			}
+
+			got, err := st.GetRun(ctx, seed.owner, seed.pipeline, seed.run)
+			if err != nil {
+				t.Fatalf("got error getting run: %v", err)
+			}
+
+			if !got.Cancelled || got.Success != nil || got.End == nil {
+				t.Fatalf("expected run to stay cancelled, got %+v", got)
+			}
+		})
+	}
+}
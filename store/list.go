@@ -0,0 +1,338 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultListLimit is how many items a list call returns when
+	// it isn't asked for a specific number.
+	DefaultListLimit = 25
+	// MaxListLimit is the most items a single list call returns,
+	// no matter how many it's asked for.
+	MaxListLimit = 100
+)
+
+// ErrInvalidFilter is returned by list methods when the filter they're
+// given doesn't make sense, like an unknown run status or sort order.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Order is the direction a list is sorted in.
+type Order string
+
+const (
+	// OrderAsc sorts oldest, or lowest, first.
+	OrderAsc = Order("asc")
+	// OrderDesc sorts newest, or highest, first.
+	OrderDesc = Order("desc")
+)
+
+// SortField is what a list of named resources is sorted by.
+type SortField string
+
+const (
+	// SortByID sorts by ID, which is the order things were created in.
+	SortByID = SortField("id")
+	// SortByName sorts by name, byte by byte. Ties are broken by ID.
+	SortByName = SortField("name")
+)
+
+// ListFilter narrows down, sorts and pages through a list of named
+// resources like projects and pipelines. The zero value lists the
+// first page of everything, by ID.
+type ListFilter struct {
+	// Name only lets through resources with this in their name,
+	// ignoring case. Empty means any name.
+	Name string
+
+	// Sort is what the list is sorted by. It defaults to SortByID.
+	Sort SortField
+	// Order is the direction of the sort. It defaults to OrderAsc.
+	Order Order
+
+	// After is the cursor to continue from, as handed out by the
+	// previous page. Empty means start from the beginning. A cursor
+	// only makes sense with the same sort it was handed out with.
+	After string
+
+	// Limit is the most items to list. It defaults to DefaultListLimit
+	// and can't be more than MaxListLimit.
+	Limit int
+}
+
+// ProjectPage is one page of projects. The projects don't have their
+// remotes filled in.
+type ProjectPage struct {
+	Projects []Project
+
+	// Next is the cursor for the page after this one, to be passed in
+	// as ListFilter.After. It's empty on the last page.
+	Next string
+}
+
+// PipelinePage is one page of pipelines. The pipelines don't have their
+// runs filled in.
+type PipelinePage struct {
+	Pipelines []Pipeline
+
+	// Next is the cursor for the page after this one, to be passed in
+	// as ListFilter.After. It's empty on the last page.
+	Next string
+}
+
+// listCursor is what's behind the cursors handed out for a ListFilter.
+// It's the sort key of the last item on a page.
+type listCursor struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+func (c listCursor) encode() string {
+	buf, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(raw string) (listCursor, error) {
+	c := listCursor{}
+
+	buf, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, ErrInvalidFilter
+	}
+
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return c, ErrInvalidFilter
+	}
+
+	return c, nil
+}
+
+// normalize fills in the defaults of the filter and decodes its cursor.
+// The cursor is nil if the filter doesn't have one.
+func (f ListFilter) normalize() (ListFilter, *listCursor, error) {
+	switch f.Sort {
+	case "":
+		f.Sort = SortByID
+	case SortByID, SortByName:
+	default:
+		return f, nil, ErrInvalidFilter
+	}
+
+	switch f.Order {
+	case "":
+		f.Order = OrderAsc
+	case OrderAsc, OrderDesc:
+	default:
+		return f, nil, ErrInvalidFilter
+	}
+
+	f.Limit = normalizeLimit(f.Limit)
+
+	if f.After == "" {
+		return f, nil, nil
+	}
+
+	c, err := decodeCursor(f.After)
+	if err != nil {
+		return f, nil, err
+	}
+
+	return f, &c, nil
+}
+
+// less reports whether a sorts before b, in ascending order.
+func (f ListFilter) less(a, b listCursor) bool {
+	if f.Sort == SortByName && a.Name != b.Name {
+		return a.Name < b.Name
+	}
+
+	return a.ID < b.ID
+}
+
+// page picks the page the filter asks for out of n items. key returns
+// the ID and name of the ith item. It returns the indices of the items
+// on the page, in order, and the cursor for the next page.
+func (f ListFilter) page(n int, key func(i int) (int, string)) ([]int, string, error) {
+	f, after, err := f.normalize()
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]listCursor, n)
+	idxs := []int{}
+	for i := 0; i < n; i++ {
+		id, name := key(i)
+		keys[i] = listCursor{ID: id, Name: name}
+
+		if f.Name != "" && !strings.Contains(strings.ToLower(name), strings.ToLower(f.Name)) {
+			continue
+		}
+
+		idxs = append(idxs, i)
+	}
+
+	// before reports whether a comes before b in the requested order.
+	before := func(a, b listCursor) bool {
+		if f.Order == OrderDesc {
+			return f.less(b, a)
+		}
+
+		return f.less(a, b)
+	}
+
+	sort.Slice(idxs, func(i, j int) bool {
+		return before(keys[idxs[i]], keys[idxs[j]])
+	})
+
+	if after != nil {
+		start := sort.Search(len(idxs), func(i int) bool {
+			return before(*after, keys[idxs[i]])
+		})
+		idxs = idxs[start:]
+	}
+
+	if len(idxs) <= f.Limit {
+		return idxs, "", nil
+	}
+
+	idxs = idxs[:f.Limit]
+	last := keys[idxs[len(idxs)-1]]
+
+	return idxs, f.cursor(last.ID, last.Name), nil
+}
+
+// cursor returns the cursor pointing past the item with the given ID
+// and name. Only what the filter sorts by goes in the cursor.
+func (f ListFilter) cursor(id int, name string) string {
+	c := listCursor{ID: id}
+	if f.Sort == SortByName {
+		c.Name = name
+	}
+
+	return c.encode()
+}
+
+// RunStatus is the state of a run as far as filtering is concerned.
+type RunStatus string
+
+const (
+	// RunSucceeded matches runs that finished successfully.
+	RunSucceeded = RunStatus("success")
+	// RunFailed matches runs that finished unsuccessfully.
+	RunFailed = RunStatus("failure")
+	// RunInProgress matches runs that haven't finished yet.
+	RunInProgress = RunStatus("in_progress")
+	// RunCancelled matches runs that were cancelled.
+	RunCancelled = RunStatus("cancelled")
+)
+
+// RunFilter narrows down and pages through the runs of a pipeline.
+// The zero value lists the first page of all runs, newest first.
+type RunFilter struct {
+	// Status only lets through runs in this state. Empty means any.
+	Status RunStatus
+
+	// Since and Until bound the start time of the runs. Since is
+	// inclusive and Until is exclusive. Either can be left nil.
+	Since *time.Time
+	Until *time.Time
+
+	// Order is the order runs are listed in by count. It defaults
+	// to OrderDesc.
+	Order Order
+
+	// After is the cursor to continue from. Only runs that come after
+	// the run with this count, in Order, are listed. Zero means start
+	// from the beginning.
+	After int
+
+	// Limit is the most runs to list. It defaults to DefaultListLimit
+	// and can't be more than MaxListLimit.
+	Limit int
+}
+
+// RunPage is one page of a pipeline's runs. The runs are summaries,
+// they don't have their steps or their definitions filled in.
+type RunPage struct {
+	Runs []Run
+
+	// Next is the cursor for the page after this one, to be passed
+	// in as RunFilter.After. It's zero on the last page.
+	Next int
+}
+
+// normalize fills in the defaults of the filter and makes sure it's
+// something the stores can work with.
+func (f RunFilter) normalize() (RunFilter, error) {
+	switch f.Status {
+	case "", RunSucceeded, RunFailed, RunInProgress, RunCancelled:
+	default:
+		return f, ErrInvalidFilter
+	}
+
+	switch f.Order {
+	case "":
+		f.Order = OrderDesc
+	case OrderAsc, OrderDesc:
+	default:
+		return f, ErrInvalidFilter
+	}
+
+	if f.After < 0 {
+		return f, ErrInvalidFilter
+	}
+
+	f.Limit = normalizeLimit(f.Limit)
+
+	return f, nil
+}
+
+// matches reports whether r gets through the status and time filters.
+// It doesn't look at the cursor.
+func (f RunFilter) matches(r Run) bool {
+	switch f.Status {
+	case RunSucceeded:
+		if r.Success == nil || !*r.Success {
+			return false
+		}
+	case RunFailed:
+		if !r.Failed() {
+			return false
+		}
+	case RunInProgress:
+		if r.Success != nil || r.Cancelled {
+			return false
+		}
+	case RunCancelled:
+		if !r.Cancelled {
+			return false
+		}
+	}
+
+	if f.Since != nil && (r.Start == nil || r.Start.Before(*f.Since)) {
+		return false
+	}
+
+	if f.Until != nil && (r.Start == nil || !r.Start.Before(*f.Until)) {
+		return false
+	}
+
+	return true
+}
+
+func normalizeLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultListLimit
+	}
+
+	if limit > MaxListLimit {
+		return MaxListLimit
+	}
+
+	return limit
+}
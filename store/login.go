@@ -0,0 +1,38 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FailedLogin is a record of someone failing to log in, kept for
+// auditing.
+type FailedLogin struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	// IP is the address the login came from.
+	IP string `json:"ip"`
+	// Reason is why the login failed, like the password being wrong or
+	// the account being locked out.
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+var (
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// compareDummy compares the password against a hash that it never
+// matches. It's for when there's no user to check the password of, so
+// that logging in as someone who doesn't exist takes as long as logging
+// in with the wrong password, and can't be told apart by timing.
+func compareDummy(pass string) {
+	dummyOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("relay"), bcrypt.DefaultCost)
+	})
+
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+}
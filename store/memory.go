@@ -0,0 +1,1750 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/run-ci/relay/authz"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Memory is a RelayStore that keeps everything in process memory. It's
+// meant for local development and tests, where standing up Postgres is
+// more trouble than it's worth. Nothing is persisted.
+type Memory struct {
+	mu   sync.RWMutex
+	root *rootnode
+}
+
+// NewMemory returns an empty in-memory RelayStore. Like a freshly created
+// database, it has no groups or users in it, so callers need to seed it
+// before anyone can authenticate.
+func NewMemory() *Memory {
+	logger.WithField("store", "memory").Debug("initializing in-memory store")
+
+	return &Memory{
+		root: newRootnode(),
+	}
+}
+
+// CreateProject saves the project and sets its ID. The project is shared
+// with the group of the user creating it.
+func (st *Memory) CreateProject(ctx context.Context, p *Project) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":   "memory",
+		"project": p.Name,
+	})
+	logger.Debug("saving project")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	u, ok := st.root.users[p.User.Email]
+	if !ok {
+		logger.WithError(ErrUserNotFound).Debug("unable to create project")
+		return ErrUserNotFound
+	}
+
+	st.root.projectSeq++
+	p.ID = st.root.projectSeq
+	p.User = u.data
+	// Projects only know about their owner's primary group, like
+	// they do in Postgres.
+	p.User.Groups = nil
+	p.Group = u.data.Group
+	p.GitRemotes = nil
+
+	st.root.projects[p.ID] = &projectnode{
+		children: make(map[string]*remotenode),
+		data:     *p,
+	}
+
+	return nil
+}
+
+// GetProject returns the project with the given ID and its remotes, if
+// it's readable by the user.
+func (st *Memory) GetProject(ctx context.Context, user string, id int) (Project, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store":      "memory",
+		"project_id": id,
+	}).Debug("getting project")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	pn, ok := st.root.projects[id]
+	if !ok || !st.readable(user, pn) {
+		return Project{}, ErrProjectNotFound
+	}
+
+	p := pn.data
+	p.GitRemotes = []GitRemote{}
+	for _, rn := range sortedRemotes(pn) {
+		p.GitRemotes = append(p.GitRemotes, rn.data)
+	}
+
+	return p, nil
+}
+
+// UpdateProject applies the update to the project.
+func (st *Memory) UpdateProject(ctx context.Context, user string, id int, u ProjectUpdate) (Project, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":      "memory",
+		"project_id": id,
+	})
+	logger.Debug("updating project")
+
+	if u.Permissions != nil && !u.Permissions.Valid() {
+		return Project{}, ErrInvalidPermissions
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pn, ok := st.root.projects[id]
+	if !ok || !st.readable(user, pn) {
+		return Project{}, ErrProjectNotFound
+	}
+
+	if !st.can(user, pn, authz.Admin) {
+		return Project{}, ErrNotAuthorized
+	}
+
+	if u.Name != nil {
+		pn.data.Name = *u.Name
+	}
+
+	if u.Description != nil {
+		pn.data.Description = *u.Description
+	}
+
+	if u.Permissions != nil {
+		pn.data.Permissions = *u.Permissions
+	}
+
+	return pn.data, nil
+}
+
+// GetProjects returns a page of the projects readable by the user, without
+// their remotes.
+func (st *Memory) GetProjects(ctx context.Context, user string, f ListFilter) (ProjectPage, error) {
+	ctxlogger(ctx).WithField("store", "memory").Debug("getting all projects")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	readable := []Project{}
+	for _, pn := range st.root.projects {
+		if st.readable(user, pn) {
+			readable = append(readable, pn.data)
+		}
+	}
+
+	idxs, next, err := f.page(len(readable), func(i int) (int, string) {
+		return readable[i].ID, readable[i].Name
+	})
+	if err != nil {
+		return ProjectPage{}, err
+	}
+
+	page := ProjectPage{Projects: []Project{}, Next: next}
+	for _, i := range idxs {
+		page.Projects = append(page.Projects, readable[i])
+	}
+
+	return page, nil
+}
+
+// CreateGitRemote saves the remote under its project. The user needs to be
+// able to write to the project.
+func (st *Memory) CreateGitRemote(ctx context.Context, user string, r *GitRemote) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":      "memory",
+		"url":        r.URL,
+		"branch":     r.Branch,
+		"project_id": r.ProjectID,
+	})
+	logger.Debug("saving remote")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pn, ok := st.root.projects[r.ProjectID]
+	if !ok || !st.readable(user, pn) {
+		logger.WithError(ErrProjectNotFound).Debug("unable to find project for user")
+		return ErrProjectNotFound
+	}
+
+	if !st.writable(user, pn) {
+		logger.WithError(ErrNotAuthorized).Debug("unable to save remote")
+		return ErrNotAuthorized
+	}
+
+	remote := GitRemote{
+		URL:       r.URL,
+		Branch:    r.Branch,
+		ProjectID: r.ProjectID,
+	}
+	pn.children[remoteKey(r.URL, r.Branch)] = &remotenode{
+		children: make(map[string]*pipelinenode),
+		data:     remote,
+	}
+
+	return nil
+}
+
+// GetGitRemote returns the remote with the given URL and branch from the
+// project with the given ID.
+func (st *Memory) GetGitRemote(ctx context.Context, user string, pid int, url, branch string) (GitRemote, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store":      "memory",
+		"project_id": pid,
+	}).Debug("getting git remote")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	pn, ok := st.root.projects[pid]
+	if !ok || !st.readable(user, pn) {
+		return GitRemote{}, ErrGitRemoteNotFound
+	}
+
+	rn, ok := pn.children[remoteKey(url, branch)]
+	if !ok {
+		return GitRemote{}, ErrGitRemoteNotFound
+	}
+
+	return rn.data, nil
+}
+
+// SetWebhookSecret sets the secret the remote's webhooks are checked with.
+func (st *Memory) SetWebhookSecret(ctx context.Context, user string, pid int, url, branch, secret string) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":      "memory",
+		"project_id": pid,
+		"url":        url,
+		"branch":     branch,
+	})
+	logger.Debug("setting webhook secret")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pn, ok := st.root.projects[pid]
+	if !ok || !st.readable(user, pn) {
+		logger.WithError(ErrGitRemoteNotFound).Debug("unable to set webhook secret")
+		return ErrGitRemoteNotFound
+	}
+
+	// Anyone with the secret can start runs, so it takes being able to
+	// start them to set it.
+	if !st.writable(user, pn) || !st.can(user, pn, authz.Run) {
+		logger.WithError(ErrNotAuthorized).Debug("unable to set webhook secret")
+		return ErrNotAuthorized
+	}
+
+	rn, ok := pn.children[remoteKey(url, branch)]
+	if !ok {
+		logger.WithError(ErrGitRemoteNotFound).Debug("unable to set webhook secret")
+		return ErrGitRemoteNotFound
+	}
+
+	rn.secret = secret
+
+	return nil
+}
+
+// GetHookRemotes returns the remotes on the branch with any of the URLs
+// that have a webhook secret, with their pipelines.
+func (st *Memory) GetHookRemotes(ctx context.Context, urls []string, branch string) ([]HookRemote, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store":  "memory",
+		"urls":   urls,
+		"branch": branch,
+	}).Debug("getting webhook remotes")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	remotes := []HookRemote{}
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		key := remoteKey(url, branch)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		rn := st.findRemote(url, branch)
+		if rn == nil || rn.secret == "" {
+			continue
+		}
+
+		hr := HookRemote{GitRemote: rn.data, Secret: rn.secret}
+		hr.Pipelines = []Pipeline{}
+		for _, pln := range sortedPipelines(rn) {
+			p := pln.data
+			p.GitRemote = rn.data
+			hr.Pipelines = append(hr.Pipelines, p)
+		}
+
+		remotes = append(remotes, hr)
+	}
+
+	return remotes, nil
+}
+
+// GetPipelines returns a page of the pipelines in the project with the
+// given ID.
+func (st *Memory) GetPipelines(ctx context.Context, user string, pid int, f ListFilter) (PipelinePage, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store":      "memory",
+		"project_id": pid,
+	}).Debug("getting pipelines")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	ps := []Pipeline{}
+
+	pn, ok := st.root.projects[pid]
+	if ok && st.readable(user, pn) {
+		for _, rn := range pn.children {
+			for _, pln := range rn.children {
+				ps = append(ps, pln.data)
+			}
+		}
+	}
+
+	idxs, next, err := f.page(len(ps), func(i int) (int, string) {
+		return ps[i].ID, ps[i].Name
+	})
+	if err != nil {
+		return PipelinePage{}, err
+	}
+
+	page := PipelinePage{Pipelines: []Pipeline{}, Next: next}
+	for _, i := range idxs {
+		page.Pipelines = append(page.Pipelines, ps[i])
+	}
+
+	return page, nil
+}
+
+// GetPipeline returns the pipeline with the given ID along with its runs.
+// The runs don't have their steps filled in.
+func (st *Memory) GetPipeline(ctx context.Context, user string, id int) (Pipeline, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"id":    id,
+	}).Debug("getting pipeline")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	pln, ok := st.root.pipelines[id]
+	if !ok || !st.readable(user, st.projectOf(pln)) {
+		return Pipeline{}, ErrPipelineNotFound
+	}
+
+	p := pln.data
+	p.Runs = []Run{}
+	for _, rn := range sortedRuns(pln) {
+		r := rn.data
+		r.Definition = nil
+		p.Runs = append(p.Runs, r)
+	}
+
+	return p, nil
+}
+
+// GetPipelineID returns the ID of the pipeline with the given name on the
+// given remote. If there isn't one, it returns ErrNoPipelines.
+func (st *Memory) GetPipelineID(ctx context.Context, remote GitRemote, name string) (int, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store":  "memory",
+		"url":    remote.URL,
+		"branch": remote.Branch,
+		"name":   name,
+	}).Debug("getting pipeline id")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	for _, pln := range st.root.pipelines {
+		gr := pln.data.GitRemote
+		if gr.URL == remote.URL && gr.Branch == remote.Branch && pln.data.Name == name {
+			return pln.data.ID, nil
+		}
+	}
+
+	return 0, ErrNoPipelines
+}
+
+// SetPipelineDefinition saves the steps the pipeline was last run with.
+func (st *Memory) SetPipelineDefinition(ctx context.Context, id int, def json.RawMessage) error {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"id":    id,
+	}).Debug("setting pipeline definition")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pln, ok := st.root.pipelines[id]
+	if !ok {
+		return ErrPipelineNotFound
+	}
+
+	pln.data.Definition = append(json.RawMessage(nil), def...)
+
+	return nil
+}
+
+// CreatePipeline saves the pipeline under the remote it came from and
+// sets its ID. If no project has that remote, it returns
+// ErrGitRemoteNotFound.
+func (st *Memory) CreatePipeline(ctx context.Context, p *Pipeline) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":  "memory",
+		"name":   p.Name,
+		"url":    p.GitRemote.URL,
+		"branch": p.GitRemote.Branch,
+	})
+	logger.Debug("saving pipeline")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rn := st.findRemote(p.GitRemote.URL, p.GitRemote.Branch)
+	if rn == nil {
+		logger.WithError(ErrGitRemoteNotFound).Debug("unable to create pipeline")
+		return ErrGitRemoteNotFound
+	}
+
+	st.root.pipelineSeq++
+	p.ID = st.root.pipelineSeq
+	p.ProjectID = rn.data.ProjectID
+	p.GitRemote.ProjectID = rn.data.ProjectID
+
+	data := *p
+	data.Runs = nil
+
+	pln := &pipelinenode{
+		children: make(map[int]*runnode),
+		parent:   rn,
+		data:     data,
+	}
+	rn.children[p.Name] = pln
+	st.root.pipelines[p.ID] = pln
+
+	return nil
+}
+
+// CreateRun saves the run and sets its count to the next one in its
+// pipeline.
+func (st *Memory) CreateRun(ctx context.Context, r *Run) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":       "memory",
+		"pipeline_id": r.PipelineID,
+	})
+	logger.Debug("saving pipeline run")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pln, ok := st.root.pipelines[r.PipelineID]
+	if !ok {
+		logger.WithError(ErrPipelineNotFound).Debug("unable to save pipeline run")
+		return ErrPipelineNotFound
+	}
+
+	st.addRun(pln, r)
+
+	return nil
+}
+
+// QueueRun saves a run the user wants to start and sets its count.
+func (st *Memory) QueueRun(ctx context.Context, user string, r *Run) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":       "memory",
+		"pipeline_id": r.PipelineID,
+	})
+	logger.Debug("queuing pipeline run")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pln, ok := st.root.pipelines[r.PipelineID]
+	if !ok || !st.readable(user, st.projectOf(pln)) {
+		logger.WithError(ErrPipelineNotFound).Debug("unable to queue pipeline run")
+		return ErrPipelineNotFound
+	}
+
+	if !st.can(user, st.projectOf(pln), authz.Run) {
+		logger.WithError(ErrNotAuthorized).Debug("unable to queue pipeline run")
+		return ErrNotAuthorized
+	}
+
+	st.addRun(pln, r)
+
+	return nil
+}
+
+// StartRun sets the start time of a queued run, unless it was cancelled.
+func (st *Memory) StartRun(ctx context.Context, r *Run) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rn := st.findRun(r.PipelineID, r.Count)
+	if rn == nil {
+		return ErrRunNotFound
+	}
+
+	if rn.data.Cancelled {
+		return ErrRunCancelled
+	}
+
+	rn.data.Start = r.Start
+
+	return nil
+}
+
+// RunCancelled returns whether the run has been cancelled.
+func (st *Memory) RunCancelled(ctx context.Context, pid, n int) (bool, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	rn := st.findRun(pid, n)
+	if rn == nil {
+		return false, ErrRunNotFound
+	}
+
+	return rn.data.Cancelled, nil
+}
+
+// CancelRun marks the nth run of the pipeline with the given ID as
+// cancelled, and ends it if it hasn't started.
+func (st *Memory) CancelRun(ctx context.Context, user string, pid, n int) (Run, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":       "memory",
+		"pipeline_id": pid,
+		"count":       n,
+	})
+	logger.Debug("cancelling run")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pln, ok := st.root.pipelines[pid]
+	if !ok || !st.readable(user, st.projectOf(pln)) {
+		logger.WithError(ErrRunNotFound).Debug("unable to cancel run")
+		return Run{}, ErrRunNotFound
+	}
+
+	if !st.can(user, st.projectOf(pln), authz.Run) {
+		logger.WithError(ErrNotAuthorized).Debug("unable to cancel run")
+		return Run{}, ErrNotAuthorized
+	}
+
+	rn, ok := pln.children[n]
+	if !ok {
+		logger.WithError(ErrRunNotFound).Debug("unable to cancel run")
+		return Run{}, ErrRunNotFound
+	}
+
+	if rn.data.End != nil {
+		logger.WithError(ErrRunFinished).Debug("unable to cancel run")
+		return Run{}, ErrRunFinished
+	}
+
+	rn.data.MarkCancelled()
+	if rn.data.Start == nil {
+		rn.data.SetEnd()
+	}
+
+	return rn.data, nil
+}
+
+// RetryRun queues a run with what the nth run of the pipeline with the given
+// ID was run with. Resuming it copies the steps the old run got through.
+func (st *Memory) RetryRun(ctx context.Context, user string, pid, n int, resume bool) (Run, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":       "memory",
+		"pipeline_id": pid,
+		"count":       n,
+		"resume":      resume,
+	})
+	logger.Debug("retrying run")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pln, ok := st.root.pipelines[pid]
+	if !ok || !st.readable(user, st.projectOf(pln)) {
+		logger.WithError(ErrRunNotFound).Debug("unable to retry run")
+		return Run{}, ErrRunNotFound
+	}
+
+	if !st.can(user, st.projectOf(pln), authz.Run) {
+		logger.WithError(ErrNotAuthorized).Debug("unable to retry run")
+		return Run{}, ErrNotAuthorized
+	}
+
+	rn, ok := pln.children[n]
+	if !ok {
+		logger.WithError(ErrRunNotFound).Debug("unable to retry run")
+		return Run{}, ErrRunNotFound
+	}
+
+	old := rn.data
+	err := checkRetry(old, resume)
+	if err != nil {
+		logger.WithError(err).Debug("unable to retry run")
+		return Run{}, err
+	}
+
+	r := Run{
+		PipelineID: pid,
+		Branch:     old.Branch,
+		Commit:     old.Commit,
+		Parameters: old.Parameters,
+		Definition: old.Definition,
+		RetryOf:    n,
+	}
+	st.addRun(pln, &r)
+
+	if !resume {
+		return r, nil
+	}
+
+	nrn := pln.children[r.Count]
+	for _, sn := range sortedSteps(rn) {
+		if sn.data.Success == nil || !*sn.data.Success {
+			break
+		}
+
+		s := sn.data
+		s.RunCount = r.Count
+		nsn := st.addStep(nrn, &s)
+
+		for _, tn := range sortedTasks(sn) {
+			t := tn.data
+			t.StepID = s.ID
+			st.addTask(nsn, &t)
+		}
+
+		r.Steps = append(r.Steps, s)
+	}
+
+	return r, nil
+}
+
+// addRun saves the run under the pipeline with the next count.
+func (st *Memory) addRun(pln *pipelinenode, r *Run) {
+	pln.runSeq++
+	r.Count = pln.runSeq
+
+	data := *r
+	data.Steps = nil
+
+	pln.children[r.Count] = &runnode{
+		children: make(map[int]*stepnode),
+		data:     data,
+	}
+}
+
+// CreateStep saves the step under its run and sets its ID.
+func (st *Memory) CreateStep(ctx context.Context, s *Step) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":       "memory",
+		"pipeline_id": s.PipelineID,
+		"run_count":   s.RunCount,
+		"name":        s.Name,
+	})
+	logger.Debug("saving run step")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rn := st.findRun(s.PipelineID, s.RunCount)
+	if rn == nil {
+		logger.WithError(ErrRunNotFound).Debug("unable to save run step")
+		return ErrRunNotFound
+	}
+
+	st.addStep(rn, s)
+
+	return nil
+}
+
+// addStep saves the step under the run with the next ID, and returns its
+// node.
+func (st *Memory) addStep(rn *runnode, s *Step) *stepnode {
+	st.root.stepSeq++
+	s.ID = st.root.stepSeq
+
+	data := *s
+	data.Tasks = nil
+
+	sn := &stepnode{
+		children: make(map[int]*tasknode),
+		parent:   rn,
+		data:     data,
+	}
+	rn.children[s.ID] = sn
+	st.root.steps[s.ID] = sn
+
+	return sn
+}
+
+// CreateTask saves the task under its step and sets its ID.
+func (st *Memory) CreateTask(ctx context.Context, t *Task) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":   "memory",
+		"name":    t.Name,
+		"step_id": t.StepID,
+	})
+	logger.Debug("saving step task")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sn, ok := st.root.steps[t.StepID]
+	if !ok {
+		logger.WithError(ErrStepNotFound).Debug("unable to save step task")
+		return ErrStepNotFound
+	}
+
+	st.addTask(sn, t)
+
+	return nil
+}
+
+// addTask saves the task under the step with the next ID.
+func (st *Memory) addTask(sn *stepnode, t *Task) {
+	st.root.taskSeq++
+	t.ID = st.root.taskSeq
+
+	tn := &tasknode{
+		parent: sn,
+		data:   *t,
+	}
+	sn.children[t.ID] = tn
+	st.root.tasks[t.ID] = tn
+}
+
+// UpdatePipeline updates the pipeline's success status.
+func (st *Memory) UpdatePipeline(ctx context.Context, p *Pipeline) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pln, ok := st.root.pipelines[p.ID]
+	if !ok {
+		return ErrPipelineNotFound
+	}
+
+	pln.data.Success = p.Success
+
+	return nil
+}
+
+// UpdateRun updates the run's start and end times, its success and
+// cancelled statuses, and the commit it checked out.
+func (st *Memory) UpdateRun(ctx context.Context, r *Run) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rn := st.findRun(r.PipelineID, r.Count)
+	if rn == nil {
+		return ErrRunNotFound
+	}
+
+	rn.data.Start = r.Start
+	rn.data.Success = r.Success
+	rn.data.Commit = r.Commit
+	rn.data.End = r.End
+
+	// Whatever is running the run might not have heard that it was
+	// cancelled, which doesn't make it any less cancelled.
+	if rn.data.Cancelled || r.Cancelled {
+		rn.data.MarkCancelled()
+		r.MarkCancelled()
+	}
+
+	return nil
+}
+
+// UpdateStep updates the step's success and cancelled statuses and end time.
+func (st *Memory) UpdateStep(ctx context.Context, s *Step) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sn, ok := st.root.steps[s.ID]
+	if !ok {
+		return ErrStepNotFound
+	}
+
+	sn.data.Success = s.Success
+	sn.data.Cancelled = s.Cancelled
+	sn.data.End = s.End
+
+	return nil
+}
+
+// UpdateTask updates the task's success and cancelled statuses and end time.
+func (st *Memory) UpdateTask(ctx context.Context, t *Task) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	tn, ok := st.root.tasks[t.ID]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	tn.data.Success = t.Success
+	tn.data.Cancelled = t.Cancelled
+	tn.data.End = t.End
+
+	return nil
+}
+
+// GetRun returns the nth run of the pipeline with the given ID, along
+// with its steps.
+func (st *Memory) GetRun(ctx context.Context, user string, pid, n int) (Run, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store":       "memory",
+		"pipeline_id": pid,
+		"count":       n,
+	}).Debug("getting run")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	pln, ok := st.root.pipelines[pid]
+	if !ok || !st.readable(user, st.projectOf(pln)) {
+		return Run{}, ErrRunNotFound
+	}
+
+	rn, ok := pln.children[n]
+	if !ok {
+		return Run{}, ErrRunNotFound
+	}
+
+	r := rn.data
+	r.Steps = []Step{}
+	for _, sn := range sortedSteps(rn) {
+		r.Steps = append(r.Steps, sn.data)
+	}
+
+	return r, nil
+}
+
+// ListRuns returns a page of the pipeline's runs that match the filter.
+func (st *Memory) ListRuns(ctx context.Context, user string, pid int, f RunFilter) (RunPage, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":       "memory",
+		"pipeline_id": pid,
+	})
+	logger.Debug("listing runs")
+
+	f, err := f.normalize()
+	if err != nil {
+		return RunPage{}, err
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	pln, ok := st.root.pipelines[pid]
+	if !ok || !st.readable(user, st.projectOf(pln)) {
+		return RunPage{}, ErrPipelineNotFound
+	}
+
+	rns := sortedRuns(pln)
+	if f.Order == OrderDesc {
+		for i, j := 0, len(rns)-1; i < j; i, j = i+1, j-1 {
+			rns[i], rns[j] = rns[j], rns[i]
+		}
+	}
+
+	page := RunPage{Runs: []Run{}}
+	for _, rn := range rns {
+		r := rn.data
+
+		if f.After != 0 {
+			if f.Order == OrderAsc && r.Count <= f.After {
+				continue
+			}
+			if f.Order == OrderDesc && r.Count >= f.After {
+				continue
+			}
+		}
+
+		if !f.matches(r) {
+			continue
+		}
+
+		if len(page.Runs) == f.Limit {
+			page.Next = page.Runs[len(page.Runs)-1].Count
+			break
+		}
+
+		r.Steps = nil
+		r.Definition = nil
+		page.Runs = append(page.Runs, r)
+	}
+
+	return page, nil
+}
+
+// GetStep returns the step with the given ID along with its tasks.
+func (st *Memory) GetStep(ctx context.Context, user string, id int) (Step, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"id":    id,
+	}).Debug("getting step")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	sn, ok := st.root.steps[id]
+	if !ok || !st.readable(user, st.projectOf(st.root.pipelines[sn.data.PipelineID])) {
+		return Step{}, ErrStepNotFound
+	}
+
+	s := sn.data
+	s.Tasks = []Task{}
+	for _, tn := range sortedTasks(sn) {
+		s.Tasks = append(s.Tasks, tn.data)
+	}
+
+	return s, nil
+}
+
+// GetTask returns the task with the given ID.
+func (st *Memory) GetTask(ctx context.Context, user string, id int) (Task, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"id":    id,
+	}).Debug("getting task")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	tn, ok := st.root.tasks[id]
+	if !ok {
+		return Task{}, ErrTaskNotFound
+	}
+
+	pln := st.root.pipelines[tn.parent.data.PipelineID]
+	if !st.readable(user, st.projectOf(pln)) {
+		return Task{}, ErrTaskNotFound
+	}
+
+	return tn.data, nil
+}
+
+// DeleteProject removes the project along with its remotes and everything
+// under them.
+func (st *Memory) DeleteProject(ctx context.Context, user string, id int) ([]GitRemote, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"id":    id,
+	})
+	logger.Debug("deleting project")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pn, ok := st.root.projects[id]
+	if !ok || !st.readable(user, pn) {
+		return nil, ErrProjectNotFound
+	}
+
+	if !st.writable(user, pn) {
+		return nil, ErrNotAuthorized
+	}
+
+	remotes := []GitRemote{}
+	for _, rn := range sortedRemotes(pn) {
+		st.deleteRemote(pn, rn)
+		remotes = append(remotes, rn.data)
+	}
+
+	delete(st.root.projects, id)
+
+	return remotes, nil
+}
+
+// DeleteGitRemote removes the remote from the project along with its
+// pipelines and everything under them.
+func (st *Memory) DeleteGitRemote(ctx context.Context, user string, pid int, url, branch string) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store":      "memory",
+		"project_id": pid,
+		"url":        url,
+		"branch":     branch,
+	})
+	logger.Debug("deleting git remote")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pn, ok := st.root.projects[pid]
+	if !ok || !st.readable(user, pn) {
+		return ErrGitRemoteNotFound
+	}
+
+	if !st.writable(user, pn) {
+		return ErrNotAuthorized
+	}
+
+	rn, ok := pn.children[remoteKey(url, branch)]
+	if !ok {
+		return ErrGitRemoteNotFound
+	}
+
+	st.deleteRemote(pn, rn)
+
+	return nil
+}
+
+// DeletePipeline removes the pipeline along with its runs, steps and tasks.
+func (st *Memory) DeletePipeline(ctx context.Context, user string, id int) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"id":    id,
+	})
+	logger.Debug("deleting pipeline")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pln, ok := st.root.pipelines[id]
+	if !ok || !st.readable(user, st.projectOf(pln)) {
+		return ErrPipelineNotFound
+	}
+
+	if !st.writable(user, st.projectOf(pln)) {
+		return ErrNotAuthorized
+	}
+
+	st.deletePipeline(pln)
+
+	return nil
+}
+
+// CreateGroup saves the group. Group names are unique.
+func (st *Memory) CreateGroup(ctx context.Context, g *Group) error {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"name":  g.Name,
+	}).Debug("saving group")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.root.groups[g.Name]; ok {
+		return ErrGroupExists
+	}
+
+	group := *g
+	st.root.groups[g.Name] = &group
+
+	return nil
+}
+
+// GetGroups returns every group, sorted by name.
+func (st *Memory) GetGroups(ctx context.Context) ([]Group, error) {
+	ctxlogger(ctx).WithField("store", "memory").Debug("getting groups")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	groups := make([]Group, 0, len(st.root.groups))
+	for _, g := range st.root.groups {
+		groups = append(groups, *g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	return groups, nil
+}
+
+// DeleteGroup deletes the group, as long as no user or project is in it.
+func (st *Memory) DeleteGroup(ctx context.Context, name string) error {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"name":  name,
+	}).Debug("deleting group")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.root.groups[name]; !ok {
+		return ErrGroupNotFound
+	}
+
+	for _, u := range st.root.users {
+		for _, g := range u.data.Groups {
+			if g.Name == name {
+				return ErrGroupInUse
+			}
+		}
+	}
+
+	for _, pn := range st.root.projects {
+		if pn.data.Group.Name == name {
+			return ErrGroupInUse
+		}
+	}
+
+	delete(st.root.groups, name)
+
+	return nil
+}
+
+// CreateUser saves the user with its password hashed. Users without a
+// group are put in DefaultGroup, which has to exist already.
+func (st *Memory) CreateUser(ctx context.Context, u *User) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": u.Email,
+	})
+	logger.Debug("saving user")
+
+	if u.Group.Name == "" {
+		logger.Debugf("got user with no group, setting to %v", DefaultGroup.Name)
+		u.Group = DefaultGroup
+	}
+
+	password, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	if err != nil {
+		logger.WithError(err).Debug("unable to encrypt password")
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	u.Groups = memberships(u.Group, u.Groups)
+	for _, g := range u.Groups {
+		if _, ok := st.root.groups[g.Name]; !ok {
+			return ErrGroupNotFound
+		}
+	}
+
+	if _, ok := st.root.users[u.Email]; ok {
+		return ErrUserExists
+	}
+
+	data := *u
+	data.Password = ""
+	st.root.users[u.Email] = &usernode{
+		data:     data,
+		password: password,
+	}
+
+	return nil
+}
+
+// GetUser returns the user with the given email, without a password.
+func (st *Memory) GetUser(ctx context.Context, email string) (User, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": email,
+	}).Debug("getting user")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	u, ok := st.root.users[email]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return u.user(), nil
+}
+
+// GetUsers returns every user, sorted by email, without passwords.
+func (st *Memory) GetUsers(ctx context.Context) ([]User, error) {
+	ctxlogger(ctx).WithField("store", "memory").Debug("getting users")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	users := make([]User, 0, len(st.root.users))
+	for _, u := range st.root.users {
+		users = append(users, u.user())
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+
+	return users, nil
+}
+
+// UpdateUser applies the update to the user with the given email.
+func (st *Memory) UpdateUser(ctx context.Context, email string, u UserUpdate) (User, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": email,
+	})
+	logger.Debug("updating user")
+
+	var password []byte
+	if u.Password != nil {
+		var err error
+		password, err = bcrypt.GenerateFromPassword([]byte(*u.Password), bcrypt.DefaultCost)
+		if err != nil {
+			logger.WithError(err).Debug("unable to encrypt password")
+			return User{}, err
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	un, ok := st.root.users[email]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	groups := un.data.Groups
+	if u.Groups != nil {
+		groups = *u.Groups
+	}
+
+	primary := un.data.Group
+	if u.Group != nil && u.Group.Name != primary.Name {
+		primary = *u.Group
+
+		if u.Groups == nil {
+			groups = withoutGroup(groups, un.data.Group.Name)
+		}
+	}
+
+	groups = memberships(primary, groups)
+	for _, g := range groups {
+		if _, ok := st.root.groups[g.Name]; !ok {
+			return User{}, ErrGroupNotFound
+		}
+	}
+
+	un.data.Group = primary
+	un.data.Groups = groups
+
+	if u.Name != nil {
+		un.data.Name = *u.Name
+	}
+
+	if u.Admin != nil {
+		un.data.Admin = *u.Admin
+	}
+
+	if u.Disabled != nil {
+		un.data.Disabled = *u.Disabled
+	}
+
+	if password != nil {
+		un.password = password
+	}
+
+	return un.user(), nil
+}
+
+// Authenticate checks the password for the user with the given email.
+func (st *Memory) Authenticate(ctx context.Context, email, pass string) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": email,
+	})
+	logger.Debug("authenticating user")
+
+	if pass == "" {
+		return ErrNotAuthenticated
+	}
+
+	st.mu.RLock()
+	u, ok := st.root.users[email]
+	st.mu.RUnlock()
+
+	if !ok || u.data.Disabled {
+		compareDummy(pass)
+		return ErrNotAuthenticated
+	}
+
+	err := bcrypt.CompareHashAndPassword(u.password, []byte(pass))
+	if err != nil {
+		logger.WithError(err).Debug("unable to authenticate")
+		return ErrNotAuthenticated
+	}
+
+	return nil
+}
+
+// readable reports whether the user can see the project.
+func (st *Memory) readable(user string, pn *projectnode) bool {
+	return st.can(user, pn, authz.Read)
+}
+
+// writable reports whether the user can change the project.
+func (st *Memory) writable(user string, pn *projectnode) bool {
+	return st.can(user, pn, authz.Write)
+}
+
+// can reports whether the user can take the action on the project, going
+// by the policy in authz like every other store.
+func (st *Memory) can(user string, pn *projectnode, act authz.Action) bool {
+	if pn == nil {
+		return false
+	}
+
+	subj := authz.Subject{ID: user}
+	if u, ok := st.root.users[user]; ok {
+		for _, g := range u.data.Groups {
+			subj.Groups = append(subj.Groups, g.Name)
+		}
+	}
+
+	return authz.Can(subj, act, pn.data.Authorization.resource())
+}
+
+func (st *Memory) projectOf(pln *pipelinenode) *projectnode {
+	if pln == nil {
+		return nil
+	}
+
+	return st.root.projects[pln.parent.data.ProjectID]
+}
+
+// deleteRemote takes the remote out of the project, dropping its
+// pipelines from the indexes on the way.
+func (st *Memory) deleteRemote(pn *projectnode, rn *remotenode) {
+	for _, pln := range rn.children {
+		st.deletePipeline(pln)
+	}
+
+	delete(pn.children, remoteKey(rn.data.URL, rn.data.Branch))
+}
+
+// deletePipeline takes the pipeline out of its remote, dropping it and
+// its steps and tasks from the indexes.
+func (st *Memory) deletePipeline(pln *pipelinenode) {
+	for _, rn := range pln.children {
+		for _, sn := range rn.children {
+			for _, tn := range sn.children {
+				delete(st.root.tasks, tn.data.ID)
+			}
+			delete(st.root.steps, sn.data.ID)
+		}
+	}
+
+	delete(st.root.pipelines, pln.data.ID)
+	delete(pln.parent.children, pln.data.Name)
+}
+
+func (st *Memory) findRemote(url, branch string) *remotenode {
+	for _, pn := range st.root.projects {
+		if rn, ok := pn.children[remoteKey(url, branch)]; ok {
+			return rn
+		}
+	}
+
+	return nil
+}
+
+func (st *Memory) findRun(pid, count int) *runnode {
+	pln, ok := st.root.pipelines[pid]
+	if !ok {
+		return nil
+	}
+
+	return pln.children[count]
+}
+
+// The sorted* helpers below exist because map iteration order is random,
+// and results should come back in the order they were created in.
+
+func sortedRemotes(pn *projectnode) []*remotenode {
+	keys := make([]string, 0, len(pn.children))
+	for k := range pn.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := make([]*remotenode, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, pn.children[k])
+	}
+
+	return ret
+}
+
+func sortedPipelines(rn *remotenode) []*pipelinenode {
+	ret := make([]*pipelinenode, 0, len(rn.children))
+	for _, pln := range rn.children {
+		ret = append(ret, pln)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].data.ID < ret[j].data.ID
+	})
+
+	return ret
+}
+
+func sortedRuns(pln *pipelinenode) []*runnode {
+	ret := make([]*runnode, 0, len(pln.children))
+	for _, rn := range pln.children {
+		ret = append(ret, rn)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].data.Count < ret[j].data.Count
+	})
+
+	return ret
+}
+
+func sortedSteps(rn *runnode) []*stepnode {
+	ret := make([]*stepnode, 0, len(rn.children))
+	for _, sn := range rn.children {
+		ret = append(ret, sn)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].data.ID < ret[j].data.ID
+	})
+
+	return ret
+}
+
+func sortedTasks(sn *stepnode) []*tasknode {
+	ret := make([]*tasknode, 0, len(sn.children))
+	for _, tn := range sn.children {
+		ret = append(ret, tn)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].data.ID < ret[j].data.ID
+	})
+
+	return ret
+}
+
+// CreateAccessToken saves the token's hash and hands out the token.
+func (st *Memory) CreateAccessToken(ctx context.Context, t *AccessToken) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": t.User,
+		"name":  t.Name,
+	})
+	logger.Debug("saving access token")
+
+	if err := t.checkScopes(); err != nil {
+		return err
+	}
+
+	token, hash, err := newToken(AccessTokenPrefix)
+	if err != nil {
+		logger.WithError(err).Debug("unable to generate access token")
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.root.users[t.User]; !ok {
+		return ErrUserNotFound
+	}
+
+	for _, tn := range st.root.tokens {
+		if tn.data.User == t.User && tn.data.Name == t.Name {
+			return ErrAccessTokenExists
+		}
+	}
+
+	st.root.tokenSeq++
+	t.ID = st.root.tokenSeq
+	t.CreatedAt = time.Now()
+	t.LastUsed = nil
+	t.Token = ""
+
+	data := *t
+	data.Scopes = append([]Scope(nil), t.Scopes...)
+	st.root.tokens[t.ID] = &tokennode{
+		data: data,
+		hash: string(hash),
+	}
+
+	t.Token = token
+
+	return nil
+}
+
+// GetAccessTokens returns the user's access tokens, sorted by ID.
+func (st *Memory) GetAccessTokens(ctx context.Context, user string) ([]AccessToken, error) {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": user,
+	}).Debug("getting access tokens")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	tokens := []AccessToken{}
+	for _, tn := range st.root.tokens {
+		if tn.data.User == user {
+			tokens = append(tokens, tn.token())
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID < tokens[j].ID
+	})
+
+	return tokens, nil
+}
+
+// RevokeAccessToken deletes the user's access token.
+func (st *Memory) RevokeAccessToken(ctx context.Context, user string, id int) error {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": user,
+		"id":    id,
+	}).Debug("revoking access token")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	tn, ok := st.root.tokens[id]
+	if !ok || tn.data.User != user {
+		return ErrAccessTokenNotFound
+	}
+
+	delete(st.root.tokens, id)
+
+	return nil
+}
+
+// AuthenticateAccessToken finds the access token by its hash.
+func (st *Memory) AuthenticateAccessToken(ctx context.Context, token string) (AccessToken, error) {
+	logger := ctxlogger(ctx).WithField("store", "memory")
+	logger.Debug("authenticating access token")
+
+	if !isAccessToken(token) {
+		return AccessToken{}, ErrNotAuthenticated
+	}
+
+	hash := string(hashToken(token))
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, tn := range st.root.tokens {
+		if tn.hash != hash {
+			continue
+		}
+
+		u, ok := st.root.users[tn.data.User]
+		if !ok || u.data.Disabled || tn.data.expired(now) {
+			break
+		}
+
+		tn.data.LastUsed = &now
+
+		return tn.token(), nil
+	}
+
+	return AccessToken{}, ErrNotAuthenticated
+}
+
+// CreateRefreshToken saves the refresh token's hash in a new family.
+func (st *Memory) CreateRefreshToken(ctx context.Context, t *RefreshToken) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": t.User,
+	})
+	logger.Debug("saving refresh token")
+
+	token, hash, err := newToken(refreshTokenPrefix)
+	if err != nil {
+		logger.WithError(err).Debug("unable to generate refresh token")
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.root.users[t.User]; !ok {
+		return ErrUserNotFound
+	}
+
+	// Expired refresh tokens are only kept around until the next
+	// one is created.
+	now := time.Now()
+	for h, rn := range st.root.refreshTokens {
+		if !now.Before(rn.data.ExpiresAt) {
+			delete(st.root.refreshTokens, h)
+		}
+	}
+
+	st.root.refreshSeq++
+	t.ID = st.root.refreshSeq
+	t.Family = uuid.New().String()
+	t.Token = ""
+
+	st.root.refreshTokens[string(hash)] = &refreshnode{data: *t}
+
+	t.Token = token
+
+	return nil
+}
+
+// RotateRefreshToken marks the refresh token as used and saves a new one
+// in its family.
+func (st *Memory) RotateRefreshToken(ctx context.Context, token string, expires time.Time) (RefreshToken, error) {
+	logger := ctxlogger(ctx).WithField("store", "memory")
+	logger.Debug("rotating refresh token")
+
+	next, hash, err := newToken(refreshTokenPrefix)
+	if err != nil {
+		logger.WithError(err).Debug("unable to generate refresh token")
+		return RefreshToken{}, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rn, ok := st.root.refreshTokens[string(hashToken(token))]
+	if !ok {
+		return RefreshToken{}, ErrNotAuthenticated
+	}
+
+	if rn.used {
+		logger.WithField("family", rn.data.Family).Warn("refresh token reused, revoking its family")
+		st.revokeFamily(rn.data.Family)
+
+		return RefreshToken{}, ErrNotAuthenticated
+	}
+
+	u, ok := st.root.users[rn.data.User]
+	if !ok || u.data.Disabled || !time.Now().Before(rn.data.ExpiresAt) {
+		return RefreshToken{}, ErrNotAuthenticated
+	}
+
+	rn.used = true
+
+	st.root.refreshSeq++
+	t := RefreshToken{
+		ID:        st.root.refreshSeq,
+		Family:    rn.data.Family,
+		User:      rn.data.User,
+		ExpiresAt: expires,
+	}
+	st.root.refreshTokens[string(hash)] = &refreshnode{data: t}
+
+	t.Token = next
+
+	return t, nil
+}
+
+// RevokeRefreshToken deletes every refresh token in the token's family.
+func (st *Memory) RevokeRefreshToken(ctx context.Context, token string) error {
+	ctxlogger(ctx).WithField("store", "memory").Debug("revoking refresh token")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if rn, ok := st.root.refreshTokens[string(hashToken(token))]; ok {
+		st.revokeFamily(rn.data.Family)
+	}
+
+	return nil
+}
+
+// RevokeJWT puts the JWT on the revocation list.
+func (st *Memory) RevokeJWT(ctx context.Context, id string, expires time.Time) error {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"jti":   id,
+	}).Debug("revoking jwt")
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for jti, exp := range st.root.revokedJWTs {
+		if !now.Before(exp) {
+			delete(st.root.revokedJWTs, jti)
+		}
+	}
+
+	st.root.revokedJWTs[id] = expires
+
+	return nil
+}
+
+// JWTRevoked reports whether the JWT is on the revocation list.
+func (st *Memory) JWTRevoked(ctx context.Context, id string) (bool, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	_, ok := st.root.revokedJWTs[id]
+	return ok, nil
+}
+
+// RecordFailedLogin saves the failed login.
+func (st *Memory) RecordFailedLogin(ctx context.Context, l *FailedLogin) error {
+	ctxlogger(ctx).WithFields(log.Fields{
+		"store": "memory",
+		"email": l.Email,
+	}).Debug("saving failed login")
+
+	if l.At.IsZero() {
+		l.At = time.Now()
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.root.failedLoginSeq++
+	l.ID = st.root.failedLoginSeq
+
+	st.root.failedLogins = append(st.root.failedLogins, *l)
+
+	return nil
+}
+
+// GetFailedLogins returns the newest failed logins.
+func (st *Memory) GetFailedLogins(ctx context.Context, email string, limit int) ([]FailedLogin, error) {
+	ctxlogger(ctx).WithField("store", "memory").Debug("retrieving failed logins")
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	logins := []FailedLogin{}
+	for i := len(st.root.failedLogins) - 1; i >= 0 && len(logins) < normalizeLimit(limit); i-- {
+		if l := st.root.failedLogins[i]; email == "" || l.Email == email {
+			logins = append(logins, l)
+		}
+	}
+
+	return logins, nil
+}
+
+func (st *Memory) revokeFamily(family string) {
+	for h, rn := range st.root.refreshTokens {
+		if rn.data.Family == family {
+			delete(st.root.refreshTokens, h)
+		}
+	}
+}
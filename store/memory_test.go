@@ -0,0 +1,702 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func seedMemory(t *testing.T) *Memory {
+	ctx := context.Background()
+	st := NewMemory()
+
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("got error seeding store: %v", err)
+		}
+	}
+
+	must(st.CreateGroup(ctx, &Group{Name: "a"}))
+	must(st.CreateGroup(ctx, &Group{Name: "b"}))
+
+	users := []User{
+		{Email: "owner@test", Group: Group{Name: "a"}},
+		{Email: "member@test", Group: Group{Name: "a"}},
+		{Email: "outsider@test", Group: Group{Name: "b"}},
+	}
+	for _, u := range users {
+		u.Password = "test"
+		must(st.CreateUser(ctx, &u))
+	}
+
+	projects := []Permission{
+		Permission(PermGroupRead),
+		Permission(PermPublicRead),
+		Permission(0),
+	}
+	for _, perms := range projects {
+		p := Project{
+			Name: "test",
+			Authorization: Authorization{
+				User:        User{Email: "owner@test"},
+				Permissions: perms,
+			},
+		}
+		must(st.CreateProject(ctx, &p))
+	}
+
+	return st
+}
+
+func TestMemoryReadScoping(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	tests := []struct {
+		user     string
+		expected []int
+	}{
+		{user: "owner@test", expected: []int{1, 2, 3}},
+		{user: "member@test", expected: []int{1, 2}},
+		{user: "outsider@test", expected: []int{2}},
+		{user: "", expected: []int{2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			page, err := st.GetProjects(ctx, test.user, ListFilter{})
+			if err != nil {
+				t.Fatalf("got error getting projects: %v", err)
+			}
+			ps := page.Projects
+
+			if len(ps) != len(test.expected) {
+				t.Fatalf("expected projects %v, got %+v", test.expected, ps)
+			}
+
+			for i, p := range ps {
+				if p.ID != test.expected[i] {
+					t.Fatalf("expected projects %v, got %+v", test.expected, ps)
+				}
+			}
+
+			for id := 1; id <= 3; id++ {
+				_, err := st.GetProject(ctx, test.user, id)
+
+				visible := false
+				for _, exp := range test.expected {
+					visible = visible || exp == id
+				}
+
+				if visible && err != nil {
+					t.Fatalf("expected to get project %v, got error %v", id, err)
+				}
+
+				if !visible && err != ErrProjectNotFound {
+					t.Fatalf("expected %v for project %v, got %v", ErrProjectNotFound, id, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryCreateRunConcurrently(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	err := st.CreateGitRemote(ctx, "owner@test", &GitRemote{URL: "//test.git", Branch: "master", ProjectID: 1})
+	if err != nil {
+		t.Fatalf("got error creating git remote: %v", err)
+	}
+
+	p := Pipeline{
+		Name:      "default",
+		GitRemote: GitRemote{URL: "//test.git", Branch: "master"},
+	}
+	err = st.CreatePipeline(ctx, &p)
+	if err != nil {
+		t.Fatalf("got error creating pipeline: %v", err)
+	}
+
+	n := 50
+	counts := make(chan int, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := Run{PipelineID: p.ID}
+			if err := st.CreateRun(ctx, &r); err != nil {
+				t.Errorf("got error creating run: %v", err)
+			}
+
+			counts <- r.Count
+		}()
+	}
+	wg.Wait()
+	close(counts)
+
+	seen := map[int]bool{}
+	for c := range counts {
+		if seen[c] {
+			t.Fatalf("run count %v was handed out twice", c)
+		}
+		seen[c] = true
+	}
+
+	for c := 1; c <= n; c++ {
+		if !seen[c] {
+			t.Fatalf("run count %v was skipped", c)
+		}
+	}
+}
+
+func TestMemoryQueueRun(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	err := st.CreateGitRemote(ctx, "owner@test", &GitRemote{URL: "//test.git", Branch: "master", ProjectID: 1})
+	if err != nil {
+		t.Fatalf("got error creating git remote: %v", err)
+	}
+
+	p := Pipeline{
+		Name:      "default",
+		GitRemote: GitRemote{URL: "//test.git", Branch: "master"},
+	}
+	err = st.CreatePipeline(ctx, &p)
+	if err != nil {
+		t.Fatalf("got error creating pipeline: %v", err)
+	}
+
+	def := []byte(`[{"name": "test", "tasks": []}]`)
+	if err := st.SetPipelineDefinition(ctx, p.ID, def); err != nil {
+		t.Fatalf("got error setting pipeline definition: %v", err)
+	}
+
+	got, err := st.GetPipeline(ctx, "owner@test", p.ID)
+	if err != nil {
+		t.Fatalf("got error getting pipeline: %v", err)
+	}
+
+	if string(got.Definition) != string(def) {
+		t.Fatalf("expected definition %s, got %s", def, got.Definition)
+	}
+
+	// The project only has the group read bit set.
+	tests := []struct {
+		user     string
+		expected error
+		count    int
+	}{
+		{user: "outsider@test", expected: ErrPipelineNotFound},
+		{user: "member@test", expected: ErrNotAuthorized},
+		{user: "owner@test", count: 1},
+	}
+
+	for _, test := range tests {
+		r := Run{PipelineID: p.ID}
+		err := st.QueueRun(ctx, test.user, &r)
+		if err != test.expected {
+			t.Fatalf("%v: expected error %v, got %v", test.user, test.expected, err)
+		}
+
+		if r.Count != test.count {
+			t.Fatalf("%v: expected run count %v, got %v", test.user, test.count, r.Count)
+		}
+	}
+
+	run, err := st.GetRun(ctx, "owner@test", p.ID, 1)
+	if err != nil {
+		t.Fatalf("got error getting queued run: %v", err)
+	}
+
+	if run.Start != nil || run.Success != nil {
+		t.Fatalf("expected queued run not to have started, got %+v", run)
+	}
+}
+
+func TestMemoryCancelRun(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	err := st.CreateGitRemote(ctx, "owner@test", &GitRemote{URL: "//test.git", Branch: "master", ProjectID: 1})
+	if err != nil {
+		t.Fatalf("got error creating git remote: %v", err)
+	}
+
+	p := Pipeline{
+		Name:      "default",
+		GitRemote: GitRemote{URL: "//test.git", Branch: "master"},
+	}
+	if err := st.CreatePipeline(ctx, &p); err != nil {
+		t.Fatalf("got error creating pipeline: %v", err)
+	}
+
+	queued, started := Run{PipelineID: p.ID}, Run{PipelineID: p.ID}
+	for _, r := range []*Run{&queued, &started} {
+		if err := st.QueueRun(ctx, "owner@test", r); err != nil {
+			t.Fatalf("got error queuing run: %v", err)
+		}
+	}
+
+	started.SetStart()
+	if err := st.StartRun(ctx, &started); err != nil {
+		t.Fatalf("got error starting run: %v", err)
+	}
+
+	// The project only has the group read bit set.
+	tests := []struct {
+		user     string
+		count    int
+		expected error
+	}{
+		{user: "outsider@test", count: queued.Count, expected: ErrRunNotFound},
+		{user: "member@test", count: queued.Count, expected: ErrNotAuthorized},
+		{user: "owner@test", count: 99, expected: ErrRunNotFound},
+		{user: "owner@test", count: queued.Count},
+		{user: "owner@test", count: queued.Count, expected: ErrRunFinished},
+		{user: "owner@test", count: started.Count},
+	}
+
+	for _, test := range tests {
+		_, err := st.CancelRun(ctx, test.user, p.ID, test.count)
+		if err != test.expected {
+			t.Fatalf("%v: expected error %v cancelling run %v, got %v", test.user, test.expected, test.count, err)
+		}
+	}
+
+	// Queued runs are ended when they're cancelled, and can't be started
+	// after that.
+	r, err := st.GetRun(ctx, "owner@test", p.ID, queued.Count)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if !r.Cancelled || r.End == nil || r.Success != nil {
+		t.Fatalf("expected queued run to be cancelled and ended, got %+v", r)
+	}
+
+	queued.SetStart()
+	if err := st.StartRun(ctx, &queued); err != ErrRunCancelled {
+		t.Fatalf("expected error %v starting cancelled run, got %v", ErrRunCancelled, err)
+	}
+
+	// Started runs are left for the runlet to end.
+	r, err = st.GetRun(ctx, "owner@test", p.ID, started.Count)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if !r.Cancelled || r.End != nil {
+		t.Fatalf("expected started run to be cancelled but not ended, got %+v", r)
+	}
+
+	page, err := st.ListRuns(ctx, "owner@test", p.ID, RunFilter{Status: RunInProgress})
+	if err != nil {
+		t.Fatalf("got error listing runs: %v", err)
+	}
+
+	if len(page.Runs) != 0 {
+		t.Fatalf("expected cancelled runs not to be in progress, got %+v", page.Runs)
+	}
+}
+
+func TestMemoryRetryRun(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	err := st.CreateGitRemote(ctx, "owner@test", &GitRemote{URL: "//test.git", Branch: "master", ProjectID: 1})
+	if err != nil {
+		t.Fatalf("got error creating git remote: %v", err)
+	}
+
+	p := Pipeline{
+		Name:      "default",
+		GitRemote: GitRemote{URL: "//test.git", Branch: "master"},
+	}
+	if err := st.CreatePipeline(ctx, &p); err != nil {
+		t.Fatalf("got error creating pipeline: %v", err)
+	}
+
+	def := []byte(`[{"name": "build", "tasks": []}, {"name": "test", "tasks": []}]`)
+	failed := Run{
+		PipelineID: p.ID,
+		Branch:     "dev",
+		Parameters: map[string]string{"TARGET": "prod"},
+		Definition: def,
+	}
+	if err := st.QueueRun(ctx, "owner@test", &failed); err != nil {
+		t.Fatalf("got error queuing run: %v", err)
+	}
+
+	// The first step's task exits with 0 and the second one's doesn't,
+	// which fails the step, and the run with it.
+	for _, status := range []int{0, 1} {
+		s := Step{Name: "step", PipelineID: p.ID, RunCount: failed.Count}
+		s.SetStart()
+		if err := st.CreateStep(ctx, &s); err != nil {
+			t.Fatalf("got error creating step: %v", err)
+		}
+
+		tk := Task{Name: "task", StepID: s.ID}
+		tk.SetStart()
+		if err := st.CreateTask(ctx, &tk); err != nil {
+			t.Fatalf("got error creating task: %v", err)
+		}
+
+		tk.SetEnd()
+		tk.MarkExited(status)
+		if err := st.UpdateTask(ctx, &tk); err != nil {
+			t.Fatalf("got error updating task: %v", err)
+		}
+
+		s.SetEnd()
+		s.MarkSuccess(!tk.Failed())
+		if err := st.UpdateStep(ctx, &s); err != nil {
+			t.Fatalf("got error updating step: %v", err)
+		}
+
+		if s.Failed() {
+			failed.MarkSuccess(false)
+		}
+	}
+
+	if !failed.Failed() {
+		t.Fatal("expected task that exited with 1 to fail the run")
+	}
+
+	failed.Commit = "abc123"
+	failed.SetStart()
+	failed.SetEnd()
+	if err := st.UpdateRun(ctx, &failed); err != nil {
+		t.Fatalf("got error updating run: %v", err)
+	}
+
+	unfinished := Run{PipelineID: p.ID, Definition: def}
+	if err := st.QueueRun(ctx, "owner@test", &unfinished); err != nil {
+		t.Fatalf("got error queuing run: %v", err)
+	}
+
+	unrecorded := Run{PipelineID: p.ID}
+	unrecorded.SetStart()
+	unrecorded.SetEnd()
+	if err := st.CreateRun(ctx, &unrecorded); err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+
+	// The project only has the group read bit set.
+	tests := []struct {
+		name     string
+		user     string
+		count    int
+		resume   bool
+		expected error
+	}{
+		{name: "outsider", user: "outsider@test", count: failed.Count, expected: ErrRunNotFound},
+		{name: "member", user: "member@test", count: failed.Count, expected: ErrNotAuthorized},
+		{name: "missing", user: "owner@test", count: 99, expected: ErrRunNotFound},
+		{name: "unfinished", user: "owner@test", count: unfinished.Count, expected: ErrRunNotFinished},
+		{name: "unrecorded", user: "owner@test", count: unrecorded.Count, expected: ErrRunNotRetryable},
+	}
+
+	for _, test := range tests {
+		_, err := st.RetryRun(ctx, test.user, p.ID, test.count, test.resume)
+		if err != test.expected {
+			t.Fatalf("%v: expected error %v, got %v", test.name, test.expected, err)
+		}
+	}
+
+	retry, err := st.RetryRun(ctx, "owner@test", p.ID, failed.Count, false)
+	if err != nil {
+		t.Fatalf("got error retrying run: %v", err)
+	}
+
+	if retry.RetryOf != failed.Count || retry.Branch != "dev" || retry.Commit != "abc123" ||
+		retry.Parameters["TARGET"] != "prod" || string(retry.Definition) != string(def) {
+		t.Fatalf("expected retry of run %v with the same inputs, got %+v", failed.Count, retry)
+	}
+
+	if retry.Start != nil || len(retry.Steps) != 0 {
+		t.Fatalf("expected retry to be queued without steps, got %+v", retry)
+	}
+
+	resumed, err := st.RetryRun(ctx, "owner@test", p.ID, failed.Count, true)
+	if err != nil {
+		t.Fatalf("got error resuming run: %v", err)
+	}
+
+	got, err := st.GetRun(ctx, "owner@test", p.ID, resumed.Count)
+	if err != nil {
+		t.Fatalf("got error getting resumed run: %v", err)
+	}
+
+	if len(got.Steps) != 1 || got.Steps[0].Success == nil || !*got.Steps[0].Success {
+		t.Fatalf("expected resumed run to have the step that succeeded, got %+v", got.Steps)
+	}
+
+	orig, err := st.GetRun(ctx, "owner@test", p.ID, failed.Count)
+	if err != nil {
+		t.Fatalf("got error getting failed run: %v", err)
+	}
+
+	if len(orig.Steps) != 2 || !orig.Steps[1].Failed() {
+		t.Fatalf("expected failed run to have the step that failed, got %+v", orig.Steps)
+	}
+
+	s, err := st.GetStep(ctx, "owner@test", got.Steps[0].ID)
+	if err != nil {
+		t.Fatalf("got error getting copied step: %v", err)
+	}
+
+	if len(s.Tasks) != 1 || s.Tasks[0].Name != "task" {
+		t.Fatalf("expected copied step to have its task, got %+v", s.Tasks)
+	}
+
+	succeeded := resumed
+	succeeded.SetStart()
+	succeeded.SetEnd()
+	succeeded.MarkSuccess(true)
+	if err := st.UpdateRun(ctx, &succeeded); err != nil {
+		t.Fatalf("got error updating run: %v", err)
+	}
+
+	if _, err := st.RetryRun(ctx, "owner@test", p.ID, succeeded.Count, true); err != ErrRunSucceeded {
+		t.Fatalf("expected error %v resuming run that succeeded, got %v", ErrRunSucceeded, err)
+	}
+}
+
+func TestMemoryHookRemotes(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	for _, url := range []string{"//test.git", "//other.git"} {
+		err := st.CreateGitRemote(ctx, "owner@test", &GitRemote{URL: url, Branch: "master", ProjectID: 1})
+		if err != nil {
+			t.Fatalf("got error creating git remote: %v", err)
+		}
+	}
+
+	p := Pipeline{
+		Name:      "default",
+		GitRemote: GitRemote{URL: "//test.git", Branch: "master"},
+	}
+	if err := st.CreatePipeline(ctx, &p); err != nil {
+		t.Fatalf("got error creating pipeline: %v", err)
+	}
+
+	// The project only has the group read bit set.
+	tests := []struct {
+		user     string
+		url      string
+		expected error
+	}{
+		{user: "outsider@test", url: "//test.git", expected: ErrGitRemoteNotFound},
+		{user: "member@test", url: "//test.git", expected: ErrNotAuthorized},
+		{user: "owner@test", url: "//missing.git", expected: ErrGitRemoteNotFound},
+		{user: "owner@test", url: "//test.git"},
+	}
+
+	for _, test := range tests {
+		err := st.SetWebhookSecret(ctx, test.user, 1, test.url, "master", "shh")
+		if err != test.expected {
+			t.Fatalf("%v: expected error %v setting secret of %v, got %v", test.user, test.expected, test.url, err)
+		}
+	}
+
+	// The secret is what webhooks start runs with, so it takes the run
+	// bit as well as the write bit.
+	perms := []struct {
+		perms    Permission
+		expected error
+	}{
+		{perms: Permission(PermGroupRead | PermGroupWrite), expected: ErrNotAuthorized},
+		{perms: Permission(PermGroupRead | PermGroupRun), expected: ErrNotAuthorized},
+		{perms: Permission(PermGroupRead | PermGroupWrite | PermGroupRun)},
+	}
+
+	for _, test := range perms {
+		perms := test.perms
+		if _, err := st.UpdateProject(ctx, "owner@test", 1, ProjectUpdate{Permissions: &perms}); err != nil {
+			t.Fatalf("got error updating project permissions: %v", err)
+		}
+
+		err := st.SetWebhookSecret(ctx, "member@test", 1, "//test.git", "master", "shh")
+		if err != test.expected {
+			t.Fatalf("%08b: expected error %v setting secret, got %v", test.perms, test.expected, err)
+		}
+	}
+
+	remotes, err := st.GetHookRemotes(ctx, []string{"//test.git", "//other.git"}, "master")
+	if err != nil {
+		t.Fatalf("got error getting webhook remotes: %v", err)
+	}
+
+	// Remotes without a secret don't have webhooks.
+	if len(remotes) != 1 || remotes[0].URL != "//test.git" || remotes[0].Secret != "shh" {
+		t.Fatalf("expected only //test.git with its secret, got %+v", remotes)
+	}
+
+	if len(remotes[0].Pipelines) != 1 || remotes[0].Pipelines[0].ID != p.ID {
+		t.Fatalf("expected remote to have pipeline %v, got %+v", p.ID, remotes[0].Pipelines)
+	}
+
+	remotes, err = st.GetHookRemotes(ctx, []string{"//test.git"}, "dev")
+	if err != nil {
+		t.Fatalf("got error getting webhook remotes: %v", err)
+	}
+
+	if len(remotes) != 0 {
+		t.Fatalf("expected no remotes on another branch, got %+v", remotes)
+	}
+}
+
+func TestMemoryAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	if err := st.Authenticate(ctx, "owner@test", "test"); err != nil {
+		t.Fatalf("expected valid credentials to authenticate, got %v", err)
+	}
+
+	if err := st.Authenticate(ctx, "owner@test", "wrong"); err != ErrNotAuthenticated {
+		t.Fatalf("expected %v for a bad password, got %v", ErrNotAuthenticated, err)
+	}
+
+	if err := st.Authenticate(ctx, "nobody@test", "test"); err != ErrNotAuthenticated {
+		t.Fatalf("expected %v for an unknown user, got %v", ErrNotAuthenticated, err)
+	}
+
+	if err := st.CreateUser(ctx, &User{Email: "nopass@test", Group: Group{Name: "a"}}); err != nil {
+		t.Fatalf("got error creating user: %v", err)
+	}
+
+	if err := st.Authenticate(ctx, "nopass@test", ""); err != ErrNotAuthenticated {
+		t.Fatalf("expected %v for an empty password, got %v", ErrNotAuthenticated, err)
+	}
+}
+
+func TestMemoryListRunsPages(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	err := st.CreateGitRemote(ctx, "owner@test", &GitRemote{URL: "//test.git", Branch: "master", ProjectID: 3})
+	if err != nil {
+		t.Fatalf("got error creating git remote: %v", err)
+	}
+
+	p := Pipeline{
+		Name:      "default",
+		GitRemote: GitRemote{URL: "//test.git", Branch: "master"},
+	}
+	err = st.CreatePipeline(ctx, &p)
+	if err != nil {
+		t.Fatalf("got error creating pipeline: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := st.CreateRun(ctx, &Run{PipelineID: p.ID}); err != nil {
+			t.Fatalf("got error creating run: %v", err)
+		}
+	}
+
+	var counts []int
+	f := RunFilter{Order: OrderAsc, Limit: 2}
+	for {
+		page, err := st.ListRuns(ctx, "owner@test", p.ID, f)
+		if err != nil {
+			t.Fatalf("got error listing runs: %v", err)
+		}
+
+		for _, r := range page.Runs {
+			counts = append(counts, r.Count)
+		}
+
+		if page.Next == 0 {
+			break
+		}
+		f.After = page.Next
+	}
+
+	if len(counts) != 5 {
+		t.Fatalf("expected to page through 5 runs, got %v", counts)
+	}
+	for i, c := range counts {
+		if c != i+1 {
+			t.Fatalf("expected runs in ascending order, got %v", counts)
+		}
+	}
+
+	// Project 3 isn't shared with anyone.
+	_, err = st.ListRuns(ctx, "member@test", p.ID, RunFilter{})
+	if err != ErrPipelineNotFound {
+		t.Fatalf("expected %v for a private pipeline, got %v", ErrPipelineNotFound, err)
+	}
+}
+
+func TestMemoryGroupMemberships(t *testing.T) {
+	ctx := context.Background()
+	st := seedMemory(t)
+
+	visible := func(user string) []int {
+		page, err := st.GetProjects(ctx, user, ListFilter{})
+		if err != nil {
+			t.Fatalf("got error getting projects: %v", err)
+		}
+
+		ids := []int{}
+		for _, p := range page.Projects {
+			ids = append(ids, p.ID)
+		}
+
+		return ids
+	}
+
+	groupNames := func(u User) string {
+		names := ""
+		for _, g := range u.Groups {
+			names += g.Name + " "
+		}
+
+		return names
+	}
+
+	groups := []Group{{Name: "a"}}
+	u, err := st.UpdateUser(ctx, "outsider@test", UserUpdate{Groups: &groups})
+	if err != nil {
+		t.Fatalf("got error adding user to group: %v", err)
+	}
+
+	if u.Group.Name != "b" || groupNames(u) != "a b " {
+		t.Fatalf("expected primary group b and groups a and b, got %+v", u)
+	}
+
+	if ids := visible("outsider@test"); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("expected a member of both groups to see projects [1 2], got %v", ids)
+	}
+
+	if err := st.DeleteGroup(ctx, "a"); err != ErrGroupInUse {
+		t.Fatalf("expected %v deleting a group with members, got %v", ErrGroupInUse, err)
+	}
+
+	u, err = st.UpdateUser(ctx, "outsider@test", UserUpdate{Group: &Group{Name: "a"}})
+	if err != nil {
+		t.Fatalf("got error moving user: %v", err)
+	}
+
+	if u.Group.Name != "a" || groupNames(u) != "a " {
+		t.Fatalf("expected moving the primary group to drop the old one, got %+v", u)
+	}
+
+	if err := st.DeleteGroup(ctx, "b"); err != nil {
+		t.Fatalf("got error deleting emptied group: %v", err)
+	}
+
+	groups = []Group{{Name: "b"}}
+	_, err = st.UpdateUser(ctx, "outsider@test", UserUpdate{Groups: &groups})
+	if err != ErrGroupNotFound {
+		t.Fatalf("expected %v adding user to a missing group, got %v", ErrGroupNotFound, err)
+	}
+}
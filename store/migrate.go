@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationLock is the key of the Postgres advisory lock held while
+// migrating, so that an api-server and a runlet booting at the same time
+// don't both try to apply the same migration. It's "relay" in hex.
+const migrationLock = 0x72656c6179
+
+// ErrUnknownSchemaVersion is returned when asked to migrate to a version
+// that no migration in this build has.
+var ErrUnknownSchemaVersion = errors.New("unknown schema version")
+
+// Migrator is implemented by stores with a schema that has to be brought
+// up to date before they can be used.
+type Migrator interface {
+	// Migrate applies every migration that hasn't been applied yet.
+	Migrate(context.Context) error
+	// MigrateTo applies or rolls back migrations until the schema is at
+	// the given version. Version 0 is an empty database.
+	MigrateTo(ctx context.Context, version int) error
+}
+
+// LatestSchemaVersion is the version the schema will be at once every
+// migration in this build has been applied.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate brings the Postgres schema up to the latest version.
+func (st *Postgres) Migrate(ctx context.Context) error {
+	return st.MigrateTo(ctx, LatestSchemaVersion())
+}
+
+// MigrateTo moves the Postgres schema to the given version, applying or
+// rolling back migrations as needed. Everything happens in one
+// transaction, so a failed migration leaves the schema untouched.
+func (st *Postgres) MigrateTo(ctx context.Context, version int) error {
+	logger := ctxlogger(ctx).WithField("target_version", version)
+
+	if version < 0 || version > LatestSchemaVersion() {
+		logger.WithError(ErrUnknownSchemaVersion).Debug("unable to migrate")
+		return ErrUnknownSchemaVersion
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.WithError(err).Debug("unable to begin migration transaction")
+		return err
+	}
+
+	err = migrate(ctx, logger, tx, version)
+	if err != nil {
+		logger.WithError(err).Debug("rolling back migration transaction")
+
+		if rberr := tx.Rollback(); rberr != nil {
+			logger.WithError(rberr).Debug("unable to roll back migration transaction")
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func migrate(ctx context.Context, logger *log.Entry, tx *sql.Tx, version int) error {
+	// The lock is released automatically when the transaction ends.
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock)
+	if err != nil {
+		logger.WithError(err).Debug("unable to acquire migration lock")
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)
+	`)
+	if err != nil {
+		logger.WithError(err).Debug("unable to create schema_migrations table")
+		return err
+	}
+
+	var current int
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).
+		Scan(&current)
+	if err != nil {
+		logger.WithError(err).Debug("unable to query current schema version")
+		return err
+	}
+
+	logger = logger.WithField("current_version", current)
+
+	if current > LatestSchemaVersion() {
+		// Something newer than this build has migrated the database.
+		// Running against it could do damage, so refuse.
+		err := fmt.Errorf("schema is at version %v, newer than this build's %v",
+			current, LatestSchemaVersion())
+		logger.WithError(err).Debug("unable to migrate")
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > version {
+			continue
+		}
+
+		logger.WithFields(log.Fields{
+			"version": m.version,
+			"name":    m.name,
+		}).Info("applying migration")
+
+		if _, err := tx.ExecContext(ctx, m.up); err != nil {
+			logger.WithError(err).Debug("unable to apply migration")
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+			m.version, m.name)
+		if err != nil {
+			logger.WithError(err).Debug("unable to record migration")
+			return err
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= version {
+			continue
+		}
+
+		logger.WithFields(log.Fields{
+			"version": m.version,
+			"name":    m.name,
+		}).Info("rolling back migration")
+
+		if _, err := tx.ExecContext(ctx, m.down); err != nil {
+			logger.WithError(err).Debug("unable to roll back migration")
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+		if err != nil {
+			logger.WithError(err).Debug("unable to record migration rollback")
+			return err
+		}
+	}
+
+	return nil
+}
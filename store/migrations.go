@@ -0,0 +1,297 @@
+package store
+
+// migration is one versioned change to the Postgres schema. Migrations are
+// applied in order of version, and every one of them needs a way back down
+// so that a bad deploy can be rolled back.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrations is the full history of the schema. Never edit a migration that
+// has been released, add a new one to the end instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// The IF NOT EXISTS clauses are here so that databases created
+		// by the runci/postgres image, before the schema lived in this
+		// repository, can adopt this migration without losing data.
+		up: `
+		CREATE TABLE IF NOT EXISTS groups (
+			name TEXT PRIMARY KEY
+		);
+
+		CREATE TABLE IF NOT EXISTS users (
+			email TEXT PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			password BYTEA NOT NULL,
+			group_name TEXT NOT NULL REFERENCES groups (name)
+		);
+
+		CREATE TABLE IF NOT EXISTS projects (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT,
+			permissions SMALLINT NOT NULL DEFAULT 0,
+			user_email TEXT NOT NULL REFERENCES users (email),
+			group_name TEXT NOT NULL REFERENCES groups (name)
+		);
+
+		CREATE TABLE IF NOT EXISTS git_remotes (
+			url TEXT NOT NULL,
+			branch TEXT NOT NULL,
+			project_id INTEGER NOT NULL REFERENCES projects (id),
+			PRIMARY KEY (url, branch)
+		);
+
+		CREATE TABLE IF NOT EXISTS pipelines (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			success BOOLEAN,
+			remote_url TEXT NOT NULL,
+			remote_branch TEXT NOT NULL,
+			project_id INTEGER NOT NULL REFERENCES projects (id),
+			FOREIGN KEY (remote_url, remote_branch) REFERENCES git_remotes (url, branch)
+		);
+
+		CREATE TABLE IF NOT EXISTS runs (
+			count INTEGER NOT NULL,
+			start_time TIMESTAMPTZ,
+			end_time TIMESTAMPTZ,
+			success BOOLEAN,
+			pipeline_id INTEGER NOT NULL REFERENCES pipelines (id)
+		);
+
+		CREATE TABLE IF NOT EXISTS steps (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			start_time TIMESTAMPTZ,
+			end_time TIMESTAMPTZ,
+			success BOOLEAN,
+			pipeline_id INTEGER NOT NULL REFERENCES pipelines (id),
+			run_count INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS tasks (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			start_time TIMESTAMPTZ,
+			end_time TIMESTAMPTZ,
+			success BOOLEAN,
+			step_id INTEGER NOT NULL REFERENCES steps (id)
+		);
+		`,
+		down: `
+		DROP TABLE IF EXISTS tasks;
+		DROP TABLE IF EXISTS steps;
+		DROP TABLE IF EXISTS runs;
+		DROP TABLE IF EXISTS pipelines;
+		DROP TABLE IF EXISTS git_remotes;
+		DROP TABLE IF EXISTS projects;
+		DROP TABLE IF EXISTS users;
+		DROP TABLE IF EXISTS groups;
+		`,
+	},
+	{
+		version: 2,
+		name:    "per-pipeline run sequence",
+		// pipelines.run_count is the sequence run counts are taken
+		// from. Bumping it locks the pipeline's row, so concurrent
+		// runs of one pipeline get handed counts one at a time. If a
+		// database already has duplicate runs from before this, adding
+		// the constraint fails and they have to be cleaned up by hand.
+		up: `
+		ALTER TABLE pipelines
+			ADD COLUMN run_count INTEGER NOT NULL DEFAULT 0;
+
+		UPDATE pipelines
+		SET run_count = COALESCE((
+			SELECT MAX(runs.count) FROM runs
+			WHERE runs.pipeline_id = pipelines.id
+		), 0);
+
+		ALTER TABLE runs
+			ADD CONSTRAINT runs_pipeline_id_count_key UNIQUE (pipeline_id, count);
+
+		ALTER TABLE steps
+			ADD CONSTRAINT steps_run_fkey FOREIGN KEY (pipeline_id, run_count)
+			REFERENCES runs (pipeline_id, count);
+		`,
+		down: `
+		ALTER TABLE steps DROP CONSTRAINT IF EXISTS steps_run_fkey;
+		ALTER TABLE runs DROP CONSTRAINT IF EXISTS runs_pipeline_id_count_key;
+		ALTER TABLE pipelines DROP COLUMN IF EXISTS run_count;
+		`,
+	},
+	{
+		version: 3,
+		name:    "user admin and disabled flags",
+		// The default user is the only one that exists before users
+		// can be managed through the API, so it's made an admin to
+		// bootstrap the rest.
+		up: `
+		ALTER TABLE users
+			ADD COLUMN admin BOOLEAN NOT NULL DEFAULT false,
+			ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT false;
+
+		UPDATE users SET admin = true WHERE email = 'default@local-relay';
+		`,
+		down: `
+		ALTER TABLE users
+			DROP COLUMN IF EXISTS admin,
+			DROP COLUMN IF EXISTS disabled;
+		`,
+	},
+	{
+		version: 4,
+		name:    "group memberships",
+		// users.group_name stays around as the primary group, which
+		// is what new projects are shared with. Every user is a member
+		// of their primary group.
+		up: `
+		CREATE TABLE group_members (
+			user_email TEXT NOT NULL REFERENCES users (email),
+			group_name TEXT NOT NULL REFERENCES groups (name),
+			PRIMARY KEY (user_email, group_name)
+		);
+
+		INSERT INTO group_members (user_email, group_name)
+		SELECT email, group_name FROM users;
+		`,
+		down: `
+		DROP TABLE IF EXISTS group_members;
+		`,
+	},
+	{
+		version: 5,
+		name:    "personal access tokens",
+		up: `
+		CREATE TABLE access_tokens (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			user_email TEXT NOT NULL REFERENCES users (email),
+			hash BYTEA NOT NULL UNIQUE,
+			scopes TEXT[] NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ,
+			last_used TIMESTAMPTZ,
+			UNIQUE (user_email, name)
+		);
+		`,
+		down: `
+		DROP TABLE IF EXISTS access_tokens;
+		`,
+	},
+	{
+		version: 6,
+		name:    "refresh tokens and jwt revocation list",
+		up: `
+		CREATE TABLE refresh_tokens (
+			id SERIAL PRIMARY KEY,
+			family TEXT NOT NULL,
+			user_email TEXT NOT NULL REFERENCES users (email),
+			hash BYTEA NOT NULL UNIQUE,
+			expires_at TIMESTAMPTZ NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT false
+		);
+
+		CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family);
+
+		CREATE TABLE revoked_jwts (
+			id TEXT PRIMARY KEY,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		`,
+		down: `
+		DROP TABLE IF EXISTS revoked_jwts;
+		DROP TABLE IF EXISTS refresh_tokens;
+		`,
+	},
+	{
+		version: 7,
+		name:    "failed logins",
+		up: `
+		CREATE TABLE failed_logins (
+			id SERIAL PRIMARY KEY,
+			email TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+
+		CREATE INDEX failed_logins_email_idx ON failed_logins (email);
+		`,
+		down: `
+		DROP TABLE IF EXISTS failed_logins;
+		`,
+	},
+	{
+		version: 8,
+		name:    "pipeline definitions",
+		up: `
+		ALTER TABLE pipelines ADD COLUMN definition JSONB;
+		`,
+		down: `
+		ALTER TABLE pipelines DROP COLUMN IF EXISTS definition;
+		`,
+	},
+	{
+		version: 9,
+		name:    "cancelled runs",
+		up: `
+		ALTER TABLE runs ADD COLUMN cancelled BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE steps ADD COLUMN cancelled BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE tasks ADD COLUMN cancelled BOOLEAN NOT NULL DEFAULT false;
+		`,
+		down: `
+		ALTER TABLE tasks DROP COLUMN IF EXISTS cancelled;
+		ALTER TABLE steps DROP COLUMN IF EXISTS cancelled;
+		ALTER TABLE runs DROP COLUMN IF EXISTS cancelled;
+		`,
+	},
+	{
+		version: 10,
+		// COMMIT is a keyword, so the Git columns are prefixed.
+		name: "run inputs",
+		up: `
+		ALTER TABLE runs ADD COLUMN git_branch TEXT NOT NULL DEFAULT '';
+		ALTER TABLE runs ADD COLUMN git_commit TEXT NOT NULL DEFAULT '';
+		ALTER TABLE runs ADD COLUMN parameters JSONB;
+		ALTER TABLE runs ADD COLUMN definition JSONB;
+		ALTER TABLE runs ADD COLUMN retry_of INTEGER;
+		`,
+		down: `
+		ALTER TABLE runs DROP COLUMN IF EXISTS retry_of;
+		ALTER TABLE runs DROP COLUMN IF EXISTS definition;
+		ALTER TABLE runs DROP COLUMN IF EXISTS parameters;
+		ALTER TABLE runs DROP COLUMN IF EXISTS git_commit;
+		ALTER TABLE runs DROP COLUMN IF EXISTS git_branch;
+		`,
+	},
+	{
+		version: 11,
+		name:    "webhook secrets",
+		up: `
+		ALTER TABLE git_remotes ADD COLUMN webhook_secret TEXT NOT NULL DEFAULT '';
+		`,
+		down: `
+		ALTER TABLE git_remotes DROP COLUMN IF EXISTS webhook_secret;
+		`,
+	},
+	{
+		version: 12,
+		// The default user has no password, so it can't be an admin.
+		// The first admin comes from RELAY_ADMIN_EMAIL instead. Rolling
+		// back leaves it alone, since nobody should get admin that way.
+		name: "revoke default user admin",
+		up: `
+		UPDATE users SET admin = false WHERE email = 'default@local-relay';
+		`,
+		down: `
+		SELECT 1;
+		`,
+	},
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("expected migration %q to be version %v, got %v", m.name, i+1, m.version)
+		}
+
+		if m.name == "" {
+			t.Fatalf("migration %v has no name", m.version)
+		}
+
+		if strings.TrimSpace(m.up) == "" || strings.TrimSpace(m.down) == "" {
+			t.Fatalf("migration %v needs both an up and a down", m.version)
+		}
+	}
+
+	if LatestSchemaVersion() != len(migrations) {
+		t.Fatalf("expected latest version %v, got %v", len(migrations), LatestSchemaVersion())
+	}
+}
@@ -1,9 +1,15 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
 
-	_ "github.com/lib/pq" // load the postgres driver
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/run-ci/relay/authz"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
@@ -32,10 +38,110 @@ func NewPostgres(connstr string) (RelayStore, error) {
 	}, nil
 }
 
+// withTx runs fn in a transaction, committing if it returns nil and rolling
+// back otherwise.
+func (st *Postgres) withTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		if rberr := tx.Rollback(); rberr != nil {
+			ctxlogger(ctx).WithError(rberr).Debug("unable to roll back transaction")
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkUpdated turns the result of an UPDATE or DELETE that didn't touch
+// any rows into notfound.
+func checkUpdated(res sql.Result, err error, notfound error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return notfound
+	}
+
+	return nil
+}
+
+// sqlArgs are the arguments of a query that's built up bit by bit.
+type sqlArgs []interface{}
+
+// add appends v to the arguments and returns its placeholder.
+func (args *sqlArgs) add(v interface{}) string {
+	*args = append(*args, v)
+	return fmt.Sprintf("$%v", len(*args))
+}
+
+// listSQL returns the clauses that narrow down, sort and limit a query
+// the way f asks, to be put after its WHERE clause. The ID and name
+// columns are what's filtered and sorted on. Names are compared byte by
+// byte, like the memory store does. One more row than the limit is asked
+// for, to tell whether there's another page.
+func listSQL(f ListFilter, after *listCursor, idcol, namecol string, args *sqlArgs) string {
+	sqlq := ""
+
+	if f.Name != "" {
+		sqlq += fmt.Sprintf("AND strpos(lower(%v), lower(%v)) > 0\n", namecol, args.add(f.Name))
+	}
+
+	cmp, dir := ">", "ASC"
+	if f.Order == OrderDesc {
+		cmp, dir = "<", "DESC"
+	}
+
+	if f.Sort == SortByName {
+		if after != nil {
+			sqlq += fmt.Sprintf("AND (%v COLLATE \"C\", %v) %v (%v::text, %v)\n",
+				namecol, idcol, cmp, args.add(after.Name), args.add(after.ID))
+		}
+		sqlq += fmt.Sprintf("ORDER BY %v COLLATE \"C\" %v, %v %v\n", namecol, dir, idcol, dir)
+	} else {
+		if after != nil {
+			sqlq += fmt.Sprintf("AND %v %v %v\n", idcol, cmp, args.add(after.ID))
+		}
+		sqlq += fmt.Sprintf("ORDER BY %v %v\n", idcol, dir)
+	}
+
+	sqlq += "LIMIT " + args.add(f.Limit+1)
+
+	return sqlq
+}
+
+// These are the SQLSTATE codes of the Postgres errors the store knows
+// how to turn into its own errors.
+const (
+	pqUniqueViolation     = pq.ErrorCode("23505")
+	pqForeignKeyViolation = pq.ErrorCode("23503")
+)
+
+// pqerrcode returns the SQLSTATE code of err if it came from Postgres,
+// and an empty code otherwise.
+func pqerrcode(err error) pq.ErrorCode {
+	if pqerr, ok := err.(*pq.Error); ok {
+		return pqerr.Code
+	}
+
+	return ""
+}
+
 // CreateProject saves the project in the database and sets its ID to
 // what Postgres assigned it.
-func (st *Postgres) CreateProject(p *Project) error {
-	logger := logger.WithField("project", p.Name)
+func (st *Postgres) CreateProject(ctx context.Context, p *Project) error {
+	logger := ctxlogger(ctx).WithField("project", p.Name)
 	logger.Debug("saving project to postgres")
 
 	sqlinsert := `
@@ -47,7 +153,7 @@ func (st *Postgres) CreateProject(p *Project) error {
 	`
 
 	// Using QueryRow because the insert is returning the ID.
-	err := st.db.QueryRow(sqlinsert, p.Name, p.Description, p.Permissions,
+	err := st.db.QueryRowContext(ctx, sqlinsert, p.Name, p.Description, p.Permissions,
 		// Duplication is necessary here because the driver will get confused
 		// and infer two different types for the same parameter.
 		p.User.Email, p.User.Email).
@@ -61,47 +167,29 @@ func (st *Postgres) CreateProject(p *Project) error {
 }
 
 // CreateGitRemote stores the passed in GitRemote in Postgres.
-func (st *Postgres) CreateGitRemote(user string, r *GitRemote) error {
-	logger := logger.WithFields(logrus.Fields{
+func (st *Postgres) CreateGitRemote(ctx context.Context, user string, r *GitRemote) error {
+	logger := ctxlogger(ctx).WithFields(logrus.Fields{
 		"url":        r.URL,
 		"branch":     r.Branch,
 		"project_id": r.ProjectID,
 	})
 	logger.Debug("saving remote to postgres")
 
-	// It's enough to just check the group here because if the
-	// user email matches then the group name must also match.
-	authq := `
-	SELECT COUNT(*)
-	FROM projects
-	INNER JOIN users
-	ON users.group_name = projects.group_name
-	WHERE users.email = $1
-	AND projects.id = $2;
-	`
-
-	var count int
-	err := st.db.QueryRow(authq, user, r.ProjectID).Scan(&count)
-	if err != nil {
-		// This should always return a row, even if the row says
-		// there's no users matching the criteria.
-		logger.WithError(err).Debug("unable to query for auth count")
-		return err
-	}
-
-	if count < 1 {
-		logger.WithError(ErrProjectNotFound).Error("unable to find project for user")
-		return ErrProjectNotFound
-	}
-
 	sqlinsert := `
 	INSERT INTO git_remotes (url, branch, project_id)
 	VALUES
 		($1, $2, $3)
 	`
 
-	_, err = st.db.Exec(sqlinsert, r.URL, r.Branch, r.ProjectID)
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		err := checkProject(ctx, tx, user, r.ProjectID, ErrProjectNotFound, authz.Write)
+		if err != nil {
+			return err
+		}
 
+		_, err = tx.ExecContext(ctx, sqlinsert, r.URL, r.Branch, r.ProjectID)
+		return err
+	})
 	if err != nil {
 		logger.WithError(err).Debug("unable to create git remote")
 	}
@@ -110,8 +198,8 @@ func (st *Postgres) CreateGitRemote(user string, r *GitRemote) error {
 
 // GetGitRemote retrieves the remote for the project with the given ID, using the
 // url and branch.
-func (st *Postgres) GetGitRemote(user string, pid int, url string, branch string) (GitRemote, error) {
-	logger := logger.WithField("project_id", pid)
+func (st *Postgres) GetGitRemote(ctx context.Context, user string, pid int, url string, branch string) (GitRemote, error) {
+	logger := ctxlogger(ctx).WithField("project_id", pid)
 	logger.Debug("getting git remote from postgres")
 
 	sqlq := `
@@ -123,16 +211,17 @@ func (st *Postgres) GetGitRemote(user string, pid int, url string, branch string
 	ON proj.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE (u.email = $1
-		OR u.group_name = proj.group_name AND (proj.permissions & 128) != 0
-		OR (proj.permissions & 16) != 0)
+	WHERE ` + canSQL(authz.Read, "proj", "$1") + `
 		AND proj.id = $2
 		AND gr.url = $3
 		AND gr.branch = $4;
 	`
 
 	var remote GitRemote
-	err := st.db.QueryRow(sqlq, user, pid, url, branch).Scan(&remote.URL, &remote.Branch, &remote.ProjectID)
+	err := st.db.QueryRowContext(ctx, sqlq, user, pid, url, branch).Scan(&remote.URL, &remote.Branch, &remote.ProjectID)
+	if err == sql.ErrNoRows {
+		err = ErrGitRemoteNotFound
+	}
 	if err != nil {
 		logger.WithError(err).Debug("unable to query database")
 	}
@@ -140,10 +229,112 @@ func (st *Postgres) GetGitRemote(user string, pid int, url string, branch string
 	return remote, err
 }
 
+// SetWebhookSecret is part of the RelayStore interface.
+func (st *Postgres) SetWebhookSecret(ctx context.Context, user string, pid int, url, branch, secret string) error {
+	logger := ctxlogger(ctx).WithFields(logrus.Fields{
+		"project_id": pid,
+		"url":        url,
+		"branch":     branch,
+	})
+	logger.Debug("setting webhook secret")
+
+	sqlupdate := `
+	UPDATE git_remotes
+	SET webhook_secret = $1
+	WHERE project_id = $2 AND url = $3 AND branch = $4
+	`
+
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		// Anyone with the secret can start runs, so it takes being
+		// able to start them to set it.
+		err := checkProject(ctx, tx, user, pid, ErrGitRemoteNotFound, authz.Write, authz.Run)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, sqlupdate, secret, pid, url, branch)
+		return checkUpdated(res, err, ErrGitRemoteNotFound)
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to set webhook secret")
+	}
+
+	return err
+}
+
+// GetHookRemotes is part of the RelayStore interface.
+func (st *Postgres) GetHookRemotes(ctx context.Context, urls []string, branch string) ([]HookRemote, error) {
+	logger := ctxlogger(ctx).WithFields(logrus.Fields{
+		"urls":   urls,
+		"branch": branch,
+	})
+	logger.Debug("getting webhook remotes from postgres")
+
+	sqlq := `
+	SELECT gr.url, gr.branch, gr.project_id, gr.webhook_secret,
+		p.id, p.name, p.definition
+	FROM git_remotes AS gr
+	LEFT JOIN pipelines AS p
+	ON gr.url = p.remote_url
+		AND gr.branch = p.remote_branch
+	WHERE gr.url = ANY($1)
+		AND gr.branch = $2
+		AND gr.webhook_secret <> ''
+	ORDER BY gr.url, p.id
+	`
+
+	rows, err := st.db.QueryContext(ctx, sqlq, pq.Array(urls), branch)
+	if err != nil {
+		logger.WithError(err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	remotes := []HookRemote{}
+	for rows.Next() {
+		var hr HookRemote
+		var id sql.NullInt64
+		var name sql.NullString
+		var def []byte
+		err := rows.Scan(&hr.URL, &hr.Branch, &hr.ProjectID, &hr.Secret, &id, &name, &def)
+		if err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return nil, err
+		}
+
+		// Rows are ordered by remote, so a new remote starts whenever
+		// the URL changes.
+		if len(remotes) == 0 || remotes[len(remotes)-1].URL != hr.URL {
+			hr.Pipelines = []Pipeline{}
+			remotes = append(remotes, hr)
+		}
+
+		if !id.Valid {
+			continue
+		}
+
+		last := &remotes[len(remotes)-1]
+		last.Pipelines = append(last.Pipelines, Pipeline{
+			ID:         int(id.Int64),
+			Name:       name.String,
+			GitRemote:  last.GitRemote,
+			ProjectID:  last.ProjectID,
+			Definition: def,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Debug("unable to read rows")
+		return nil, err
+	}
+
+	return remotes, nil
+}
+
 // GetProject retrieves the Project with the given id from postgres. If
 // it's not found for the user it returns ErrProjectNotFound.
-func (st *Postgres) GetProject(user string, id int) (Project, error) {
-	logger := logger.WithField("project_id", id)
+func (st *Postgres) GetProject(ctx context.Context, user string, id int) (Project, error) {
+	logger := ctxlogger(ctx).WithField("project_id", id)
 	logger.Debug("getting project from postgres")
 
 	sqlq := `
@@ -151,39 +342,40 @@ func (st *Postgres) GetProject(user string, id int) (Project, error) {
 		u.email, u.name, g.name,
 		gr.url, gr.branch, gr.project_id
 	FROM projects AS proj
-	INNER JOIN git_remotes AS gr
+	LEFT JOIN git_remotes AS gr
 	ON proj.id = gr.project_id
 	INNER JOIN users AS u
 	ON proj.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE (u.email = $2
-		OR u.group_name = proj.group_name AND (proj.permissions & 128) != 0
-		OR (proj.permissions & 16) != 0)
+	WHERE ` + canSQL(authz.Read, "proj", "$2") + `
 		AND proj.id = $1;
 	`
 
-	rows, err := st.db.Query(sqlq, id, user)
+	rows, err := st.db.QueryContext(ctx, sqlq, id, user)
 	if err != nil {
 		logger.WithError(err).Debug("unable to query database")
 		return Project{}, err
 	}
+	defer rows.Close()
 
+	found := false
 	p := Project{
 		GitRemotes: []GitRemote{},
 	}
 	for rows.Next() {
-		var gr GitRemote
-		var desc sql.NullString
+		var desc, url, branch sql.NullString
+		var remoteProject sql.NullInt64
 		// It's safe to always overwrite `p` here because these values
 		// should always be the same.
 		err := rows.Scan(&p.ID, &p.Name, &desc, &p.Permissions,
 			&p.User.Email, &p.User.Name, &p.Group.Name,
-			&gr.URL, &gr.Branch, &gr.ProjectID)
+			&url, &branch, &remoteProject)
 		if err != nil {
 			logger.WithError(err).Debug("unable to scan row")
 			return p, err
 		}
+		found = true
 
 		p.User.Group.Name = p.Group.Name
 
@@ -191,18 +383,98 @@ func (st *Postgres) GetProject(user string, id int) (Project, error) {
 			p.Description = desc.String
 		}
 
-		p.GitRemotes = append(p.GitRemotes, gr)
+		// A project without remotes still has its one row, with the
+		// remote's columns NULL.
+		if remoteProject.Valid {
+			p.GitRemotes = append(p.GitRemotes, GitRemote{
+				URL:       url.String,
+				Branch:    branch.String,
+				ProjectID: int(remoteProject.Int64),
+			})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Debug("unable to read rows")
+		return Project{}, err
+	}
+
+	if !found {
+		return Project{}, ErrProjectNotFound
+	}
+
+	return p, nil
+}
+
+// UpdateProject implements part of RelayStore. It applies the update to the
+// project with the given ID.
+func (st *Postgres) UpdateProject(ctx context.Context, user string, id int, u ProjectUpdate) (Project, error) {
+	logger := ctxlogger(ctx).WithField("project_id", id)
+	logger.Debug("updating project")
+
+	if u.Permissions != nil && !u.Permissions.Valid() {
+		return Project{}, ErrInvalidPermissions
+	}
+
+	// NULL arguments leave their columns alone.
+	sqlupdate := `
+	UPDATE projects AS p
+	SET name = COALESCE($2, p.name),
+		description = COALESCE($3, p.description),
+		permissions = COALESCE($4, p.permissions)
+	FROM users AS u
+	WHERE p.id = $1 AND p.user_email = u.email
+	RETURNING p.id, p.name, p.description, p.permissions,
+		u.email, u.name, u.group_name, p.group_name
+	`
+
+	var perms sql.NullInt64
+	if u.Permissions != nil {
+		perms = sql.NullInt64{Int64: int64(*u.Permissions), Valid: true}
+	}
+
+	p := Project{}
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		err := checkProject(ctx, tx, user, id, ErrProjectNotFound, authz.Admin)
+		if err != nil {
+			return err
+		}
+
+		var desc sql.NullString
+		err = tx.QueryRowContext(ctx, sqlupdate, id, u.Name, u.Description, perms).
+			Scan(&p.ID, &p.Name, &desc, &p.Permissions,
+				&p.User.Email, &p.User.Name, &p.User.Group.Name, &p.Group.Name)
+		if err != nil {
+			return err
+		}
+
+		if desc.Valid {
+			p.Description = desc.String
+		}
+
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to update project")
+		return Project{}, err
 	}
 
+	logger.Debug("project updated")
+
 	return p, nil
 }
 
-// GetProjects retrieves all Projects from Postgres.
-func (st *Postgres) GetProjects(user string) ([]Project, error) {
+// GetProjects retrieves a page of the Projects the user can see from Postgres.
+func (st *Postgres) GetProjects(ctx context.Context, user string, f ListFilter) (ProjectPage, error) {
+	logger := ctxlogger(ctx)
 	logger.Debug("fetching all projects from postgres")
 
-	// The 128 and 16 below correspond to the bits for "group read"
-	// and "public read" permissions.
+	f, after, err := f.normalize()
+	if err != nil {
+		logger.WithError(err).Debug("invalid list filter")
+		return ProjectPage{}, err
+	}
+
 	sqlq := `
 	SELECT p.id, p.name, p.description, p.permissions, u.email, u.name, g.name
 	FROM projects AS p
@@ -210,18 +482,19 @@ func (st *Postgres) GetProjects(user string) ([]Project, error) {
 	ON p.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE u.email = $1
-		OR u.group_name = p.group_name AND (p.permissions & 128) != 0
-		OR (p.permissions & 16) != 0;
+	WHERE ` + canSQL(authz.Read, "p", "$1") + `
 	`
+	args := sqlArgs{user}
+	sqlq += listSQL(f, after, "p.id", "p.name", &args)
 
-	rows, err := st.db.Query(sqlq, user)
+	rows, err := st.db.QueryContext(ctx, sqlq, args...)
 	if err != nil {
 		logger.WithField("error", err).Debug("unable to query database")
-		return nil, err
+		return ProjectPage{}, err
 	}
+	defer rows.Close()
 
-	ps := []Project{}
+	page := ProjectPage{Projects: []Project{}}
 	for rows.Next() {
 		p := Project{}
 		var desc sql.NullString
@@ -229,7 +502,7 @@ func (st *Postgres) GetProjects(user string) ([]Project, error) {
 			&p.User.Email, &p.User.Name, &p.User.Group.Name)
 		if err != nil {
 			logger.WithField("error", err).Debug("unable to scan row")
-			return ps, err
+			return ProjectPage{}, err
 		}
 
 		// This needs to be populated correctly.
@@ -239,15 +512,37 @@ func (st *Postgres) GetProjects(user string) ([]Project, error) {
 			p.Description = desc.String
 		}
 
-		ps = append(ps, p)
+		page.Projects = append(page.Projects, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Debug("unable to read rows")
+		return ProjectPage{}, err
+	}
+
+	if len(page.Projects) > f.Limit {
+		page.Projects = page.Projects[:f.Limit]
+		last := page.Projects[f.Limit-1]
+		page.Next = f.cursor(last.ID, last.Name)
 	}
 
-	return ps, nil
+	return page, nil
 }
 
-// GetPipelines implements the RelayStore interface. It returns a list of all
+// GetPipelines implements the RelayStore interface. It returns a page of the
 // pipelines for the project with the given id.
-func (st *Postgres) GetPipelines(user string, pid int) ([]Pipeline, error) {
+func (st *Postgres) GetPipelines(ctx context.Context, user string, pid int, f ListFilter) (PipelinePage, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"project_id": pid,
+		"query":      "get_pipelines",
+	})
+
+	f, after, err := f.normalize()
+	if err != nil {
+		logger.WithError(err).Debug("invalid list filter")
+		return PipelinePage{}, err
+	}
+
 	sqlq := `
 	SELECT p.id, p.name, p.remote_url, p.remote_branch, p.success
 	FROM pipelines AS p
@@ -257,23 +552,20 @@ func (st *Postgres) GetPipelines(user string, pid int) ([]Pipeline, error) {
 	ON proj.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE (u.email = $2
-		OR u.group_name = proj.group_name AND (proj.permissions & 128) != 0
-		OR (proj.permissions & 16) != 0)
-		AND p.project_id = $1;
+	WHERE ` + canSQL(authz.Read, "proj", "$2") + `
+		AND p.project_id = $1
 	`
+	args := sqlArgs{pid, user}
+	sqlq += listSQL(f, after, "p.id", "p.name", &args)
 
-	logger := logger.WithFields(log.Fields{
-		"project_id": pid,
-		"query":      "get_pipelines",
-	})
-
-	rows, err := st.db.Query(sqlq, pid, user)
+	rows, err := st.db.QueryContext(ctx, sqlq, args...)
 	if err != nil {
 		logger.WithError(err).Debug("unable to query postgres for pipelines")
+		return PipelinePage{}, err
 	}
+	defer rows.Close()
 
-	ps := []Pipeline{}
+	page := PipelinePage{Pipelines: []Pipeline{}}
 	for rows.Next() {
 		p := Pipeline{
 			ProjectID: pid,
@@ -283,25 +575,37 @@ func (st *Postgres) GetPipelines(user string, pid int) ([]Pipeline, error) {
 		if err != nil {
 			logger.WithError(err).Debug("unable to scan row")
 
-			return ps, err
+			return PipelinePage{}, err
 		}
 
-		ps = append(ps, p)
+		page.Pipelines = append(page.Pipelines, p)
 	}
 
-	return ps, nil
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Debug("unable to read rows")
+		return PipelinePage{}, err
+	}
+
+	if len(page.Pipelines) > f.Limit {
+		page.Pipelines = page.Pipelines[:f.Limit]
+		last := page.Pipelines[f.Limit-1]
+		page.Next = f.cursor(last.ID, last.Name)
+	}
+
+	return page, nil
 }
 
-// GetPipeline retrieves the Pipeline with the given id from postgres.
-func (st *Postgres) GetPipeline(user string, id int) (Pipeline, error) {
-	logger := logger.WithField("id", id)
+// GetPipeline retrieves the Pipeline with the given id from postgres. If
+// it's not found for the user it returns ErrPipelineNotFound.
+func (st *Postgres) GetPipeline(ctx context.Context, user string, id int) (Pipeline, error) {
+	logger := ctxlogger(ctx).WithField("id", id)
 	logger.Debug("getting pipeline from postgres")
 
 	sqlq := `
-	SELECT p.name, p.success, p.remote_url, p.remote_branch, p.project_id,
-		r.count, r.start_time, r.end_time, r.success
+	SELECT p.name, p.success, p.remote_url, p.remote_branch, p.project_id, p.definition,
+		r.count, r.start_time, r.end_time, r.success, r.cancelled
 	FROM pipelines AS p
-	INNER JOIN runs AS r
+	LEFT JOIN runs AS r
 	ON p.id = r.pipeline_id
 	INNER JOIN projects AS proj
 	ON p.project_id = proj.id
@@ -309,41 +613,64 @@ func (st *Postgres) GetPipeline(user string, id int) (Pipeline, error) {
 	ON proj.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE (u.email = $2
-		OR u.group_name = proj.group_name AND (proj.permissions & 128) != 0
-		OR (proj.permissions & 16) != 0)
+	WHERE ` + canSQL(authz.Read, "proj", "$2") + `
 		AND p.id = $1;
 	`
 
-	var p Pipeline
-	rows, err := st.db.Query(sqlq, id, user)
+	rows, err := st.db.QueryContext(ctx, sqlq, id, user)
 	if err != nil {
 		logger.WithError(err).Debug("unable to query database")
-		return p, err
+		return Pipeline{}, err
 	}
+	defer rows.Close()
 
+	found := false
+	p := Pipeline{
+		Runs: []Run{},
+	}
 	for rows.Next() {
 		r := Run{PipelineID: id}
 
 		// It's safe to always overwrite `p` here because these values
 		// should always be the same.
-		err := rows.Scan(&p.Name, &p.Success, &p.GitRemote.URL, &p.GitRemote.Branch, &p.ProjectID,
-			&r.Count, &r.Start, &r.End, &r.Success)
+		var def []byte
+		var count sql.NullInt64
+		var cancelled sql.NullBool
+		err := rows.Scan(&p.Name, &p.Success, &p.GitRemote.URL, &p.GitRemote.Branch, &p.ProjectID, &def,
+			&count, &r.Start, &r.End, &r.Success, &cancelled)
 		if err != nil {
 			logger.WithError(err).Debug("unable to scan row")
 			return p, err
 		}
+		found = true
+
+		p.Definition = def
+
+		// A pipeline that hasn't been run still has its one row, with
+		// the run's columns NULL.
+		if count.Valid {
+			r.Count = int(count.Int64)
+			r.Cancelled = cancelled.Bool
+			p.Runs = append(p.Runs, r)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Debug("unable to read rows")
+		return Pipeline{}, err
+	}
 
-		p.Runs = append(p.Runs, r)
+	if !found {
+		return Pipeline{}, ErrPipelineNotFound
 	}
 
 	p.ID = id
 
-	return p, err
+	return p, nil
 }
 
 // UpdatePipeline is part of the RelayStore interface.
-func (st *Postgres) UpdatePipeline(p *Pipeline) error {
+func (st *Postgres) UpdatePipeline(ctx context.Context, p *Pipeline) error {
 	// TODO: fix bug here. The finish time is never updated.
 	sqlupdate := `
 	UPDATE pipelines
@@ -351,7 +678,7 @@ func (st *Postgres) UpdatePipeline(p *Pipeline) error {
 	WHERE pipelines.id = $2
 	`
 
-	logger := logger.WithFields(log.Fields{
+	logger := ctxlogger(ctx).WithFields(log.Fields{
 		"id":      p.ID,
 		"success": p.Success,
 		"query":   "set_pipeline_success",
@@ -359,14 +686,42 @@ func (st *Postgres) UpdatePipeline(p *Pipeline) error {
 
 	logger.Debug("setting pipeline success")
 
-	_, err := st.db.Exec(sqlupdate, p.Success, p.ID)
+	_, err := st.db.ExecContext(ctx, sqlupdate, p.Success, p.ID)
 	return err
 }
 
+// SetPipelineDefinition is part of the RelayStore interface.
+func (st *Postgres) SetPipelineDefinition(ctx context.Context, id int, def json.RawMessage) error {
+	logger := ctxlogger(ctx).WithField("id", id)
+	logger.Debug("setting pipeline definition")
+
+	sqlupdate := `
+	UPDATE pipelines
+	SET definition = $1
+	WHERE id = $2
+	`
+
+	// The definition is sent as a string, since pq sends []byte as
+	// BYTEA, which isn't JSON.
+	jsondef := sql.NullString{String: string(def), Valid: len(def) > 0}
+
+	res, err := st.db.ExecContext(ctx, sqlupdate, jsondef, id)
+	if err != nil {
+		logger.WithError(err).Debug("unable to set pipeline definition")
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrPipelineNotFound
+	}
+
+	return nil
+}
+
 // GetPipelineID queries Postgres for the ID of the pipeline matching the
 // filters. If no pipelines are found it returns ErrNoPipelines.
-func (st *Postgres) GetPipelineID(remote GitRemote, name string) (id int, err error) {
-	logger := logger.WithFields(log.Fields{
+func (st *Postgres) GetPipelineID(ctx context.Context, remote GitRemote, name string) (id int, err error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
 		"url":    remote.URL,
 		"branch": remote.Branch,
 		"name":   name,
@@ -383,7 +738,7 @@ func (st *Postgres) GetPipelineID(remote GitRemote, name string) (id int, err er
 
 	logger.Debug("retrieving id from postgres")
 
-	err = st.db.QueryRow(sqlq, remote.URL, remote.Branch, name).Scan(&id)
+	err = st.db.QueryRowContext(ctx, sqlq, remote.URL, remote.Branch, name).Scan(&id)
 	if err == sql.ErrNoRows {
 		err = ErrNoPipelines
 	}
@@ -392,8 +747,8 @@ func (st *Postgres) GetPipelineID(remote GitRemote, name string) (id int, err er
 }
 
 // CreatePipeline saves a Pipeline to Postgres.
-func (st *Postgres) CreatePipeline(p *Pipeline) error {
-	logger := logger.WithFields(log.Fields{
+func (st *Postgres) CreatePipeline(ctx context.Context, p *Pipeline) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
 		"name":   p.Name,
 		"url":    p.GitRemote.URL,
 		"branch": p.GitRemote.Branch,
@@ -416,7 +771,7 @@ func (st *Postgres) CreatePipeline(p *Pipeline) error {
 	logger.Debug("saving pipeline")
 
 	// Using QueryRow because the insert is returning "count".
-	err := st.db.QueryRow(
+	err := st.db.QueryRowContext(ctx,
 		sqlinsert, p.Name, p.GitRemote.URL, p.GitRemote.Branch).
 		Scan(&p.ID)
 	if err != nil {
@@ -431,128 +786,576 @@ func (st *Postgres) CreatePipeline(p *Pipeline) error {
 
 // CreateRun is part of the PipelineStore interface. It creates a new pipeline
 // run in the database and sets the count.
-func (st *Postgres) CreateRun(r *Run) error {
-	logger := logger.WithFields(log.Fields{
+//
+// The count comes from the pipeline's run_count column, which is bumped in
+// the same transaction as the insert. The bump locks the pipeline's row
+// until the transaction is done, so runs of the same pipeline created at
+// the same time are numbered one after the other. If a run with the count
+// exists anyway, ErrRunConflict is returned and nothing is saved.
+func (st *Postgres) CreateRun(ctx context.Context, r *Run) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
 		"pipeline_id": r.PipelineID,
 	})
 
-	sqlinsert := `
-	WITH run_count AS (
-		SELECT COUNT(*) from runs
-		WHERE runs.pipeline_id = $4
-	)
-	INSERT INTO runs (count, start_time, end_time, success, pipeline_id)
-	SELECT run_count.count+1, $1, $2, $3, $4
-	FROM run_count
-	RETURNING count
-	`
-
 	logger.Debug("saving pipeline run")
 
-	// Using QueryRow because the insert is returning "count".
-	err := st.db.QueryRow(
-		sqlinsert, r.Start, r.End, r.Success, r.PipelineID).
-		Scan(&r.Count)
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		return insertRun(ctx, tx, r)
+	})
 	if err != nil {
 		logger.WithField("error", err).Debug("unable to insert pipeline run")
 		return err
 	}
 
-	logger.Debug("pipeline run saved")
+	logger.WithField("count", r.Count).Debug("pipeline run saved")
 
 	return nil
 }
 
-// CreateStep is part of the PipelineStore interface. It creates a new run step
-// in the database and sets the ID.
-func (st *Postgres) CreateStep(s *Step) error {
-	logger := logger.WithFields(log.Fields{
-		"pipeline_id": s.PipelineID,
-		"run_count":   s.RunCount,
-		"name":        s.Name,
+// QueueRun is part of the RelayStore interface.
+func (st *Postgres) QueueRun(ctx context.Context, user string, r *Run) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"pipeline_id": r.PipelineID,
 	})
 
-	sqlinsert := `
-	INSERT INTO steps (name, start_time, end_time, success, pipeline_id, run_count)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	RETURNING id
+	sqlproject := `
+	SELECT project_id
+	FROM pipelines
+	WHERE id = $1
 	`
 
-	logger.Debug("saving run step")
+	logger.Debug("queuing pipeline run")
 
-	// Using QueryRow because the insert is returning "id".
-	err := st.db.QueryRow(
-		sqlinsert, s.Name, s.Start, s.End, s.Success, s.PipelineID, s.RunCount).
-		Scan(&s.ID)
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		var pid int
+		err := tx.QueryRowContext(ctx, sqlproject, r.PipelineID).Scan(&pid)
+		if err == sql.ErrNoRows {
+			return ErrPipelineNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkProject(ctx, tx, user, pid, ErrPipelineNotFound, authz.Run)
+		if err != nil {
+			return err
+		}
+
+		return insertRun(ctx, tx, r)
+	})
 	if err != nil {
-		logger.WithField("error", err).Debug("unable to insert run step")
+		logger.WithError(err).Debug("unable to queue pipeline run")
 		return err
 	}
 
-	logger.Debug("run step saved")
+	logger.WithField("count", r.Count).Debug("pipeline run queued")
 
 	return nil
 }
 
-// CreateTask is part of the PipelineStore interface. It creates a new task in
-// the database and sets the ID.
-func (st *Postgres) CreateTask(t *Task) error {
-	logger := logger.WithFields(log.Fields{
-		"name":    t.Name,
-		"step_id": t.StepID,
+// StartRun is part of the RelayStore interface.
+func (st *Postgres) StartRun(ctx context.Context, r *Run) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"pipeline_id": r.PipelineID,
+		"count":       r.Count,
 	})
 
-	sqlinsert := `
-	INSERT INTO tasks (name, start_time, end_time, success, step_id)
-	VALUES ($1, $2, $3, $4, $5)
-	RETURNING id
+	sqlcancelled := `
+	SELECT cancelled
+	FROM runs
+	WHERE pipeline_id = $1 AND count = $2
+	FOR UPDATE
 	`
 
-	logger.Debug("saving step task")
+	sqlupdate := `
+	UPDATE runs
+	SET start_time = $3
+	WHERE pipeline_id = $1 AND count = $2
+	`
 
-	// Using QueryRow because the insert is returning "id".
-	err := st.db.QueryRow(
-		sqlinsert, t.Name, t.Start, t.End, t.Success, t.StepID).
-		Scan(&t.ID)
+	logger.Debug("starting pipeline run")
+
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		var cancelled bool
+		err := tx.QueryRowContext(ctx, sqlcancelled, r.PipelineID, r.Count).Scan(&cancelled)
+		if err == sql.ErrNoRows {
+			return ErrRunNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if cancelled {
+			return ErrRunCancelled
+		}
+
+		res, err := tx.ExecContext(ctx, sqlupdate, r.PipelineID, r.Count, r.Start)
+		return checkUpdated(res, err, ErrRunNotFound)
+	})
 	if err != nil {
-		logger.WithField("error", err).Debug("unable to insert step task")
+		logger.WithError(err).Debug("unable to start pipeline run")
 		return err
 	}
 
-	logger.Debug("step task saved")
+	logger.Debug("pipeline run started")
 
 	return nil
 }
 
-// UpdateRun implements part of PipelineStore. It updates a run task's success
-// status and end time.
-func (st *Postgres) UpdateRun(r *Run) error {
-	logger := logger.WithFields(log.Fields{
-		"pipeline_id": r.PipelineID,
-		"count":       r.Count,
-		"end":         r.End,
-		"success":     r.Success,
+// RunCancelled returns whether the nth run of the pipeline with the given ID
+// has been cancelled, or ErrRunNotFound if there's no such run.
+func (st *Postgres) RunCancelled(ctx context.Context, pid, n int) (bool, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"pipeline_id": pid,
+		"count":       n,
 	})
 
-	sqlupdate := `
-	UPDATE runs
-	SET success = $1, end_time = $2
-	WHERE runs.pipeline_id = $3 AND runs.count = $4
+	sqlq := `
+	SELECT cancelled
+	FROM runs
+	WHERE pipeline_id = $1 AND count = $2
+	`
+
+	var cancelled bool
+	err := st.db.QueryRowContext(ctx, sqlq, pid, n).Scan(&cancelled)
+	if err == sql.ErrNoRows {
+		return false, ErrRunNotFound
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to check whether run was cancelled")
+		return false, err
+	}
+
+	return cancelled, nil
+}
+
+// CancelRun is part of the RelayStore interface.
+func (st *Postgres) CancelRun(ctx context.Context, user string, pid, n int) (Run, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"pipeline_id": pid,
+		"count":       n,
+	})
+
+	sqlproject := `
+	SELECT project_id
+	FROM pipelines
+	WHERE id = $1
+	`
+
+	sqlrun := `
+	SELECT start_time, end_time
+	FROM runs
+	WHERE pipeline_id = $1 AND count = $2
+	FOR UPDATE
+	`
+
+	// Runs that haven't started yet are ended here, since nothing else
+	// is going to end them.
+	sqlupdate := `
+	UPDATE runs
+	SET cancelled = true, success = NULL,
+		end_time = CASE WHEN start_time IS NULL THEN now() ELSE end_time END
+	WHERE pipeline_id = $1 AND count = $2
+	RETURNING end_time
+	`
+
+	logger.Debug("cancelling pipeline run")
+
+	r := Run{PipelineID: pid, Count: n}
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		var proj int
+		err := tx.QueryRowContext(ctx, sqlproject, pid).Scan(&proj)
+		if err == sql.ErrNoRows {
+			return ErrRunNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkProject(ctx, tx, user, proj, ErrRunNotFound, authz.Run)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, sqlrun, pid, n).Scan(&r.Start, &r.End)
+		if err == sql.ErrNoRows {
+			return ErrRunNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if r.End != nil {
+			return ErrRunFinished
+		}
+
+		r.MarkCancelled()
+		return tx.QueryRowContext(ctx, sqlupdate, pid, n).Scan(&r.End)
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to cancel pipeline run")
+		return Run{}, err
+	}
+
+	logger.Debug("pipeline run cancelled")
+
+	return r, nil
+}
+
+// RetryRun is part of the RelayStore interface.
+func (st *Postgres) RetryRun(ctx context.Context, user string, pid, n int, resume bool) (Run, error) {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"pipeline_id": pid,
+		"count":       n,
+		"resume":      resume,
+	})
+
+	sqlproject := `
+	SELECT project_id
+	FROM pipelines
+	WHERE id = $1
+	`
+
+	sqlrun := `
+	SELECT end_time, success, git_branch, git_commit, parameters, definition
+	FROM runs
+	WHERE pipeline_id = $1 AND count = $2
+	`
+
+	sqlsteps := `
+	SELECT id, name, start_time, end_time, success
+	FROM steps
+	WHERE pipeline_id = $1 AND run_count = $2
+	ORDER BY id
+	`
+
+	sqlstep := `
+	INSERT INTO steps (name, start_time, end_time, success, pipeline_id, run_count)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id
+	`
+
+	sqltasks := `
+	INSERT INTO tasks (name, start_time, end_time, success, step_id)
+	SELECT name, start_time, end_time, success, $1
+	FROM tasks
+	WHERE step_id = $2
+	ORDER BY id
+	`
+
+	logger.Debug("retrying pipeline run")
+
+	r := Run{PipelineID: pid, RetryOf: n}
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		var proj int
+		err := tx.QueryRowContext(ctx, sqlproject, pid).Scan(&proj)
+		if err == sql.ErrNoRows {
+			return ErrRunNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkProject(ctx, tx, user, proj, ErrRunNotFound, authz.Run)
+		if err != nil {
+			return err
+		}
+
+		old := Run{PipelineID: pid, Count: n}
+		var params, def []byte
+		err = tx.QueryRowContext(ctx, sqlrun, pid, n).
+			Scan(&old.End, &old.Success, &old.Branch, &old.Commit, &params, &def)
+		if err == sql.ErrNoRows {
+			return ErrRunNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = scanRunInputs(&old, params, def, sql.NullInt64{})
+		if err != nil {
+			return err
+		}
+
+		err = checkRetry(old, resume)
+		if err != nil {
+			return err
+		}
+
+		r.Branch = old.Branch
+		r.Commit = old.Commit
+		r.Parameters = old.Parameters
+		r.Definition = old.Definition
+
+		err = insertRun(ctx, tx, &r)
+		if err != nil {
+			return err
+		}
+
+		if !resume {
+			return nil
+		}
+
+		// The old steps are all read before any are copied, since the
+		// connection can't be used for anything else while there are
+		// rows left to read.
+		rows, err := tx.QueryContext(ctx, sqlsteps, pid, n)
+		if err != nil {
+			return err
+		}
+
+		var oldIDs []int
+		for rows.Next() {
+			var id int
+			s := Step{PipelineID: pid, RunCount: r.Count}
+			err := rows.Scan(&id, &s.Name, &s.Start, &s.End, &s.Success)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			if s.Success == nil || !*s.Success {
+				break
+			}
+
+			oldIDs = append(oldIDs, id)
+			r.Steps = append(r.Steps, s)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range r.Steps {
+			s := &r.Steps[i]
+
+			err := tx.QueryRowContext(ctx, sqlstep, s.Name, s.Start, s.End, s.Success, pid, r.Count).
+				Scan(&s.ID)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, sqltasks, s.ID, oldIDs[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to retry pipeline run")
+		return Run{}, err
+	}
+
+	logger.WithField("retry", r.Count).Debug("pipeline run retried")
+
+	return r, nil
+}
+
+// insertRun saves the run with the next count of its pipeline and sets
+// the count. Bumping the pipeline's run_count locks its row until the
+// transaction is done, so concurrent runs get counts one at a time. The
+// count also goes past any run that's already saved, in case run_count
+// fell behind the runs, which would otherwise conflict on the same count
+// every time, since a conflict rolls the bump back with the insert.
+func insertRun(ctx context.Context, tx *sql.Tx, r *Run) error {
+	sqlcount := `
+	UPDATE pipelines
+	SET run_count = GREATEST(run_count, (
+		SELECT COALESCE(MAX(count), 0) FROM runs WHERE pipeline_id = $1
+	)) + 1
+	WHERE id = $1
+	RETURNING run_count
+	`
+
+	sqlinsert := `
+	INSERT INTO runs (count, start_time, end_time, success, pipeline_id,
+		git_branch, git_commit, parameters, definition, retry_of)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	params, def, retryOf, err := runInputs(r)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx, sqlcount, r.PipelineID).Scan(&count)
+	if err == sql.ErrNoRows {
+		return ErrPipelineNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, sqlinsert, count, r.Start, r.End, r.Success, r.PipelineID,
+		r.Branch, r.Commit, params, def, retryOf)
+	if pqerrcode(err) == pqUniqueViolation {
+		return ErrRunConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	r.Count = count
+	return nil
+}
+
+// runInputs returns what the run was run with as it's saved. The JSON is
+// sent as strings, since pq sends []byte as BYTEA, which isn't JSON.
+func runInputs(r *Run) (params, def sql.NullString, retryOf sql.NullInt64, err error) {
+	if r.Parameters != nil {
+		buf, err := json.Marshal(r.Parameters)
+		if err != nil {
+			return params, def, retryOf, err
+		}
+
+		params = sql.NullString{String: string(buf), Valid: true}
+	}
+
+	def = sql.NullString{String: string(r.Definition), Valid: len(r.Definition) > 0}
+	retryOf = sql.NullInt64{Int64: int64(r.RetryOf), Valid: r.RetryOf != 0}
+
+	return params, def, retryOf, nil
+}
+
+// scanRunInputs sets what the run was run with from how it's saved.
+func scanRunInputs(r *Run, params, def []byte, retryOf sql.NullInt64) error {
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &r.Parameters); err != nil {
+			return err
+		}
+	}
+
+	if len(def) > 0 {
+		r.Definition = def
+	}
+
+	r.RetryOf = int(retryOf.Int64)
+
+	return nil
+}
+
+// CreateStep is part of the PipelineStore interface. It creates a new run step
+// in the database and sets the ID. If the step's run doesn't exist it returns
+// ErrRunNotFound.
+func (st *Postgres) CreateStep(ctx context.Context, s *Step) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"pipeline_id": s.PipelineID,
+		"run_count":   s.RunCount,
+		"name":        s.Name,
+	})
+
+	// Selecting from runs means nothing is inserted unless the
+	// run is there to attach the step to.
+	sqlinsert := `
+	INSERT INTO steps (name, start_time, end_time, success, pipeline_id, run_count)
+	SELECT $1, $2, $3, $4, r.pipeline_id, r.count
+	FROM runs AS r
+	WHERE r.pipeline_id = $5 AND r.count = $6
+	RETURNING id
 	`
 
 	logger.Debug("saving run step")
 
-	st.db.Exec(sqlupdate, r.Success, r.End, r.PipelineID, r.Count)
+	// Using QueryRow because the insert is returning "id".
+	err := st.db.QueryRowContext(ctx,
+		sqlinsert, s.Name, s.Start, s.End, s.Success, s.PipelineID, s.RunCount).
+		Scan(&s.ID)
+	if err == sql.ErrNoRows {
+		err = ErrRunNotFound
+	}
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to insert run step")
+		return err
+	}
 
 	logger.Debug("run step saved")
 
 	return nil
 }
 
+// CreateTask is part of the PipelineStore interface. It creates a new task in
+// the database and sets the ID. If the task's step doesn't exist it returns
+// ErrStepNotFound.
+func (st *Postgres) CreateTask(ctx context.Context, t *Task) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"name":    t.Name,
+		"step_id": t.StepID,
+	})
+
+	sqlinsert := `
+	INSERT INTO tasks (name, start_time, end_time, success, step_id)
+	SELECT $1, $2, $3, $4, s.id
+	FROM steps AS s
+	WHERE s.id = $5
+	RETURNING id
+	`
+
+	logger.Debug("saving step task")
+
+	// Using QueryRow because the insert is returning "id".
+	err := st.db.QueryRowContext(ctx,
+		sqlinsert, t.Name, t.Start, t.End, t.Success, t.StepID).
+		Scan(&t.ID)
+	if err == sql.ErrNoRows {
+		err = ErrStepNotFound
+	}
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to insert step task")
+		return err
+	}
+
+	logger.Debug("step task saved")
+
+	return nil
+}
+
+// UpdateRun implements part of PipelineStore. It updates a run's start and
+// end times, its success and cancelled statuses, and the commit it checked
+// out.
+func (st *Postgres) UpdateRun(ctx context.Context, r *Run) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"pipeline_id": r.PipelineID,
+		"count":       r.Count,
+		"end":         r.End,
+		"success":     r.Success,
+	})
+
+	// Whatever is running the run might not have heard that it was
+	// cancelled, so a cancelled run stays cancelled, and cancelled runs
+	// are neither successes nor failures.
+	sqlupdate := `
+	UPDATE runs
+	SET success = CASE WHEN runs.cancelled OR $6 THEN NULL ELSE $1::BOOLEAN END,
+		end_time = $2, start_time = $5, cancelled = runs.cancelled OR $6, git_commit = $7
+	WHERE runs.pipeline_id = $3 AND runs.count = $4
+	RETURNING success, cancelled
+	`
+
+	logger.Debug("saving pipeline run")
+
+	err := st.db.QueryRowContext(ctx, sqlupdate, r.Success, r.End, r.PipelineID, r.Count, r.Start, r.Cancelled, r.Commit).
+		Scan(&r.Success, &r.Cancelled)
+	if err == sql.ErrNoRows {
+		err = ErrRunNotFound
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to update pipeline run")
+		return err
+	}
+
+	logger.Debug("pipeline run saved")
+
+	return nil
+}
+
 // UpdateStep is part of the PipelineStore interface. It update's a step's
-// success status and end time with what's passed in.
-func (st *Postgres) UpdateStep(s *Step) error {
-	logger := logger.WithFields(log.Fields{
+// success and cancelled statuses and end time with what's passed in.
+func (st *Postgres) UpdateStep(ctx context.Context, s *Step) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
 		"pipeline_id": s.PipelineID,
 		"run_count":   s.RunCount,
 		"name":        s.Name,
@@ -563,13 +1366,18 @@ func (st *Postgres) UpdateStep(s *Step) error {
 
 	sqlupdate := `
 	UPDATE steps
-	SET success = $1, end_time = $2
+	SET success = $1, end_time = $2, cancelled = $4
 	WHERE steps.id = $3
 	`
 
 	logger.Debug("saving run step")
 
-	st.db.Exec(sqlupdate, s.Success, s.End, s.ID)
+	res, err := st.db.ExecContext(ctx, sqlupdate, s.Success, s.End, s.ID, s.Cancelled)
+	err = checkUpdated(res, err, ErrStepNotFound)
+	if err != nil {
+		logger.WithError(err).Debug("unable to update run step")
+		return err
+	}
 
 	logger.Debug("run step saved")
 
@@ -577,9 +1385,9 @@ func (st *Postgres) UpdateStep(s *Step) error {
 }
 
 // UpdateTask is part of the PipelineStore interface. It updates the task's
-// success status and end time with what's passed in.
-func (st *Postgres) UpdateTask(t *Task) error {
-	logger := logger.WithFields(log.Fields{
+// success and cancelled statuses and end time with what's passed in.
+func (st *Postgres) UpdateTask(ctx context.Context, t *Task) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
 		"name":    t.Name,
 		"step_id": t.StepID,
 		"success": t.Success,
@@ -589,13 +1397,18 @@ func (st *Postgres) UpdateTask(t *Task) error {
 
 	sqlupdate := `
 	UPDATE tasks
-	SET success = $1, end_time = $2
+	SET success = $1, end_time = $2, cancelled = $4
 	WHERE tasks.id = $3
 	`
 
 	logger.Debug("saving step task")
 
-	st.db.Exec(sqlupdate, t.Success, t.End, t.ID)
+	res, err := st.db.ExecContext(ctx, sqlupdate, t.Success, t.End, t.ID, t.Cancelled)
+	err = checkUpdated(res, err, ErrTaskNotFound)
+	if err != nil {
+		logger.WithError(err).Debug("unable to update step task")
+		return err
+	}
 
 	logger.Debug("step task saved")
 
@@ -604,18 +1417,19 @@ func (st *Postgres) UpdateTask(t *Task) error {
 
 // GetRun returns the nth run of the pipeline with the given ID. If the run
 // isn't found it returns ErrRunNotFound.
-func (st *Postgres) GetRun(user string, pid, n int) (Run, error) {
-	logger := logger.WithFields(logrus.Fields{
+func (st *Postgres) GetRun(ctx context.Context, user string, pid, n int) (Run, error) {
+	logger := ctxlogger(ctx).WithFields(logrus.Fields{
 		"pipeline_id": pid,
 		"count":       n,
 	})
 	logger.Debug("getting run from postgres")
 
 	sqlq := `
-	SELECT r.start_time, r.end_time, r.success,
-		s.id, s.name, s.start_time, s.end_time, s.success
+	SELECT r.start_time, r.end_time, r.success, r.cancelled,
+		r.git_branch, r.git_commit, r.parameters, r.definition, r.retry_of,
+		s.id, s.name, s.start_time, s.end_time, s.success, s.cancelled
 	FROM runs AS r
-	INNER JOIN steps AS s
+	LEFT JOIN steps AS s
 	ON r.count = s.run_count
 		AND r.pipeline_id = s.pipeline_id
 	INNER JOIN pipelines AS p
@@ -626,23 +1440,23 @@ func (st *Postgres) GetRun(user string, pid, n int) (Run, error) {
 	ON proj.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE (u.email = $3
-		OR u.group_name = proj.group_name AND (proj.permissions & 128) != 0
-		OR (proj.permissions & 16) != 0)
+	WHERE ` + canSQL(authz.Read, "proj", "$3") + `
 		AND r.pipeline_id = $1 AND r.count = $2
 	`
 
-	r := Run{
-		PipelineID: pid,
-		Count:      n,
-	}
-	rows, err := st.db.Query(sqlq, pid, n, user)
+	rows, err := st.db.QueryContext(ctx, sqlq, pid, n, user)
 	if err != nil {
-		// TODO: if this is ErrNoRows return ErrRunNotFound.
 		logger.WithError(err).Debug("unable to query database")
-		return r, err
+		return Run{}, err
 	}
+	defer rows.Close()
 
+	found := false
+	r := Run{
+		PipelineID: pid,
+		Count:      n,
+		Steps:      []Step{},
+	}
 	for rows.Next() {
 		s := Step{
 			PipelineID: pid,
@@ -651,30 +1465,181 @@ func (st *Postgres) GetRun(user string, pid, n int) (Run, error) {
 
 		// It's safe to always overwrite `r` here because these values
 		// should always be the same.
-		err := rows.Scan(&r.Start, &r.End, &r.Success,
-			&s.ID, &s.Name, &s.Start, &s.End, &s.Success)
+		var params, def []byte
+		var retryOf, stepID sql.NullInt64
+		var stepName sql.NullString
+		var stepCancelled sql.NullBool
+		err := rows.Scan(&r.Start, &r.End, &r.Success, &r.Cancelled,
+			&r.Branch, &r.Commit, &params, &def, &retryOf,
+			&stepID, &stepName, &s.Start, &s.End, &s.Success, &stepCancelled)
+		if err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return r, err
+		}
+		found = true
+
+		err = scanRunInputs(&r, params, def, retryOf)
 		if err != nil {
 			logger.WithError(err).Debug("unable to scan row")
 			return r, err
 		}
 
-		r.Steps = append(r.Steps, s)
+		// A run without steps yet still has its one row, with the step's
+		// columns NULL.
+		if stepID.Valid {
+			s.ID = int(stepID.Int64)
+			s.Name = stepName.String
+			s.Cancelled = stepCancelled.Bool
+			r.Steps = append(r.Steps, s)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Debug("unable to read rows")
+		return Run{}, err
+	}
+
+	if !found {
+		return Run{}, ErrRunNotFound
 	}
 
 	return r, nil
 }
 
-// GetStep returns the nth run of the pipeline with the given ID. If the Step
-// isn't found it returns ErrStepNotFound.
-func (st *Postgres) GetStep(user string, id int) (Step, error) {
-	logger := logger.WithField("id", id)
-	logger.Debug("getting step from postgres")
+// ListRuns returns a page of summaries of the runs of the pipeline with the
+// given ID, narrowed down by the filter. If the user can't see the pipeline
+// it returns ErrPipelineNotFound.
+func (st *Postgres) ListRuns(ctx context.Context, user string, pid int, f RunFilter) (RunPage, error) {
+	logger := ctxlogger(ctx).WithFields(logrus.Fields{
+		"pipeline_id": pid,
+	})
+	logger.Debug("listing runs from postgres")
 
-	sqlq := `
-	SELECT s.name, s.start_time, s.end_time, s.success,
-		t.id, t.name, t.start_time, t.end_time, t.success
-	FROM steps AS s
-	INNER JOIN tasks AS t
+	f, err := f.normalize()
+	if err != nil {
+		logger.WithError(err).Debug("invalid run filter")
+		return RunPage{}, err
+	}
+
+	sqlvisible := `
+	SELECT p.id
+	FROM pipelines AS p
+	INNER JOIN projects AS proj
+	ON p.project_id = proj.id
+	INNER JOIN users AS u
+	ON proj.user_email = u.email
+	WHERE ` + canSQL(authz.Read, "proj", "$2") + `
+		AND p.id = $1
+	`
+
+	err = st.db.QueryRowContext(ctx, sqlvisible, pid, user).Scan(&pid)
+	if err == sql.ErrNoRows {
+		return RunPage{}, ErrPipelineNotFound
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to query database")
+		return RunPage{}, err
+	}
+
+	sqlq := `
+	SELECT r.count, r.start_time, r.end_time, r.success, r.cancelled,
+		r.git_branch, r.git_commit, r.parameters, r.retry_of
+	FROM runs AS r
+	WHERE r.pipeline_id = $1
+	`
+	args := sqlArgs{pid}
+	arg := args.add
+
+	switch f.Status {
+	case RunSucceeded:
+		sqlq += "AND r.success = true\n"
+	case RunFailed:
+		sqlq += "AND r.success = false\n"
+	case RunInProgress:
+		sqlq += "AND r.success IS NULL AND NOT r.cancelled\n"
+	case RunCancelled:
+		sqlq += "AND r.cancelled\n"
+	}
+
+	if f.Since != nil {
+		sqlq += "AND r.start_time >= " + arg(*f.Since) + "\n"
+	}
+
+	if f.Until != nil {
+		sqlq += "AND r.start_time < " + arg(*f.Until) + "\n"
+	}
+
+	order := "ASC"
+	if f.Order == OrderDesc {
+		order = "DESC"
+	}
+
+	if f.After != 0 {
+		if f.Order == OrderAsc {
+			sqlq += "AND r.count > " + arg(f.After) + "\n"
+		} else {
+			sqlq += "AND r.count < " + arg(f.After) + "\n"
+		}
+	}
+
+	// Asking for one more run than fits on the page is how
+	// to tell whether there's a page after this one.
+	sqlq += "ORDER BY r.count " + order + "\n"
+	sqlq += "LIMIT " + arg(f.Limit+1)
+
+	rows, err := st.db.QueryContext(ctx, sqlq, args...)
+	if err != nil {
+		logger.WithError(err).Debug("unable to query database")
+		return RunPage{}, err
+	}
+	defer rows.Close()
+
+	page := RunPage{Runs: []Run{}}
+	for rows.Next() {
+		r := Run{PipelineID: pid}
+
+		var params []byte
+		var retryOf sql.NullInt64
+		err := rows.Scan(&r.Count, &r.Start, &r.End, &r.Success, &r.Cancelled,
+			&r.Branch, &r.Commit, &params, &retryOf)
+		if err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return RunPage{}, err
+		}
+
+		err = scanRunInputs(&r, params, nil, retryOf)
+		if err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return RunPage{}, err
+		}
+
+		page.Runs = append(page.Runs, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Debug("unable to read rows")
+		return RunPage{}, err
+	}
+
+	if len(page.Runs) > f.Limit {
+		page.Runs = page.Runs[:f.Limit]
+		page.Next = page.Runs[f.Limit-1].Count
+	}
+
+	return page, nil
+}
+
+// GetStep returns the nth run of the pipeline with the given ID. If the Step
+// isn't found it returns ErrStepNotFound.
+func (st *Postgres) GetStep(ctx context.Context, user string, id int) (Step, error) {
+	logger := ctxlogger(ctx).WithField("id", id)
+	logger.Debug("getting step from postgres")
+
+	sqlq := `
+	SELECT s.name, s.start_time, s.end_time, s.success, s.cancelled,
+		t.id, t.name, t.start_time, t.end_time, t.success, t.cancelled
+	FROM steps AS s
+	INNER JOIN tasks AS t
 	ON s.id = t.step_id
 	INNER JOIN runs AS r
 	ON s.run_count = r.count
@@ -686,14 +1651,12 @@ func (st *Postgres) GetStep(user string, id int) (Step, error) {
 	ON proj.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE (u.email = $2
-		OR u.group_name = proj.group_name AND (proj.permissions & 128) != 0
-		OR (proj.permissions & 16) != 0)
+	WHERE ` + canSQL(authz.Read, "proj", "$2") + `
 		AND s.id = $1
 	`
 
 	s := Step{ID: id}
-	rows, err := st.db.Query(sqlq, id, user)
+	rows, err := st.db.QueryContext(ctx, sqlq, id, user)
 	if err != nil {
 		logger.WithError(err).Debug("unable to query database")
 		return s, err
@@ -706,8 +1669,8 @@ func (st *Postgres) GetStep(user string, id int) (Step, error) {
 	// The loop has to be unrolled to handle the first call to
 	// Next() that was used to check for a result.
 	t := Task{StepID: id}
-	err = rows.Scan(&s.Name, &s.Start, &s.End, &s.Success,
-		&t.ID, &t.Name, &t.Start, &t.End, &t.Success)
+	err = rows.Scan(&s.Name, &s.Start, &s.End, &s.Success, &s.Cancelled,
+		&t.ID, &t.Name, &t.Start, &t.End, &t.Success, &t.Cancelled)
 	if err != nil {
 		logger.WithError(err).Debug("unable to scan row")
 		return s, err
@@ -720,8 +1683,8 @@ func (st *Postgres) GetStep(user string, id int) (Step, error) {
 
 		// It's safe to always overwrite `s` here because these values
 		// should always be the same.
-		err := rows.Scan(&s.Name, &s.Start, &s.End, &s.Success,
-			&t.ID, &t.Name, &t.Start, &t.End, &t.Success)
+		err := rows.Scan(&s.Name, &s.Start, &s.End, &s.Success, &s.Cancelled,
+			&t.ID, &t.Name, &t.Start, &t.End, &t.Success, &t.Cancelled)
 		if err != nil {
 			logger.WithError(err).Debug("unable to scan row")
 			return s, err
@@ -735,12 +1698,12 @@ func (st *Postgres) GetStep(user string, id int) (Step, error) {
 
 // GetTask returns the Task with the given ID. If the Task
 // isn't found it returns ErrTaskNotFound.
-func (st *Postgres) GetTask(user string, id int) (Task, error) {
-	logger := logger.WithField("id", id)
+func (st *Postgres) GetTask(ctx context.Context, user string, id int) (Task, error) {
+	logger := ctxlogger(ctx).WithField("id", id)
 	logger.Debug("getting Task from postgres")
 
 	sqlq := `
-	SELECT t.name, t.start_time, t.end_time, t.success, t.step_id
+	SELECT t.name, t.start_time, t.end_time, t.success, t.cancelled, t.step_id
 	FROM tasks AS t
 	INNER JOIN steps AS s
 	ON t.step_id = s.id 
@@ -754,15 +1717,13 @@ func (st *Postgres) GetTask(user string, id int) (Task, error) {
 	ON proj.user_email = u.email
 	INNER JOIN groups AS g
 	ON u.group_name = g.name
-	WHERE (u.email = $2
-		OR u.group_name = proj.group_name AND (proj.permissions & 128) != 0
-		OR (proj.permissions & 16) != 0)
+	WHERE ` + canSQL(authz.Read, "proj", "$2") + `
 		AND t.id = $1;
 	`
 
 	t := Task{ID: id}
-	err := st.db.QueryRow(sqlq, id, user).
-		Scan(&t.Name, &t.Start, &t.End, &t.Success, &t.StepID)
+	err := st.db.QueryRowContext(ctx, sqlq, id, user).
+		Scan(&t.Name, &t.Start, &t.End, &t.Success, &t.Cancelled, &t.StepID)
 	if err != nil {
 		logger.WithError(err).Debug("unable to query row")
 		if err == sql.ErrNoRows {
@@ -773,9 +1734,233 @@ func (st *Postgres) GetTask(user string, id int) (Task, error) {
 	return t, err
 }
 
+// DeleteProject implements part of RelayStore. It deletes the project with
+// the given ID along with its remotes and everything under them.
+func (st *Postgres) DeleteProject(ctx context.Context, user string, id int) ([]GitRemote, error) {
+	logger := ctxlogger(ctx).WithField("id", id)
+	logger.Debug("deleting project")
+
+	sqlremotes := `
+	SELECT url, branch
+	FROM git_remotes
+	WHERE project_id = $1
+	ORDER BY url, branch
+	`
+
+	remotes := []GitRemote{}
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		err := checkProjectWrite(ctx, tx, user, id, ErrProjectNotFound)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, sqlremotes, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			r := GitRemote{ProjectID: id}
+			if err := rows.Scan(&r.URL, &r.Branch); err != nil {
+				return err
+			}
+
+			remotes = append(remotes, r)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		err = deletePipelines(ctx, tx, "project_id = $1", id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM git_remotes WHERE project_id = $1", id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM projects WHERE id = $1", id)
+		return err
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to delete project")
+		return nil, err
+	}
+
+	logger.Debug("project deleted")
+
+	return remotes, nil
+}
+
+// DeleteGitRemote implements part of RelayStore. It deletes the remote from
+// the project along with its pipelines and everything under them.
+func (st *Postgres) DeleteGitRemote(ctx context.Context, user string, pid int, url, branch string) error {
+	logger := ctxlogger(ctx).WithFields(log.Fields{
+		"project_id": pid,
+		"url":        url,
+		"branch":     branch,
+	})
+	logger.Debug("deleting git remote")
+
+	sqldelete := `
+	DELETE FROM git_remotes
+	WHERE project_id = $1 AND url = $2 AND branch = $3
+	`
+
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		err := checkProjectWrite(ctx, tx, user, pid, ErrGitRemoteNotFound)
+		if err != nil {
+			return err
+		}
+
+		err = deletePipelines(ctx, tx,
+			"project_id = $1 AND remote_url = $2 AND remote_branch = $3", pid, url, branch)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, sqldelete, pid, url, branch)
+		return checkUpdated(res, err, ErrGitRemoteNotFound)
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to delete git remote")
+		return err
+	}
+
+	logger.Debug("git remote deleted")
+
+	return nil
+}
+
+// DeletePipeline implements part of RelayStore. It deletes the pipeline with
+// the given ID along with its runs, steps and tasks.
+func (st *Postgres) DeletePipeline(ctx context.Context, user string, id int) error {
+	logger := ctxlogger(ctx).WithField("id", id)
+	logger.Debug("deleting pipeline")
+
+	sqlproject := `
+	SELECT project_id
+	FROM pipelines
+	WHERE id = $1
+	`
+
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		var pid int
+		err := tx.QueryRowContext(ctx, sqlproject, id).Scan(&pid)
+		if err == sql.ErrNoRows {
+			return ErrPipelineNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkProjectWrite(ctx, tx, user, pid, ErrPipelineNotFound)
+		if err != nil {
+			return err
+		}
+
+		return deletePipelines(ctx, tx, "id = $1", id)
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to delete pipeline")
+		return err
+	}
+
+	logger.Debug("pipeline deleted")
+
+	return nil
+}
+
+// checkProjectWrite makes sure the user can write to the project with the
+// given ID, locking the project's row until tx is done. If the user can't
+// see the project at all, notfound is returned.
+func checkProjectWrite(ctx context.Context, tx *sql.Tx, user string, id int, notfound error) error {
+	return checkProject(ctx, tx, user, id, notfound, authz.Write)
+}
+
+// checkProject makes sure the user can take the actions on the project with
+// the given ID, locking the project's row until tx is done. If the user
+// can't see the project at all, notfound is returned.
+func checkProject(ctx context.Context, tx *sql.Tx, user string, id int, notfound error, acts ...authz.Action) error {
+	sqlq := `
+	SELECT p.user_email, p.group_name, p.permissions,
+		ARRAY(SELECT gm.group_name FROM group_members AS gm WHERE gm.user_email = $2)
+	FROM projects AS p
+	WHERE p.id = $1
+	FOR UPDATE
+	`
+
+	var auth Authorization
+	var groups []string
+	err := tx.QueryRowContext(ctx, sqlq, id, user).
+		Scan(&auth.User.Email, &auth.Group.Name, &auth.Permissions, pq.Array(&groups))
+	if err == sql.ErrNoRows {
+		return notfound
+	}
+	if err != nil {
+		return err
+	}
+
+	subj := authz.Subject{ID: user, Groups: groups}
+
+	if !authz.Can(subj, authz.Read, auth.resource()) {
+		return notfound
+	}
+
+	for _, act := range acts {
+		if !authz.Can(subj, act, auth.resource()) {
+			return ErrNotAuthorized
+		}
+	}
+
+	return nil
+}
+
+// canSQL returns a condition for a query's WHERE clause that only lets
+// through the rows of the projects table, aliased as proj, that the user
+// can take the action on. The user is given as a placeholder.
+func canSQL(act authz.Action, proj, user string) string {
+	c := authz.Columns{
+		Owner:       proj + ".user_email",
+		Group:       proj + ".group_name",
+		Permissions: proj + ".permissions",
+	}
+
+	groups := fmt.Sprintf("ARRAY(SELECT subj.group_name FROM group_members AS subj WHERE subj.user_email = %v)", user)
+
+	return authz.Where(act, c, user, groups)
+}
+
+// deletePipelines deletes the pipelines matching the condition, along with
+// their runs, steps and tasks. The condition is on the pipelines table and
+// can use args as $1, $2 and so on.
+func deletePipelines(ctx context.Context, tx *sql.Tx, cond string, args ...interface{}) error {
+	pipelines := "SELECT id FROM pipelines WHERE " + cond
+
+	stmts := []string{
+		`DELETE FROM tasks WHERE step_id IN (
+			SELECT id FROM steps WHERE pipeline_id IN (` + pipelines + `))`,
+		"DELETE FROM steps WHERE pipeline_id IN (" + pipelines + ")",
+		"DELETE FROM runs WHERE pipeline_id IN (" + pipelines + ")",
+		"DELETE FROM pipelines WHERE " + cond,
+	}
+
+	for _, stmt := range stmts {
+		_, err := tx.ExecContext(ctx, stmt, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // CreateGroup creates the passed in group in the database.
-func (st *Postgres) CreateGroup(g *Group) error {
-	logger := logger.WithField("name", g.Name)
+func (st *Postgres) CreateGroup(ctx context.Context, g *Group) error {
+	logger := ctxlogger(ctx).WithField("name", g.Name)
 	logger.Debug("saving group")
 
 	sqlq := `
@@ -784,13 +1969,68 @@ func (st *Postgres) CreateGroup(g *Group) error {
 		($1)
 	`
 
-	_, err := st.db.Exec(sqlq, g.Name)
+	_, err := st.db.ExecContext(ctx, sqlq, g.Name)
+	if pqerrcode(err) == pqUniqueViolation {
+		return ErrGroupExists
+	}
+
 	return err
 }
 
+// GetGroups returns every group in the database, sorted by name.
+func (st *Postgres) GetGroups(ctx context.Context) ([]Group, error) {
+	logger := ctxlogger(ctx)
+	logger.Debug("getting groups")
+
+	sqlq := `
+	SELECT name
+	FROM groups
+	ORDER BY name COLLATE "C"
+	`
+
+	rows, err := st.db.QueryContext(ctx, sqlq)
+	if err != nil {
+		logger.WithError(err).Debug("unable to query groups")
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		g := Group{}
+		if err := rows.Scan(&g.Name); err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return nil, err
+		}
+
+		groups = append(groups, g)
+	}
+
+	return groups, rows.Err()
+}
+
+// DeleteGroup deletes the group from the database. The foreign keys from
+// users and projects keep groups that are still in use from going away.
+func (st *Postgres) DeleteGroup(ctx context.Context, name string) error {
+	logger := ctxlogger(ctx).WithField("name", name)
+	logger.Debug("deleting group")
+
+	sqlq := `
+	DELETE FROM groups
+	WHERE name = $1
+	`
+
+	res, err := st.db.ExecContext(ctx, sqlq, name)
+	if pqerrcode(err) == pqForeignKeyViolation {
+		return ErrGroupInUse
+	}
+
+	return checkUpdated(res, err, ErrGroupNotFound)
+}
+
 // CreateUser creates the passed in user in the database.
-func (st *Postgres) CreateUser(u *User) error {
-	logger := logger.WithField("email", u.Email)
+func (st *Postgres) CreateUser(ctx context.Context, u *User) error {
+	logger := ctxlogger(ctx).WithField("email", u.Email)
 	logger.Debug("saving user")
 
 	if u.Group.Name == "" {
@@ -804,34 +2044,262 @@ func (st *Postgres) CreateUser(u *User) error {
 		return err
 	}
 
+	u.Groups = memberships(u.Group, u.Groups)
+
+	err = st.withTx(ctx, func(tx *sql.Tx) error {
+		sqlq := `
+		INSERT INTO users (email, name, password, group_name, admin, disabled)
+		VALUES
+			($1, $2, $3, $4, $5, $6)
+		`
+
+		_, err := tx.ExecContext(ctx, sqlq, u.Email, u.Name, password, u.Group.Name, u.Admin, u.Disabled)
+		if err != nil {
+			return err
+		}
+
+		return addMemberships(ctx, tx, u.Email, u.Groups)
+	})
+	switch pqerrcode(err) {
+	case pqUniqueViolation:
+		return ErrUserExists
+	case pqForeignKeyViolation:
+		return ErrGroupNotFound
+	}
+
+	if err != nil {
+		logger.WithError(err).Debug("unable to save user")
+	}
+
+	return err
+}
+
+// addMemberships makes the user a member of the groups. Groups the user is
+// already a member of are skipped.
+func addMemberships(ctx context.Context, tx *sql.Tx, email string, groups []Group) error {
 	sqlq := `
-	INSERT INTO users (email, name, password, group_name)
+	INSERT INTO group_members (user_email, group_name)
 	VALUES
-		($1, $2, $3, $4)
+		($1, $2)
+	ON CONFLICT DO NOTHING
 	`
 
-	_, err = st.db.Exec(sqlq, u.Email, u.Name, password, u.Group.Name)
-	return err
+	for _, g := range groups {
+		_, err := tx.ExecContext(ctx, sqlq, email, g.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// userColumns are the columns scanned by scanUser, in order.
+const userColumns = `users.email, users.name, users.group_name, users.admin, users.disabled,
+	ARRAY(
+		SELECT gm.group_name FROM group_members AS gm
+		WHERE gm.user_email = users.email
+		ORDER BY gm.group_name COLLATE "C"
+	)`
+
+// scanUser scans a row of userColumns into a user.
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	u := User{}
+	groups := []string{}
+
+	err := row.Scan(&u.Email, &u.Name, &u.Group.Name, &u.Admin, &u.Disabled, pq.Array(&groups))
+	for _, g := range groups {
+		u.Groups = append(u.Groups, Group{Name: g})
+	}
+
+	return u, err
+}
+
+// GetUser returns the user with the given email, without a password.
+func (st *Postgres) GetUser(ctx context.Context, email string) (User, error) {
+	logger := ctxlogger(ctx).WithField("email", email)
+	logger.Debug("getting user")
+
+	sqlq := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE users.email = $1
+	`
+
+	u, err := scanUser(st.db.QueryRowContext(ctx, sqlq, email))
+	if err == sql.ErrNoRows {
+		return u, ErrUserNotFound
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to query row")
+	}
+
+	return u, err
+}
+
+// GetUsers returns every user in the database, sorted by email, without
+// passwords.
+func (st *Postgres) GetUsers(ctx context.Context) ([]User, error) {
+	logger := ctxlogger(ctx)
+	logger.Debug("getting users")
+
+	sqlq := `
+	SELECT ` + userColumns + `
+	FROM users
+	ORDER BY users.email COLLATE "C"
+	`
+
+	rows, err := st.db.QueryContext(ctx, sqlq)
+	if err != nil {
+		logger.WithError(err).Debug("unable to query users")
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return nil, err
+		}
+
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// UpdateUser applies the update to the user with the given email and
+// returns what's in the database afterwards.
+func (st *Postgres) UpdateUser(ctx context.Context, email string, u UserUpdate) (User, error) {
+	logger := ctxlogger(ctx).WithField("email", email)
+	logger.Debug("updating user")
+
+	var password []byte
+	if u.Password != nil {
+		var err error
+		password, err = bcrypt.GenerateFromPassword([]byte(*u.Password), bcrypt.DefaultCost)
+		if err != nil {
+			logger.WithError(err).Debug("unable to encrypt password")
+			return User{}, err
+		}
+	}
+
+	var updated User
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		sqlq := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE users.email = $1
+		FOR UPDATE
+		`
+
+		old, err := scanUser(tx.QueryRowContext(ctx, sqlq, email))
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		groups := old.Groups
+		if u.Groups != nil {
+			groups = *u.Groups
+		}
+
+		primary := old.Group
+		if u.Group != nil && u.Group.Name != primary.Name {
+			primary = *u.Group
+
+			if u.Groups == nil {
+				groups = withoutGroup(groups, old.Group.Name)
+			}
+		}
+
+		groups = memberships(primary, groups)
+
+		sqlq = `
+		UPDATE users
+		SET name = COALESCE($2, name),
+			password = COALESCE($3, password),
+			group_name = $4,
+			admin = COALESCE($5, admin),
+			disabled = COALESCE($6, disabled)
+		WHERE users.email = $1
+		`
+
+		_, err = tx.ExecContext(ctx, sqlq, email, u.Name, password, primary.Name, u.Admin, u.Disabled)
+		if err != nil {
+			return err
+		}
+
+		names := []string{}
+		for _, g := range groups {
+			names = append(names, g.Name)
+		}
+
+		sqlq = `
+		DELETE FROM group_members
+		WHERE user_email = $1
+		AND NOT group_name = ANY($2)
+		`
+
+		_, err = tx.ExecContext(ctx, sqlq, email, pq.Array(names))
+		if err != nil {
+			return err
+		}
+
+		err = addMemberships(ctx, tx, email, groups)
+		if err != nil {
+			return err
+		}
+
+		sqlq = `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE users.email = $1
+		`
+
+		updated, err = scanUser(tx.QueryRowContext(ctx, sqlq, email))
+		return err
+	})
+	if pqerrcode(err) == pqForeignKeyViolation {
+		return updated, ErrGroupNotFound
+	}
+	if err != nil && err != ErrUserNotFound {
+		logger.WithError(err).Debug("unable to update user")
+	}
+
+	return updated, err
 }
 
 // Authenticate checks the password for the user with the given email address.
-func (st *Postgres) Authenticate(email, pass string) error {
-	logger := logger.WithField("email", email)
+func (st *Postgres) Authenticate(ctx context.Context, email, pass string) error {
+	logger := ctxlogger(ctx).WithField("email", email)
 	logger.Debug("authenticating user")
 
+	if pass == "" {
+		return ErrNotAuthenticated
+	}
+
 	sqlq := `
 	SELECT password
 	FROM users
 	WHERE users.email = $1
+	AND NOT users.disabled
 	`
 
 	cryptpass := []byte{}
-	err := st.db.QueryRow(sqlq, email).Scan(&cryptpass)
+	err := st.db.QueryRowContext(ctx, sqlq, email).Scan(&cryptpass)
 	if err != nil {
 		logger.WithError(err).Debug("unable to query row")
 		if err == sql.ErrNoRows {
+			compareDummy(pass)
 			return ErrNotAuthenticated
 		}
+
+		return err
 	}
 
 	err = bcrypt.CompareHashAndPassword(cryptpass, []byte(pass))
@@ -842,3 +2310,408 @@ func (st *Postgres) Authenticate(email, pass string) error {
 
 	return nil
 }
+
+// accessTokenColumns are the columns scanned by scanAccessToken, in order.
+const accessTokenColumns = `access_tokens.id, access_tokens.name, access_tokens.user_email,
+	access_tokens.scopes, access_tokens.created_at, access_tokens.expires_at,
+	access_tokens.last_used`
+
+// scanAccessToken scans a row of accessTokenColumns into an access token.
+func scanAccessToken(row interface{ Scan(...interface{}) error }) (AccessToken, error) {
+	t := AccessToken{}
+	scopes := []string{}
+	var expires, used pq.NullTime
+
+	err := row.Scan(&t.ID, &t.Name, &t.User, pq.Array(&scopes), &t.CreatedAt, &expires, &used)
+	for _, s := range scopes {
+		t.Scopes = append(t.Scopes, Scope(s))
+	}
+
+	if expires.Valid {
+		t.ExpiresAt = &expires.Time
+	}
+
+	if used.Valid {
+		t.LastUsed = &used.Time
+	}
+
+	return t, err
+}
+
+// CreateAccessToken saves the token's hash in the database and hands out
+// the token.
+func (st *Postgres) CreateAccessToken(ctx context.Context, t *AccessToken) error {
+	logger := ctxlogger(ctx).WithFields(logrus.Fields{
+		"email": t.User,
+		"name":  t.Name,
+	})
+	logger.Debug("saving access token")
+
+	if err := t.checkScopes(); err != nil {
+		return err
+	}
+
+	token, hash, err := newToken(AccessTokenPrefix)
+	if err != nil {
+		logger.WithError(err).Debug("unable to generate access token")
+		return err
+	}
+
+	scopes := []string{}
+	for _, s := range t.Scopes {
+		scopes = append(scopes, string(s))
+	}
+
+	sqlq := `
+	INSERT INTO access_tokens (name, user_email, hash, scopes, expires_at)
+	VALUES
+		($1, $2, $3, $4, $5)
+	RETURNING ` + accessTokenColumns
+
+	created, err := scanAccessToken(st.db.QueryRowContext(ctx, sqlq,
+		t.Name, t.User, hash, pq.Array(scopes), t.ExpiresAt))
+	switch pqerrcode(err) {
+	case pqUniqueViolation:
+		return ErrAccessTokenExists
+	case pqForeignKeyViolation:
+		return ErrUserNotFound
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to save access token")
+		return err
+	}
+
+	*t = created
+	t.Token = token
+
+	return nil
+}
+
+// GetAccessTokens returns the user's access tokens, sorted by ID.
+func (st *Postgres) GetAccessTokens(ctx context.Context, user string) ([]AccessToken, error) {
+	logger := ctxlogger(ctx).WithField("email", user)
+	logger.Debug("getting access tokens")
+
+	sqlq := `
+	SELECT ` + accessTokenColumns + `
+	FROM access_tokens
+	WHERE access_tokens.user_email = $1
+	ORDER BY access_tokens.id
+	`
+
+	rows, err := st.db.QueryContext(ctx, sqlq, user)
+	if err != nil {
+		logger.WithError(err).Debug("unable to query access tokens")
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []AccessToken{}
+	for rows.Next() {
+		t, err := scanAccessToken(rows)
+		if err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return nil, err
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// RevokeAccessToken deletes the user's access token from the database.
+func (st *Postgres) RevokeAccessToken(ctx context.Context, user string, id int) error {
+	logger := ctxlogger(ctx).WithFields(logrus.Fields{
+		"email": user,
+		"id":    id,
+	})
+	logger.Debug("revoking access token")
+
+	sqlq := `
+	DELETE FROM access_tokens
+	WHERE id = $1
+	AND user_email = $2
+	`
+
+	res, err := st.db.ExecContext(ctx, sqlq, id, user)
+	return checkUpdated(res, err, ErrAccessTokenNotFound)
+}
+
+// AuthenticateAccessToken looks the access token up by its hash, marking
+// it as used on the way.
+func (st *Postgres) AuthenticateAccessToken(ctx context.Context, token string) (AccessToken, error) {
+	logger := ctxlogger(ctx)
+	logger.Debug("authenticating access token")
+
+	if !isAccessToken(token) {
+		return AccessToken{}, ErrNotAuthenticated
+	}
+
+	sqlq := `
+	UPDATE access_tokens
+	SET last_used = now()
+	FROM users
+	WHERE access_tokens.hash = $1
+	AND (access_tokens.expires_at IS NULL OR access_tokens.expires_at > now())
+	AND users.email = access_tokens.user_email
+	AND NOT users.disabled
+	RETURNING ` + accessTokenColumns
+
+	t, err := scanAccessToken(st.db.QueryRowContext(ctx, sqlq, hashToken(token)))
+	if err == sql.ErrNoRows {
+		return t, ErrNotAuthenticated
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to query row")
+	}
+
+	return t, err
+}
+
+// CreateRefreshToken saves the refresh token's hash in the database, in a
+// new family.
+func (st *Postgres) CreateRefreshToken(ctx context.Context, t *RefreshToken) error {
+	logger := ctxlogger(ctx).WithField("email", t.User)
+	logger.Debug("saving refresh token")
+
+	token, hash, err := newToken(refreshTokenPrefix)
+	if err != nil {
+		logger.WithError(err).Debug("unable to generate refresh token")
+		return err
+	}
+
+	family := uuid.New().String()
+
+	err = st.withTx(ctx, func(tx *sql.Tx) error {
+		// Expired refresh tokens are only kept around until the next
+		// one is created.
+		_, err := tx.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE expires_at <= now()")
+		if err != nil {
+			return err
+		}
+
+		sqlq := `
+		INSERT INTO refresh_tokens (family, user_email, hash, expires_at)
+		VALUES
+			($1, $2, $3, $4)
+		RETURNING id
+		`
+
+		return tx.QueryRowContext(ctx, sqlq, family, t.User, hash, t.ExpiresAt).Scan(&t.ID)
+	})
+	if pqerrcode(err) == pqForeignKeyViolation {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		logger.WithError(err).Debug("unable to save refresh token")
+		return err
+	}
+
+	t.Family = family
+	t.Token = token
+
+	return nil
+}
+
+// RotateRefreshToken marks the refresh token as used and saves a new one
+// in its family, all in one transaction.
+func (st *Postgres) RotateRefreshToken(ctx context.Context, token string, expires time.Time) (RefreshToken, error) {
+	logger := ctxlogger(ctx)
+	logger.Debug("rotating refresh token")
+
+	next, hash, err := newToken(refreshTokenPrefix)
+	if err != nil {
+		logger.WithError(err).Debug("unable to generate refresh token")
+		return RefreshToken{}, err
+	}
+
+	t := RefreshToken{ExpiresAt: expires, Token: next}
+
+	// The family has to stay revoked when a reused token is caught, so
+	// the transaction is committed and the error is returned after.
+	reused := false
+
+	err = st.withTx(ctx, func(tx *sql.Tx) error {
+		sqlq := `
+		SELECT rt.id, rt.family, rt.user_email, rt.used,
+			rt.expires_at > now() AND NOT u.disabled
+		FROM refresh_tokens AS rt
+		INNER JOIN users AS u
+		ON rt.user_email = u.email
+		WHERE rt.hash = $1
+		FOR UPDATE OF rt
+		`
+
+		var id int
+		var used, valid bool
+		err := tx.QueryRowContext(ctx, sqlq, hashToken(token)).
+			Scan(&id, &t.Family, &t.User, &used, &valid)
+		if err == sql.ErrNoRows {
+			return ErrNotAuthenticated
+		}
+		if err != nil {
+			return err
+		}
+
+		if used {
+			reused = true
+
+			_, err := tx.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE family = $1", t.Family)
+			return err
+		}
+
+		if !valid {
+			return ErrNotAuthenticated
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET used = true WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+
+		sqlq = `
+		INSERT INTO refresh_tokens (family, user_email, hash, expires_at)
+		VALUES
+			($1, $2, $3, $4)
+		RETURNING id
+		`
+
+		return tx.QueryRowContext(ctx, sqlq, t.Family, t.User, hash, t.ExpiresAt).Scan(&t.ID)
+	})
+	if reused && err == nil {
+		logger.WithField("family", t.Family).Warn("refresh token reused, revoking its family")
+		err = ErrNotAuthenticated
+	}
+	if err != nil {
+		if err != ErrNotAuthenticated {
+			logger.WithError(err).Debug("unable to rotate refresh token")
+		}
+
+		return RefreshToken{}, err
+	}
+
+	return t, nil
+}
+
+// RevokeRefreshToken deletes every refresh token in the token's family.
+func (st *Postgres) RevokeRefreshToken(ctx context.Context, token string) error {
+	logger := ctxlogger(ctx)
+	logger.Debug("revoking refresh token")
+
+	sqlq := `
+	DELETE FROM refresh_tokens
+	WHERE family IN (
+		SELECT family FROM refresh_tokens WHERE hash = $1
+	)
+	`
+
+	_, err := st.db.ExecContext(ctx, sqlq, hashToken(token))
+	if err != nil {
+		logger.WithError(err).Debug("unable to revoke refresh token")
+	}
+
+	return err
+}
+
+// RevokeJWT puts the JWT on the revocation list in the database, clearing
+// out the ones that have expired since.
+func (st *Postgres) RevokeJWT(ctx context.Context, id string, expires time.Time) error {
+	logger := ctxlogger(ctx).WithField("jti", id)
+	logger.Debug("revoking jwt")
+
+	err := st.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM revoked_jwts WHERE expires_at <= now()")
+		if err != nil {
+			return err
+		}
+
+		sqlq := `
+		INSERT INTO revoked_jwts (id, expires_at)
+		VALUES
+			($1, $2)
+		ON CONFLICT DO NOTHING
+		`
+
+		_, err = tx.ExecContext(ctx, sqlq, id, expires)
+		return err
+	})
+	if err != nil {
+		logger.WithError(err).Debug("unable to revoke jwt")
+	}
+
+	return err
+}
+
+// JWTRevoked reports whether the JWT is on the revocation list.
+func (st *Postgres) JWTRevoked(ctx context.Context, id string) (bool, error) {
+	sqlq := `
+	SELECT EXISTS (SELECT 1 FROM revoked_jwts WHERE id = $1)
+	`
+
+	revoked := false
+	err := st.db.QueryRowContext(ctx, sqlq, id).Scan(&revoked)
+	if err != nil {
+		ctxlogger(ctx).WithError(err).Debug("unable to query row")
+	}
+
+	return revoked, err
+}
+
+// RecordFailedLogin saves the failed login in the database.
+func (st *Postgres) RecordFailedLogin(ctx context.Context, l *FailedLogin) error {
+	logger := ctxlogger(ctx).WithField("email", l.Email)
+	logger.Debug("saving failed login")
+
+	if l.At.IsZero() {
+		l.At = time.Now()
+	}
+
+	sqlq := `
+	INSERT INTO failed_logins (email, ip, reason, at)
+	VALUES
+		($1, $2, $3, $4)
+	RETURNING id
+	`
+
+	err := st.db.QueryRowContext(ctx, sqlq, l.Email, l.IP, l.Reason, l.At).Scan(&l.ID)
+	if err != nil {
+		logger.WithError(err).Debug("unable to save failed login")
+	}
+
+	return err
+}
+
+// GetFailedLogins returns the newest failed logins from the database.
+func (st *Postgres) GetFailedLogins(ctx context.Context, email string, limit int) ([]FailedLogin, error) {
+	logger := ctxlogger(ctx).WithField("email", email)
+	logger.Debug("getting failed logins")
+
+	sqlq := `
+	SELECT id, email, ip, reason, at
+	FROM failed_logins
+	WHERE $1 = '' OR email = $1
+	ORDER BY id DESC
+	LIMIT $2
+	`
+
+	rows, err := st.db.QueryContext(ctx, sqlq, email, normalizeLimit(limit))
+	if err != nil {
+		logger.WithError(err).Debug("unable to query failed logins")
+		return nil, err
+	}
+	defer rows.Close()
+
+	logins := []FailedLogin{}
+	for rows.Next() {
+		l := FailedLogin{}
+		if err := rows.Scan(&l.ID, &l.Email, &l.IP, &l.Reason, &l.At); err != nil {
+			logger.WithError(err).Debug("unable to scan row")
+			return nil, err
+		}
+
+		logins = append(logins, l)
+	}
+
+	return logins, rows.Err()
+}
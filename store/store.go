@@ -1,9 +1,13 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"sort"
 	"time"
 
+	"github.com/run-ci/relay/authz"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,6 +28,27 @@ var (
 	// ErrRunNotFound is an error returned when a run isn't found for a
 	// given pipeline.
 	ErrRunNotFound = errors.New("run not found")
+	// ErrRunConflict is an error returned when a run can't be saved
+	// because its pipeline already has a run with the same count. Counts
+	// are handed out one at a time, so it means something else is
+	// numbering runs, and trying again won't help.
+	ErrRunConflict = errors.New("run already exists")
+	// ErrRunFinished is an error returned when trying to cancel a run
+	// that has already finished.
+	ErrRunFinished = errors.New("run already finished")
+	// ErrRunCancelled is an error returned when trying to start a run
+	// that was cancelled before it started.
+	ErrRunCancelled = errors.New("run cancelled")
+	// ErrRunNotFinished is an error returned when trying to retry a run
+	// that hasn't finished yet.
+	ErrRunNotFinished = errors.New("run hasn't finished")
+	// ErrRunSucceeded is an error returned when trying to resume a run
+	// that succeeded, which has no failed step to resume from.
+	ErrRunSucceeded = errors.New("run succeeded, there's nothing to resume")
+	// ErrRunNotRetryable is an error returned when trying to retry a run
+	// that doesn't have its steps recorded, which runs from before they
+	// were don't.
+	ErrRunNotRetryable = errors.New("run's steps weren't recorded, it can't be retried")
 	// ErrStepNotFound is an error returned when a Step isn't found.
 	ErrStepNotFound = errors.New("step not found")
 	// ErrTaskNotFound is an error returned when a Task isn't found.
@@ -37,6 +62,28 @@ var (
 	// ErrGitRemoteNotFound is what's returned when a Git remote coudln't be
 	// found in the store.
 	ErrGitRemoteNotFound = errors.New("git remote not found")
+	// ErrNotAuthorized is what's returned when a user can see a resource
+	// but isn't allowed to do what they asked to do with it. Users that
+	// can't see the resource get the resource's not found error instead.
+	ErrNotAuthorized = errors.New("not authorized")
+	// ErrInvalidPermissions is what's returned when a Permission has
+	// any of the bits reserved for extensibility set.
+	ErrInvalidPermissions = errors.New("invalid permissions")
+	// ErrUserNotFound is what's returned when a user couldn't be found
+	// in the store.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is what's returned when trying to create a user with
+	// an email that's already taken.
+	ErrUserExists = errors.New("user already exists")
+	// ErrGroupNotFound is what's returned when a group couldn't be found
+	// in the store.
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrGroupExists is what's returned when trying to create a group
+	// with a name that's already taken.
+	ErrGroupExists = errors.New("group already exists")
+	// ErrGroupInUse is what's returned when trying to delete a group
+	// that still has users or projects in it.
+	ErrGroupInUse = errors.New("group still has users or projects")
 )
 
 var (
@@ -45,35 +92,35 @@ var (
 		Name: "default",
 	}
 
-	// DefaultUser is the first user the store should be seeded with. It's
-	// only for bootstrapping other users. This user has no password so
-	// make sure to lock it down.
+	// DefaultUser is the user dev/seed-db owns everything it seeds with.
+	// It has no password, so nobody can log in as it, and it isn't an
+	// admin. The first admin comes from RELAY_ADMIN_EMAIL and
+	// RELAY_ADMIN_PASSWORD instead.
 	DefaultUser = User{
 		Name:  "default",
 		Email: "default@local-relay",
 
-		// Remember to delete this user once you've bootstrapped. :)
 		Password: "",
 	}
 
 	// PermGroupRead denotes a user's group has the ability to read
 	// the resoruce.
-	PermGroupRead = byte(128)
+	PermGroupRead = authz.GroupRead
 	// PermGroupWrite denotes a user's group ahs the ability to edit
 	// the resource.
-	PermGroupWrite = byte(64)
+	PermGroupWrite = authz.GroupWrite
 	// PermGroupRun denotes a user's group has the ability to run
 	// the resource.
-	PermGroupRun = byte(32)
+	PermGroupRun = authz.GroupRun
 	// PermPublicRead denotes any unauthorized request to read the
 	// resource can be accepted.
-	PermPublicRead = byte(16)
+	PermPublicRead = authz.PublicRead
 	// PermPublicWrite denotes any unauthorized request to edit
 	// the resource can be accepted.
-	PermPublicWrite = byte(8)
+	PermPublicWrite = authz.PublicWrite
 	//PermPublicRun denotes any unauthorized request to edit the
 	// resource can be accepted.
-	PermPublicRun = byte(4)
+	PermPublicRun = authz.PublicRun
 )
 
 func init() {
@@ -87,61 +134,208 @@ func init() {
 // so that store implementations can be seamlessly swapped out. Consumers
 // should define their own interfaces that use a subset of this interface's
 // functions related to what they're interested in.
+//
+// Every method takes a context so that callers can cancel or bound the
+// work done by the store. Implementations should stop as soon as they can
+// once the context is done.
 type RelayStore interface {
 	// CreateProject saves a project in the store, setting whatever
 	// values on the input that need to be set at create-time.
-	CreateProject(*Project) error
+	CreateProject(context.Context, *Project) error
 	// GetProject returns a Project with its GitRemotes. It doesn't
 	// fetch the actual pipelines in those remotes.
-	GetProject(user string, id int) (Project, error)
-	// GetProjects returns a preview list of Projects, without any
-	// information as to what's inside those Projects. This operation
+	GetProject(ctx context.Context, user string, id int) (Project, error)
+	// GetProjects returns a page of a preview list of Projects, without
+	// any information as to what's inside those Projects. This operation
 	// is scoped to a specific user.
-	GetProjects(user string) ([]Project, error)
-
-	CreateGitRemote(string, *GitRemote) error
-	GetGitRemote(string, int, string, string) (GitRemote, error)
-
-	GetPipelines(user string, projectid int) ([]Pipeline, error)
-	GetPipeline(user string, id int) (Pipeline, error)
+	GetProjects(ctx context.Context, user string, f ListFilter) (ProjectPage, error)
+	// UpdateProject applies the update to the project with the passed
+	// in ID and returns the updated project, without its remotes. Only
+	// the owner and members of the project's group with the group
+	// write bit can update a project, the public write bit isn't
+	// enough. Users that can't see the project get ErrProjectNotFound.
+	UpdateProject(ctx context.Context, user string, id int, u ProjectUpdate) (Project, error)
+
+	// CreateGitRemote saves the remote in its project, which the user
+	// needs to be able to write to. If they can read it but not write
+	// to it, ErrNotAuthorized is returned.
+	CreateGitRemote(context.Context, string, *GitRemote) error
+	GetGitRemote(context.Context, string, int, string, string) (GitRemote, error)
+	// SetWebhookSecret sets the secret the webhooks of the Git remote
+	// are checked with. An empty secret turns them off. Webhooks start
+	// runs, so the user needs to be able to both write to the remote's
+	// project and run it. Users that can't read it get
+	// ErrGitRemoteNotFound, and users that can read it but not write to
+	// it or run it get ErrNotAuthorized.
+	SetWebhookSecret(ctx context.Context, user string, pid int, url, branch, secret string) error
+	// GetHookRemotes returns the Git remotes on the branch with any of
+	// the URLs that have a webhook secret, with their pipelines. It
+	// isn't scoped to a user, since webhooks don't come from one. The
+	// secret is what they're checked with instead.
+	GetHookRemotes(ctx context.Context, urls []string, branch string) ([]HookRemote, error)
+
+	// GetPipelines returns a page of the pipelines in the project with
+	// the passed in ID, without their runs.
+	GetPipelines(ctx context.Context, user string, projectid int, f ListFilter) (PipelinePage, error)
+	GetPipeline(ctx context.Context, user string, id int) (Pipeline, error)
 	// GetPipelineID takes these fields because it's the only way to
 	// identify a pipeline before the ID is known. If there are no
 	// pipelines matching these filters, implementations should return
 	// ErrNoPipelines.
-	GetPipelineID(GitRemote, string) (int, error)
+	GetPipelineID(context.Context, GitRemote, string) (int, error)
+	// SetPipelineDefinition saves the steps the pipeline with the passed
+	// in ID was last run with.
+	SetPipelineDefinition(ctx context.Context, id int, def json.RawMessage) error
 
 	// GetRun returns the nth run for the pipeline with the passed
 	// in ID from the store. If a run with that count isn't found
 	// for whatever reason, ErrRunNotFound is returned.
-	GetRun(user string, pid, n int) (Run, error)
+	GetRun(ctx context.Context, user string, pid, n int) (Run, error)
+	// ListRuns returns a page of summaries of the runs of the pipeline
+	// with the passed in ID, narrowed down by the filter. If the user
+	// can't see the pipeline, ErrPipelineNotFound is returned.
+	ListRuns(ctx context.Context, user string, pid int, f RunFilter) (RunPage, error)
 	// GetStep returns the step with the given ID from the store.
 	// If no step with that ID is found, ErrStepNotFound should
 	// be returned.
-	GetStep(user string, id int) (Step, error)
+	GetStep(ctx context.Context, user string, id int) (Step, error)
 	// GetTask returns the Task with the given ID from the store.
 	// If no Task with that ID is found, ErrTaskNotFound should
 	// be returned.
-	GetTask(user string, id int) (Task, error)
+	GetTask(ctx context.Context, user string, id int) (Task, error)
 
 	// These Create* methods save their respective resources in
-	// the store, setting create-time values on the input.
-	CreatePipeline(*Pipeline) error
-	CreateRun(*Run) error
-	CreateStep(*Step) error
-	CreateTask(*Task) error
+	// the store, setting create-time values on the input. Steps and
+	// tasks are saved on their own, as they start, rather than with
+	// their run, so that how far the run has got can be seen while
+	// it's going. Holding the run's transaction open until it finished
+	// would hide that, and hold up numbering every other run of the
+	// pipeline for as long as the run took.
+	CreatePipeline(context.Context, *Pipeline) error
+	CreateRun(context.Context, *Run) error
+	CreateStep(context.Context, *Step) error
+	CreateTask(context.Context, *Task) error
+
+	// QueueRun saves a run the user wants to start, which hasn't
+	// started yet, and sets its count like CreateRun does. The user
+	// needs run permission on the pipeline's project. Users that can't
+	// read the project get ErrPipelineNotFound, and users that can read
+	// it but not run it get ErrNotAuthorized.
+	QueueRun(ctx context.Context, user string, r *Run) error
+	// StartRun sets the start time of a queued run, unless it was
+	// cancelled before it started, in which case it returns
+	// ErrRunCancelled and the run shouldn't be started.
+	StartRun(context.Context, *Run) error
+	// RunCancelled returns whether the nth run of the pipeline with the
+	// given ID has been cancelled. It's for whatever is running the run
+	// to check, so it isn't scoped to a user.
+	RunCancelled(ctx context.Context, pid, n int) (bool, error)
+	// CancelRun marks the nth run of the pipeline with the given ID as
+	// cancelled and returns it. Runs that haven't started yet are ended
+	// right away. Runs that have are only marked, and it's up to whatever
+	// is running them to stop them and end them. The user needs run
+	// permission on the pipeline's project. Users that can't read the
+	// project get ErrRunNotFound, and users that can read it but not run
+	// it get ErrNotAuthorized. Runs that have already finished can't be
+	// cancelled, and get ErrRunFinished.
+	CancelRun(ctx context.Context, user string, pid, n int) (Run, error)
+	// RetryRun queues a run of the pipeline with the given ID with what
+	// its nth run was run with, and returns it. With resume set, the
+	// steps of the nth run before its first one that didn't succeed are
+	// copied to the new run, tasks and all, for their results to be
+	// reused rather than them being run again. The user needs run
+	// permission on the pipeline's project, with the same errors as
+	// CancelRun. Runs that haven't finished get ErrRunNotFinished, runs
+	// without their steps recorded get ErrRunNotRetryable, and resuming
+	// a run that succeeded gets ErrRunSucceeded.
+	RetryRun(ctx context.Context, user string, pid, n int, resume bool) (Run, error)
 
 	// These Update* methods update their respective resources in
 	// the store, setting update-time values on the input if there
 	// are any.
-	UpdatePipeline(*Pipeline) error
-	UpdateRun(*Run) error
-	UpdateStep(*Step) error
-	UpdateTask(*Task) error
-
-	CreateGroup(*Group) error
-	CreateUser(*User) error
-
-	Authenticate(user, pass string) error
+	UpdatePipeline(context.Context, *Pipeline) error
+	UpdateRun(context.Context, *Run) error
+	UpdateStep(context.Context, *Step) error
+	UpdateTask(context.Context, *Task) error
+
+	// These Delete* methods remove their respective resources from the
+	// store, along with everything under them, down to the tasks. The
+	// user needs write permission on the resource's project. Users that
+	// can't read the project get the resource's not found error, so that
+	// its existence isn't leaked, and users that can read it but not
+	// write to it get ErrNotAuthorized. DeleteProject returns the Git
+	// remotes that were removed with the project.
+	DeleteProject(ctx context.Context, user string, id int) ([]GitRemote, error)
+	DeleteGitRemote(ctx context.Context, user string, pid int, url, branch string) error
+	DeletePipeline(ctx context.Context, user string, id int) error
+
+	CreateGroup(context.Context, *Group) error
+	// GetGroups returns every group, sorted by name.
+	GetGroups(context.Context) ([]Group, error)
+	// DeleteGroup deletes the group with the passed in name. Groups
+	// that still have users or projects in them can't be deleted, for
+	// those ErrGroupInUse is returned.
+	DeleteGroup(ctx context.Context, name string) error
+
+	// CreateUser saves the user along with their memberships, which are
+	// their primary group and any others in Groups.
+	CreateUser(context.Context, *User) error
+	// GetUser returns the user with the passed in email and their groups,
+	// without their password. If there's no such user, ErrUserNotFound is
+	// returned.
+	GetUser(ctx context.Context, email string) (User, error)
+	// GetUsers returns every user, sorted by email.
+	GetUsers(context.Context) ([]User, error)
+	// UpdateUser applies the update to the user with the passed in email
+	// and returns the updated user. A new password is hashed before it's
+	// saved, and new groups have to exist already.
+	UpdateUser(ctx context.Context, email string, u UserUpdate) (User, error)
+
+	// Authenticate checks the user's password. Disabled users never
+	// authenticate, and neither does an empty password, since that's
+	// what users made without one have.
+	Authenticate(ctx context.Context, user, pass string) error
+
+	// CreateAccessToken saves a new access token for the token's user,
+	// setting its ID, creation time and the token itself.
+	CreateAccessToken(context.Context, *AccessToken) error
+	// GetAccessTokens returns the user's access tokens, without the
+	// tokens themselves, sorted by ID.
+	GetAccessTokens(ctx context.Context, user string) ([]AccessToken, error)
+	// RevokeAccessToken deletes the user's access token with the given
+	// ID, so it can't be used anymore.
+	RevokeAccessToken(ctx context.Context, user string, id int) error
+	// AuthenticateAccessToken returns the access token matching the
+	// passed in token and marks it as used. Expired tokens and tokens of
+	// disabled users don't authenticate.
+	AuthenticateAccessToken(ctx context.Context, token string) (AccessToken, error)
+
+	// CreateRefreshToken saves a refresh token for the token's user,
+	// starting a new family, and sets its ID, family and the token
+	// itself.
+	CreateRefreshToken(context.Context, *RefreshToken) error
+	// RotateRefreshToken trades the refresh token in for a new one in
+	// the same family, expiring at the given time. Unknown, expired and
+	// already used refresh tokens, and those of disabled users, don't
+	// authenticate. Using one twice revokes its family.
+	RotateRefreshToken(ctx context.Context, token string, expires time.Time) (RefreshToken, error)
+	// RevokeRefreshToken revokes the family of the refresh token.
+	// Revoking an unknown refresh token does nothing.
+	RevokeRefreshToken(ctx context.Context, token string) error
+
+	// RevokeJWT adds the JWT with the given ID to the revocation list.
+	// It's kept there until it expires, after which it's useless anyway.
+	RevokeJWT(ctx context.Context, id string, expires time.Time) error
+	// JWTRevoked reports whether the JWT with the given ID is on the
+	// revocation list.
+	JWTRevoked(ctx context.Context, id string) (bool, error)
+
+	// RecordFailedLogin saves the failed login, setting its ID, and its
+	// time if it doesn't have one.
+	RecordFailedLogin(context.Context, *FailedLogin) error
+	// GetFailedLogins returns up to limit failed logins, newest first,
+	// for the email, or for everyone if it's empty.
+	GetFailedLogins(ctx context.Context, email string, limit int) ([]FailedLogin, error)
 }
 
 // Authorization encodes authorization information. It's only meant to
@@ -163,6 +357,14 @@ type Project struct {
 	Authorization
 }
 
+// ProjectUpdate is a partial update to a project. Only the fields that
+// aren't nil are changed.
+type ProjectUpdate struct {
+	Name        *string     `json:"name"`
+	Description *string     `json:"description"`
+	Permissions *Permission `json:"permissions"`
+}
+
 // Permission is a byte encoding of the possible permissions that
 // can be assigned to a project. It's in the following format:
 //
@@ -174,6 +376,15 @@ type Project struct {
 // for "write" and "x" for "execute".
 type Permission byte
 
+// permReserved are the bits of a Permission kept for extensibility.
+const permReserved = byte(3)
+
+// Valid reports whether the permission only has bits that mean something
+// set.
+func (p Permission) Valid() bool {
+	return byte(p)&permReserved == 0
+}
+
 // GitRemote is the remote location of a Git repository, specified
 // by the URL and branch name.
 type GitRemote struct {
@@ -194,6 +405,11 @@ type Pipeline struct {
 	GitRemote GitRemote `json:"git_remote"`
 	ProjectID int       `json:"project_id"`
 
+	// Definition is the steps of the pipeline, as the JSON they were in
+	// when the runlet last ran it. It's what runs that are started from
+	// the API run. It's empty until the pipeline's first run.
+	Definition json.RawMessage `json:"definition,omitempty"`
+
 	// The steps are accessed run by run because a pipeline
 	// can be updated to have different steps. Placing them
 	// directly on the pipeline itself would mean that the
@@ -207,6 +423,21 @@ type Run struct {
 	Start   *time.Time `json:"start"`
 	End     *time.Time `json:"end"`
 	Success *bool      `json:"success"` // mid-run is neither success nor failure
+	// Cancelled is whether the run was stopped before it finished. Cancelled
+	// runs are neither successes nor failures.
+	Cancelled bool `json:"cancelled"`
+
+	// These are what the run was run with, so that it can be run again
+	// the same way. Commit is the commit that was checked out, which
+	// isn't known until the runlet checks it out, unless it was asked
+	// for. Definition is the steps, like the pipeline's.
+	Branch     string            `json:"branch,omitempty"`
+	Commit     string            `json:"commit,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Definition json.RawMessage   `json:"definition,omitempty"`
+
+	// RetryOf is the count of the run this one retried, if it's a retry.
+	RetryOf int `json:"retry_of,omitempty"`
 
 	// This attribute is necessary to have here because a run can only be
 	// identified by the combination of its pipeline and its place.
@@ -223,6 +454,9 @@ type Step struct {
 	Start   *time.Time `json:"start"`
 	End     *time.Time `json:"end"`
 	Success *bool      `json:"success"` // mid-run is neither success nor failure
+	// Cancelled is whether the step was stopped, or skipped, because its
+	// run was cancelled.
+	Cancelled bool `json:"cancelled"`
 
 	PipelineID int `json:"-"`
 	RunCount   int `json:"-"`
@@ -238,6 +472,9 @@ type Task struct {
 	Start   *time.Time `json:"start"`
 	End     *time.Time `json:"end"`
 	Success *bool      `json:"success"` // mid-run is neither success nor failure
+	// Cancelled is whether the task was stopped, or skipped, because its
+	// run was cancelled.
+	Cancelled bool `json:"cancelled"`
 
 	StepID int `json:"-"`
 }
@@ -248,7 +485,68 @@ type User struct {
 	Email    string `json:"email"`
 	Password string `json:"password,omitempty"`
 
+	// Group is the user's primary group. Projects the user creates
+	// are shared with it.
 	Group Group `json:"group"`
+	// Groups is every group the user is a member of, sorted by name.
+	// It always has Group in it. The group permissions of a project
+	// apply to members of any of the user's groups.
+	Groups []Group `json:"groups"`
+
+	// Admin users can manage other users and groups.
+	Admin bool `json:"admin"`
+	// Disabled users can't authenticate. Users are disabled rather than
+	// deleted so that the projects they own stay around.
+	Disabled bool `json:"disabled"`
+}
+
+// UserUpdate is a partial update to a user. Only the fields that aren't
+// nil are changed.
+//
+// A new primary group takes the place of the old one in the user's groups.
+// A new list of groups replaces the old list wholesale, and the primary
+// group is always kept in it.
+type UserUpdate struct {
+	Name     *string  `json:"name"`
+	Password *string  `json:"password"`
+	Group    *Group   `json:"group"`
+	Groups   *[]Group `json:"groups"`
+	Admin    *bool    `json:"admin"`
+	Disabled *bool    `json:"disabled"`
+}
+
+// memberships returns the groups a user with the given primary group and
+// other groups is a member of, sorted by name and without duplicates.
+func memberships(primary Group, groups []Group) []Group {
+	seen := map[string]bool{primary.Name: true}
+	all := []Group{primary}
+
+	for _, g := range groups {
+		if seen[g.Name] {
+			continue
+		}
+
+		seen[g.Name] = true
+		all = append(all, g)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+
+	return all
+}
+
+// withoutGroup returns the groups other than the one with the given name.
+func withoutGroup(groups []Group, name string) []Group {
+	rest := []Group{}
+	for _, g := range groups {
+		if g.Name != name {
+			rest = append(rest, g)
+		}
+	}
+
+	return rest
 }
 
 // Group is an aggregate of users to make things like assigning permissions
@@ -257,6 +555,15 @@ type Group struct {
 	Name string `json:"name"`
 }
 
+// resource returns what authz needs to know about the authorization.
+func (a Authorization) resource() authz.Resource {
+	return authz.Resource{
+		Owner:       a.User.Email,
+		Group:       a.Group.Name,
+		Permissions: byte(a.Permissions),
+	}
+}
+
 // MarkSuccess is a convenience method for setting the success status.
 func (p *Pipeline) MarkSuccess(s bool) {
 	p.Success = &s
@@ -291,6 +598,30 @@ func (r *Run) Failed() bool {
 	return r.Success != nil && *r.Success == false
 }
 
+// checkRetry returns why the run can't be retried, or resumed, if it can't.
+func checkRetry(r Run, resume bool) error {
+	if r.End == nil {
+		return ErrRunNotFinished
+	}
+
+	if len(r.Definition) == 0 {
+		return ErrRunNotRetryable
+	}
+
+	if resume && r.Success != nil && *r.Success {
+		return ErrRunSucceeded
+	}
+
+	return nil
+}
+
+// MarkCancelled is a convenience method for marking the run as cancelled,
+// which leaves it neither a success nor a failure.
+func (r *Run) MarkCancelled() {
+	r.Cancelled = true
+	r.Success = nil
+}
+
 // SetStart is a convenience method for setting the start time pointer.
 func (st *Step) SetStart() {
 	t := time.Now()
@@ -308,6 +639,19 @@ func (st *Step) MarkSuccess(s bool) {
 	st.Success = &s
 }
 
+// Failed is a convenience method for checking the success status
+// for a failure.
+func (st *Step) Failed() bool {
+	return st.Success != nil && *st.Success == false
+}
+
+// MarkCancelled is a convenience method for marking the step as cancelled,
+// which leaves it neither a success nor a failure.
+func (st *Step) MarkCancelled() {
+	st.Cancelled = true
+	st.Success = nil
+}
+
 // SetStart is a convenience method for setting the start time pointer.
 func (task *Task) SetStart() {
 	t := time.Now()
@@ -324,3 +668,22 @@ func (task *Task) SetEnd() {
 func (task *Task) MarkSuccess(s bool) {
 	task.Success = &s
 }
+
+// MarkExited is a convenience method for setting the success status from
+// the exit status of the task's container, which only succeeded if it's 0.
+func (task *Task) MarkExited(status int) {
+	task.MarkSuccess(status == 0)
+}
+
+// Failed is a convenience method for checking the success status
+// for a failure.
+func (task *Task) Failed() bool {
+	return task.Success != nil && *task.Success == false
+}
+
+// MarkCancelled is a convenience method for marking the task as cancelled,
+// which leaves it neither a success nor a failure.
+func (task *Task) MarkCancelled() {
+	task.Cancelled = true
+	task.Success = nil
+}
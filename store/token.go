@@ -0,0 +1,133 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// AccessTokenPrefix starts every personal access token, so they can be
+// told apart from JWTs and spotted if they leak.
+const AccessTokenPrefix = "relay_pat_"
+
+var (
+	// ErrAccessTokenNotFound is what's returned when a user doesn't have
+	// an access token with the given ID.
+	ErrAccessTokenNotFound = errors.New("access token not found")
+	// ErrAccessTokenExists is what's returned when a user already has an
+	// access token with the name of the one being created.
+	ErrAccessTokenExists = errors.New("access token already exists")
+	// ErrInvalidScopes is what's returned when an access token is created
+	// without scopes, or with one that doesn't exist.
+	ErrInvalidScopes = errors.New("invalid access token scopes")
+)
+
+// Scope is something an access token is allowed to be used for.
+type Scope string
+
+const (
+	// ScopeRead allows reading anything the user can read.
+	ScopeRead = Scope("read")
+	// ScopeWrite allows changing anything the user can change.
+	ScopeWrite = Scope("write")
+	// ScopeRun allows starting runs of anything the user can run.
+	ScopeRun = Scope("run")
+)
+
+// AccessToken is a long-lived credential that acts as its user, for
+// scripts and bots. Only a hash of the token itself is stored, so it's
+// handed out once, when it's created, and never again.
+type AccessToken struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	User  string `json:"user"`
+	Token string `json:"token,omitempty"`
+
+	Scopes []Scope `json:"scopes"`
+
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the token stops working. Tokens without one
+	// work until they're revoked.
+	ExpiresAt *time.Time `json:"expires_at"`
+	LastUsed  *time.Time `json:"last_used"`
+}
+
+// Allows reports whether the token's scopes allow s.
+func (t AccessToken) Allows(s Scope) bool {
+	for _, scope := range t.Scopes {
+		if scope == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expired reports whether the token has expired as of now.
+func (t AccessToken) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// checkScopes makes sure the token has scopes and all of them exist.
+func (t AccessToken) checkScopes() error {
+	if len(t.Scopes) == 0 {
+		return ErrInvalidScopes
+	}
+
+	for _, s := range t.Scopes {
+		switch s {
+		case ScopeRead, ScopeWrite, ScopeRun:
+		default:
+			return ErrInvalidScopes
+		}
+	}
+
+	return nil
+}
+
+// newToken returns a new random token starting with prefix, and its hash.
+func newToken(prefix string) (string, []byte, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+
+	token := prefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash tokens are stored and looked up by. Unlike
+// passwords, tokens are long and random, so a fast hash is enough and
+// lets them be looked up directly.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// isAccessToken reports whether the string looks like an access token.
+func isAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+// refreshTokenPrefix starts every refresh token.
+const refreshTokenPrefix = "relay_rt_"
+
+// RefreshToken is traded in for a new access token, along with a new
+// refresh token to use next time. Every refresh token can only be traded
+// in once. The tokens that come from one login are a family, and if any
+// of them is traded in twice, it's been stolen and the whole family is
+// revoked.
+type RefreshToken struct {
+	ID     int
+	Family string
+	User   string
+	// Token is the refresh token itself. Only a hash of it is stored,
+	// so it's only set when the refresh token is created.
+	Token string
+
+	ExpiresAt time.Time
+}
@@ -1,12 +1,93 @@
 package store
 
+import "time"
+
+// The tree below is the shape of the data held by the Memory store. Each
+// node owns its children, mirroring the foreign keys in the SQL schema, so
+// that walking from a project down to a task is the same as joining the
+// tables in Postgres.
+
 type rootnode struct {
+	users    map[string]*usernode
+	groups   map[string]*Group
+	projects map[int]*projectnode
+	tokens   map[int]*tokennode
+
+	// Refresh tokens are keyed by their hash, and revoked JWTs by their
+	// ID, since that's how they're looked up.
+	refreshTokens map[string]*refreshnode
+	revokedJWTs   map[string]time.Time
+
+	// Failed logins are kept in the order they happened in.
+	failedLogins []FailedLogin
+
+	// These are indexes into the tree, since pipelines, steps and tasks
+	// can be looked up by ID directly.
+	pipelines map[int]*pipelinenode
+	steps     map[int]*stepnode
+	tasks     map[int]*tasknode
+
+	// Serial counters, like the ones Postgres keeps for ID columns.
+	projectSeq  int
+	pipelineSeq int
+	stepSeq     int
+	taskSeq     int
+	tokenSeq    int
+	refreshSeq  int
+
+	failedLoginSeq int
+}
+
+type usernode struct {
+	data     User
+	password []byte
+}
+
+type tokennode struct {
+	data AccessToken
+	hash string
+}
+
+type refreshnode struct {
+	data RefreshToken
+	used bool
+}
+
+// token returns a copy of the access token that's safe to hand out.
+func (tn *tokennode) token() AccessToken {
+	t := tn.data
+	t.Scopes = append([]Scope(nil), tn.data.Scopes...)
+
+	return t
+}
+
+// user returns a copy of the user that's safe to hand out.
+func (un *usernode) user() User {
+	u := un.data
+	u.Groups = append([]Group(nil), un.data.Groups...)
+
+	return u
+}
+
+type projectnode struct {
+	children map[string]*remotenode
+	data     Project
+}
+
+type remotenode struct {
 	children map[string]*pipelinenode
+	data     GitRemote
+	// secret is what the remote's webhooks are checked with.
+	secret string
 }
 
 type pipelinenode struct {
-	children map[string]*runnode
+	children map[int]*runnode
+	parent   *remotenode
 	data     Pipeline
+	// runSeq is the count of the last run handed out, kept apart
+	// from len(children) so counts are never reused.
+	runSeq int
 }
 
 type runnode struct {
@@ -16,9 +97,32 @@ type runnode struct {
 
 type stepnode struct {
 	children map[int]*tasknode
+	parent   *runnode
 	data     Step
 }
 
 type tasknode struct {
-	data Task
+	parent *stepnode
+	data   Task
+}
+
+func newRootnode() *rootnode {
+	return &rootnode{
+		users:    make(map[string]*usernode),
+		groups:   make(map[string]*Group),
+		projects: make(map[int]*projectnode),
+		tokens:   make(map[int]*tokennode),
+
+		refreshTokens: make(map[string]*refreshnode),
+		revokedJWTs:   make(map[string]time.Time),
+		pipelines:     make(map[int]*pipelinenode),
+		steps:         make(map[int]*stepnode),
+		tasks:         make(map[int]*tasknode),
+	}
+}
+
+// remoteKey is how remotes are keyed under their project, since a
+// remote is identified by both its URL and its branch.
+func remoteKey(url, branch string) string {
+	return url + "#" + branch
 }
@@ -0,0 +1,11 @@
+package store
+
+// HookRemote is a Git remote that can have runs started by the webhooks
+// of where it's hosted.
+type HookRemote struct {
+	GitRemote
+
+	// Secret is what the webhooks are checked with. It's never handed
+	// out anywhere else, since anyone with it can start runs.
+	Secret string
+}